@@ -0,0 +1,142 @@
+package sidebreaker
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Logger for the access log, nil when it is disabled
+var accessLog *slog.Logger
+
+// Open the access log, "stdout" or the path of a file the records are appended to.
+// Records use the same format as the application log.
+func setupAccessLog(path string, format string) error {
+	if path == "" {
+		return nil
+	}
+	var out io.Writer = os.Stdout
+	if path != "stdout" {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		out = f
+	}
+	var handler slog.Handler = slog.NewTextHandler(out, nil)
+	if format == "json" {
+		handler = slog.NewJSONHandler(out, nil)
+	}
+	accessLog = slog.New(handler)
+	return nil
+}
+
+// Outcomes of a proxied request or tunnel
+const (
+	outcomeSuccess       = "success"
+	outcomeError         = "error"
+	outcomeTimeout       = "timeout"
+	outcomeProtocolError = "protocol_error"
+	outcomeRejected      = "rejected"
+	outcomeClientError   = "client_error"
+)
+
+// accessRecord is one record of the access log, describing a proxied request or tunnel
+type accessRecord struct {
+	start       time.Time
+	requestID   int64
+	correlation string
+	client      string
+	method      string
+	destination string
+	path        string
+	breaker     string
+	outcome     string
+	status      int
+	bytesIn     int64
+	bytesOut    int64
+	timeline    *timeline
+	// Latency histograms of the host, nil for the hosts that aren't in the configuration
+	latency *hostLatency
+	// StatsD client and archiver of the sidebreaker, nil when they are off
+	statsd  *statsdClient
+	archive *archiver
+}
+
+func (s *Sidebreaker) newAccessRecord(req *http.Request, ctx *goproxy.ProxyCtx, host Breakers) *accessRecord {
+	return &accessRecord{
+		start:       time.Now(),
+		requestID:   ctx.Session,
+		correlation: correlationID(ctx),
+		client:      req.RemoteAddr,
+		method:      req.Method,
+		destination: req.URL.Host,
+		path:        req.URL.Path,
+		breaker:     host.Host.Host,
+		latency:     s.latencies.get(host.Host.Host),
+		statsd:      s.statsd,
+		archive:     s.archive,
+	}
+}
+
+// Write the record and send the request metrics once the request or tunnel is over. The byte
+// counters can still be updated by tunnel copies that are being torn down so they are read atomically.
+func (r *accessRecord) write(outcome string, status int) {
+	r.timeline.add("closed", "outcome", outcome, "status", status, "bytes_in", atomic.LoadInt64(&r.bytesIn), "bytes_out", atomic.LoadInt64(&r.bytesOut))
+	if r.breaker != "" {
+		trafficFor(r.breaker).add(r.method == http.MethodConnect, atomic.LoadInt64(&r.bytesIn), atomic.LoadInt64(&r.bytesOut))
+	}
+	// Rejected calls are answered right away, they would hide the latency of the host
+	if l := r.latency; l != nil && outcome != outcomeRejected {
+		if r.method == http.MethodConnect {
+			l.tunnel.record(time.Since(r.start))
+		} else {
+			l.request.record(time.Since(r.start))
+		}
+	}
+	r.statsd.request(r.breaker, outcome, time.Since(r.start))
+	r.archive.request(r.breaker, outcome, time.Since(r.start))
+	if accessLog == nil {
+		return
+	}
+	decision := "allowed"
+	if outcome == outcomeRejected {
+		decision = "rejected"
+	}
+	accessLog.Info("access",
+		"request_id", r.requestID,
+		"correlation_id", r.correlation,
+		"client", r.client,
+		"method", r.method,
+		"destination", r.destination,
+		"path", r.path,
+		"breaker", r.breaker,
+		"decision", decision,
+		"outcome", outcome,
+		"status", status,
+		"bytes_in", atomic.LoadInt64(&r.bytesIn),
+		"bytes_out", atomic.LoadInt64(&r.bytesOut),
+		"duration_ms", time.Since(r.start).Milliseconds(),
+	)
+}
+
+// Wrap a reader so the bytes read from it are added to a counter
+func countReader(r io.Reader, n *int64) io.Reader {
+	return &countingReader{r, n}
+}
+
+type countingReader struct {
+	io.Reader
+	n *int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	atomic.AddInt64(r.n, int64(n))
+	return n, err
+}
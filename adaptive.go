@@ -0,0 +1,207 @@
+package sidebreaker
+
+import (
+	"expvar"
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Algorithms of the adaptive concurrency limits
+const (
+	adaptiveAIMD     = "aimd"
+	adaptiveGradient = "gradient"
+)
+
+// Requests rejected by the adaptive concurrency limit of their host
+var adaptiveRejected = expvar.NewMap("adaptiveRejected")
+
+// AdaptiveConcurrency struct for the configuration, a cap on the requests in flight to a host that
+// follows the latency of the host, as the concurrency limits of Netflix do
+type AdaptiveConcurrency struct {
+	Algorithm        string   `json:"algorithm" doc:"How the limit adapts: aimd adds one on success and cuts it on a slow or failed call, gradient follows the ratio of the usual latency to the current one, disabled when not set" example:"gradient"`
+	InitialLimit     int      `json:"initialLimit" doc:"Requests in flight allowed at the start, 20 by default" example:"20"`
+	MinLimit         int      `json:"minLimit" doc:"Lowest the limit goes, 1 by default" example:"1"`
+	MaxLimit         int      `json:"maxLimit" doc:"Highest the limit goes, 1000 by default" example:"200"`
+	Backoff          float64  `json:"backoff" doc:"Share of the limit kept after a slow or failed call (aimd), 0.9 by default" example:"0.9"`
+	LatencyThreshold Duration `json:"latencyThreshold" doc:"Milliseconds over which a call counts as slow (aimd), the timeout of the host when not set" example:"500"`
+	Tolerance        float64  `json:"tolerance" doc:"How much slower than usual calls may get before the limit goes down (gradient), 1.5 by default" example:"1.5"`
+}
+
+func (a AdaptiveConcurrency) enabled() bool {
+	return a.Algorithm != ""
+}
+
+func (a AdaptiveConcurrency) withDefaults(host Host) AdaptiveConcurrency {
+	if a.InitialLimit == 0 {
+		a.InitialLimit = 20
+	}
+	if a.MinLimit == 0 {
+		a.MinLimit = 1
+	}
+	if a.MaxLimit == 0 {
+		a.MaxLimit = 1000
+	}
+	if a.Backoff == 0 {
+		a.Backoff = 0.9
+	}
+	if a.LatencyThreshold == 0 {
+		a.LatencyThreshold = host.Timeout
+	}
+	if a.Tolerance == 0 {
+		a.Tolerance = 1.5
+	}
+	return a
+}
+
+// Samples the usual latency of the gradient is averaged over
+const gradientLongWindow = 600
+
+// adaptiveLimiter caps the requests in flight to a host, the cap moves with each completed call
+type adaptiveLimiter struct {
+	config AdaptiveConcurrency
+
+	mu       sync.Mutex
+	limit    float64
+	inFlight int
+	// Average latency in nanoseconds of the last gradientLongWindow calls (gradient)
+	longLatency float64
+	samples     int
+}
+
+func newAdaptiveLimiter(config AdaptiveConcurrency) *adaptiveLimiter {
+	return &adaptiveLimiter{config: config, limit: float64(config.InitialLimit)}
+}
+
+// Take a slot, the returned function gives it back with the latency of the call and whether it
+// failed. It is nil when the limit is reached.
+func (l *adaptiveLimiter) acquire() func(latency time.Duration, failed bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inFlight >= int(l.limit) {
+		return nil
+	}
+	l.inFlight++
+	inFlight := l.inFlight
+	return func(latency time.Duration, failed bool) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.inFlight--
+		// Calls that never reached the upstream say nothing about it
+		if latency > 0 || failed {
+			l.update(latency, failed, inFlight)
+		}
+	}
+}
+
+// Move the limit after a call that had inFlight calls in flight with it
+func (l *adaptiveLimiter) update(latency time.Duration, failed bool, inFlight int) {
+	switch l.config.Algorithm {
+	case adaptiveAIMD:
+		threshold := l.config.LatencyThreshold.Duration()
+		if failed || (threshold > 0 && latency > threshold) {
+			l.limit = l.limit * l.config.Backoff
+		} else if inFlight*2 >= int(l.limit) {
+			// Only a limit that is used grows, a quiet host would grow it without a bound otherwise
+			l.limit++
+		}
+	case adaptiveGradient:
+		sample := float64(latency)
+		if l.samples < gradientLongWindow {
+			l.samples++
+		}
+		l.longLatency += (sample - l.longLatency) / float64(l.samples)
+		gradient := 0.5
+		if !failed && sample > 0 {
+			gradient = max(0.5, min(1, l.config.Tolerance*l.longLatency/sample))
+		}
+		if gradient == 1 && inFlight*2 < int(l.limit) {
+			// A limit that isn't used has nothing to learn from a fast call
+			break
+		}
+		// Some calls may queue at the host, the square root of the limit as the original does
+		next := l.limit*gradient + math.Sqrt(l.limit)
+		l.limit = l.limit*0.8 + next*0.2
+	}
+	l.limit = min(max(l.limit, float64(l.config.MinLimit)), float64(l.config.MaxLimit))
+}
+
+func (l *adaptiveLimiter) usage() map[string]int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return map[string]int64{"limit": int64(l.limit), "inFlight": int64(l.inFlight)}
+}
+
+// The adaptive limiters of the last sidebreaker created, in the metrics
+var publishedAdaptiveLimiters atomic.Pointer[hostSettings[*adaptiveLimiter]]
+
+func init() {
+	expvar.Publish("adaptiveConcurrency", expvar.Func(func() any {
+		usage := map[string]map[string]int64{}
+		if limiters := publishedAdaptiveLimiters.Load(); limiters != nil {
+			for host, l := range limiters.all() {
+				usage[host] = l.usage()
+			}
+		}
+		return usage
+	}))
+}
+
+// Set up the limiters of the hosts with an adaptive concurrency limit, hosts whose settings didn't
+// change keep theirs
+func (s *Sidebreaker) setupAdaptiveLimiters(hosts []Host) {
+	s.adaptiveLimiters.update(func(current map[string]*adaptiveLimiter) map[string]*adaptiveLimiter {
+		limiters := map[string]*adaptiveLimiter{}
+		for _, h := range hosts {
+			if !h.AdaptiveConcurrency.enabled() {
+				continue
+			}
+			config := h.AdaptiveConcurrency.withDefaults(h)
+			l, ok := current[h.Host]
+			if !ok || l.config != config {
+				l = newAdaptiveLimiter(config)
+			}
+			limiters[h.Host] = l
+		}
+		return limiters
+	})
+}
+
+// Take a slot of the adaptive limit of a host, see adaptiveLimiter.acquire. Hosts without a limit
+// always get one.
+func (s *Sidebreaker) acquireAdaptive(host string) func(latency time.Duration, failed bool) {
+	l := s.adaptiveLimiters.get(host)
+	if l == nil {
+		return func(time.Duration, bool) {}
+	}
+	done := l.acquire()
+	if done == nil {
+		adaptiveRejected.Add(host, 1)
+	}
+	return done
+}
+
+// Check the settings of an adaptive limit
+func (a AdaptiveConcurrency) validate() error {
+	if !a.enabled() {
+		return nil
+	}
+	if a.Algorithm != adaptiveAIMD && a.Algorithm != adaptiveGradient {
+		return fmt.Errorf("algorithm must be %s or %s, got %q", adaptiveAIMD, adaptiveGradient, a.Algorithm)
+	}
+	if a.InitialLimit < 0 || a.MinLimit < 0 || a.MaxLimit < 0 || a.LatencyThreshold < 0 {
+		return fmt.Errorf("limits and latencyThreshold must not be negative")
+	}
+	if a.MaxLimit > 0 && a.MinLimit > a.MaxLimit {
+		return fmt.Errorf("minLimit %d is above maxLimit %d", a.MinLimit, a.MaxLimit)
+	}
+	if a.Backoff < 0 || a.Backoff >= 1 {
+		return fmt.Errorf("backoff must be between 0 and 1, got %g", a.Backoff)
+	}
+	if a.Tolerance != 0 && a.Tolerance < 1 {
+		return fmt.Errorf("tolerance must be 1 or more, got %g", a.Tolerance)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package sidebreaker
+
+import (
+	"crypto/tls"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+)
+
+// Admin struct for the configuration, the listener of the admin endpoints apart from the proxy, so
+// they can stay on the loopback while the proxy is exposed
+type Admin struct {
+	Listen string    `json:"listen" doc:"Address the admin endpoints listen on as host:port instead of the loopback on adminPort, such as 0.0.0.0:3131 to scrape the metrics from other pods" example:"0.0.0.0:3131"`
+	Cert   string    `json:"cert" doc:"PEM file of the certificate the admin endpoints are served with over TLS, plain HTTP when not set" example:"/etc/sidebreaker/admin.crt"`
+	Key    string    `json:"key" doc:"PEM file of the private key of the certificate" example:"/etc/sidebreaker/admin.key"`
+	Auth   ProxyAuth `json:"auth" doc:"Credentials the admin endpoints require in Authorization, open when not set"`
+}
+
+// Port of the admin endpoints when neither adminPort nor admin.listen is set
+const defaultAdminPort = 3131
+
+// The port of the admin endpoints, they are never served on the proxy port
+func (c Configuration) adminPort() int {
+	if c.AdminPort == 0 && c.Admin.Listen == "" {
+		return defaultAdminPort
+	}
+	return c.AdminPort
+}
+
+// The TLS configuration of the admin endpoints and its certificate, nil for plain HTTP. The certificate
+// is read again once its files change.
+func (a Admin) tlsConfig() (*tls.Config, *certificateFile, error) {
+	if a.Cert == "" {
+		return nil, nil, nil
+	}
+	cert, err := loadCertificateFile("admin", a.Cert, a.Key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &tls.Config{GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return cert.certificate(), nil
+	}}, cert, nil
+}
+
+// Tunnels currently open and running goroutines, to find leaks when handling many tunnels
+var openTunnels = expvar.NewInt("openTunnels")
+
+func init() {
+	expvar.Publish("goroutines", expvar.Func(func() interface{} { return runtime.NumGoroutine() }))
+}
+
+// Handler of the admin endpoints: metrics, configuration reference and schema, log level, platform and tuning reports, connection timelines, faults, breakers, traffic and latency by host, certificates, pushed configurations and their version, maintenance mode, tripping and resetting breakers, draining and optionally the pprof profiles.
+// It has its own mux so nothing registered on the default mux, such as pprof, is served by accident.
+func adminHandler(pprofEnabled bool, s *Sidebreaker) http.Handler {
+	hosts := s.hosts
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/docs/config", configReference)
+	mux.HandleFunc("/docs/example", configExample)
+	mux.HandleFunc("/docs/schema", configSchema)
+	mux.HandleFunc("/admin/loglevel", logLevelHandler(s))
+	mux.HandleFunc("/admin/capabilities", capabilitiesHandler)
+	mux.HandleFunc("/admin/tuning", tuningHandler)
+	mux.HandleFunc("/admin/timeline", timelineHandler(s))
+	mux.HandleFunc("/admin/faults", faultsHandler(s))
+	mux.HandleFunc("/admin/traffic", trafficHandler)
+	mux.HandleFunc("/admin/latency", latencyHandler(s))
+	mux.HandleFunc("/admin/certificates", certificatesHandler(s))
+	mux.HandleFunc("/admin/breakers", breakersHandler(hosts))
+	mux.HandleFunc("/admin/config", configHandler(s))
+	mux.HandleFunc("/admin/config/version", configVersionHandler(s))
+	mux.HandleFunc("/admin/drain", drainHandler(s))
+	mux.HandleFunc("/hosts/", hostsHandler(s))
+	if pprofEnabled {
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	return mux
+}
+
+// Serve the admin endpoints on their own port, over TLS with a configuration
+func serveAdmin(listener net.Listener, handler http.Handler, config *tls.Config) error {
+	logger.Info("Admin listening", "address", listener.Addr().String(), "tls", config != nil)
+	if config != nil {
+		listener = tls.NewListener(listener, config)
+	}
+	server := &http.Server{Handler: handler, ErrorLog: debugLog()}
+	return fmt.Errorf("error serving admin endpoints: %w", server.Serve(listener))
+}
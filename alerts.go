@@ -0,0 +1,266 @@
+package sidebreaker
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// SlackAlerts struct for the configuration, an incoming webhook of Slack the alerts are posted to
+type SlackAlerts struct {
+	WebhookURL string   `json:"webhookUrl" secret:"true" doc:"Incoming webhook URL of the channel, SLACK_WEBHOOK_URL when not set" example:"https://hooks.slack.com/services/T000/B000/XXXX"`
+	Hosts      []string `json:"hosts" doc:"Hosts whose alerts are posted, every host and the clock alerts when empty" example:"api.example.com"`
+	MaxPerHour int      `json:"maxPerHour" doc:"Open and other alerts posted per hour at most, the others are dropped, no limit when not set" example:"20"`
+}
+
+// PagerDutyAlerts struct for the configuration, a service of PagerDuty the open breakers raise incidents on
+type PagerDutyAlerts struct {
+	RoutingKey string   `json:"routingKey" secret:"true" doc:"Integration key of the Events API v2 integration of the service, PAGERDUTY_ROUTING_KEY when not set"`
+	URL        string   `json:"url" doc:"Events API endpoint, https://events.pagerduty.com/v2/enqueue by default" example:"https://events.eu.pagerduty.com/v2/enqueue"`
+	Hosts      []string `json:"hosts" doc:"Hosts whose breakers raise incidents, every host when empty" example:"payments.example.com"`
+	MaxPerHour int      `json:"maxPerHour" doc:"Incidents raised per hour at most, the others are dropped, no limit when not set" example:"10"`
+}
+
+const defaultPagerDutyURL = "https://events.pagerduty.com/v2/enqueue"
+
+// Alerts by channel and result, as slack.sent, slack.dropped over the rate limit and slack.failed
+var alertsSent = expvar.NewMap("alerts")
+
+func (s SlackAlerts) webhook() string {
+	if s.WebhookURL != "" {
+		return s.WebhookURL
+	}
+	return os.Getenv("SLACK_WEBHOOK_URL")
+}
+
+func (p PagerDutyAlerts) routingKey() string {
+	if p.RoutingKey != "" {
+		return p.RoutingKey
+	}
+	return os.Getenv("PAGERDUTY_ROUTING_KEY")
+}
+
+func (p PagerDutyAlerts) endpoint() string {
+	if p.URL != "" {
+		return p.URL
+	}
+	return defaultPagerDutyURL
+}
+
+// Check the settings of the alert channels
+func (s SlackAlerts) validate() error {
+	return validateAlertURL(s.webhook(), "webhookUrl or SLACK_WEBHOOK_URL")
+}
+
+func (p PagerDutyAlerts) validate() error {
+	if p.routingKey() == "" {
+		return fmt.Errorf("routingKey or PAGERDUTY_ROUTING_KEY is required")
+	}
+	return validateAlertURL(p.endpoint(), "url")
+}
+
+func validateAlertURL(raw string, name string) error {
+	if raw == "" {
+		return fmt.Errorf("%s is required", name)
+	}
+	if u, err := url.Parse(raw); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%s must be an http or https URL", name)
+	}
+	return nil
+}
+
+// Text of an alert for people
+func (n Notification) text() string {
+	switch n.Event {
+	case "open":
+		if n.OpenFor < time.Second {
+			return "Circuit breaker open for " + n.Host
+		}
+		return fmt.Sprintf("Circuit breaker open for %s since %s", n.Host, n.OpenFor.Round(time.Second))
+	case "closed":
+		return fmt.Sprintf("Circuit breaker closed for %s after %s open", n.Host, n.OpenFor.Round(time.Second))
+	}
+	if n.Host == "" {
+		return "Sidebreaker " + n.Event + ": " + n.Message
+	}
+	return fmt.Sprintf("%s for %s: %s", n.Event, n.Host, n.Message)
+}
+
+// Post a JSON body to an alert channel, answers other than 2xx are errors
+func postAlert(client *http.Client, endpoint string, body any) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(endpoint, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(detail))
+	}
+	return nil
+}
+
+// slackNotifier posts the alerts to an incoming webhook
+type slackNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (s slackNotifier) Notify(n Notification) error {
+	icon := ":warning:"
+	switch n.Event {
+	case "open":
+		icon = ":red_circle:"
+	case "closed":
+		icon = ":large_green_circle:"
+	}
+	return postAlert(s.client, s.url, map[string]string{"text": icon + " " + n.text()})
+}
+
+// pagerDutyNotifier triggers an incident when a breaker opens and resolves it once it closes, each
+// sidebreaker and host has its own incident
+type pagerDutyNotifier struct {
+	url    string
+	key    string
+	source string
+	client *http.Client
+}
+
+func (p pagerDutyNotifier) Notify(n Notification) error {
+	event := map[string]any{
+		"routing_key": p.key,
+		"dedup_key":   "sidebreaker/" + p.source + "/" + n.Host,
+	}
+	switch n.Event {
+	case "open":
+		event["event_action"] = "trigger"
+		event["payload"] = map[string]any{
+			"summary":        n.text(),
+			"source":         p.source,
+			"severity":       "error",
+			"component":      n.Host,
+			"custom_details": map[string]string{"open_for": n.OpenFor.Round(time.Millisecond).String()},
+		}
+	default:
+		event["event_action"] = "resolve"
+	}
+	return postAlert(p.client, p.url, event)
+}
+
+// channelNotifier sends the alerts of its hosts to a channel, within its rate limit. Close alerts
+// follow the open alert of the host: they go through when it was sent and are dropped with it.
+type channelNotifier struct {
+	name       string
+	hosts      map[string]bool
+	maxPerHour int
+	// Only the open and close alerts of the breakers go to the channel
+	breakersOnly bool
+	notifier     Notifier
+
+	mu   sync.Mutex
+	sent []time.Time
+	open map[string]bool
+}
+
+func newChannelNotifier(name string, hosts []string, maxPerHour int, notifier Notifier) *channelNotifier {
+	c := &channelNotifier{name: name, maxPerHour: maxPerHour, notifier: notifier, open: map[string]bool{}}
+	if len(hosts) > 0 {
+		c.hosts = map[string]bool{}
+		for _, h := range hosts {
+			c.hosts[canonicalHost(h)] = true
+		}
+	}
+	return c
+}
+
+// Test wether an alert may be sent now, and keep it for the rate limit and the close alert
+func (c *channelNotifier) allow(n Notification) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n.Event == "closed" {
+		open := c.open[n.Host]
+		delete(c.open, n.Host)
+		return open
+	}
+	if c.maxPerHour > 0 {
+		hourAgo := n.Time.Add(-time.Hour)
+		for len(c.sent) > 0 && !c.sent[0].After(hourAgo) {
+			c.sent = c.sent[1:]
+		}
+		if len(c.sent) >= c.maxPerHour {
+			return false
+		}
+		c.sent = append(c.sent, n.Time)
+	}
+	if n.Event == "open" {
+		c.open[n.Host] = true
+	}
+	return true
+}
+
+// Failures are logged here, so a channel that is down doesn't hold back the alerts of the others
+func (c *channelNotifier) Notify(n Notification) error {
+	if c.hosts != nil && !c.hosts[n.Host] {
+		return nil
+	}
+	if c.breakersOnly && n.Event != "open" && n.Event != "closed" {
+		return nil
+	}
+	if !c.allow(n) {
+		alertsSent.Add(c.name+".dropped", 1)
+		logger.Debug("Dropped alert over the rate limit of the channel", "channel", c.name, "host", n.Host, "event", n.Event)
+		return nil
+	}
+	if err := c.notifier.Notify(n); err != nil {
+		alertsSent.Add(c.name+".failed", 1)
+		logger.Error("error sending alert", "channel", c.name, "host", n.Host, "event", n.Event, "error", err)
+		return nil
+	}
+	alertsSent.Add(c.name+".sent", 1)
+	return nil
+}
+
+// multiNotifier sends each alert to every notifier in turn
+type multiNotifier []Notifier
+
+func (m multiNotifier) Notify(n Notification) error {
+	var errs []error
+	for _, notifier := range m {
+		if err := notifier.Notify(n); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// The notifier of the configuration: the log, and the Slack and PagerDuty channels
+func newNotifier(policy NotificationPolicy) Notifier {
+	if len(policy.Slack) == 0 && len(policy.PagerDuty) == 0 {
+		return logNotifier{}
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	source, _ := os.Hostname()
+	notifiers := multiNotifier{logNotifier{}}
+	for _, s := range policy.Slack {
+		notifiers = append(notifiers, newChannelNotifier("slack", s.Hosts, s.MaxPerHour, slackNotifier{url: s.webhook(), client: client}))
+	}
+	for _, p := range policy.PagerDuty {
+		c := newChannelNotifier("pagerduty", p.Hosts, p.MaxPerHour, pagerDutyNotifier{url: p.endpoint(), key: p.routingKey(), source: source, client: client})
+		// The other alerts aren't worth paging for
+		c.breakersOnly = true
+		notifiers = append(notifiers, c)
+	}
+	return notifiers
+}
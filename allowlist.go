@@ -0,0 +1,96 @@
+package sidebreaker
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+// networks are the networks of a setting, IPs are networks of a single address
+type networks []netip.Prefix
+
+func parseNetworks(values []string) (networks, error) {
+	prefixes := make(networks, 0, len(values))
+	for _, v := range values {
+		if ip, err := netip.ParseAddr(v); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(ip, ip.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, fmt.Errorf("networks must be CIDRs or IPs such as 10.0.0.0/8, got %q", v)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// Test wether the IP of an address is in one of the networks, IPv4 addresses mapped to IPv6 as the
+// dual stack listeners accept them are seen as IPv4
+func (n networks) contain(addr net.Addr) bool {
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+	for _, p := range n {
+		if p.Contains(ap.Addr().Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Connections closed because they came from outside the allowed clients, per listener
+var rejectedClients = expvar.NewMap("rejectedClients")
+
+// The client of a PROXY protocol header is outside the allowed clients
+var errClientNotAllowed = errors.New("client not allowed")
+
+// allowListener closes the connections from outside the allowed clients as soon as they are
+// accepted, or once their PROXY protocol header is read
+type allowListener struct {
+	net.Listener
+	name    string
+	allowed networks
+}
+
+// Only accept the connections of l from the allowed clients, any client when none are set
+func allowClients(l net.Listener, name string, allowed []string) net.Listener {
+	if len(allowed) == 0 {
+		return l
+	}
+	// Validated with the configuration
+	prefixes, _ := parseNetworks(allowed)
+	return &allowListener{Listener: l, name: name, allowed: prefixes}
+}
+
+func (l *allowListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return conn, err
+		}
+		// The client is the one of the header, read in the goroutine serving the connection so a
+		// slow client doesn't hold up Accept
+		if pc, ok := conn.(*proxyProtocolConn); ok {
+			pc.allowed = l
+			return conn, nil
+		}
+		if l.allows(conn.RemoteAddr()) {
+			return conn, nil
+		}
+		conn.Close()
+	}
+}
+
+// Test wether a client is allowed, the others are counted and logged
+func (l *allowListener) allows(addr net.Addr) bool {
+	if l.allowed.contain(addr) {
+		return true
+	}
+	rejectedClients.Add(l.name, 1)
+	logger.Debug("Closing a connection from outside the allowed clients", "listener", l.name, "client", addr.String())
+	return false
+}
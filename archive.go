@@ -0,0 +1,300 @@
+package sidebreaker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Archive struct for the configuration of the stats archive
+type Archive struct {
+	Bucket   string   `json:"bucket" doc:"Bucket the stats are archived to, disabled when not set" example:"sidebreaker-archive"`
+	Region   string   `json:"region" doc:"Region of the bucket, us-east-1 by default" example:"eu-west-1"`
+	Endpoint string   `json:"endpoint" doc:"Endpoint of S3 compatible services such as GCS or MinIO" example:"https://storage.googleapis.com"`
+	Prefix   string   `json:"prefix" doc:"Prefix of the object names, sidebreaker/archive by default" example:"sidebreaker/archive"`
+	Format   string   `json:"format" doc:"Format of the archives: json (JSON lines) or parquet" example:"parquet"`
+	Interval Duration `json:"interval" doc:"Milliseconds between archives, 3600000 (one hour) by default" example:"3600000"`
+}
+
+// Stats of a host during an archive period
+type hostAggregate struct {
+	requests       int64
+	successes      int64
+	errors         int64
+	timeouts       int64
+	protocolErrors int64
+	rejected       int64
+	latencyTotal   time.Duration
+	latencyMax     time.Duration
+	openTime       time.Duration
+}
+
+// hostStatsRow is a row of the host stats archive
+type hostStatsRow struct {
+	PeriodStart    time.Time `json:"periodStart"`
+	PeriodEnd      time.Time `json:"periodEnd"`
+	Instance       string    `json:"instance"`
+	Host           string    `json:"host"`
+	Requests       int64     `json:"requests"`
+	Successes      int64     `json:"successes"`
+	Errors         int64     `json:"errors"`
+	Timeouts       int64     `json:"timeouts"`
+	ProtocolErrors int64     `json:"protocolErrors"`
+	Rejected       int64     `json:"rejected"`
+	LatencyAvgMs   float64   `json:"latencyAvgMs"`
+	LatencyMaxMs   float64   `json:"latencyMaxMs"`
+	OpenMs         int64     `json:"openMs"`
+}
+
+// breakerTransition is a row of the breaker timeline archive
+type breakerTransition struct {
+	Time     time.Time `json:"time"`
+	Instance string    `json:"instance"`
+	Breaker  string    `json:"breaker"`
+	State    string    `json:"state"`
+}
+
+// archiver aggregates the stats of each host and the breaker transitions, and writes them
+// to a bucket at the end of each period
+type archiver struct {
+	bucket   *s3Storage
+	prefix   string
+	format   string
+	instance string
+
+	mu        sync.Mutex
+	start     time.Time
+	hosts     map[string]*hostAggregate
+	openSince map[string]time.Time
+	timeline  []breakerTransition
+}
+
+// Start archiving when a bucket is configured, the archiver is nil when the archive is disabled
+func newArchiver(config Archive, done <-chan struct{}) (*archiver, error) {
+	if config.Bucket == "" {
+		return nil, nil
+	}
+	if config.Format == "" {
+		config.Format = "json"
+	}
+	if config.Format != "json" && config.Format != "parquet" {
+		return nil, fmt.Errorf("unknown archive format %q, use json or parquet", config.Format)
+	}
+	bucket, err := newS3Storage(StorageConfig{Bucket: config.Bucket, Region: config.Region, Endpoint: config.Endpoint, Prefix: config.Prefix})
+	if err != nil {
+		return nil, err
+	}
+	prefix := bucket.prefix
+	if config.Prefix == "" {
+		prefix = "sidebreaker/archive"
+	}
+	// Many sidecars can share a bucket, their objects and rows carry the machine name
+	instance, _ := os.Hostname()
+	a := &archiver{
+		bucket:    bucket,
+		prefix:    prefix,
+		format:    config.Format,
+		instance:  instance,
+		start:     time.Now(),
+		hosts:     map[string]*hostAggregate{},
+		openSince: map[string]time.Time{},
+	}
+	interval := config.Interval.Duration()
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				a.flush(now)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return a, nil
+}
+
+func (a *archiver) host(name string) *hostAggregate {
+	h, ok := a.hosts[name]
+	if !ok {
+		h = &hostAggregate{}
+		a.hosts[name] = h
+	}
+	return h
+}
+
+// Count a finished request or tunnel
+func (a *archiver) request(host string, outcome string, latency time.Duration) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	h := a.host(host)
+	h.requests++
+	switch outcome {
+	case outcomeSuccess:
+		h.successes++
+	case outcomeError:
+		h.errors++
+	case outcomeTimeout:
+		h.timeouts++
+	case outcomeProtocolError:
+		h.protocolErrors++
+	case outcomeRejected:
+		h.rejected++
+	}
+	h.latencyTotal += latency
+	if latency > h.latencyMax {
+		h.latencyMax = latency
+	}
+}
+
+// Record a breaker opening or closing
+func (a *archiver) transition(breaker string, state string, t time.Time) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.timeline = append(a.timeline, breakerTransition{Time: t, Instance: a.instance, Breaker: breaker, State: state})
+	since, open := a.openSince[breaker]
+	switch {
+	case state == "open" && !open:
+		a.openSince[breaker] = t
+	case state == "closed" && open:
+		a.host(breaker).openTime += t.Sub(laterTime(since, a.start))
+		delete(a.openSince, breaker)
+	}
+}
+
+func laterTime(a time.Time, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// Write the stats and timeline of the period ending now, and start a new period
+func (a *archiver) flush(now time.Time) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	for breaker, since := range a.openSince {
+		a.host(breaker).openTime += now.Sub(laterTime(since, a.start))
+	}
+	start, hosts, timeline := a.start, a.hosts, a.timeline
+	a.start, a.hosts, a.timeline = now, map[string]*hostAggregate{}, nil
+	a.mu.Unlock()
+
+	rows := make([]hostStatsRow, 0, len(hosts))
+	for name, h := range hosts {
+		row := hostStatsRow{
+			PeriodStart:    start,
+			PeriodEnd:      now,
+			Instance:       a.instance,
+			Host:           name,
+			Requests:       h.requests,
+			Successes:      h.successes,
+			Errors:         h.errors,
+			Timeouts:       h.timeouts,
+			ProtocolErrors: h.protocolErrors,
+			Rejected:       h.rejected,
+			LatencyMaxMs:   float64(h.latencyMax) / float64(time.Millisecond),
+			OpenMs:         h.openTime.Milliseconds(),
+		}
+		if h.requests > 0 {
+			row.LatencyAvgMs = float64(h.latencyTotal) / float64(h.requests) / float64(time.Millisecond)
+		}
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Host < rows[j].Host })
+
+	if len(rows) > 0 {
+		a.put("hosts", start, a.encodeHostStats(rows))
+	}
+	if len(timeline) > 0 {
+		a.put("timeline", start, a.encodeTimeline(timeline))
+	}
+}
+
+// Objects are partitioned by day so query engines can skip the days they don't need
+func (a *archiver) put(kind string, start time.Time, data []byte) {
+	start = start.UTC()
+	ext := ".jsonl"
+	if a.format == "parquet" {
+		ext = ".parquet"
+	}
+	key := fmt.Sprintf("%s/%s/dt=%s/%s-%s%s", a.prefix, kind, start.Format("2006-01-02"), start.Format("150405"), a.instance, ext)
+	if err := a.bucket.put(key, data); err != nil {
+		logger.Warn("Error archiving stats", "object", key, "error", err)
+		return
+	}
+	logger.Debug("Stats archived", "object", key)
+}
+
+func (a *archiver) encodeHostStats(rows []hostStatsRow) []byte {
+	if a.format != "parquet" {
+		return encodeJSONLines(len(rows), func(i int) interface{} { return rows[i] })
+	}
+	columns := []parquetColumn{
+		{name: "periodStart", kind: parquetTimestamp},
+		{name: "periodEnd", kind: parquetTimestamp},
+		{name: "instance", kind: parquetString},
+		{name: "host", kind: parquetString},
+		{name: "requests", kind: parquetInt64},
+		{name: "successes", kind: parquetInt64},
+		{name: "errors", kind: parquetInt64},
+		{name: "timeouts", kind: parquetInt64},
+		{name: "protocolErrors", kind: parquetInt64},
+		{name: "rejected", kind: parquetInt64},
+		{name: "latencyAvgMs", kind: parquetDouble},
+		{name: "latencyMaxMs", kind: parquetDouble},
+		{name: "openMs", kind: parquetInt64},
+	}
+	for _, r := range rows {
+		values := []interface{}{r.PeriodStart, r.PeriodEnd, r.Instance, r.Host, r.Requests, r.Successes, r.Errors,
+			r.Timeouts, r.ProtocolErrors, r.Rejected, r.LatencyAvgMs, r.LatencyMaxMs, r.OpenMs}
+		for i, v := range values {
+			columns[i].values = append(columns[i].values, v)
+		}
+	}
+	return encodeParquet(columns)
+}
+
+func (a *archiver) encodeTimeline(timeline []breakerTransition) []byte {
+	if a.format != "parquet" {
+		return encodeJSONLines(len(timeline), func(i int) interface{} { return timeline[i] })
+	}
+	columns := []parquetColumn{
+		{name: "time", kind: parquetTimestamp},
+		{name: "instance", kind: parquetString},
+		{name: "breaker", kind: parquetString},
+		{name: "state", kind: parquetString},
+	}
+	for _, t := range timeline {
+		values := []interface{}{t.Time, t.Instance, t.Breaker, t.State}
+		for i, v := range values {
+			columns[i].values = append(columns[i].values, v)
+		}
+	}
+	return encodeParquet(columns)
+}
+
+func encodeJSONLines(n int, line func(i int) interface{}) []byte {
+	var b bytes.Buffer
+	encoder := json.NewEncoder(&b)
+	for i := 0; i < n; i++ {
+		encoder.Encode(line(i))
+	}
+	return b.Bytes()
+}
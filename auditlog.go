@@ -0,0 +1,71 @@
+package sidebreaker
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// File of the audit log, nil when it is disabled. Writes are serialized so entries don't interleave.
+var (
+	auditFile   *os.File
+	auditFileMu sync.Mutex
+)
+
+// Open the audit log, a file the admin actions are appended to as JSON lines. Only the owner can read
+// it as it tells who changed what.
+func setupAuditLog(path string) error {
+	if path == "" {
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	auditFile = f
+	return nil
+}
+
+// Who called an admin endpoint: the user of the basic auth credentials and the client address, as
+// ops@10.0.0.5. Tokens are never written, their calls only have the address.
+func auditCaller(req *http.Request) string {
+	who, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		who = req.RemoteAddr
+	}
+	if user, _, ok := req.BasicAuth(); ok && user != "" {
+		who = user + "@" + who
+	}
+	return who
+}
+
+// Record an admin action called through the admin endpoints
+func (s *Sidebreaker) audit(req *http.Request, action string, target string, detail string) {
+	s.recordAudit(auditCaller(req), action, target, detail)
+}
+
+// Record an admin action in the audit log file and in the audit log of the storage. The file is
+// synced after each entry, an action that was applied is on disk even if the process dies right after.
+func (s *Sidebreaker) recordAudit(who string, action string, target string, detail string) {
+	e := AuditEntry{Time: time.Now(), Who: who, Action: action, Target: target, Detail: detail}
+	if auditFile != nil {
+		line, _ := json.Marshal(e)
+		auditFileMu.Lock()
+		_, err := auditFile.Write(append(line, '\n'))
+		if err == nil {
+			err = auditFile.Sync()
+		}
+		auditFileMu.Unlock()
+		if err != nil {
+			logger.Error("Error writing the audit log", "action", action, "error", err)
+		}
+	}
+	if s.storage != nil {
+		if err := s.storage.AppendAudit(e); err != nil {
+			logger.Warn("Error writing the audit log", "action", action, "error", err)
+		}
+	}
+}
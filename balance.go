@@ -0,0 +1,294 @@
+package sidebreaker
+
+import (
+	"context"
+	"crypto/tls"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http/httptrace"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How the new connections of a host are spread over its addresses
+const (
+	balanceRoundRobin       = "round-robin"
+	balanceLeastConnections = "least-connections"
+)
+
+// Connections opened, open and failed per host and address, for the hosts that balance their connections
+var (
+	endpointConnections = expvar.NewMap("endpointConnections")
+	endpointOpen        = expvar.NewMap("endpointOpen")
+	endpointFailures    = expvar.NewMap("endpointFailures")
+)
+
+// OutlierDetection struct for the configuration, addresses of the host that keep failing are ejected
+// from the balancer for a while, apart from the breaker of the host
+type OutlierDetection struct {
+	ConsecutiveFailures int      `json:"consecutiveFailures" doc:"Failed connections and calls in a row that eject an address of the host, no ejection when not set" example:"5"`
+	Ejection            Duration `json:"ejection" doc:"How long an address is ejected, each ejection of an address that was ejected recently lasts longer by as much, up to ten times, 30s by default" example:"30s"`
+	MaxEjectionPercent  int      `json:"maxEjectionPercent" doc:"Percentage of the addresses of the host that can be ejected at once, one address at least is always left, 50 by default" example:"50"`
+}
+
+// Test wether addresses of the host are ejected
+func (o OutlierDetection) enabled() bool {
+	return o.ConsecutiveFailures > 0
+}
+
+// Ejections per host and address
+var endpointEjections = expvar.NewMap("endpointEjections")
+
+// balancer spreads the new connections of a host over its addresses, the ones listed in the
+// configuration or the ones it resolves to. Addresses whose last connection failed are tried last
+// until a connection to them succeeds again, ejected addresses aren't tried at all.
+type balancer struct {
+	host      string
+	strategy  string
+	addresses []string
+	outlier   OutlierDetection
+
+	next      uint32
+	mu        sync.Mutex
+	endpoints map[string]*endpointState
+	known     int
+}
+
+// endpointState is what the balancer knows of an address of its host
+type endpointState struct {
+	failing      bool
+	consecutive  int
+	ejections    int
+	ejectedUntil time.Time
+}
+
+// Create the balancers of the hosts that list addresses, balance their connections or eject failing
+// addresses. Hosts whose addresses and settings didn't change keep the state of their addresses.
+func (s *Sidebreaker) setupBalancers(hosts []Host) {
+	s.balancers.update(func(current map[string]*balancer) map[string]*balancer {
+		updated := map[string]*balancer{}
+		for _, h := range hosts {
+			if h.Balance == "" && len(h.Addresses) == 0 && !h.OutlierDetection.enabled() {
+				continue
+			}
+			outlier := h.OutlierDetection
+			if outlier.Ejection <= 0 {
+				outlier.Ejection = Duration(30 * time.Second)
+			}
+			if outlier.MaxEjectionPercent <= 0 {
+				outlier.MaxEjectionPercent = 50
+			}
+			if b, ok := current[h.Host]; ok && b.strategy == h.Balance && slices.Equal(b.addresses, h.Addresses) && b.outlier == outlier {
+				updated[h.Host] = b
+			} else {
+				updated[h.Host] = &balancer{host: h.Host, strategy: h.Balance, addresses: h.Addresses, outlier: outlier, endpoints: map[string]*endpointState{}}
+			}
+		}
+		return updated
+	})
+}
+
+// Put the addresses in the order to try them: rotated on each connection for round-robin, by the
+// connections open to them for least-connections, and the ones that failed last. Ejected addresses
+// are left out.
+func (b *balancer) order(addrs []string) []string {
+	if b == nil {
+		return addrs
+	}
+	ordered := addrs
+	if b.strategy != "" && len(addrs) > 1 {
+		start := int(atomic.AddUint32(&b.next, 1)-1) % len(addrs)
+		ordered = append(append([]string(nil), addrs[start:]...), addrs[:start]...)
+	}
+	if b.strategy == balanceLeastConnections {
+		open := make(map[string]int64, len(ordered))
+		for _, a := range ordered {
+			open[a] = nestedCounter(endpointOpen, b.host, a).Value()
+		}
+		sort.SliceStable(ordered, func(i, j int) bool { return open[ordered[i]] < open[ordered[j]] })
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.known = len(addrs)
+	if len(b.endpoints) == 0 {
+		return ordered
+	}
+	now := time.Now()
+	kept := make([]string, 0, len(ordered))
+	for _, a := range ordered {
+		if e := b.endpoints[a]; e == nil || !now.Before(e.ejectedUntil) {
+			kept = append(kept, a)
+		}
+	}
+	if len(kept) == 0 {
+		// The host resolves to fewer addresses than when they were ejected, try them all
+		kept = ordered
+	}
+	sort.SliceStable(kept, func(i, j int) bool {
+		return !b.failing(kept[i]) && b.failing(kept[j])
+	})
+	return kept
+}
+
+// Test wether an address is ejected
+func (b *balancer) ejected(addr string) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e := b.endpoints[addr]
+	return e != nil && time.Now().Before(e.ejectedUntil)
+}
+
+func (b *balancer) failing(addr string) bool {
+	e := b.endpoints[addr]
+	return e != nil && e.failing
+}
+
+func (b *balancer) endpoint(addr string) *endpointState {
+	e, ok := b.endpoints[addr]
+	if !ok {
+		e = &endpointState{}
+		b.endpoints[addr] = e
+	}
+	return e
+}
+
+// Record the outcome of a connection to an address, an open connection is counted until it is closed
+func (b *balancer) connected(addr string, conn net.Conn, err error) net.Conn {
+	if b == nil {
+		return conn
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err != nil {
+		b.endpoint(addr).failing = true
+		b.failed(addr)
+		nestedCounter(endpointFailures, b.host, addr).Add(1)
+		return nil
+	}
+	if e, ok := b.endpoints[addr]; ok {
+		e.failing = false
+	}
+	nestedCounter(endpointConnections, b.host, addr).Add(1)
+	open := nestedCounter(endpointOpen, b.host, addr)
+	open.Add(1)
+	return &endpointConn{countedConn: &countedConn{Conn: conn, open: open}, balancer: b, addr: addr}
+}
+
+// Count a failure of an address, the address is ejected after the consecutive failures of the outlier
+// detection unless too many addresses of the host are ejected already
+func (b *balancer) failed(addr string) {
+	if !b.outlier.enabled() {
+		return
+	}
+	e := b.endpoint(addr)
+	e.consecutive++
+	now := time.Now()
+	if e.consecutive < b.outlier.ConsecutiveFailures || now.Before(e.ejectedUntil) {
+		return
+	}
+	ejected := 0
+	for _, other := range b.endpoints {
+		if now.Before(other.ejectedUntil) {
+			ejected++
+		}
+	}
+	if ejected+1 > max(1, b.known*b.outlier.MaxEjectionPercent/100) || ejected+1 >= b.known {
+		return
+	}
+	base := b.outlier.Ejection.Duration()
+	if now.Sub(e.ejectedUntil) > base*time.Duration(e.ejections) {
+		// Back for longer than it was ejected, the address starts over
+		e.ejections = 0
+	}
+	e.ejections++
+	ejection := base * time.Duration(min(e.ejections, 10))
+	e.ejectedUntil = now.Add(ejection)
+	e.consecutive = 0
+	nestedCounter(endpointEjections, b.host, addr).Add(1)
+	logger.Warn("Ejected an address of the host", "host", b.host, "address", addr, "failures", b.outlier.ConsecutiveFailures, "ejection", ejection.String())
+}
+
+// Record the outcome of a call on a connection to an address
+func (b *balancer) called(addr string, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if failed {
+		b.failed(addr)
+	} else if e, ok := b.endpoints[addr]; ok {
+		e.consecutive = 0
+	}
+}
+
+// endpointConn is a connection to an address of a balanced host, its calls count for the outlier detection
+type endpointConn struct {
+	*countedConn
+	balancer *balancer
+	addr     string
+}
+
+// Record the outcome of a call on an upstream connection, for the outlier detection of its host
+func reportCall(conn net.Conn, failed bool) {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	if ec, ok := conn.(*endpointConn); ok {
+		ec.balancer.called(ec.addr, failed)
+	}
+}
+
+// Trace the connection a request gets when the host ejects failing addresses, the returned function
+// records the outcome of the call
+func (s *Sidebreaker) traceCall(ctx context.Context, host string) (context.Context, func(failed bool)) {
+	if b := s.balancers.get(host); b == nil || !b.outlier.enabled() {
+		return ctx, func(bool) {}
+	}
+	var mu sync.Mutex
+	var conn net.Conn
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			mu.Lock()
+			conn = info.Conn
+			mu.Unlock()
+		},
+	})
+	return ctx, func(failed bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		if conn != nil {
+			reportCall(conn, failed)
+		}
+	}
+}
+
+// The address to dial for an address of a host, addresses without a port take the port the client asked for
+func endpointAddr(addr string, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return net.JoinHostPort(canonicalHost(addr), port)
+	}
+	return addr
+}
+
+// Check the addresses of a host, host or IP with an optional port
+func validateAddresses(addrs []string) error {
+	for _, a := range addrs {
+		host, port, err := net.SplitHostPort(a)
+		if err != nil {
+			host, port = a, ""
+		}
+		if host == "" {
+			return fmt.Errorf("address must be a host or IP with an optional port, got %q", a)
+		}
+		if p, err := strconv.Atoi(port); port != "" && (err != nil || p < 1 || p > 65535) {
+			return fmt.Errorf("port of %q must be between 1 and 65535", a)
+		}
+	}
+	return nil
+}
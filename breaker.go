@@ -0,0 +1,72 @@
+package sidebreaker
+
+import (
+	"sync"
+
+	"github.com/rubyist/circuitbreaker"
+)
+
+// Breaker is implemented by the circuit breakers used for hosts. The breakers from
+// github.com/rubyist/circuitbreaker implement it, custom ones can embed them and override what they need.
+type Breaker interface {
+	Ready() bool
+	Success()
+	Fail()
+	Trip()
+	Reset()
+	Tripped() bool
+	Failures() int64
+	ConsecFailures() int64
+	Successes() int64
+	ErrorRate() float64
+	Subscribe() <-chan circuit.BreakerEvent
+}
+
+// BreakerFactory creates the breaker for a host from its configuration
+type BreakerFactory func(host Host) Breaker
+
+// Break types available for the breakType setting of the configuration
+var (
+	breakTypesMu sync.RWMutex
+	breakTypes   = map[string]BreakerFactory{
+		"consecutive": func(host Host) Breaker {
+			return newTimedBreaker(circuit.ConsecutiveTripFunc(host.Threshold))
+		},
+		"threshold": func(host Host) Breaker {
+			return newTimedBreaker(circuit.ThresholdTripFunc(host.Threshold))
+		},
+		"rate": func(host Host) Breaker {
+			return newTimedBreaker(circuit.RateTripFunc(host.Rate/100, 100))
+		},
+	}
+)
+
+// RegisterBreakType makes a custom break type available to the configuration. It is meant to be
+// called from an init function before New, registering a built-in name replaces it.
+//
+//	func init() {
+//		sidebreaker.RegisterBreakType("slowstart", func(host sidebreaker.Host) sidebreaker.Breaker {
+//			return circuit.NewBreakerWithOptions(&circuit.Options{Clock: sidebreaker.MonotonicClock, ShouldTrip: mySlowStartTrip(host.Threshold)})
+//		})
+//	}
+func RegisterBreakType(name string, factory BreakerFactory) {
+	breakTypesMu.Lock()
+	defer breakTypesMu.Unlock()
+	breakTypes[name] = factory
+}
+
+// Create the circuit breaker for a host according to its configuration.
+// Hosts with a policy get a breaker without trip function, the policy trips it instead.
+// Unknown break types get the default consecutive breaker.
+func newBreaker(host Host) Breaker {
+	if host.Policy != "" {
+		return newTimedBreaker(nil)
+	}
+	breakTypesMu.RLock()
+	factory, ok := breakTypes[host.BreakType]
+	breakTypesMu.RUnlock()
+	if !ok {
+		return newTimedBreaker(circuit.ConsecutiveTripFunc(5))
+	}
+	return factory(host)
+}
@@ -0,0 +1,377 @@
+package sidebreaker
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// livenessInspector is implemented by the inspectors of long lived protocols. Their tunnels have
+// no total timeout, instead they are closed once the upstream stops answering.
+type livenessInspector interface {
+	protocolInspector
+	// dead reports whether the upstream stopped answering, Err then describes why
+	dead(now time.Time) bool
+}
+
+// Default time an upstream of a long lived protocol can stay silent while a client waits for it
+const defaultHeartbeat = 30 * time.Second
+
+// Liveness interval of a host, the heartbeat setting or the default
+func heartbeatInterval(host Host) time.Duration {
+	if host.Heartbeat > 0 {
+		return host.Heartbeat.Duration()
+	}
+	return defaultHeartbeat
+}
+
+// Watch a long lived tunnel and close it when the upstream stops answering, until stop is closed
+func watchLiveness(live livenessInspector, stop <-chan struct{}, closeTunnel func()) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			if live.dead(now) {
+				closeTunnel()
+				return
+			}
+		}
+	}
+}
+
+// Only the first bytes of a frame are kept for inspection, the rest is skipped
+const frameKeep = 512
+
+// frameScanner splits a stream into length prefixed frames and calls onFrame with the first bytes
+// of each frame, bodies such as message payloads are skipped without buffering them
+type frameScanner struct {
+	headerLen int
+	length    func(header []byte) int
+	onFrame   func(frame []byte)
+
+	buf   []byte
+	total int
+	skip  int
+}
+
+// Feed bytes to the scanner, it returns false when the stream doesn't look like frames
+func (s *frameScanner) write(p []byte) bool {
+	for len(p) > 0 {
+		if s.skip > 0 {
+			n := s.skip
+			if n > len(p) {
+				n = len(p)
+			}
+			s.skip -= n
+			p = p[n:]
+			continue
+		}
+
+		if len(s.buf) < s.headerLen {
+			n := s.headerLen - len(s.buf)
+			if n > len(p) {
+				n = len(p)
+			}
+			s.buf = append(s.buf, p[:n]...)
+			p = p[n:]
+			if len(s.buf) < s.headerLen {
+				return true
+			}
+			s.total = s.length(s.buf)
+			if s.total < s.headerLen {
+				return false
+			}
+		}
+
+		want := s.total
+		if want > frameKeep {
+			want = frameKeep
+		}
+		n := want - len(s.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		s.buf = append(s.buf, p[:n]...)
+		p = p[n:]
+		if len(s.buf) < want {
+			return true
+		}
+		s.onFrame(s.buf)
+		s.skip = s.total - want
+		s.buf = s.buf[:0]
+	}
+	return true
+}
+
+// AMQP 0-9-1 frame types and the connection methods we look at
+const (
+	amqpFrameMethod = 1
+	amqpClassConn   = 10
+	amqpTune        = 30
+	amqpTuneOk      = 31
+	amqpClose       = 50
+	amqpBlocked     = 60
+	amqpUnblocked   = 61
+)
+
+// amqpInspector follows an AMQP 0-9-1 connection. The broker closing the connection with an error is a
+// failure, and once heartbeats are negotiated a broker that misses two of them is considered dead.
+// A broker that blocks publishers for longer than the heartbeat setting is considered dead too.
+type amqpInspector struct {
+	inspectorState
+	interval time.Duration
+
+	client       *frameScanner
+	server       *frameScanner
+	clientHeader int
+	serverStart  []byte
+	serverSeen   bool
+
+	heartbeat    time.Duration
+	lastServer   time.Time
+	blockedSince time.Time
+	blockReason  string
+}
+
+func newAMQPInspector(host Host) *amqpInspector {
+	m := &amqpInspector{interval: heartbeatInterval(host), lastServer: time.Now()}
+	length := func(header []byte) int { return 7 + int(binary.BigEndian.Uint32(header[3:7])) + 1 }
+	m.client = &frameScanner{headerLen: 7, length: length, onFrame: m.clientFrame}
+	m.server = &frameScanner{headerLen: 7, length: length, onFrame: m.serverFrame}
+	return m
+}
+
+// Parse the class and method of a connection method frame
+func amqpMethod(frame []byte) (method uint16, args []byte, ok bool) {
+	if len(frame) < 11 || frame[0] != amqpFrameMethod || binary.BigEndian.Uint16(frame[7:9]) != amqpClassConn {
+		return 0, nil, false
+	}
+	return binary.BigEndian.Uint16(frame[9:11]), frame[11:], true
+}
+
+// Read a short string argument
+func amqpShortString(args []byte) string {
+	if len(args) < 1 || len(args) < 1+int(args[0]) {
+		return ""
+	}
+	return string(args[1 : 1+int(args[0])])
+}
+
+func (m *amqpInspector) fromClient(p []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// The client starts with the 8 byte protocol header
+	if m.clientHeader < 8 {
+		n := 8 - m.clientHeader
+		if n > len(p) {
+			n = len(p)
+		}
+		m.clientHeader += n
+		p = p[n:]
+	}
+	m.client.write(p)
+}
+
+func (m *amqpInspector) clientFrame(frame []byte) {
+	// The heartbeat the client agreed to in Tune-Ok is the one used by both sides
+	if method, args, ok := amqpMethod(frame); ok && method == amqpTuneOk && len(args) >= 8 {
+		m.heartbeat = time.Duration(binary.BigEndian.Uint16(args[6:8])) * time.Second
+	}
+}
+
+func (m *amqpInspector) fromServer(p []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastServer = time.Now()
+	if m.done {
+		return
+	}
+	// A broker that doesn't support the protocol version answers with its own protocol header, its
+	// first bytes are held until they tell
+	if !m.serverSeen {
+		m.serverStart = append(m.serverStart, p...)
+		if len(m.serverStart) < 4 {
+			return
+		}
+		if string(m.serverStart[:4]) == "AMQP" {
+			m.err = fmt.Errorf("amqp protocol version not supported by the broker")
+			m.done = true
+			return
+		}
+		p, m.serverStart, m.serverSeen = m.serverStart, nil, true
+	}
+	if !m.server.write(p) {
+		m.done = true
+	}
+}
+
+func (m *amqpInspector) serverFrame(frame []byte) {
+	method, args, ok := amqpMethod(frame)
+	if !ok {
+		return
+	}
+	switch method {
+	case amqpTune:
+		if m.heartbeat == 0 && len(args) >= 8 {
+			m.heartbeat = time.Duration(binary.BigEndian.Uint16(args[6:8])) * time.Second
+		}
+	case amqpClose:
+		if len(args) >= 2 {
+			if code := binary.BigEndian.Uint16(args[:2]); code != 200 && m.err == nil {
+				m.err = fmt.Errorf("amqp connection closed by the broker: %d %s", code, amqpShortString(args[2:]))
+			}
+		}
+	case amqpBlocked:
+		m.blockedSince = time.Now()
+		m.blockReason = amqpShortString(args)
+	case amqpUnblocked:
+		m.blockedSince = time.Time{}
+	}
+}
+
+func (m *amqpInspector) dead(now time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.blockedSince.IsZero() && now.Sub(m.blockedSince) > m.interval {
+		m.err = fmt.Errorf("amqp broker blocked publishing for %s: %s", now.Sub(m.blockedSince).Round(time.Second), m.blockReason)
+		return true
+	}
+	if m.heartbeat > 0 && now.Sub(m.lastServer) > 2*m.heartbeat {
+		m.err = fmt.Errorf("amqp broker missed its heartbeats for %s", now.Sub(m.lastServer).Round(time.Second))
+		return true
+	}
+	return false
+}
+
+// Kafka API key of produce requests, which get no response when acks is 0
+const kafkaProduce = 0
+
+// kafkaInspector follows the requests of a Kafka client. A broker that leaves a request
+// unanswered for longer than the heartbeat setting is considered dead.
+type kafkaInspector struct {
+	inspectorState
+	interval time.Duration
+
+	client *frameScanner
+	server *frameScanner
+
+	pending      int
+	waitingSince time.Time
+}
+
+func newKafkaInspector(host Host) *kafkaInspector {
+	m := &kafkaInspector{interval: heartbeatInterval(host)}
+	length := func(header []byte) int { return 4 + int(int32(binary.BigEndian.Uint32(header))) }
+	m.client = &frameScanner{headerLen: 4, length: length, onFrame: m.request}
+	m.server = &frameScanner{headerLen: 4, length: length, onFrame: m.response}
+	return m
+}
+
+func (m *kafkaInspector) fromClient(p []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.done && !m.client.write(p) {
+		m.done = true
+	}
+}
+
+func (m *kafkaInspector) fromServer(p []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.done && !m.server.write(p) {
+		m.done = true
+	}
+}
+
+func (m *kafkaInspector) request(frame []byte) {
+	if kafkaExpectsResponse(frame) {
+		if m.pending == 0 {
+			m.waitingSince = time.Now()
+		}
+		m.pending++
+	}
+}
+
+func (m *kafkaInspector) response(frame []byte) {
+	if m.pending > 0 {
+		m.pending--
+	}
+	m.waitingSince = time.Now()
+}
+
+func (m *kafkaInspector) dead(now time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.pending > 0 && now.Sub(m.waitingSince) > m.interval {
+		m.err = fmt.Errorf("kafka broker left %d requests unanswered for %s", m.pending, now.Sub(m.waitingSince).Round(time.Second))
+		return true
+	}
+	return false
+}
+
+// Test wether a request gets a response, only produce requests with acks 0 don't
+func kafkaExpectsResponse(frame []byte) bool {
+	// size, api key, api version, correlation id and the client id length
+	if len(frame) < 14 || binary.BigEndian.Uint16(frame[4:6]) != kafkaProduce {
+		return true
+	}
+	version := binary.BigEndian.Uint16(frame[6:8])
+	rest := frame[14:]
+	if n := int(int16(binary.BigEndian.Uint16(frame[12:14]))); n > 0 {
+		if len(rest) < n {
+			return true
+		}
+		rest = rest[n:]
+	}
+
+	switch {
+	case version >= 9:
+		// Flexible versions have tagged fields in the header and a compact transactional id
+		tags, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return true
+		}
+		rest = rest[n:]
+		for i := uint64(0); i < tags; i++ {
+			if _, n = binary.Uvarint(rest); n <= 0 {
+				return true
+			}
+			rest = rest[n:]
+			size, n := binary.Uvarint(rest)
+			if n <= 0 || uint64(len(rest)-n) < size {
+				return true
+			}
+			rest = rest[n+int(size):]
+		}
+		length, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return true
+		}
+		rest = rest[n:]
+		if length > 0 {
+			if uint64(len(rest)) < length-1 {
+				return true
+			}
+			rest = rest[length-1:]
+		}
+	case version >= 3:
+		if len(rest) < 2 {
+			return true
+		}
+		n := int(int16(binary.BigEndian.Uint16(rest)))
+		rest = rest[2:]
+		if n > 0 {
+			if len(rest) < n {
+				return true
+			}
+			rest = rest[n:]
+		}
+	}
+	if len(rest) < 2 {
+		return true
+	}
+	return int16(binary.BigEndian.Uint16(rest)) != 0
+}
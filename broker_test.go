@@ -0,0 +1,135 @@
+package sidebreaker
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+)
+
+// AMQP frame of a type on channel 0
+func amqpFrame(kind byte, payload string) string {
+	header := []byte{kind, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(header[3:], uint32(len(payload)))
+	return string(header) + payload + "\xce"
+}
+
+// AMQP connection method frame
+func amqpConnMethod(method uint16, args string) string {
+	return amqpFrame(amqpFrameMethod, string([]byte{0, amqpClassConn, byte(method >> 8), byte(method)})+args)
+}
+
+// Tune and Tune-Ok arguments with a heartbeat in seconds
+func amqpTuneArgs(heartbeat uint16) string {
+	return "\x07\xff\x00\x02\x00\x00" + string([]byte{byte(heartbeat >> 8), byte(heartbeat)})
+}
+
+// Test wether the AMQP brokers closing with an error, refusing the protocol version, missing their
+// heartbeats or blocking publishers too long are found, also with frames split over reads
+func TestAMQPInspector(t *testing.T) {
+	header := "AMQP\x00\x00\x09\x01"
+	start := amqpConnMethod(10, "\x00\x09"+strings.Repeat("x", 40))
+	tune := amqpConnMethod(amqpTune, amqpTuneArgs(60))
+	tuneOk := amqpConnMethod(amqpTuneOk, amqpTuneArgs(10))
+	publish := amqpFrame(3, strings.Repeat("m", 2000))
+	forced := amqpConnMethod(amqpClose, "\x01\x40\x11CONNECTION_FORCED\x00\x00\x00\x00")
+	tests := []struct {
+		name      string
+		exchanges []exchange
+		// dead after this long without anything from the broker
+		after    time.Duration
+		dead     bool
+		expected string
+	}{
+		{"negotiated heartbeat", []exchange{clientSends(header), serverSends(start + tune), clientSends(tuneOk)}, 15 * time.Second, false, ""},
+		{"missed heartbeats", []exchange{clientSends(header), serverSends(start + tune), clientSends(tuneOk)}, 25 * time.Second, true, "amqp broker missed its heartbeats"},
+		{"heartbeat of the broker", []exchange{clientSends(header), serverSends(start + tune)}, 3 * time.Minute, true, "amqp broker missed its heartbeats"},
+		{"heartbeats turned off by the client", []exchange{clientSends(header), serverSends(start + tune), clientSends(amqpConnMethod(amqpTuneOk, amqpTuneArgs(0)))}, time.Hour, false, ""},
+		{"no heartbeat", []exchange{clientSends(header), serverSends(start)}, time.Hour, false, ""},
+		{"closed by the broker", []exchange{clientSends(header), serverSends(start), serverSends(publish + forced)}, 0, false, "amqp connection closed by the broker: 320 CONNECTION_FORCED"},
+		{"closed normally", []exchange{clientSends(header), serverSends(start + amqpConnMethod(amqpClose, "\x00\xc8\x02OK\x00\x00\x00\x00"))}, 0, false, ""},
+		{"version not supported", []exchange{clientSends("AMQP\x00\x00\x08\x00"), serverSends(header), serverSends(forced)}, 0, false, "amqp protocol version not supported by the broker"},
+		{"blocked too long", []exchange{clientSends(header), serverSends(start + amqpConnMethod(amqpBlocked, "\x0clow on memory"))}, 6 * time.Second, true, "amqp broker blocked publishing"},
+		{"unblocked", []exchange{clientSends(header), serverSends(start + amqpConnMethod(amqpBlocked, "\x0clow on memory") + amqpConnMethod(amqpUnblocked, ""))}, 6 * time.Second, false, ""},
+	}
+	for _, test := range tests {
+		for _, split := range []bool{false, true} {
+			m := newAMQPInspector(Host{Host: "amqp.example.com", Heartbeat: 5000})
+			inspectTunnel(m, test.exchanges, split)
+			if dead := m.dead(time.Now().Add(test.after)); dead != test.dead {
+				t.Errorf("%s (split %v): expected dead %v, got %v", test.name, split, test.dead, dead)
+			}
+			if got := inspectorErr(m); !strings.HasPrefix(got, test.expected) || (test.expected == "") != (got == "") {
+				t.Errorf("%s (split %v): expected %q, got %q", test.name, split, test.expected, got)
+			}
+		}
+	}
+}
+
+// Kafka request with its api key and version, the client id and the rest of the request
+func kafkaRequest(apiKey, version uint16, rest string) string {
+	b := make([]byte, 14)
+	binary.BigEndian.PutUint16(b[4:], apiKey)
+	binary.BigEndian.PutUint16(b[6:], version)
+	binary.BigEndian.PutUint32(b[8:], 7)
+	binary.BigEndian.PutUint16(b[12:], 3)
+	b = append(b, "app"...)
+	b = append(b, rest...)
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+	return string(b)
+}
+
+// Test wether only produce requests with acks 0 go without a response, in every version
+func TestKafkaExpectsResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		request  string
+		expected bool
+	}{
+		{"metadata", kafkaRequest(3, 9, "\x00"), true},
+		{"produce v2 acks 0", kafkaRequest(kafkaProduce, 2, "\x00\x00\x00\x00\x75\x30"), false},
+		{"produce v2 acks 1", kafkaRequest(kafkaProduce, 2, "\x00\x01\x00\x00\x75\x30"), true},
+		{"produce v3 acks 0", kafkaRequest(kafkaProduce, 3, "\xff\xff\x00\x00\x00\x00\x75\x30"), false},
+		{"produce v3 transactional", kafkaRequest(kafkaProduce, 3, "\x00\x02tx\xff\xff\x00\x00\x75\x30"), true},
+		{"produce v3 acks all", kafkaRequest(kafkaProduce, 3, "\xff\xff\xff\xff\x00\x00\x75\x30"), true},
+		{"produce v9 acks 0", kafkaRequest(kafkaProduce, 9, "\x00\x00\x00\x00\x00\x00\x75\x30"), false},
+		{"produce v9 tagged fields", kafkaRequest(kafkaProduce, 9, "\x01\x00\x02ab\x03tx\x00\x00\x00\x00\x75\x30"), false},
+		{"produce v9 acks 1", kafkaRequest(kafkaProduce, 9, "\x00\x00\x00\x01\x00\x00\x75\x30"), true},
+		{"produce cut short", kafkaRequest(kafkaProduce, 3, "\xff"), true},
+	}
+	for _, test := range tests {
+		if got := kafkaExpectsResponse([]byte(test.request)); got != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, got)
+		}
+	}
+}
+
+// Test wether a Kafka broker leaving requests unanswered is dead, also with frames split over reads
+func TestKafkaInspector(t *testing.T) {
+	metadata := kafkaRequest(3, 9, "\x00")
+	fireAndForget := kafkaRequest(kafkaProduce, 3, "\xff\xff\x00\x00\x00\x00\x75\x30"+strings.Repeat("r", 1000))
+	response := "\x00\x00\x00\x08\x00\x00\x00\x07\x00\x00\x00\x00"
+	tests := []struct {
+		name      string
+		exchanges []exchange
+		dead      bool
+	}{
+		{"answered", []exchange{clientSends(metadata), serverSends(response)}, false},
+		{"unanswered", []exchange{clientSends(metadata)}, true},
+		{"one of two answered", []exchange{clientSends(metadata + metadata), serverSends(response)}, true},
+		{"produce with acks 0", []exchange{clientSends(fireAndForget + fireAndForget)}, false},
+		{"not kafka", []exchange{clientSends("\xff\xff\xff\xff" + metadata)}, false},
+	}
+	for _, test := range tests {
+		for _, split := range []bool{false, true} {
+			m := newKafkaInspector(Host{Host: "kafka.example.com", Heartbeat: 5000})
+			inspectTunnel(m, test.exchanges, split)
+			if dead := m.dead(time.Now().Add(6 * time.Second)); dead != test.dead {
+				t.Errorf("%s (split %v): expected dead %v, got %v", test.name, split, test.dead, dead)
+			}
+			if got := inspectorErr(m); test.dead != strings.HasPrefix(got, "kafka broker left") {
+				t.Errorf("%s (split %v): expected an error when dead, got %q", test.name, split, got)
+			}
+		}
+	}
+}
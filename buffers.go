@@ -0,0 +1,61 @@
+package sidebreaker
+
+import (
+	"expvar"
+	"io"
+	"sync"
+)
+
+// Size of the buffers tunnel data is copied through when the configuration doesn't say, as io.Copy
+const defaultCopyBufferSize = 32 * 1024
+
+// Bounds of copyBufferSize, small buffers cost a system call per few bytes and large ones the
+// memory of every tunnel
+const (
+	minCopyBufferSize = 1024
+	maxCopyBufferSize = 1024 * 1024
+)
+
+// Copy buffers allocated because the pool had none to give back, a count that keeps growing
+// under steady load means the buffers are too short lived to be reused
+var copyBufferAllocs = expvar.NewInt("copyBufferAllocs")
+
+// Buffers of the tunnel copies, each tunnel holds two while it is open and gives them back once
+// it is done so thousands of tunnels don't each allocate their own
+var (
+	copyBuffers    = newBufferPool(defaultCopyBufferSize)
+	copyBuffersMu  sync.Mutex
+	copyBufferSize = defaultCopyBufferSize
+)
+
+func newBufferPool(size int) *sync.Pool {
+	return &sync.Pool{New: func() any {
+		copyBufferAllocs.Add(1)
+		b := make([]byte, size)
+		return &b
+	}}
+}
+
+// Set the size of the copy buffers, buffers of the previous size are dropped with their pool
+func setupCopyBuffers(size int) {
+	if size == 0 {
+		size = defaultCopyBufferSize
+	}
+	copyBuffersMu.Lock()
+	defer copyBuffersMu.Unlock()
+	if size != copyBufferSize {
+		copyBuffers = newBufferPool(size)
+		copyBufferSize = size
+	}
+}
+
+// Copy src to dst through a pooled buffer. As with io.Copy, the buffer isn't used when src or dst
+// copy by themselves, as two TCP connections do with splice.
+func copyBuffer(dst io.Writer, src io.Reader) (int64, error) {
+	copyBuffersMu.Lock()
+	pool := copyBuffers
+	copyBuffersMu.Unlock()
+	buf := pool.Get().(*[]byte)
+	defer pool.Put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
@@ -0,0 +1,107 @@
+package sidebreaker
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Capability is a platform feature the sidebreaker uses when it is available, and what it does without
+type Capability struct {
+	Name      string `json:"name"`
+	Available bool   `json:"available"`
+	Detail    string `json:"detail"`
+}
+
+// Capabilities detected on startup, they are detected again once the privileges are dropped
+var (
+	capabilitiesMu sync.RWMutex
+	capabilities   []Capability
+)
+
+// Detect what the platform, the container and our privileges allow and log a report
+func detectCapabilities() {
+	detected := []Capability{
+		probeReusePort(),
+		probeSplice(),
+		probeRestart(),
+		probeSetuid(),
+		probeSeccomp(),
+		probeICMP4(),
+		probeEBPF(),
+		probeTProxy(),
+	}
+	capabilitiesMu.Lock()
+	capabilities = detected
+	capabilitiesMu.Unlock()
+
+	available, unavailable := []string{}, []string{}
+	for _, c := range detected {
+		if c.Available {
+			available = append(available, c.Name)
+		} else {
+			unavailable = append(unavailable, c.Name)
+		}
+	}
+	logger.Info("Platform capabilities", "available", strings.Join(available, ","), "unavailable", strings.Join(unavailable, ","))
+}
+
+// Test wether a capability was detected
+func hasCapability(name string) bool {
+	capabilitiesMu.RLock()
+	defer capabilitiesMu.RUnlock()
+	for _, c := range capabilities {
+		if c.Name == name {
+			return c.Available
+		}
+	}
+	return false
+}
+
+// Handler for the capability report
+func capabilitiesHandler(w http.ResponseWriter, req *http.Request) {
+	capabilitiesMu.RLock()
+	report := capabilities
+	capabilitiesMu.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, report)
+}
+
+func probeReusePort() Capability {
+	c := Capability{Name: "reusePort", Detail: "listeners can share their port with a new sidebreaker"}
+	l, err := (&net.ListenConfig{Control: reusePortControl}).Listen(context.Background(), "tcp", "127.0.0.1:0")
+	if err != nil {
+		c.Detail = "reusePort is ignored: " + err.Error()
+		return c
+	}
+	l.Close()
+	c.Available = true
+	return c
+}
+
+func probeRestart() Capability {
+	if RestartSignal == nil {
+		return Capability{Name: "restart", Detail: "listeners can't be handed to a new process, restart by stopping and starting"}
+	}
+	return Capability{Name: "restart", Available: true, Detail: "listeners are handed to a new process on restarts"}
+}
+
+// ICMP health checks use raw sockets, or unprivileged ping sockets without the privileges for them
+func probeICMP4() Capability {
+	c := Capability{Name: "icmp", Available: true, Detail: "icmp health checks use raw sockets"}
+	if conn, err := net.ListenPacket("ip4:icmp", ""); err == nil {
+		conn.Close()
+		return c
+	}
+	c.Detail = "icmp health checks use unprivileged ping sockets"
+	conn, err := pingSocket(false)
+	if err != nil {
+		c.Available = false
+		c.Detail = "icmp health checks fail, use tcp health checks: " + err.Error()
+		return c
+	}
+	conn.Close()
+	return c
+}
@@ -0,0 +1,74 @@
+package sidebreaker
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Tunnels between two TCP connections are copied with splice by the Go runtime, in the kernel
+func probeSplice() Capability {
+	c := Capability{Name: "splice", Detail: "tunnel data is copied in the kernel"}
+	r, w, err := os.Pipe()
+	if err != nil {
+		c.Detail = "tunnel data is copied through userspace buffers: " + err.Error()
+		return c
+	}
+	defer r.Close()
+	defer w.Close()
+	// An empty pipe has nothing to splice, anything but the call being refused means it is there
+	_, err = unix.Splice(int(r.Fd()), nil, int(w.Fd()), nil, 1, unix.SPLICE_F_NONBLOCK)
+	if err == unix.ENOSYS || err == unix.EPERM {
+		c.Detail = "tunnel data is copied through userspace buffers: " + err.Error()
+		return c
+	}
+	c.Available = true
+	return c
+}
+
+func probeSetuid() Capability {
+	return Capability{Name: "setuid", Available: true, Detail: "runAs can switch user once the ports are bound"}
+}
+
+func probeSeccomp() Capability {
+	c := Capability{Name: "seccomp", Detail: "runAs can apply a seccomp profile"}
+	if !seccompSupported {
+		c.Detail = "runAs.seccomp is only supported on amd64 and arm64"
+		return c
+	}
+	if err := unix.Prctl(unix.PR_GET_SECCOMP, 0, 0, 0, 0); err != nil {
+		c.Detail = "runAs.seccomp fails, the kernel has no seccomp: " + err.Error()
+		return c
+	}
+	c.Available = true
+	return c
+}
+
+// eBPF and TPROXY are reported for the environment, the sidebreaker doesn't load programs
+// or proxy transparently
+func probeEBPF() Capability {
+	c := Capability{Name: "ebpf", Detail: "bpf programs can be loaded, not used by the sidebreaker"}
+	// BPF_MAP_CREATE without attributes is invalid, refused and missing syscalls fail differently
+	_, _, errno := unix.Syscall(unix.SYS_BPF, 0, 0, 0)
+	if errno == unix.ENOSYS || errno == unix.EPERM {
+		c.Detail = "bpf programs can't be loaded: " + errno.Error()
+		return c
+	}
+	c.Available = true
+	return c
+}
+
+func probeTProxy() Capability {
+	c := Capability{Name: "tproxy", Detail: "transparent sockets can be opened, not used by the sidebreaker"}
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, 0)
+	if err == nil {
+		err = unix.SetsockoptInt(fd, unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+		unix.Close(fd)
+	}
+	if err != nil {
+		c.Detail = "transparent sockets can't be opened: " + err.Error()
+		return c
+	}
+	c.Available = true
+	return c
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+
+package sidebreaker
+
+import "runtime"
+
+func probeSplice() Capability {
+	return Capability{Name: "splice", Detail: "tunnel data is copied through userspace buffers, splice is Linux only"}
+}
+
+func probeSetuid() Capability {
+	if runtime.GOOS == "windows" {
+		return Capability{Name: "setuid", Detail: "runAs.user is not supported on Windows"}
+	}
+	return Capability{Name: "setuid", Available: true, Detail: "runAs can switch user once the ports are bound"}
+}
+
+func probeSeccomp() Capability {
+	return Capability{Name: "seccomp", Detail: "runAs.seccomp is Linux only"}
+}
+
+func probeEBPF() Capability {
+	return Capability{Name: "ebpf", Detail: "eBPF is Linux only"}
+}
+
+func probeTProxy() Capability {
+	return Capability{Name: "tproxy", Detail: "TPROXY is Linux only"}
+}
@@ -0,0 +1,178 @@
+package sidebreaker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"expvar"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// How often the certificate files are checked for changes
+const certificateCheckInterval = 10 * time.Second
+
+// Certificates loaded again after their files changed by owner, as admin.reloaded, and the changes
+// that couldn't be loaded, as api.example.com.failed
+var certificateReloads = expvar.NewMap("certificateReloads")
+
+// certificateFile is a certificate and its key read from PEM files. It is read again once the files
+// change, so renewed certificates are used without a restart. Files that can't be loaded, such as a
+// certificate renewed before its key, leave the previous certificate in use until they can.
+type certificateFile struct {
+	owner    string
+	certPath string
+	keyPath  string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modified [2]time.Time
+	loaded   time.Time
+	err      error
+}
+
+// CertificateStatus struct, a certificate of the sidebreaker in the admin API. The owner is admin for
+// the certificate of the admin endpoints and the host for the client certificates of the hosts.
+type CertificateStatus struct {
+	Owner     string    `json:"owner"`
+	File      string    `json:"file"`
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	NotAfter  time.Time `json:"notAfter"`
+	ExpiresIn Duration  `json:"expiresIn"`
+	Loaded    time.Time `json:"loaded"`
+	Error     string    `json:"error,omitempty"`
+}
+
+func loadCertificateFile(owner string, certPath string, keyPath string) (*certificateFile, error) {
+	c := &certificateFile{owner: owner, certPath: certPath, keyPath: keyPath}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certificateFile) modTimes() ([2]time.Time, error) {
+	var modified [2]time.Time
+	for i, path := range []string{c.certPath, c.keyPath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return modified, err
+		}
+		modified[i] = info.ModTime()
+	}
+	return modified, nil
+}
+
+// Read the files, the certificate in use is only replaced by one that loads
+func (c *certificateFile) load() error {
+	modified, err := c.modTimes()
+	if err == nil {
+		var cert tls.Certificate
+		cert, err = tls.LoadX509KeyPair(c.certPath, c.keyPath)
+		if err == nil {
+			cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		}
+		if err == nil {
+			c.mu.Lock()
+			c.cert, c.modified, c.loaded, c.err = &cert, modified, time.Now(), nil
+			c.mu.Unlock()
+			return nil
+		}
+	}
+	c.mu.Lock()
+	c.err = err
+	c.mu.Unlock()
+	return fmt.Errorf("error loading the certificate of %s: %w", c.owner, err)
+}
+
+// Load the files again when they changed since the certificate in use was read
+func (c *certificateFile) refresh() {
+	modified, err := c.modTimes()
+	c.mu.Lock()
+	unchanged := err == nil && modified == c.modified
+	failing := c.err != nil
+	c.mu.Unlock()
+	if unchanged {
+		return
+	}
+	if err := c.load(); err != nil {
+		// Logged once, the files are tried again on every check until they load
+		if !failing {
+			certificateReloads.Add(c.owner+".failed", 1)
+			logger.Error("error reloading certificate, the previous one stays in use", "owner", c.owner, "file", c.certPath, "error", err)
+		}
+		return
+	}
+	certificateReloads.Add(c.owner+".reloaded", 1)
+	logger.Info("Reloaded certificate", "owner", c.owner, "file", c.certPath, "notAfter", c.certificate().Leaf.NotAfter)
+}
+
+// The certificate in use
+func (c *certificateFile) certificate() *tls.Certificate {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cert
+}
+
+func (c *certificateFile) status() CertificateStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := CertificateStatus{
+		Owner:     c.owner,
+		File:      c.certPath,
+		Subject:   c.cert.Leaf.Subject.String(),
+		Issuer:    c.cert.Leaf.Issuer.String(),
+		NotAfter:  c.cert.Leaf.NotAfter,
+		ExpiresIn: Duration(time.Until(c.cert.Leaf.NotAfter).Round(time.Second).Milliseconds()),
+		Loaded:    c.loaded,
+	}
+	if c.err != nil {
+		s.Error = c.err.Error()
+	}
+	return s
+}
+
+// The certificates of the admin endpoints and of the hosts, the hosts of the last reload
+func (s *Sidebreaker) certificateFiles() []*certificateFile {
+	var files []*certificateFile
+	if s.adminCertificate != nil {
+		files = append(files, s.adminCertificate)
+	}
+	for _, t := range s.upstreamTLS.all() {
+		if t.cert != nil {
+			files = append(files, t.cert)
+		}
+	}
+	return files
+}
+
+// Check the certificate files for changes and load the ones that changed, until done is closed
+func (s *Sidebreaker) watchCertificates(done <-chan struct{}) {
+	for wait(done, certificateCheckInterval) {
+		for _, c := range s.certificateFiles() {
+			c.refresh()
+		}
+	}
+}
+
+// Report the certificates in use with their expiry, the ones expiring first first
+func certificatesHandler(s *Sidebreaker) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		report := []CertificateStatus{}
+		for _, c := range s.certificateFiles() {
+			report = append(report, c.status())
+		}
+		sort.Slice(report, func(i, j int) bool { return report[i].NotAfter.Before(report[j].NotAfter) })
+		w.Header().Set("Content-Type", "application/json")
+		writeJSON(w, report)
+	}
+}
@@ -0,0 +1,100 @@
+package sidebreaker
+
+import (
+	"errors"
+	"expvar"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Calls that failed because the client went away rather than the host, they are left out of the
+// breaker of the host unless it sets strictClientErrors
+var clientFailures = expvar.NewMap("clientFailures")
+
+// Record a call that failed on the client side, strict hosts count it as a failure of the host.
+// It returns whether the breaker was updated.
+func (b Breakers) clientFailed(latency time.Duration) bool {
+	clientFailures.Add(b.Host.Host, 1)
+	if b.Host.StrictClientErrors {
+		b.Fail(latency)
+		return true
+	}
+	return false
+}
+
+// clientWriter is the client side of a tunnel, it keeps the first error reading from or writing to the
+// client so a client that went away isn't taken for a failing upstream
+type clientWriter struct {
+	net.Conn
+
+	mu  sync.Mutex
+	err error
+}
+
+// A write that reaches the deadline of the tunnel is its timeout, not the client going away
+func (c *clientWriter) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+		c.fail(err)
+	}
+	return n, err
+}
+
+// A read that fails other than at the end of the data, such as a reset, is the client aborting the
+// tunnel. Reads that reach the deadline or that we closed the connection under aren't.
+func (c *clientWriter) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if err != nil && err != io.EOF && !errors.Is(err, os.ErrDeadlineExceeded) && !errors.Is(err, net.ErrClosed) {
+		c.fail(err)
+	}
+	return n, err
+}
+
+// Keep the first error with the client
+func (c *clientWriter) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = err
+	}
+}
+
+// Tunnels half close the client connection once the upstream is done
+func (c *clientWriter) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// The error with the client, nil while the reads and writes succeed
+func (c *clientWriter) failed() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Tunnels that ran out of time because of the client rather than the host
+var (
+	errClientKeptOpen = errors.New("client kept the tunnel open after the upstream was done")
+	errClientClosed   = errors.New("client closed the tunnel before the upstream was done")
+)
+
+// Tell which side a tunnel that ran out of time waited on, from the errors of its directions: nil for
+// the upstream, the error of the client otherwise. When the upstream was done the client kept the
+// tunnel open, and when the client was done first it ended the tunnel, unless the upstream never
+// answered it.
+func tunnelTimedOutOnClient(upstreamErr, downstreamErr error, answered bool) error {
+	clientDone := !errors.Is(upstreamErr, os.ErrDeadlineExceeded)
+	upstreamDone := !errors.Is(downstreamErr, os.ErrDeadlineExceeded)
+	switch {
+	case upstreamDone:
+		return errClientKeptOpen
+	case clientDone && answered:
+		return errClientClosed
+	}
+	return nil
+}
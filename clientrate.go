@@ -0,0 +1,228 @@
+package sidebreaker
+
+import (
+	"expvar"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// ClientRateLimit struct for the configuration, a token bucket for each client of the sidebreaker so
+// one noisy process can't starve the others sharing it
+type ClientRateLimit struct {
+	Rate    float64      `json:"rate" doc:"Requests and tunnels a client may start per second, no limit when not set" example:"100"`
+	Burst   int          `json:"burst" doc:"Calls a client may start at once above its rate, the rate rounded up by default" example:"200"`
+	Key     string       `json:"key" doc:"How clients are told apart: ip for their address or header for the value of header along with their address, ip by default" example:"ip"`
+	Header  string       `json:"header" doc:"Header naming the client when key is header, the clients without it are told apart by address" example:"X-Client-Id"`
+	Clients []ClientRate `json:"clients" doc:"Rates of particular clients, instead of the rate of the others"`
+}
+
+// ClientRate struct for the configuration, the rate of a particular client
+type ClientRate struct {
+	Client string  `json:"client" doc:"Address or header value of the client" example:"10.0.0.5"`
+	Rate   float64 `json:"rate" doc:"Requests and tunnels the client may start per second" example:"500"`
+	Burst  int     `json:"burst" doc:"Calls the client may start at once above its rate, the rate rounded up by default" example:"1000"`
+}
+
+func (c ClientRateLimit) enabled() bool {
+	return c.Rate > 0 || len(c.Clients) > 0
+}
+
+// Check the settings of the client rate limit
+func (c ClientRateLimit) validate() error {
+	if c.Rate < 0 || c.Burst < 0 {
+		return fmt.Errorf("rate and burst must not be negative")
+	}
+	if c.Key != "" && c.Key != "ip" && c.Key != "header" {
+		return fmt.Errorf("key must be ip or header, got %q", c.Key)
+	}
+	if c.Key == "header" && c.Header == "" {
+		return fmt.Errorf("header is required when key is header")
+	}
+	for _, client := range c.Clients {
+		if client.Client == "" || client.Rate <= 0 || client.Burst < 0 {
+			return fmt.Errorf("clients need a client and a positive rate")
+		}
+	}
+	return nil
+}
+
+// Clients counted by name in clientRateLimited, the calls of the clients refused after them are
+// counted as other so a flood of addresses or header values can't grow the metrics without end
+const maxRateLimitedClients = 1000
+
+// Calls refused because their client went over its rate, by client, and the clients counted by name
+var (
+	clientRateLimited    = expvar.NewMap("clientRateLimited")
+	rateLimitedClients   int
+	rateLimitedClientsMu sync.Mutex
+)
+
+// Count a call refused for its client
+func countRateLimited(client string) {
+	rateLimitedClientsMu.Lock()
+	defer rateLimitedClientsMu.Unlock()
+	if clientRateLimited.Get(client) == nil {
+		if rateLimitedClients >= maxRateLimitedClients {
+			client = "other"
+		} else {
+			rateLimitedClients++
+		}
+	}
+	clientRateLimited.Add(client, 1)
+}
+
+// tokenBucket lets calls through at its rate, with a burst of calls at once after a quiet time
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	b := float64(burst)
+	if b == 0 {
+		b = math.Ceil(rate)
+	}
+	return &tokenBucket{rate: rate, burst: b, tokens: b, last: now}
+}
+
+// Take a token, or tell how long until the next one
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// Test wether a bucket is full again, it can be dropped as a new one would be the same
+func (b *tokenBucket) full(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+// clientRateLimiter has the buckets of the clients seen, the buckets of clients that went quiet are dropped
+type clientRateLimiter struct {
+	config ClientRateLimit
+	rates  map[string]ClientRate
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+// Create the client rate limit, nil when clients aren't limited
+func newClientRateLimiter(config ClientRateLimit) *clientRateLimiter {
+	if !config.enabled() {
+		return nil
+	}
+	l := &clientRateLimiter{config: config, rates: map[string]ClientRate{}, buckets: map[string]*tokenBucket{}, swept: time.Now()}
+	for _, c := range config.Clients {
+		l.rates[c.Client] = c
+	}
+	return l
+}
+
+// The client of a request, its address or the value of its header along with its address when
+// clients are told apart by header, and the name its rate is looked up by. The header is set by the
+// client, with the address a client can't spend the tokens of another one sending the same value.
+func (l *clientRateLimiter) clientOf(req *http.Request) (string, string) {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+	if l.config.Key == "header" {
+		if id := req.Header.Get(l.config.Header); id != "" {
+			return id + "@" + ip, id
+		}
+	}
+	return ip, ip
+}
+
+// Take a token of the client of a request, the wait until the next token when it has none left.
+// Clients without a rate of their own and without a default rate aren't limited.
+func (l *clientRateLimiter) allow(req *http.Request) (string, bool, time.Duration) {
+	client, name := l.clientOf(req)
+	rate, burst := l.config.Rate, l.config.Burst
+	if r, ok := l.rates[name]; ok {
+		rate, burst = r.Rate, r.Burst
+	}
+	if rate <= 0 {
+		return client, true, 0
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.swept) > time.Minute {
+		for id, b := range l.buckets {
+			if b.full(now) {
+				delete(l.buckets, id)
+			}
+		}
+		l.swept = now
+	}
+	b, ok := l.buckets[client]
+	if !ok {
+		b = newTokenBucket(rate, burst, now)
+		l.buckets[client] = b
+	}
+	ok, wait := b.take(now)
+	if !ok {
+		countRateLimited(client)
+	}
+	return client, ok, wait
+}
+
+// The answer to a call over the rate of its client, it tells when the client gets its next token
+func clientRateResponse(req *http.Request, wait time.Duration) *http.Response {
+	resp := goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusTooManyRequests, "Too many requests from this client")
+	resp.Header.Set("Retry-After", strconv.FormatInt(max(retryAfterSeconds(wait), 1), 10))
+	// The answer to a CONNECT is written as is
+	resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+	return resp
+}
+
+// Refuse the plain HTTP requests and CONNECT calls of the clients over their rate, before the breakers
+// so they never count for a host. The requests inside a MITM tunnel count through their CONNECT.
+func (l *clientRateLimiter) register(proxy *goproxy.ProxyHttpServer) {
+	limit := func(req *http.Request) *http.Response {
+		client, ok, wait := l.allow(req)
+		if ok {
+			return nil
+		}
+		logger.Debug("Client over its rate, refusing the call", "client", client, "host", req.URL.Host)
+		return clientRateResponse(req, wait)
+	}
+	proxy.OnRequest().DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		return req, limit(req)
+	})
+	proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		if resp := limit(ctx.Req); resp != nil {
+			ctx.Resp = resp
+			return goproxy.RejectConnect, host
+		}
+		return nil, host
+	})
+}
+
+// Refuse the requests of the reverse proxy of the clients over their rate
+func (l *clientRateLimiter) protect(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if client, ok, wait := l.allow(req); !ok {
+			logger.Debug("Client over its rate, refusing the call", "client", client, "host", req.Host)
+			w.Header().Set("Retry-After", strconv.FormatInt(max(retryAfterSeconds(wait), 1), 10))
+			http.Error(w, "Too many requests from this client", http.StatusTooManyRequests)
+			return
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
@@ -0,0 +1,94 @@
+package sidebreaker
+
+import (
+	"expvar"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+)
+
+// Test wether clients over their rate are refused, and counted by name up to maxRateLimitedClients
+func TestClientRateLimited(t *testing.T) {
+	l := &clientRateLimiter{config: ClientRateLimit{Rate: 0.001, Burst: 1}, rates: map[string]ClientRate{}, buckets: map[string]*tokenBucket{}}
+	keys := func() int {
+		n := 0
+		clientRateLimited.Do(func(expvar.KeyValue) { n++ })
+		return n
+	}
+	count := func(client string) int64 {
+		if v, ok := clientRateLimited.Get(client).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	before, first, others := keys(), count("10.0.0.1"), count("other")
+	for i := 0; i < maxRateLimitedClients+10; i++ {
+		req := httptest.NewRequest("GET", "http://api.example.com/", nil)
+		req.RemoteAddr = fmt.Sprintf("10.%d.%d.1:1234", i/256, i%256)
+		if _, ok, _ := l.allow(req); !ok {
+			t.Fatalf("expected the first call of %s through", req.RemoteAddr)
+		}
+		if _, ok, wait := l.allow(req); ok || wait <= 0 {
+			t.Fatalf("expected the second call of %s refused with a wait, got %v %v", req.RemoteAddr, ok, wait)
+		}
+	}
+	if got := keys() - before; got > maxRateLimitedClients+1 {
+		t.Errorf("expected at most %d clients counted, got %d", maxRateLimitedClients+1, got)
+	}
+	if got := count("other") - others; got < 10 {
+		t.Errorf("expected the clients after the first %d counted as other, got %d", maxRateLimitedClients, got)
+	}
+	if got := count("10.0.0.1") - first; got != 1 {
+		t.Errorf("expected 1 call of 10.0.0.1 refused, got %d", got)
+	}
+}
+
+// Test wether clients told apart by header are told apart by their address too, and take the rate
+// of their header value
+func TestClientOf(t *testing.T) {
+	l := &clientRateLimiter{config: ClientRateLimit{Key: "header", Header: "X-Client-Id"}}
+	tests := []struct {
+		remote   string
+		header   string
+		client   string
+		name     string
+		ipClient string
+	}{
+		{"10.0.0.5:1234", "billing", "billing@10.0.0.5", "billing", "10.0.0.5"},
+		{"10.0.0.6:1234", "billing", "billing@10.0.0.6", "billing", "10.0.0.6"},
+		{"10.0.0.5:1234", "", "10.0.0.5", "10.0.0.5", "10.0.0.5"},
+		{"[2001:db8::1]:1234", "billing", "billing@2001:db8::1", "billing", "2001:db8::1"},
+		{"pipe", "billing", "billing@pipe", "billing", "pipe"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "http://api.example.com/", nil)
+		req.RemoteAddr = test.remote
+		if test.header != "" {
+			req.Header.Set("X-Client-Id", test.header)
+		}
+		if client, name := l.clientOf(req); client != test.client || name != test.name {
+			t.Errorf("expected %s named %s for %s %q, got %s named %s", test.client, test.name, test.remote, test.header, client, name)
+		}
+		ip := &clientRateLimiter{config: ClientRateLimit{}}
+		if client, name := ip.clientOf(req); client != test.ipClient || name != test.ipClient {
+			t.Errorf("expected %s by address for %s, got %s named %s", test.ipClient, test.remote, client, name)
+		}
+	}
+
+	// A client can't spend the tokens of another sending the same value, and both get its rate
+	l = &clientRateLimiter{config: ClientRateLimit{Rate: 0.001, Burst: 1, Key: "header", Header: "X-Client-Id"},
+		rates: map[string]ClientRate{"billing": {Client: "billing", Rate: 0.001, Burst: 2}}, buckets: map[string]*tokenBucket{}}
+	for _, remote := range []string{"10.0.0.5:1234", "10.0.0.6:1234"} {
+		req := httptest.NewRequest("GET", "http://api.example.com/", nil)
+		req.RemoteAddr = remote
+		req.Header.Set("X-Client-Id", "billing")
+		for i := 0; i < 2; i++ {
+			if _, ok, _ := l.allow(req); !ok {
+				t.Errorf("expected call %d of billing from %s through", i+1, remote)
+			}
+		}
+		if _, ok, _ := l.allow(req); ok {
+			t.Errorf("expected the third call of billing from %s refused", remote)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package sidebreaker
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clients of a host with their own breaker when the host doesn't set maxClients, and how long a
+// client goes without calls before its breaker can be dropped for a new client
+const (
+	defaultMaxClients = 1000
+	clientBreakerIdle = 10 * time.Minute
+)
+
+// Calls by host of the clients that didn't get their own breaker as the host had its maxClients
+var clientBreakersFull = expvar.NewMap("clientBreakersFull")
+
+// clientBreakers holds a breaker per client of a host, so one misbehaving caller
+// doesn't open the breaker for everyone else. Breakers are created on the first call of a client,
+// up to max clients. Once there are max, the breakers of idle clients make room for new ones and
+// the other new clients share the breaker of the host.
+type clientBreakers struct {
+	damping  FlapDamping
+	notifier *policyNotifier
+	max      int
+
+	mu        sync.Mutex
+	breakers  map[string]*clientBreaker
+	lastSweep time.Time
+	closed    bool
+}
+
+// clientBreaker is the breaker of a client with the time of its last call, the watcher of the
+// breaker stops when it is dropped
+type clientBreaker struct {
+	Breakers
+	lastCall time.Time
+}
+
+func newClientBreakers(damping FlapDamping, notifier *policyNotifier, max int) *clientBreakers {
+	if max <= 0 {
+		max = defaultMaxClients
+	}
+	return &clientBreakers{
+		damping:  damping,
+		notifier: notifier,
+		max:      max,
+		breakers: map[string]*clientBreaker{},
+	}
+}
+
+// Drop the breakers of the clients idle for clientBreakerIdle, at most once a minute as it goes
+// through every client. Called with the lock held.
+func (c *clientBreakers) dropIdle(now time.Time) {
+	if now.Sub(c.lastSweep) < time.Minute {
+		return
+	}
+	c.lastSweep = now
+	for id, client := range c.breakers {
+		if now.Sub(client.lastCall) >= clientBreakerIdle {
+			close(client.done)
+			delete(c.breakers, id)
+		}
+	}
+}
+
+// Stop the watchers of every client, the breakers of a host replaced by a reload get no more calls
+func (c *clientBreakers) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, client := range c.breakers {
+		close(client.done)
+		delete(c.breakers, id)
+	}
+	c.closed = true
+}
+
+// Identify the client making the request, either by source IP or by the configured header
+func clientIdentity(host Host, req *http.Request) string {
+	if host.ClientKey == "header" {
+		if id := req.Header.Get(host.ClientHeader); id != "" {
+			return id
+		}
+		return "unknown"
+	}
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return ip
+}
+
+// Find the breaker for the client of a request, hosts that are not configured with
+// a client key share a single breaker for all clients, as do the clients over maxClients
+func (b Breakers) forClient(req *http.Request) Breakers {
+	if b.Clients == nil {
+		return b
+	}
+	id := clientIdentity(b.Host, req)
+
+	b.Clients.mu.Lock()
+	defer b.Clients.mu.Unlock()
+	now := time.Now()
+	if client, ok := b.Clients.breakers[id]; ok {
+		client.lastCall = now
+		return client.Breakers
+	}
+	if b.Clients.closed {
+		return b
+	}
+	if len(b.Clients.breakers) >= b.Clients.max {
+		b.Clients.dropIdle(now)
+		if len(b.Clients.breakers) >= b.Clients.max {
+			clientBreakersFull.Add(b.Host.Host, 1)
+			return b
+		}
+	}
+	h := b.Host
+	h.Host = fmt.Sprintf("%s (%s)", b.Host.Host, id)
+	client := Breakers{Host: h, Breaker: newBreaker(h), Damper: newFlapDamper(b.Clients.damping), Prefix: b.Prefix, Vendor: b.Vendor, Maintenance: b.Maintenance, Injection: b.Injection, done: make(chan struct{})}
+	if b.Policy != nil {
+		// The expression was already validated, each client needs its own latency history
+		client.Policy, _ = parsePolicy(h.Policy)
+	}
+	b.Clients.breakers[id] = &clientBreaker{Breakers: client, lastCall: now}
+	go watchBreaker(h.Host, client, b.Clients.notifier)
+	return client
+}
+
+// List the breakers of every client seen so far, sorted by name
+func (c *clientBreakers) list() []Breakers {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	list := make([]Breakers, 0, len(c.breakers))
+	for _, b := range c.breakers {
+		list = append(list, b.Breakers)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Host.Host < list[j].Host.Host })
+	return list
+}
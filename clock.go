@@ -0,0 +1,64 @@
+package sidebreaker
+
+import (
+	"expvar"
+	"fmt"
+	"time"
+
+	"github.com/facebookgo/clock"
+)
+
+// monotonicClock is the clock of the breakers. The breakers keep the time of the last failure as
+// nanoseconds since the epoch, which drops the monotonic reading of time.Now, so a step of the system
+// clock (NTP correction, VM resume) would hold an open breaker for the size of the step or end its
+// backoff early. Now is the start time plus the monotonic time elapsed since, which never jumps.
+type monotonicClock struct {
+	clock.Clock
+	start time.Time
+}
+
+func (c monotonicClock) Now() time.Time {
+	return c.start.Add(time.Since(c.start))
+}
+
+// MonotonicClock is the clock of the breakers, custom break types should pass it in their circuit.Options
+var MonotonicClock clock.Clock = monotonicClock{clock.New(), time.Now()}
+
+// Clock jumps and pauses larger than this are reported
+const clockSkewThreshold = 2 * time.Second
+
+// Clock jumps and pauses detected, by kind
+var clockEvents = expvar.NewMap("clockEvents")
+
+// Compare the wall clock with the monotonic clock every second and warn when they disagree, or when
+// the process didn't run for a while. Timeouts of calls in flight during a pause or a backwards jump
+// may be failures that never happened upstream.
+func watchClock(notifier *policyNotifier, done <-chan struct{}) {
+	const interval = time.Second
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		var now time.Time
+		select {
+		case now = <-ticker.C:
+		case <-done:
+			return
+		}
+		elapsed := now.Sub(last)
+		skew := now.Round(0).Sub(last.Round(0)) - elapsed
+		last = now
+		switch {
+		case skew > clockSkewThreshold || skew < -clockSkewThreshold:
+			clockEvent(notifier, "jump", fmt.Sprintf("the system clock jumped by %s", skew.Round(time.Millisecond)))
+		case elapsed-interval > clockSkewThreshold:
+			clockEvent(notifier, "pause", fmt.Sprintf("the sidebreaker did not run for %s", (elapsed-interval).Round(time.Millisecond)))
+		}
+	}
+}
+
+func clockEvent(notifier *policyNotifier, kind string, message string) {
+	clockEvents.Add(kind, 1)
+	logger.Warn("Clock skew detected, breaker windows are kept on the monotonic clock", "kind", kind, "detail", message)
+	notifier.Notify(Notification{Event: "clock " + kind, Time: time.Now(), Message: message})
+}
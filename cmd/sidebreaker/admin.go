@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ifuyivara/sidebreaker"
+)
+
+// Environment variable with the token the commands calling the admin API send, instead of -token
+const adminTokenEnv = "SIDEBREAKER_ADMIN_TOKEN"
+
+// adminClient calls the admin API of a running sidebreaker, for the commands run in its SSH sessions
+type adminClient struct {
+	base   string
+	token  string
+	client *http.Client
+}
+
+// adminFlags are the flags of the commands calling the admin API
+type adminFlags struct {
+	config *string
+	admin  *string
+	token  *string
+	caCert *string
+}
+
+func registerAdminFlags(flags *flag.FlagSet) *adminFlags {
+	return &adminFlags{
+		config: flags.String("config", "config.json", "Configuration of the sidebreaker, its admin address is called when -admin isn't set"),
+		admin:  flags.String("admin", "", "URL of the admin endpoints, such as https://127.0.0.1:3131"),
+		token:  flags.String("token", "", "Bearer token or user:password of admin.auth, "+adminTokenEnv+" when not set"),
+		caCert: flags.String("cacert", "", "PEM bundle the certificate of the admin endpoints is verified with"),
+	}
+}
+
+func (f *adminFlags) client() (*adminClient, error) {
+	base := *f.admin
+	if base == "" {
+		configuration, err := sidebreaker.LoadConfig(*f.config)
+		if err != nil {
+			return nil, fmt.Errorf("set -admin or run in the folder of the configuration: %w", err)
+		}
+		base = adminURL(configuration)
+	}
+	token := *f.token
+	if token == "" {
+		token = os.Getenv(adminTokenEnv)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	if *f.caCert != "" {
+		pem, err := os.ReadFile(*f.caCert)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in %s", *f.caCert)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &adminClient{base: strings.TrimSuffix(base, "/"), token: token, client: &http.Client{Timeout: 10 * time.Second, Transport: transport}}, nil
+}
+
+// The admin endpoints of a configuration as seen from the same machine: their own address or port,
+// or the proxy port
+func adminURL(c sidebreaker.Configuration) string {
+	scheme := "http"
+	if c.Admin.Cert != "" {
+		scheme = "https"
+	}
+	address := net.JoinHostPort("127.0.0.1", "3131")
+	switch {
+	case c.Admin.Listen != "":
+		host, port, _ := net.SplitHostPort(c.Admin.Listen)
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			host = "127.0.0.1"
+		}
+		address = net.JoinHostPort(host, port)
+	case c.AdminPort != 0:
+		address = net.JoinHostPort("127.0.0.1", strconv.Itoa(c.AdminPort))
+	}
+	return scheme + "://" + address
+}
+
+// Call an endpoint, the JSON of the answer is decoded into out. Answers other than 2xx are errors
+// with the text of the answer.
+func (a *adminClient) call(method string, path string, body io.Reader, out any) error {
+	req, err := http.NewRequest(method, a.base+path, body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if user, password, ok := strings.Cut(a.token, ":"); ok {
+		req.SetBasicAuth(user, password)
+	} else if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("the admin endpoints need credentials, set -token or %s", adminTokenEnv)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		text, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(text)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
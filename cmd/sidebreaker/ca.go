@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ifuyivara/sidebreaker"
+)
+
+// Manage the certificate authority of the MITM hosts: `sidebreaker ca generate` and `sidebreaker ca export`.
+// The passphrase of its key is read from SIDEBREAKER_CA_PASSPHRASE.
+func caCommand(args []string) int {
+	if len(args) > 0 {
+		switch args[0] {
+		case "generate":
+			return generateCA(args[1:])
+		case "export":
+			return exportCA(args[1:])
+		}
+	}
+	fmt.Fprintln(os.Stderr, "usage: sidebreaker ca generate|export [flags]")
+	return exitError
+}
+
+// Create a CA with its key encrypted with the passphrase, existing files are never overwritten
+func generateCA(args []string) int {
+	flags := flag.NewFlagSet("ca generate", flag.ContinueOnError)
+	certPath := flags.String("cert", "ca.crt", "PEM file the CA certificate is written to")
+	keyPath := flags.String("key", "ca.key", "PEM file the encrypted key of the CA is written to")
+	name := flags.String("name", "Sidebreaker MITM CA", "Common name of the CA")
+	days := flags.Int("days", 3650, "Days the CA is valid")
+	if err := flags.Parse(args); err != nil {
+		return exitError
+	}
+	passphrase := os.Getenv(sidebreaker.CAPassphraseEnv)
+	if passphrase == "" {
+		fmt.Fprintf(os.Stderr, "set the passphrase of the CA key in %s\n", sidebreaker.CAPassphraseEnv)
+		return exitError
+	}
+	certPEM, keyPEM, err := sidebreaker.GenerateCA(*name, time.Duration(*days)*24*time.Hour, []byte(passphrase))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error generating the CA: %s\n", err)
+		return exitError
+	}
+	if err := writeNew(*keyPath, keyPEM, 0600); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", *keyPath, err)
+		return exitError
+	}
+	if err := writeNew(*certPath, certPEM, 0644); err != nil {
+		os.Remove(*keyPath)
+		fmt.Fprintf(os.Stderr, "%s: %s\n", *certPath, err)
+		return exitError
+	}
+	fmt.Printf("Wrote %s and %s, set them as mitmCa and have the clients trust %s\n", *certPath, *keyPath, *certPath)
+	return 0
+}
+
+// Write the CA certificate for the trust stores of the clients, once its key was checked with the passphrase
+func exportCA(args []string) int {
+	flags := flag.NewFlagSet("ca export", flag.ContinueOnError)
+	certPath := flags.String("cert", "ca.crt", "PEM file of the CA certificate")
+	keyPath := flags.String("key", "ca.key", "PEM file of the key of the CA")
+	format := flags.String("format", "pem", "Format of the certificate: pem, or der for the trust stores that want it")
+	out := flags.String("out", "", "File the certificate is written to, the standard output when not set")
+	if err := flags.Parse(args); err != nil {
+		return exitError
+	}
+	ca, err := sidebreaker.LoadCA(*certPath, *keyPath, []byte(os.Getenv(sidebreaker.CAPassphraseEnv)))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	var data []byte
+	switch *format {
+	case "pem":
+		data = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Leaf.Raw})
+	case "der":
+		data = ca.Leaf.Raw
+	default:
+		fmt.Fprintf(os.Stderr, "unknown format %q, pem or der\n", *format)
+		return exitError
+	}
+	if *out == "" {
+		os.Stdout.Write(data)
+	} else if err := writeNew(*out, data, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", *out, err)
+		return exitError
+	}
+	sum := sha256.Sum256(ca.Leaf.Raw)
+	fmt.Fprintf(os.Stderr, "%s, valid until %s, SHA-256 fingerprint %s\n", ca.Leaf.Subject, ca.Leaf.NotAfter.Format(time.RFC3339), fingerprint(sum[:]))
+	return 0
+}
+
+// Write a file that doesn't exist yet
+func writeNew(path string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Fingerprint as trust stores show it, AB:CD:...
+func fingerprint(sum []byte) string {
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
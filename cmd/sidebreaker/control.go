@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/ifuyivara/sidebreaker"
+)
+
+// Trip or reset the breakers of a host of a running sidebreaker: `sidebreaker breaker trip|reset [flags] <host>`
+func breakerCommand(args []string) int {
+	if len(args) > 0 && (args[0] == "trip" || args[0] == "reset") {
+		return controlBreaker(args[0], args[1:])
+	}
+	fmt.Fprintln(os.Stderr, "usage: sidebreaker breaker trip|reset [flags] <host>")
+	return exitError
+}
+
+// Trip or reset the breakers of a host and print their state
+func controlBreaker(action string, args []string) int {
+	flags := flag.NewFlagSet("breaker "+action, flag.ContinueOnError)
+	admin := registerAdminFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return exitError
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "usage: sidebreaker breaker %s [flags] <host>\n", action)
+		return exitError
+	}
+	client, err := admin.client()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	var breakers []sidebreaker.BreakerStatus
+	if err := client.call(http.MethodPost, "/hosts/"+url.PathEscape(flags.Arg(0))+"/"+action, nil, &breakers); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	printBreakers(breakers)
+	return 0
+}
+
+// Drain a running sidebreaker, it stops once the connections in flight are done: `sidebreaker drain [flags]`
+func drain(args []string) int {
+	flags := flag.NewFlagSet("drain", flag.ContinueOnError)
+	admin := registerAdminFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return exitError
+	}
+	client, err := admin.client()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	if err := client.call(http.MethodPost, "/admin/drain", nil, nil); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	fmt.Println("Draining, the sidebreaker stops once the connections in flight are done")
+	return 0
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"syscall"
+
+	"github.com/ifuyivara/sidebreaker"
+)
+
+// Exit codes, so supervisors and scripts can tell why the sidebreaker stopped
+const (
+	exitError          = 1 // error while serving, or stopped without draining
+	exitConfigNotFound = 2 // the configuration file doesn't exist
+	exitConfigInvalid  = 3 // the configuration can't be parsed or has invalid settings
+	exitListenFailed   = 4 // a port can't be listened on, i.e. already in use
+	exitSetupFailed    = 5 // something the configuration names can't be set up, i.e. the storage is unreachable
+)
+
+// Subcommands of the binary, run when none is given
+var commands = map[string]func(args []string) int{
+	"run":      run,
+	"validate": validate,
+	"init":     initConfig,
+	"schema":   schema,
+	"status":   status,
+	"breaker":  breakerCommand,
+	"drain":    drain,
+	"version":  version,
+	"ca":       caCommand,
+}
+
+func main() {
+	name, args := "run", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	command, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q, usage: sidebreaker run|validate|init|schema|status|breaker|drain|version|ca [flags]\n", name)
+		os.Exit(exitError)
+	}
+	os.Exit(command(args))
+}
+
+// Start the sidebreaker and serve until it is stopped: `sidebreaker run [-config path] [flags]`. Every
+// setting of the configuration can be given as a flag, over the one of the file.
+func run(args []string) int {
+	flags := flag.NewFlagSet("run", flag.ContinueOnError)
+	configPath := flags.String("config", "config.json", "Configuration file, conf.d next to it is read too")
+	overrides := sidebreaker.RegisterConfigFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return exitConfigInvalid
+	}
+
+	// Load sidebreaker configuration file, from the working directory by default
+	path, err := filepath.Abs(*configPath)
+	if err != nil {
+		path = *configPath
+	}
+	sidebreaker.Logger().Info("Loading configuration", "path", path)
+	configuration, err := overrides.Load(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		sidebreaker.Logger().Error("configuration file not found", "path", path)
+		return exitConfigNotFound
+	}
+	if err != nil {
+		sidebreaker.Logger().Error("error loading sidebreaker configuration", "path", path, "error", err)
+		return exitConfigInvalid
+	}
+
+	sb, err := sidebreaker.New(configuration)
+	if err != nil {
+		sidebreaker.Logger().Error("error starting sidebreaker", "path", path, "error", err)
+		var setupErr *sidebreaker.SetupError
+		if errors.As(err, &setupErr) {
+			return exitSetupFailed
+		}
+		return exitConfigInvalid
+	}
+
+	// Deploys stop the sidebreaker with SIGTERM or SIGINT, it drains the connections in flight before
+	// exiting and a second signal stops right away. The restart signal starts a new sidebreaker with
+	// our listeners first, and we keep serving when it fails to start. The reload signal loads the
+	// configuration file again, an invalid one leaves the current configuration in use.
+	ctx, stop := context.WithCancel(context.Background())
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+		if sidebreaker.RestartSignal != nil {
+			signal.Notify(signals, sidebreaker.RestartSignal, sidebreaker.ReloadSignal)
+		}
+		for sig := range signals {
+			if sig == sidebreaker.ReloadSignal {
+				if err := sb.ReloadFile(path, overrides); err == nil {
+					sidebreaker.Logger().Info("Reloaded configuration", "path", path)
+				}
+				continue
+			}
+			if sig == sidebreaker.RestartSignal {
+				if err := sb.Restart(); err != nil {
+					sidebreaker.Logger().Error("Restart failed, still serving", "error", err)
+					continue
+				}
+			}
+			sidebreaker.Logger().Info("Stopping", "signal", sig.String())
+			stop()
+			break
+		}
+		<-signals
+		sidebreaker.Logger().Warn("Second signal, stopping without draining")
+		os.Exit(exitError)
+	}()
+
+	if err := sb.ListenAndServe(ctx); err != nil {
+		sidebreaker.Logger().Error("error serving", "error", err)
+		var listenErr *sidebreaker.ListenError
+		var setupErr *sidebreaker.SetupError
+		switch {
+		case errors.As(err, &listenErr):
+			return exitListenFailed
+		case errors.As(err, &setupErr):
+			return exitSetupFailed
+		}
+		return exitError
+	}
+	return 0
+}
+
+// Print the JSON Schema of the configuration files, for editors and CI: `sidebreaker schema > config.schema.json`
+func schema(args []string) int {
+	if err := sidebreaker.WriteConfigSchema(os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	return 0
+}
+
+// Print the version of the binary and how it was built, from the module metadata: `sidebreaker version`
+func version(args []string) int {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		fmt.Fprintln(os.Stderr, "no build information in this binary")
+		return exitError
+	}
+	fmt.Printf("sidebreaker %s\n", info.Main.Version)
+	fmt.Printf("go          %s\n", info.GoVersion)
+	settings := map[string]string{}
+	for _, s := range info.Settings {
+		settings[s.Key] = s.Value
+	}
+	for _, s := range []struct{ key, label string }{{"vcs.revision", "revision"}, {"vcs.time", "built"}, {"vcs.modified", "modified"}, {"GOOS", "os"}, {"GOARCH", "arch"}} {
+		if v := settings[s.key]; v != "" {
+			fmt.Printf("%-11s %s\n", s.label, v)
+		}
+	}
+	return 0
+}
+
+// Check a configuration file without starting, for CI before deploys: `sidebreaker validate [flags] [path]`,
+// with the same flags as run. Every problem is printed on its own line with its position, the exit
+// code is the one starting would have.
+func validate(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	overrides := sidebreaker.RegisterConfigFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return exitConfigInvalid
+	}
+	path := "config.json"
+	if flags.NArg() > 0 {
+		path = flags.Arg(0)
+	}
+	_, err := overrides.Load(path)
+	var configErrs sidebreaker.ConfigErrors
+	switch {
+	case err == nil:
+		fmt.Printf("%s is valid\n", path)
+		return 0
+	case errors.Is(err, fs.ErrNotExist):
+		fmt.Fprintf(os.Stderr, "%s: configuration file not found\n", path)
+		return exitConfigNotFound
+	case errors.As(err, &configErrs):
+		for _, e := range configErrs {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", where(path, e), fieldMessage(e))
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+	}
+	return exitConfigInvalid
+}
+
+// File and position of a configuration error, errors of the host files of conf.d name their file
+func where(path string, e sidebreaker.ConfigError) string {
+	if e.File != "" {
+		path = e.File
+	}
+	switch {
+	case e.Line > 0 && e.Column > 0:
+		return fmt.Sprintf("%s:%d:%d", path, e.Line, e.Column)
+	case e.Line > 0:
+		return fmt.Sprintf("%s:%d", path, e.Line)
+	}
+	return path
+}
+
+// Message of a configuration error without its position, printed in front instead
+func fieldMessage(e sidebreaker.ConfigError) string {
+	if e.Field == "" {
+		return e.Msg
+	}
+	return e.Field + ": " + e.Msg
+}
+
+// Write a sample configuration with every field documented: `sidebreaker init [path]`.
+// An existing file is never overwritten.
+func initConfig(args []string) int {
+	path := "config.json"
+	if len(args) > 0 {
+		path = args[0]
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+		return exitError
+	}
+	if err := sidebreaker.WriteSampleConfig(f); err != nil {
+		f.Close()
+		fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+		return exitError
+	}
+	if err := f.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+		return exitError
+	}
+	fmt.Printf("Wrote %s, edit its hosts and start the sidebreaker in the same folder\n", path)
+	return 0
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"text/tabwriter"
+
+	"github.com/ifuyivara/sidebreaker"
+)
+
+// Print the breakers of a running sidebreaker as a table: `sidebreaker status [flags] [host]`
+func status(args []string) int {
+	flags := flag.NewFlagSet("status", flag.ContinueOnError)
+	admin := registerAdminFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return exitError
+	}
+	client, err := admin.client()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	path := "/admin/breakers"
+	if flags.NArg() > 0 {
+		path += "?host=" + url.QueryEscape(flags.Arg(0))
+	}
+	var breakers []sidebreaker.BreakerStatus
+	if err := client.call(http.MethodGet, path, nil, &breakers); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	printBreakers(breakers)
+	return 0
+}
+
+// Print breakers as a table with the count of the open ones
+func printBreakers(breakers []sidebreaker.BreakerStatus) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tBREAKER\tSTATE\tSTATUS\tERROR RATE\tFAILURES\tSUCCESSES\tCONNECTIONS\tRETRY IN")
+	open := 0
+	for i, b := range breakers {
+		// The connections are those of the host, on its first line
+		connections := "-"
+		if i == 0 || breakers[i-1].Host != b.Host {
+			connections = fmt.Sprint(b.Connections)
+		}
+		// Paths and clients have breakers of their own, named after them
+		breaker := "-"
+		if b.Breaker != b.Host {
+			breaker = b.Breaker
+		}
+		retry := "-"
+		if b.RetryAfter > 0 {
+			retry = b.RetryAfter.String()
+		}
+		status := b.Status
+		if b.Message != "" {
+			status += ": " + b.Message
+		}
+		if b.State == "open" {
+			open++
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%.1f%%\t%d\t%d\t%s\t%s\n", b.Host, breaker, b.State, status, b.ErrorRate, b.Failures, b.Successes, connections, retry)
+	}
+	w.Flush()
+	fmt.Printf("\n%d breakers, %d open\n", len(breakers), open)
+}
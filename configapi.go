@@ -0,0 +1,359 @@
+package sidebreaker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Largest configuration document accepted by POST /admin/config
+const maxConfigBody = 10 << 20
+
+// ConfigChange struct, a setting changed by a configuration pushed to the admin API, by its path such
+// as hosts[api.example.com].threshold. Old is null for added settings and hosts, New for removed ones.
+// Restart is set for the settings that are only applied on the next start.
+type ConfigChange struct {
+	Field   string      `json:"field"`
+	Old     interface{} `json:"old"`
+	New     interface{} `json:"new"`
+	Restart bool        `json:"restart,omitempty"`
+}
+
+// ConfigDiff struct, the answer to a configuration pushed to the admin API. Error tells why a
+// configuration that changes settings other than the hosts isn't applied.
+type ConfigDiff struct {
+	DryRun  bool           `json:"dryRun"`
+	Applied bool           `json:"applied"`
+	Error   string         `json:"error,omitempty"`
+	Changes []ConfigChange `json:"changes"`
+}
+
+// restartError refuses a configuration that changes settings only applied on the next start, so
+// the configuration in use is always the one reported
+type restartError struct {
+	fields []string
+}
+
+func (e *restartError) Error() string {
+	return "only the hosts can change while running, change the other settings in the files and restart: " + strings.Join(e.fields, ", ")
+}
+
+// The settings of changes only applied on the next start
+func restartFields(changes []ConfigChange) []string {
+	var fields []string
+	for _, c := range changes {
+		if c.Restart {
+			fields = append(fields, c.Field)
+		}
+	}
+	return fields
+}
+
+// The changes between two configurations, as they were given without their defaults. Hosts are
+// compared by name and other lists as a whole. Secrets are compared but shown redacted.
+func diffConfig(old Configuration, new Configuration) []ConfigChange {
+	changes := []ConfigChange{}
+	diffValues("", jsonPair{toJSONValue(old), toJSONValue(redactConfig(old))}, jsonPair{toJSONValue(new), toJSONValue(redactConfig(new))}, &changes)
+	for i := range changes {
+		changes[i].Restart = !strings.HasPrefix(changes[i].Field, "hosts")
+	}
+	return changes
+}
+
+// A value as encoding/json decodes it, so values are compared as they are written in the files
+func toJSONValue(v interface{}) interface{} {
+	data, _ := json.Marshal(v)
+	var value interface{}
+	json.Unmarshal(data, &value)
+	return value
+}
+
+// jsonPair is a value of a configuration and the same value with its secrets redacted, the
+// first is compared and the second shown
+type jsonPair struct {
+	value, shown interface{}
+}
+
+func (p jsonPair) field(name string) jsonPair {
+	value, _ := p.value.(map[string]interface{})
+	shown, _ := p.shown.(map[string]interface{})
+	return jsonPair{value[name], shown[name]}
+}
+
+func diffValues(field string, old jsonPair, new jsonPair, changes *[]ConfigChange) {
+	oldObject, oldOk := old.value.(map[string]interface{})
+	newObject, newOk := new.value.(map[string]interface{})
+	if oldOk && newOk {
+		names := map[string]bool{}
+		for name := range oldObject {
+			names[name] = true
+		}
+		for name := range newObject {
+			names[name] = true
+		}
+		sorted := make([]string, 0, len(names))
+		for name := range names {
+			sorted = append(sorted, name)
+		}
+		sort.Strings(sorted)
+		for _, name := range sorted {
+			path := name
+			if field != "" {
+				path = field + "." + name
+			}
+			if field == "" && name == "hosts" {
+				diffHosts(old.field(name), new.field(name), changes)
+				continue
+			}
+			diffValues(path, old.field(name), new.field(name), changes)
+		}
+		return
+	}
+	if !reflect.DeepEqual(old.value, new.value) {
+		*changes = append(*changes, ConfigChange{Field: field, Old: old.shown, New: new.shown})
+	}
+}
+
+// Hosts are matched by name, so a host moved in the list is unchanged
+func diffHosts(old jsonPair, new jsonPair, changes *[]ConfigChange) {
+	byName := func(list jsonPair) map[string]jsonPair {
+		hosts := map[string]jsonPair{}
+		values, _ := list.value.([]interface{})
+		shown, _ := list.shown.([]interface{})
+		for i, h := range values {
+			if object, ok := h.(map[string]interface{}); ok && i < len(shown) {
+				name, _ := object["host"].(string)
+				hosts[name] = jsonPair{h, shown[i]}
+			}
+		}
+		return hosts
+	}
+	oldHosts, newHosts := byName(old), byName(new)
+	names := []string{}
+	for name := range oldHosts {
+		names = append(names, name)
+	}
+	for name := range newHosts {
+		if _, ok := oldHosts[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		o, inOld := oldHosts[name]
+		n, inNew := newHosts[name]
+		field := "hosts[" + name + "]"
+		if inOld && inNew {
+			diffValues(field, o, n, changes)
+		} else {
+			*changes = append(*changes, ConfigChange{Field: field, Old: withoutZero(o.shown), New: withoutZero(n.shown)})
+		}
+	}
+}
+
+// An added or removed host with the settings it leaves unset left out
+func withoutZero(value interface{}) interface{} {
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return value
+	}
+	set := map[string]interface{}{}
+	for name, v := range object {
+		v = withoutZero(v)
+		switch v := v.(type) {
+		case nil:
+			continue
+		case string:
+			if v == "" || v == "0s" {
+				continue
+			}
+		case float64:
+			if v == 0 {
+				continue
+			}
+		case bool:
+			if !v {
+				continue
+			}
+		case map[string]interface{}:
+			if len(v) == 0 {
+				continue
+			}
+		}
+		set[name] = v
+	}
+	return set
+}
+
+// Replace the configuration given to New by a pushed one, the hosts of the remote sources are merged
+// in as on their changes. Only the hosts can change, a configuration changing other settings is
+// refused with a restartError. Nothing changes unless the hosts reload, the failures are recorded by
+// the callers.
+func (s *Sidebreaker) applyConfig(source string, configuration Configuration, dryRun bool) ([]ConfigChange, error) {
+	r := s.remote
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	previous := r.local
+	changes := diffConfig(previous, configuration)
+	if fields := restartFields(changes); len(fields) > 0 {
+		return changes, &restartError{fields: fields}
+	}
+	r.local = configuration
+	merged, err := r.merge("", nil)
+	switch {
+	case err != nil:
+	case dryRun:
+		_, err = loadUpstreamTLS(merged.withDefaults().Hosts)
+	default:
+		err = s.Reload(merged)
+	}
+	if err != nil || dryRun {
+		r.local = previous
+	} else {
+		s.configState.applied(source, merged.withDefaults())
+	}
+	return changes, err
+}
+
+// The configuration in use with GET /admin/config: the files, flags and pushed configuration merged
+// with the hosts of the remote sources and the defaults applied, with the secrets redacted. Push a
+// whole configuration with POST /admin/config, JSON or YAML with a Content-Type naming YAML. It is
+// validated like a file and answered with the changes. The hosts are reloaded at once, all of them or
+// none. A configuration changing other settings is refused with a 409 listing them, as they would
+// only be applied on a restart that reads the files. With ?dry-run=true only the changes are answered.
+func configHandler(s *Sidebreaker) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+			configuration, version := s.configState.effective()
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("ETag", `"`+version.Hash+`"`)
+			writeJSON(w, redactConfig(configuration))
+			return
+		case http.MethodPost:
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		dryRun := req.URL.Query().Get("dry-run") == "true"
+		data, err := io.ReadAll(io.LimitReader(req.Body, maxConfigBody+1))
+		if err != nil {
+			http.Error(w, "error reading body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(data) > maxConfigBody {
+			http.Error(w, "configuration too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		name := "body"
+		if strings.Contains(req.Header.Get("Content-Type"), "yaml") {
+			name = "body.yaml"
+		}
+		var changes []ConfigChange
+		configuration, err := parseConfig([]configFile{{name: name, data: data}}, nil)
+		if err == nil {
+			changes, err = s.applyConfig("admin", configuration, dryRun)
+			if err == nil {
+				if !dryRun {
+					logger.Info("Configuration pushed with the admin API", "changes", len(changes))
+					s.audit(req, "config", "", fmt.Sprintf("%d changes", len(changes)))
+				}
+				w.Header().Set("Content-Type", "application/json")
+				writeJSON(w, ConfigDiff{DryRun: dryRun, Applied: !dryRun, Changes: changes})
+				return
+			}
+		}
+		if !dryRun {
+			s.configState.failed("admin", err)
+		}
+		var restart *restartError
+		if errors.As(err, &restart) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusConflict)
+			writeJSON(w, ConfigDiff{DryRun: dryRun, Error: err.Error(), Changes: changes})
+			return
+		}
+		msg := err.Error()
+		if errs, ok := err.(ConfigErrors); ok {
+			lines := make([]string, len(errs))
+			for i, e := range errs {
+				lines[i] = e.Error()
+			}
+			msg = strings.Join(lines, "\n")
+		}
+		http.Error(w, msg, http.StatusBadRequest)
+	}
+}
+
+// Replacement of the secrets in the configuration shown by the admin API
+const redacted = "REDACTED"
+
+// A copy of a configuration with the fields tagged secret replaced: secret:"true" fields are
+// replaced whole, secret:"password" ones only the password of their URL or user:password
+func redactConfig(configuration Configuration) Configuration {
+	var c Configuration
+	data, _ := json.Marshal(configuration)
+	json.Unmarshal(data, &c)
+	redactValue(reflect.ValueOf(&c).Elem())
+	return c
+}
+
+func redactValue(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			redactValue(v.Elem())
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			redactValue(v.Index(i))
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Field(i)
+			if !f.CanSet() {
+				continue
+			}
+			mode := v.Type().Field(i).Tag.Get("secret")
+			switch {
+			case mode == "":
+				redactValue(f)
+			case f.Kind() == reflect.String:
+				f.SetString(redactSecret(f.String(), mode))
+			case f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.String:
+				for j := 0; j < f.Len(); j++ {
+					f.Index(j).SetString(redactSecret(f.Index(j).String(), mode))
+				}
+			}
+		}
+	}
+}
+
+func redactSecret(value string, mode string) string {
+	switch {
+	case value == "":
+		return ""
+	case mode != "password":
+		return redacted
+	case strings.Contains(value, "://"):
+		u, err := url.Parse(value)
+		if err != nil {
+			return redacted
+		}
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+		}
+		return u.String()
+	}
+	if user, _, ok := strings.Cut(value, ":"); ok {
+		return user + ":" + redacted
+	}
+	return redacted
+}
@@ -0,0 +1,118 @@
+package sidebreaker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Configurations that couldn't be loaded or applied by source, as file, admin or consul, and the
+// version of the configuration in use
+var (
+	configLoadFailures = expvar.NewMap("configLoadFailures")
+	configVersion      = expvar.NewInt("configVersion")
+)
+
+// ConfigVersion struct, the configuration in use in the admin API. The version counts the
+// configurations applied since the start and the hash identifies their settings, the same settings
+// have the same hash on every sidebreaker.
+type ConfigVersion struct {
+	Version     int64          `json:"version"`
+	Hash        string         `json:"hash"`
+	Source      string         `json:"source"`
+	Applied     time.Time      `json:"applied"`
+	Failures    int64          `json:"failures"`
+	LastFailure *ConfigFailure `json:"lastFailure,omitempty"`
+}
+
+// ConfigFailure struct, the last configuration that couldn't be loaded
+type ConfigFailure struct {
+	Time   time.Time `json:"time"`
+	Source string    `json:"source"`
+	Error  string    `json:"error"`
+}
+
+// configState is the configuration in use and its version, kept as the last known good one when
+// the next can't be loaded
+type configState struct {
+	mu      sync.Mutex
+	version ConfigVersion
+	config  Configuration
+}
+
+// Record a configuration applied, with its defaults so the hash covers what is in use
+func (c *configState) applied(source string, configuration Configuration) {
+	data, _ := json.Marshal(configuration)
+	sum := sha256.Sum256(data)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.version.Version++
+	c.version.Hash = hex.EncodeToString(sum[:6])
+	c.version.Source = source
+	c.version.Applied = time.Now()
+	c.config = configuration
+	configVersion.Set(c.version.Version)
+}
+
+// Record a configuration that couldn't be loaded or applied, the one in use stays
+func (c *configState) failed(source string, err error) {
+	c.mu.Lock()
+	c.version.Failures++
+	c.version.LastFailure = &ConfigFailure{Time: time.Now(), Source: source, Error: err.Error()}
+	version, hash := c.version.Version, c.version.Hash
+	c.mu.Unlock()
+	configLoadFailures.Add(source, 1)
+	logger.Error("Invalid configuration, keeping the last known good one", "source", source, "version", version, "hash", hash, "error", err)
+}
+
+func (c *configState) current() ConfigVersion {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.version
+}
+
+// The configuration in use with its defaults and its version
+func (c *configState) effective() (Configuration, ConfigVersion) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.config, c.version
+}
+
+// ReloadFile loads a configuration file again, with the settings of the command line flags when
+// given, and applies its hosts like a configuration pushed to the admin API. The other settings of
+// the files are applied on the next start and stay as they are until then. A file that can't be
+// loaded or applied leaves the configuration in use.
+func (s *Sidebreaker) ReloadFile(path string, flags *ConfigFlags) error {
+	configuration, err := flags.Load(path)
+	if err == nil {
+		s.remote.mu.Lock()
+		running := s.remote.local
+		s.remote.mu.Unlock()
+		if fields := restartFields(diffConfig(running, configuration)); len(fields) > 0 {
+			logger.Warn("Settings of the files changed, they are applied on the next start", "fields", fields)
+		}
+		running.Hosts = configuration.Hosts
+		_, err = s.applyConfig("file", running, false)
+	}
+	if err != nil {
+		s.configState.failed("file", err)
+	}
+	return err
+}
+
+// Report the version of the configuration in use and the last one that couldn't be loaded
+func configVersionHandler(s *Sidebreaker) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		writeJSON(w, s.configState.current())
+	}
+}
@@ -0,0 +1,133 @@
+package sidebreaker
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+)
+
+// connLimit counts the tunnels and requests in flight of the process or of a host, each holding a
+// connection to the upstream, and caps them when it has a max
+type connLimit struct {
+	max     atomic.Int64
+	current atomic.Int64
+	peak    atomic.Int64
+}
+
+// Take a connection, false when the max is reached
+func (l *connLimit) acquire() bool {
+	n := l.current.Add(1)
+	if max := l.max.Load(); max > 0 && n > max {
+		l.current.Add(-1)
+		return false
+	}
+	for peak := l.peak.Load(); n > peak && !l.peak.CompareAndSwap(peak, n); peak = l.peak.Load() {
+	}
+	return true
+}
+
+func (l *connLimit) release() {
+	l.current.Add(-1)
+}
+
+// Usage of a limit for the metrics
+func (l *connLimit) usage() map[string]int64 {
+	return map[string]int64{"current": l.current.Load(), "peak": l.peak.Load(), "max": l.max.Load()}
+}
+
+// connLimits are the connections of the process and of each host. Hosts keep their counts when they
+// are reloaded.
+type connLimits struct {
+	global *connLimit
+	mu     sync.Mutex
+	hosts  map[string]*connLimit
+}
+
+func newConnLimits() *connLimits {
+	return &connLimits{global: &connLimit{}, hosts: map[string]*connLimit{}}
+}
+
+// The connections of the last sidebreaker created, in the metrics
+var publishedConnections atomic.Pointer[connLimits]
+
+// Tunnels and requests rejected because a limit was reached, by host and global for the process limit
+var connectionsRejected = expvar.NewMap("connectionsRejected")
+
+func init() {
+	expvar.Publish("connections", expvar.Func(func() any {
+		if c := publishedConnections.Load(); c != nil {
+			return c.global.usage()
+		}
+		return (&connLimit{}).usage()
+	}))
+	expvar.Publish("hostConnections", expvar.Func(func() any {
+		usage := map[string]map[string]int64{}
+		if c := publishedConnections.Load(); c != nil {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			for host, l := range c.hosts {
+				usage[host] = l.usage()
+			}
+		}
+		return usage
+	}))
+}
+
+// Set the connections of the process, for the lifetime of the process
+func (c *connLimits) setMax(max int) {
+	c.global.max.Store(int64(max))
+}
+
+// Set the connections of the hosts, replaced when the hosts are reloaded
+func (c *connLimits) setHosts(hosts []Host) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	limits := map[string]*connLimit{}
+	for _, h := range hosts {
+		l, ok := c.hosts[h.Host]
+		if !ok {
+			l = &connLimit{}
+		}
+		l.max.Store(int64(h.MaxConnections))
+		limits[h.Host] = l
+	}
+	c.hosts = limits
+}
+
+// Connections open to a host
+func (c *connLimits) open(host string) int64 {
+	c.mu.Lock()
+	l := c.hosts[host]
+	c.mu.Unlock()
+	if l == nil {
+		return 0
+	}
+	return l.current.Load()
+}
+
+// Take a connection of the process and of the host before dialing, the returned function gives
+// them back. It is nil when a limit is reached, and the call is rejected without counting for the
+// breakers of the host.
+func (c *connLimits) acquire(host string) func() {
+	c.mu.Lock()
+	l := c.hosts[host]
+	c.mu.Unlock()
+	if l != nil && !l.acquire() {
+		connectionsRejected.Add(host, 1)
+		return nil
+	}
+	if !c.global.acquire() {
+		if l != nil {
+			l.release()
+		}
+		connectionsRejected.Add("global", 1)
+		return nil
+	}
+	if l == nil {
+		return c.global.release
+	}
+	return func() {
+		l.release()
+		c.global.release()
+	}
+}
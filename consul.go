@@ -0,0 +1,96 @@
+package sidebreaker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Consul is a KV prefix the hosts are loaded from besides the configuration files. Every key under
+// the prefix holds hosts like a conf.d file, the prefix is watched and changes are applied while serving.
+type Consul struct {
+	Address    string `json:"address" doc:"URL of the Consul HTTP API, hosts aren't loaded from Consul when not set" example:"http://127.0.0.1:8500"`
+	Prefix     string `json:"prefix" doc:"KV prefix of the host files, each key under it holds hosts in JSON or YAML" example:"sidebreaker/hosts/"`
+	Datacenter string `json:"datacenter" doc:"Datacenter of the keys, the one of the agent when not set" example:"dc1"`
+	Token      string `json:"token" secret:"true" doc:"ACL token, CONSUL_HTTP_TOKEN is used when not set"`
+}
+
+func (c Consul) name() string {
+	return "consul"
+}
+
+func (c Consul) validate() error {
+	if c.Address == "" {
+		return nil
+	}
+	if u, err := url.Parse(c.Address); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("address must be an http or https URL such as http://127.0.0.1:8500, got %q", c.Address)
+	}
+	if c.Prefix == "" {
+		return fmt.Errorf("prefix is required with an address")
+	}
+	return nil
+}
+
+// consulEntry is a key of the KV store, the API sends the values base64 encoded
+type consulEntry struct {
+	Key   string
+	Value []byte
+}
+
+// Read the keys under the prefix as host files. With an index the request blocks until the prefix
+// changes past it, the index of the answer is returned for the next watch.
+func (c Consul) fetch(ctx context.Context, index uint64) ([]configFile, uint64, error) {
+	query := url.Values{"recurse": {"true"}}
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", fmt.Sprintf("%ds", int(remoteWait.Seconds())))
+	}
+	if c.Datacenter != "" {
+		query.Set("dc", c.Datacenter)
+	}
+	u := strings.TrimRight(c.Address, "/") + "/v1/kv/" + strings.TrimLeft(c.Prefix, "/") + "?" + query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, index, err
+	}
+	token := c.Token
+	if token == "" {
+		token = os.Getenv("CONSUL_HTTP_TOKEN")
+	}
+	if token != "" {
+		req.Header.Set("X-Consul-Token", token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, index, err
+	}
+	defer resp.Body.Close()
+	next, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		// No keys under the prefix
+		return nil, next, nil
+	default:
+		return nil, index, fmt.Errorf("consul answered %s", resp.Status)
+	}
+	var entries []consulEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, index, fmt.Errorf("error decoding the consul keys: %w", err)
+	}
+	var files []configFile
+	for _, e := range entries {
+		// Folders and empty keys have no hosts
+		if strings.HasSuffix(e.Key, "/") || len(strings.TrimSpace(string(e.Value))) == 0 {
+			continue
+		}
+		files = append(files, configFile{name: "consul:" + e.Key, data: e.Value, hostsOnly: true})
+	}
+	return files, next, nil
+}
@@ -0,0 +1,92 @@
+package sidebreaker
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Routes of the endpoints of a host, /hosts/{host}/maintenance, /hosts/{host}/trip and /hosts/{host}/reset
+func hostsHandler(s *Sidebreaker) http.HandlerFunc {
+	maintenance := maintenanceHandler(s)
+	trip := breakerControlHandler(s, "trip")
+	reset := breakerControlHandler(s, "reset")
+	return func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case strings.HasSuffix(req.URL.Path, "/maintenance"):
+			maintenance(w, req)
+		case strings.HasSuffix(req.URL.Path, "/trip"):
+			trip(w, req)
+		case strings.HasSuffix(req.URL.Path, "/reset"):
+			reset(w, req)
+		default:
+			http.NotFound(w, req)
+		}
+	}
+}
+
+// Trip the breakers of a host with POST /hosts/{host}/trip, its calls are rejected until a breaker
+// lets a probe through after its backoff, or reset them with POST /hosts/{host}/reset so they close
+// and start counting again. The breakers of the paths and clients of the host are tripped and reset
+// with it. Both answer the breakers of the host as GET /admin/breakers does.
+func breakerControlHandler(s *Sidebreaker, action string) http.HandlerFunc {
+	hosts := s.hosts
+	return func(w http.ResponseWriter, req *http.Request) {
+		host, _ := strings.CutSuffix(strings.TrimPrefix(req.URL.Path, "/hosts/"), "/"+action)
+		if host == "" || strings.Contains(host, "/") {
+			http.NotFound(w, req)
+			return
+		}
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		b, ok := hosts.get(host)
+		if !ok {
+			http.Error(w, "unknown host "+host, http.StatusNotFound)
+			return
+		}
+		host = b.Host.Host
+		for _, v := range b.all() {
+			if action == "trip" {
+				v.Breaker.Trip()
+			} else {
+				v.Breaker.Reset()
+				v.Damper.reset()
+			}
+		}
+		if action == "trip" {
+			logger.Warn("Breakers tripped by hand, calls are rejected", "host", host)
+		} else {
+			logger.Warn("Breakers reset by hand", "host", host)
+		}
+		s.audit(req, action, host, "")
+		report := []BreakerStatus{}
+		for _, status := range breakerReport(hosts) {
+			if status.Host == host {
+				report = append(report, status)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		writeJSON(w, report)
+	}
+}
+
+// Drain the sidebreaker with POST /admin/drain: it stops accepting connections, lets the ones in
+// flight finish for at most the drain timeout and ListenAndServe returns
+func drainHandler(s *Sidebreaker) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		s.drainOnce.Do(func() {
+			logger.Warn("Drain asked for with the admin API")
+			s.audit(req, "drain", "", "")
+			close(s.drainRequested)
+		})
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("Draining, the sidebreaker stops once the connections in flight are done\n"))
+	}
+}
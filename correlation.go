@@ -0,0 +1,67 @@
+package sidebreaker
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Header carrying the correlation ID of a call. The ID of the client is kept, calls without one get a
+// new ID. Requests send it upstream and their responses echo it to the client.
+const requestIDHeader = "X-Request-Id"
+
+// Longest correlation ID taken from a client, longer ones are replaced
+const maxCorrelationIDLength = 128
+
+// callData is kept in the UserData of the goproxy context of a call. goproxy hands it over to the
+// requests it decrypts from a MITM session.
+type callData struct {
+	correlation string
+	// The CONNECT of the session came with valid proxy credentials
+	authorized bool
+}
+
+// The data of a call, added on the first use
+func dataOf(ctx *goproxy.ProxyCtx) *callData {
+	data, ok := ctx.UserData.(*callData)
+	if !ok {
+		data = &callData{}
+		ctx.UserData = data
+	}
+	return data
+}
+
+// The correlation ID of a call, taken from the X-Request-Id header of the client or generated on the
+// first use. The handlers take it before anything else, the goroutines of a tunnel only read it.
+func correlationID(ctx *goproxy.ProxyCtx) string {
+	data := dataOf(ctx)
+	if data.correlation != "" {
+		return data.correlation
+	}
+	id := ""
+	if ctx.Req != nil {
+		id = ctx.Req.Header.Get(requestIDHeader)
+	}
+	if !validCorrelationID(id) {
+		var b [16]byte
+		rand.Read(b[:])
+		id = hex.EncodeToString(b[:])
+	}
+	data.correlation = id
+	return id
+}
+
+// Test wether a correlation ID of a client can be logged and sent upstream as it is, printable
+// ASCII without spaces and not too long
+func validCorrelationID(id string) bool {
+	if id == "" || len(id) > maxCorrelationIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,81 @@
+package sidebreaker
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"expvar"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Kinds of errors calling a host, hosts can pick the ones that count as failures of their breakers
+const (
+	dialErrorRefused  = "refused"
+	dialErrorDNS      = "dns"
+	dialErrorNXDomain = "nxdomain"
+	dialErrorTLS      = "tls"
+	dialErrorTimeout  = "timeout"
+)
+
+var dialErrorKinds = []string{dialErrorRefused, dialErrorDNS, dialErrorNXDomain, dialErrorTLS, dialErrorTimeout}
+
+// Errors calling a host by host and kind as api.example.com.refused, and those left out of the
+// breaker because the host doesn't list their kind in failOn
+var (
+	dialErrors        = expvar.NewMap("dialErrors")
+	ignoredDialErrors = expvar.NewMap("ignoredDialErrors")
+)
+
+// The kind of an error calling a host, empty for the errors of no kind such as a reset connection
+func classifyDialError(err error) string {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.IsNotFound {
+			return dialErrorNXDomain
+		}
+		return dialErrorDNS
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return dialErrorRefused
+	}
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var verifyErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	if errors.As(err, &recordErr) || errors.As(err, &alertErr) || errors.As(err, &verifyErr) ||
+		errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) || errors.As(err, &invalidErr) ||
+		strings.Contains(err.Error(), "tls: ") {
+		return dialErrorTLS
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, os.ErrDeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return dialErrorTimeout
+	}
+	return ""
+}
+
+// Record a call that failed with an error, hosts with failOn only count the errors of the kinds they
+// list. It returns the kind of the error and whether the breaker was updated.
+func (b Breakers) callFailed(err error, latency time.Duration) (string, bool) {
+	if errors.Is(err, errEgressDenied) {
+		return "egress", false
+	}
+	kind := classifyDialError(err)
+	if kind != "" {
+		dialErrors.Add(b.Host.Host+"."+kind, 1)
+	}
+	if len(b.Host.FailOn) > 0 && kind != "" && !slices.Contains(b.Host.FailOn, kind) {
+		ignoredDialErrors.Add(b.Host.Host+"."+kind, 1)
+		return kind, false
+	}
+	b.Fail(latency)
+	return kind, true
+}
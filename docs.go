@@ -0,0 +1,173 @@
+package sidebreaker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// The configuration reference and example are generated from the `doc` and `example` tags of
+// the configuration structs, so they always match the running version.
+
+// Handler for the configuration reference, one line per field
+func configReference(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	writeReference(w, reflect.TypeOf(Configuration{}), "")
+}
+
+// Handler for an example configuration using every field
+func configExample(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := writeJSON(w, exampleValue(reflect.TypeOf(Configuration{}), "")); err != nil {
+		logger.Error("error generating example configuration", "error", err)
+	}
+}
+
+// Write an indented JSON document without escaping characters such as & and >
+func writeJSON(w io.Writer, v interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// exampleObject keeps the fields of an example in the order of the struct
+type exampleObject []exampleField
+
+type exampleField struct {
+	Name  string
+	Value interface{}
+}
+
+func (o exampleObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, f := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		encoder := json.NewEncoder(&buf)
+		encoder.SetEscapeHTML(false)
+		if err := encoder.Encode(f.Name); err != nil {
+			return nil, err
+		}
+		buf.WriteByte(':')
+		if err := encoder.Encode(f.Value); err != nil {
+			return nil, err
+		}
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// Name of a field in the configuration file
+func jsonName(f reflect.StructField) string {
+	name := strings.Split(f.Tag.Get("json"), ",")[0]
+	if name == "" {
+		return f.Name
+	}
+	return name
+}
+
+// Name of a type in the configuration file
+func typeName(t reflect.Type) string {
+	if t == reflect.TypeOf(Duration(0)) {
+		return "duration"
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeName(t.Elem())
+	case reflect.Struct:
+		return "object"
+	case reflect.Slice:
+		return "list of " + typeName(t.Elem())
+	case reflect.Int, reflect.Int64:
+		return "integer"
+	case reflect.Float64:
+		return "number"
+	case reflect.Bool:
+		return "boolean"
+	default:
+		return "string"
+	}
+}
+
+// Write a line per field of the struct, nested objects are written with their full path
+func writeReference(w io.Writer, t reflect.Type, prefix string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		path := prefix + jsonName(f)
+		fmt.Fprintf(w, "%-36s %-18s %s\n", path, typeName(f.Type), f.Tag.Get("doc"))
+
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.Slice {
+			ft = ft.Elem()
+			path += "[]"
+		}
+		if ft.Kind() == reflect.Struct {
+			writeReference(w, ft, path+".")
+		}
+	}
+}
+
+// Build an example value for a type from the example tags, lists get a single element
+func exampleValue(t reflect.Type, example string) interface{} {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return exampleValue(t.Elem(), example)
+	case reflect.Struct:
+		fields := exampleObject{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if v := exampleValue(f.Type, f.Tag.Get("example")); v != nil {
+				fields = append(fields, exampleField{jsonName(f), v})
+			}
+		}
+		if len(fields) == 0 {
+			return nil
+		}
+		return fields
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Struct {
+			if v := exampleValue(t.Elem(), ""); v != nil {
+				return []interface{}{v}
+			}
+			return nil
+		}
+		if example == "" {
+			return nil
+		}
+		list := []interface{}{}
+		for _, e := range strings.Split(example, ",") {
+			list = append(list, exampleValue(t.Elem(), e))
+		}
+		return list
+	}
+
+	if example == "" {
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int64:
+		if n, err := strconv.ParseInt(example, 10, 64); err == nil {
+			return n
+		}
+	case reflect.Float64:
+		if n, err := strconv.ParseFloat(example, 64); err == nil {
+			return n
+		}
+	case reflect.Bool:
+		if b, err := strconv.ParseBool(example); err == nil {
+			return b
+		}
+	}
+	return example
+}
@@ -0,0 +1,221 @@
+package sidebreaker
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Connections accepted and open per listener and address family, and the families each listener is bound to
+var (
+	acceptedConnections = expvar.NewMap("acceptedConnections")
+	openConnections     = expvar.NewMap("openConnections")
+	listeningFamilies   = expvar.NewMap("listeningFamilies")
+	nestedCountersMu    sync.Mutex
+)
+
+// Counter of a name and key in a map of maps, such as a listener and address family
+func nestedCounter(m *expvar.Map, name string, key string) *expvar.Int {
+	nestedCountersMu.Lock()
+	defer nestedCountersMu.Unlock()
+	keys, ok := m.Get(name).(*expvar.Map)
+	if !ok {
+		keys = new(expvar.Map).Init()
+		m.Set(name, keys)
+	}
+	counter, ok := keys.Get(key).(*expvar.Int)
+	if !ok {
+		counter = new(expvar.Int)
+		keys.Set(key, counter)
+	}
+	return counter
+}
+
+// Address family of a connection by the address it was accepted on, IPv4 mapped addresses are IPv4
+func addrFamily(addr net.Addr) string {
+	if tcp, ok := addr.(*net.TCPAddr); ok && tcp.IP.To4() == nil {
+		return "ipv6"
+	}
+	return "ipv4"
+}
+
+// Test wether a listen error means the family isn't available on this host rather than the port being taken
+func familyUnavailable(err error) bool {
+	return errors.Is(err, syscall.EAFNOSUPPORT) || errors.Is(err, syscall.EADDRNOTAVAIL) || errors.Is(err, syscall.EPROTONOSUPPORT)
+}
+
+// Listener of an address family, a variable so tests can act as a host without one of them
+var listenFamily = listenNetwork
+
+// Listen on a port for IPv4 and IPv6 with a listener each, a single wildcard listener can end up
+// serving one family only depending on the host. A family that isn't available on the host is
+// skipped, any other error fails.
+func listenDualStack(name string, port int, reusePort bool) (net.Listener, error) {
+	d := &dualListener{name: name, accepted: make(chan acceptResult), done: make(chan struct{})}
+	var families []string
+	for _, f := range []struct{ network, family string }{{"tcp4", "ipv4"}, {"tcp6", "ipv6"}} {
+		l, err := listenFamily(name+"/"+f.network, f.network, fmt.Sprintf(":%d", port), reusePort)
+		if err != nil && familyUnavailable(err) {
+			logger.Warn("Address family not available, not listening on it", "listener", name, "family", f.family, "error", err)
+			continue
+		}
+		if err != nil {
+			d.Close()
+			return nil, err
+		}
+		d.listeners = append(d.listeners, l)
+		families = append(families, f.family)
+	}
+	if len(d.listeners) == 0 {
+		return nil, fmt.Errorf("neither IPv4 nor IPv6 is available")
+	}
+	published := new(expvar.String)
+	published.Set(strings.Join(families, ","))
+	listeningFamilies.Set(name, published)
+	for _, l := range d.listeners {
+		go d.acceptLoop(l)
+	}
+	return d, nil
+}
+
+// Listen on an address of the configuration, such as 127.0.0.1:3129, its connections counted like
+// the ones of the dual stack listeners
+func listenAddress(name string, address string, reusePort bool) (net.Listener, error) {
+	l, err := listenNetwork(name, "tcp", address, reusePort)
+	if err != nil {
+		return nil, err
+	}
+	d := &dualListener{name: name, listeners: []net.Listener{l}, accepted: make(chan acceptResult), done: make(chan struct{})}
+	published := new(expvar.String)
+	published.Set(addrFamily(l.Addr()))
+	listeningFamilies.Set(name, published)
+	go d.acceptLoop(l)
+	return d, nil
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// dualListener serves the connections of several listeners, each with its own accept loop so a
+// family failing to accept doesn't hold up the other
+type dualListener struct {
+	name      string
+	listeners []net.Listener
+	accepted  chan acceptResult
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (d *dualListener) acceptLoop(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if conn != nil {
+			family := addrFamily(conn.LocalAddr())
+			nestedCounter(acceptedConnections, d.name, family).Add(1)
+			open := nestedCounter(openConnections, d.name, family)
+			open.Add(1)
+			conn = &countedConn{Conn: conn, open: open}
+		}
+		select {
+		case d.accepted <- acceptResult{conn, err}:
+		case <-d.done:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+	}
+}
+
+func (d *dualListener) Accept() (net.Conn, error) {
+	select {
+	case r := <-d.accepted:
+		return r.conn, r.err
+	case <-d.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (d *dualListener) Close() error {
+	var err error
+	d.closeOnce.Do(func() {
+		close(d.done)
+		for _, l := range d.listeners {
+			if e := l.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
+	})
+	return err
+}
+
+func (d *dualListener) Addr() net.Addr {
+	addrs := make(multiAddr, len(d.listeners))
+	for i, l := range d.listeners {
+		addrs[i] = l.Addr()
+	}
+	return addrs
+}
+
+// multiAddr is the addresses of a dualListener, for logging
+type multiAddr []net.Addr
+
+func (a multiAddr) Network() string {
+	return "tcp"
+}
+
+func (a multiAddr) String() string {
+	addrs := make([]string, len(a))
+	for i, addr := range a {
+		addrs[i] = addr.String()
+	}
+	return strings.Join(addrs, ",")
+}
+
+// The form hosts are kept under: IP literals without brackets and in their canonical form, so ::1,
+// [::1] and 0:0::1 are one host and 2001:DB8::1 is 2001:db8::1. Names are left as they are.
+func canonicalHost(host string) string {
+	trimmed := strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if ip := net.ParseIP(trimmed); ip != nil {
+		return ip.String()
+	}
+	return host
+}
+
+// A host and port such as the host of a URL with its host in the canonical form, IPv6 literals in brackets
+func canonicalHostPort(hostport string) string {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return canonicalHost(hostport)
+	}
+	return net.JoinHostPort(canonicalHost(host), port)
+}
+
+// countedConn is an accepted connection counted as open until it is closed
+type countedConn struct {
+	net.Conn
+	open *expvar.Int
+	once sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() { c.open.Add(-1) })
+	return c.Conn.Close()
+}
+
+// Tunnels half close the client connection once the upstream is done
+func (c *countedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
@@ -0,0 +1,291 @@
+package sidebreaker
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Skip the test when the host has no IPv6 loopback
+func requireIPv6(t *testing.T) {
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 not available: %v", err)
+	}
+	l.Close()
+}
+
+// Act as a host without IPv4 for the duration of the test
+func withoutIPv4(t *testing.T) {
+	listenFamily = func(name string, network string, address string, reusePort bool) (net.Listener, error) {
+		if network == "tcp4" {
+			return nil, &net.OpError{Op: "listen", Net: network, Err: os.NewSyscallError("socket", syscall.EAFNOSUPPORT)}
+		}
+		return listenNetwork(name, network, address, reusePort)
+	}
+	t.Cleanup(func() { listenFamily = listenNetwork })
+}
+
+// Test wether IP literals in any form are kept under a single form, and names as they are
+func TestCanonicalHost(t *testing.T) {
+	tests := map[string]string{
+		"::1":                 "::1",
+		"[::1]":               "::1",
+		"0:0::1":              "::1",
+		"[0:0:0:0:0:0:0:1]":   "::1",
+		"2001:DB8::10":        "2001:db8::10",
+		"[2001:db8:0:0::10]":  "2001:db8::10",
+		"::ffff:192.0.2.1":    "192.0.2.1",
+		"192.0.2.1":           "192.0.2.1",
+		"api.example.com":     "api.example.com",
+		"[api.example.com]":   "[api.example.com]",
+		"fe80::1%eth0":        "fe80::1%eth0",
+		"":                    "",
+		"[2001:db8::10]:443":  "[2001:db8::10]:443",
+		"not:an:address:here": "not:an:address:here",
+	}
+	for host, expected := range tests {
+		if got := canonicalHost(host); got != expected {
+			t.Errorf("expected %q for %q, got %q", expected, host, got)
+		}
+	}
+}
+
+// Test wether hosts with ports keep their port and IPv6 literals get their brackets
+func TestCanonicalHostPort(t *testing.T) {
+	tests := map[string]string{
+		"[::1]:443":              "[::1]:443",
+		"[0:0::1]:443":           "[::1]:443",
+		"[2001:DB8:0::10]:8080":  "[2001:db8::10]:8080",
+		"192.0.2.1:80":           "192.0.2.1:80",
+		"api.example.com:443":    "api.example.com:443",
+		"api.example.com":        "api.example.com",
+		"[2001:db8::10]":         "2001:db8::10",
+		"[::ffff:192.0.2.1]:443": "192.0.2.1:443",
+	}
+	for hostport, expected := range tests {
+		if got := canonicalHostPort(hostport); got != expected {
+			t.Errorf("expected %q for %q, got %q", expected, hostport, got)
+		}
+	}
+}
+
+// Test wether connections are counted under the family of the address they were accepted on
+func TestAddrFamily(t *testing.T) {
+	tests := []struct {
+		addr     net.Addr
+		expected string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}, "ipv4"},
+		{&net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.1")}, "ipv4"},
+		{&net.TCPAddr{IP: net.ParseIP("::1")}, "ipv6"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::10")}, "ipv6"},
+		{&net.UnixAddr{Name: "/run/sidebreaker.sock"}, "ipv4"},
+	}
+	for _, test := range tests {
+		if got := addrFamily(test.addr); got != test.expected {
+			t.Errorf("expected %s for %v, got %s", test.expected, test.addr, got)
+		}
+	}
+}
+
+// Test wether the errors of a missing address family are told apart from the other listen errors
+func TestFamilyUnavailable(t *testing.T) {
+	wrap := func(err syscall.Errno) error {
+		return &net.OpError{Op: "listen", Net: "tcp4", Err: os.NewSyscallError("socket", err)}
+	}
+	tests := []struct {
+		err      error
+		expected bool
+	}{
+		{wrap(syscall.EAFNOSUPPORT), true},
+		{wrap(syscall.EADDRNOTAVAIL), true},
+		{wrap(syscall.EPROTONOSUPPORT), true},
+		{fmt.Errorf("listening: %w", wrap(syscall.EAFNOSUPPORT)), true},
+		{wrap(syscall.EADDRINUSE), false},
+		{wrap(syscall.EACCES), false},
+		{errors.New("address family not supported"), false},
+	}
+	for _, test := range tests {
+		if got := familyUnavailable(test.err); got != test.expected {
+			t.Errorf("expected %v for %v, got %v", test.expected, test.err, got)
+		}
+	}
+}
+
+// Test wether a port is served over IPv6 alone on a host without IPv4, and counted as IPv6
+func TestListenDualStackIPv6Only(t *testing.T) {
+	requireIPv6(t)
+	withoutIPv4(t)
+	l, err := listenDualStack("test-ipv6-only", 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if got := listeningFamilies.Get("test-ipv6-only").String(); got != `"ipv6"` {
+		t.Errorf("expected the listener to be on ipv6 only, got %s", got)
+	}
+	addrs := l.Addr().(multiAddr)
+	if len(addrs) != 1 || addrFamily(addrs[0]) != "ipv6" {
+		t.Fatalf("expected a single IPv6 address, got %v", addrs)
+	}
+	port := addrs[0].(*net.TCPAddr).Port
+	accepts := nestedCounter(acceptedConnections, "test-ipv6-only", "ipv6").Value()
+	conn, err := net.Dial("tcp6", net.JoinHostPort("::1", fmt.Sprint(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted.Close()
+	if got := nestedCounter(acceptedConnections, "test-ipv6-only", "ipv6").Value() - accepts; got != 1 {
+		t.Errorf("expected 1 IPv6 connection accepted, got %d", got)
+	}
+	if got := nestedCounter(openConnections, "test-ipv6-only", "ipv6").Value(); got != 0 {
+		t.Errorf("expected no IPv6 connection open after closing, got %d", got)
+	}
+}
+
+// Test wether listening fails when neither family is available, or a family fails for another reason
+func TestListenDualStackErrors(t *testing.T) {
+	listenFamily = func(name string, network string, address string, reusePort bool) (net.Listener, error) {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: os.NewSyscallError("socket", syscall.EAFNOSUPPORT)}
+	}
+	defer func() { listenFamily = listenNetwork }()
+	if _, err := listenDualStack("test-no-family", 0, false); err == nil {
+		t.Error("expected an error without any family")
+	}
+	listenFamily = func(name string, network string, address string, reusePort bool) (net.Listener, error) {
+		return nil, &net.OpError{Op: "listen", Net: network, Err: os.NewSyscallError("bind", syscall.EADDRINUSE)}
+	}
+	if _, err := listenDualStack("test-port-taken", 0, false); !errors.Is(err, syscall.EADDRINUSE) {
+		t.Errorf("expected the port to be taken, got %v", err)
+	}
+}
+
+// Test wether [::] in listen serves both families with a single socket, IPv4 clients counted as IPv4
+func TestListenAddressWildcard(t *testing.T) {
+	requireIPv6(t)
+	l, err := listenAddress("test-wildcard", "[::]:0", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	port := fmt.Sprint(l.Addr().(multiAddr)[0].(*net.TCPAddr).Port)
+	accepts := map[string]int64{}
+	for _, family := range []string{"ipv4", "ipv6"} {
+		accepts[family] = nestedCounter(acceptedConnections, "test-wildcard", family).Value()
+	}
+	for _, address := range []string{"[::1]:" + port, "127.0.0.1:" + port} {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		accepted, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		accepted.Close()
+		conn.Close()
+	}
+	for _, family := range []string{"ipv4", "ipv6"} {
+		if got := nestedCounter(acceptedConnections, "test-wildcard", family).Value() - accepts[family]; got != 1 {
+			t.Errorf("expected 1 %s connection accepted, got %d", family, got)
+		}
+	}
+}
+
+// Test wether CONNECT and plain requests to IPv6 literals in brackets reach a host configured in
+// another form of the address, over a proxy listening on IPv6 only
+func TestProxyIPv6Literals(t *testing.T) {
+	requireIPv6(t)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Listener = l
+	server.Start()
+	defer server.Close()
+	target := server.Listener.Addr().String()
+
+	configuration, err := ParseConfig([]byte(`{"port": 8080, "runAs": {"allowRoot": true},
+		"hosts": [{"host": "[0:0::1]", "breakType": "consecutive", "threshold": 2, "timeout": 1000}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(configuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyListener, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(ctx, proxyListener) }()
+	defer func() {
+		cancel()
+		<-served
+	}()
+	if _, ok := s.hosts.get("[::1]"); !ok {
+		t.Fatal("expected [::1] to be the configured host")
+	}
+
+	// CONNECT to the bracketed literal, then a request through the tunnel
+	conn, err := net.DialTimeout("tcp6", proxyListener.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the CONNECT to %s to succeed, got %s", target, resp.Status)
+	}
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", target)
+	if resp, err = http.ReadResponse(r, nil); err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "ok" {
+		t.Errorf("expected ok through the tunnel, got %q", body)
+	}
+
+	// Plain request with the literal written in another form
+	proxyURL, _ := http.NewRequest(http.MethodGet, "http://"+proxyListener.Addr().String(), nil)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL.URL)}, Timeout: 5 * time.Second}
+	_, port, _ := net.SplitHostPort(target)
+	resp, err = client.Get("http://[0:0:0:0:0:0:0:1]:" + port + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Errorf("expected ok from the plain request, got %s %q", resp.Status, body)
+	}
+	if b, _ := s.hosts.get("::1"); b.Breaker.Successes() == 0 {
+		t.Error("expected the plain request counted for ::1")
+	}
+}
@@ -0,0 +1,64 @@
+package sidebreaker
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Duration is a duration in the configuration, integer milliseconds or a Go duration string such as
+// "750ms" or "2s". It is kept in milliseconds so it converts with time.Duration(d) * time.Millisecond.
+type Duration int64
+
+// Duration as a time.Duration
+func (d Duration) Duration() time.Duration {
+	return time.Duration(d) * time.Millisecond
+}
+
+func (d Duration) String() string {
+	return d.Duration().String()
+}
+
+// Durations are written as strings such as "1m30s"
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	parsed, err := parseDuration(v)
+	if err != nil {
+		return err
+	}
+	*d = parsed
+	return nil
+}
+
+// Parse integer milliseconds or a duration string, durations shorter than a millisecond can't be kept
+func parseDuration(v interface{}) (Duration, error) {
+	switch v := v.(type) {
+	case float64:
+		if v != math.Trunc(v) {
+			return 0, fmt.Errorf("expected integer milliseconds or a duration such as \"1.5s\", got %v", v)
+		}
+		return Duration(v), nil
+	case string:
+		parsed, err := time.ParseDuration(strings.TrimSpace(v))
+		if err != nil {
+			return 0, fmt.Errorf("expected a duration such as \"750ms\" or \"2s\", got %q", v)
+		}
+		if parsed%time.Millisecond != 0 {
+			return 0, fmt.Errorf("duration %q is not a whole number of milliseconds", v)
+		}
+		return Duration(parsed / time.Millisecond), nil
+	}
+	return 0, fmt.Errorf("expected integer milliseconds or a duration such as \"2s\", got %v", v)
+}
@@ -0,0 +1,83 @@
+package sidebreaker
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Test wether durations are read from integer milliseconds and duration strings, and fractions of a
+// millisecond are refused
+func TestDurationUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		data     string
+		expected Duration
+		err      bool
+	}{
+		{`1500`, 1500, false},
+		{`0`, 0, false},
+		{`1.5e3`, 1500, false},
+		{`"750ms"`, 750, false},
+		{`"2s"`, 2000, false},
+		{`"1.5s"`, 1500, false},
+		{`"1m30s"`, 90000, false},
+		{`" 2s "`, 2000, false},
+		{`"-1s"`, -1000, false},
+		{`1.5`, 0, true},
+		{`"1.5ms"`, 0, true},
+		{`"500us"`, 0, true},
+		{`"2"`, 0, true},
+		{`"soon"`, 0, true},
+		{`true`, 0, true},
+		{`[1000]`, 0, true},
+	}
+	for _, test := range tests {
+		var d Duration
+		err := json.Unmarshal([]byte(test.data), &d)
+		if test.err {
+			if err == nil {
+				t.Errorf("expected an error for %s, got %d", test.data, d)
+			}
+			continue
+		}
+		if err != nil || d != test.expected {
+			t.Errorf("expected %d for %s, got %d %v", test.expected, test.data, d, err)
+		}
+	}
+
+	d := Duration(1000)
+	if err := json.Unmarshal([]byte(`null`), &d); err != nil || d != 1000 {
+		t.Errorf("expected null to leave the duration, got %d %v", d, err)
+	}
+	if data, _ := json.Marshal(Duration(90000)); string(data) != `"1m30s"` {
+		t.Errorf("expected \"1m30s\", got %s", data)
+	}
+}
+
+// Test wether configurations written with milliseconds read as they did before duration strings, in
+// JSON and YAML, and the same durations written as strings read the same
+func TestDurationConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		data string
+	}{
+		{"JSON milliseconds", "config.json", `{"port": 8080, "hosts": [{"host": "api.example.com", "breakType": "consecutive", "threshold": 2, "timeout": 1500}]}`},
+		{"JSON string", "config.json", `{"port": 8080, "hosts": [{"host": "api.example.com", "breakType": "consecutive", "threshold": 2, "timeout": "1.5s"}]}`},
+		{"YAML milliseconds", "config.yaml", "port: 8080\nhosts:\n  - host: api.example.com\n    breakType: consecutive\n    threshold: 2\n    timeout: 1500\n"},
+		{"YAML string", "config.yaml", "port: 8080\nhosts:\n  - host: api.example.com\n    breakType: consecutive\n    threshold: 2\n    timeout: 1500ms\n"},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), test.file)
+		os.WriteFile(path, []byte(test.data), 0o600)
+		configuration, err := LoadConfig(path)
+		if err != nil {
+			t.Errorf("%s: expected no error, got %v", test.name, err)
+			continue
+		}
+		if got := configuration.Hosts[0].Timeout; got != 1500 {
+			t.Errorf("%s: expected a timeout of 1500ms, got %d", test.name, got)
+		}
+	}
+}
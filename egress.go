@@ -0,0 +1,251 @@
+package sidebreaker
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Egress struct for the configuration, the destinations the clients of the proxy can reach
+type Egress struct {
+	Allow []EgressRule `json:"allow" doc:"Destinations the clients can reach, any destination that isn't denied when empty"`
+	Deny  []EgressRule `json:"deny" doc:"Destinations the clients can't reach, checked before allow"`
+}
+
+// EgressRule struct for the configuration, destinations by host and port
+type EgressRule struct {
+	Host  string `json:"host" doc:"Host name, *.example.com for the subdomains of a domain, IP or CIDR, any host when not set" example:"169.254.169.254"`
+	Ports []int  `json:"ports" doc:"Ports of the destinations, any port when empty" example:"443"`
+}
+
+func (r EgressRule) validate() error {
+	if r.Host == "" && len(r.Ports) == 0 {
+		return fmt.Errorf("a rule needs a host or ports")
+	}
+	if strings.Contains(r.Host, "/") {
+		if _, err := netip.ParsePrefix(r.Host); err != nil {
+			return fmt.Errorf("host must be a name, IP or CIDR, got %q", r.Host)
+		}
+	}
+	for _, p := range r.Ports {
+		if p < 1 || p > 65535 {
+			return fmt.Errorf("ports must be between 1 and 65535, got %d", p)
+		}
+	}
+	return nil
+}
+
+// Calls refused by the egress rules
+var egressDenied = expvar.NewInt("egressDenied")
+
+// egressRule is a rule with its network parsed, for the rules on IPs and CIDRs
+type egressRule struct {
+	EgressRule
+	network netip.Prefix
+}
+
+// Test wether the rule covers a destination, with the addresses its host resolves to. The host is
+// normalized like the rules.
+func (r egressRule) matches(host string, ips []netip.Addr, port int) bool {
+	if len(r.Ports) > 0 && !containsPort(r.Ports, port) {
+		return false
+	}
+	switch {
+	case r.Host == "":
+		return true
+	case r.network.IsValid():
+		for _, ip := range ips {
+			if r.network.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	case strings.HasPrefix(r.Host, "*."):
+		return strings.HasSuffix(host, r.Host[1:])
+	}
+	return host == r.Host
+}
+
+// Names are matched in lower case and without the dot of the root, so example.com. is example.com
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+func containsPort(ports []int, port int) bool {
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// egressPolicy decides the destinations the calls can reach, before the breakers
+type egressPolicy struct {
+	allow, deny []egressRule
+	resolver    *dnsResolver
+	// Names are resolved when rules match IPs to refuse the calls early, the addresses are checked
+	// again when they are dialed as a name can resolve to another address by then
+	resolve bool
+}
+
+func newEgressPolicy(config Egress, r *dnsResolver) *egressPolicy {
+	if len(config.Allow) == 0 && len(config.Deny) == 0 {
+		return nil
+	}
+	p := &egressPolicy{resolver: r}
+	parse := func(rules []EgressRule) []egressRule {
+		parsed := make([]egressRule, 0, len(rules))
+		for _, r := range rules {
+			rule := egressRule{EgressRule: r}
+			rule.Host = normalizeHost(r.Host)
+			if ip, err := netip.ParseAddr(r.Host); err == nil {
+				rule.network = netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen())
+			} else if prefix, err := netip.ParsePrefix(r.Host); err == nil {
+				rule.network = prefix.Masked()
+			}
+			p.resolve = p.resolve || rule.network.IsValid()
+			parsed = append(parsed, rule)
+		}
+		return parsed
+	}
+	p.allow = parse(config.Allow)
+	p.deny = parse(config.Deny)
+	return p
+}
+
+// The reason a destination is refused, empty when it is allowed
+func (p *egressPolicy) check(ctx context.Context, host string, port int) string {
+	host = normalizeHost(host)
+	var ips []netip.Addr
+	if ip, err := netip.ParseAddr(host); err == nil {
+		ips = []netip.Addr{ip.Unmap()}
+	} else if p.resolve {
+		// A name that doesn't resolve is only matched by name, its call fails anyway
+		addrs, _, _ := p.resolver.lookupHost(ctx, host)
+		for _, a := range addrs {
+			if ip, err := netip.ParseAddr(a); err == nil {
+				ips = append(ips, ip.Unmap())
+			}
+		}
+	}
+	return p.decide(host, ips, port)
+}
+
+// The reason a destination with its addresses is refused, empty when it is allowed
+func (p *egressPolicy) decide(host string, ips []netip.Addr, port int) string {
+	for _, r := range p.deny {
+		if r.matches(host, ips, port) {
+			return "destination denied"
+		}
+	}
+	if len(p.allow) == 0 {
+		return ""
+	}
+	for _, r := range p.allow {
+		if r.matches(host, ips, port) {
+			return ""
+		}
+	}
+	return "destination not allowed"
+}
+
+// Connections refused by the egress rules when dialed, they don't count as failures of the host
+var errEgressDenied = errors.New("refused by the egress rules")
+
+// The destination a connection of a client is opened for, with the rules its addresses are checked against
+type egressDestinationKey struct{}
+
+type egressDestination struct {
+	host   string
+	policy *egressPolicy
+}
+
+// The destinations of the configuration, the routes of the reverse proxy and the upstreams of the
+// passthroughs, are trusted as configured
+type trustedDestinationKey struct{}
+
+func withTrustedDestination(ctx context.Context) context.Context {
+	return context.WithValue(ctx, trustedDestinationKey{}, true)
+}
+
+// Check the addresses dialed for the calls of the clients to host against the rules
+func (p *egressPolicy) withCheck(ctx context.Context, host string) context.Context {
+	if p == nil || ctx.Value(trustedDestinationKey{}) != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, egressDestinationKey{}, egressDestination{host: normalizeHost(host), policy: p})
+}
+
+// Refuse to dial an address of a destination the rules refuse. The rules are checked on the address
+// actually dialed, so a name resolving to a denied address when dialed can't reach it.
+func checkEgressDial(ctx context.Context, addr string) error {
+	destination, ok := ctx.Value(egressDestinationKey{}).(egressDestination)
+	if !ok {
+		return nil
+	}
+	host := destination.host
+	ap, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return nil
+	}
+	reason := destination.policy.decide(host, []netip.Addr{ap.Addr().Unmap()}, int(ap.Port()))
+	if reason == "" {
+		return nil
+	}
+	egressDenied.Add(1)
+	logger.Info("Refusing a connection to an address of the egress rules", "destination", host, "address", addr, "reason", reason)
+	return fmt.Errorf("%s: %w", addr, errEgressDenied)
+}
+
+// How long the check of a destination waits for its addresses
+const egressResolveTimeout = 5 * time.Second
+
+// Calls to a destination the policy refuses
+func (p *egressPolicy) refused() goproxy.ReqConditionFunc {
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		port, _ := strconv.Atoi(req.URL.Port())
+		if port == 0 {
+			port = 80
+			if req.URL.Scheme == "https" || req.Method == http.MethodConnect {
+				port = 443
+			}
+		}
+		resolveCtx, cancel := context.WithTimeout(req.Context(), egressResolveTimeout)
+		defer cancel()
+		reason := p.check(resolveCtx, req.URL.Hostname(), port)
+		if reason == "" {
+			return false
+		}
+		egressDenied.Add(1)
+		logger.Info("Refusing a call to a destination of the egress rules", "client", req.RemoteAddr, "destination", net.JoinHostPort(req.URL.Hostname(), strconv.Itoa(port)), "reason", reason, "request_id", ctx.Session, "correlation_id", correlationID(ctx))
+		return true
+	}
+}
+
+// Refuse the plain HTTP requests and CONNECT calls to the destinations of the policy with a 403,
+// registered before the breakers so refused calls never count for a host
+func (p *egressPolicy) register(proxy *goproxy.ProxyHttpServer) {
+	forbidden := func(req *http.Request) *http.Response {
+		resp := goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusForbidden, "Destination not allowed")
+		// The answer to a CONNECT is written as is
+		resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+		return resp
+	}
+	proxy.OnRequest(p.refused()).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		return req, forbidden(req)
+	})
+	proxy.OnRequest(p.refused()).HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		ctx.Resp = forbidden(ctx.Req)
+		return goproxy.RejectConnect, host
+	})
+}
@@ -0,0 +1,67 @@
+package sidebreaker
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+)
+
+// errorBody is the JSON body of a response of the sidebreaker
+type errorBody struct {
+	Error         string `json:"error"`
+	Reason        string `json:"reason"`
+	Host          string `json:"host"`
+	State         string `json:"state"`
+	RetryAfter    int64  `json:"retryAfter,omitempty"`
+	RequestID     int64  `json:"requestId"`
+	CorrelationID string `json:"correlationId"`
+}
+
+// Test wether a client can read a JSON body, clients that only accept other types such as text/html get text
+func acceptsJSON(req *http.Request) bool {
+	accept := req.Header.Get("Accept")
+	return accept == "" || strings.Contains(accept, "json") || strings.Contains(accept, "*/*") || strings.Contains(accept, "application/*")
+}
+
+// Seconds a client should wait before calling again, 0 when the sidebreaker can't tell. Open breakers
+// tell when they let the next call through, limits are usually free again within a second.
+func retryAfterHint(host Breakers, reason string) int64 {
+	switch reason {
+	case reasonTripped:
+		return retryAfterSeconds(host.RetryAfter())
+	case reasonLimited:
+		return 1
+	case reasonShed:
+		return max(retryAfterSeconds(host.RetryAfter()), 1)
+	}
+	return 0
+}
+
+// The response of a call the sidebreaker answers itself, with a JSON body telling the host, the state
+// of its breaker and why, or the text alone when the configuration or the client asks for text
+func (s *Sidebreaker) errorResponse(req *http.Request, ctx *goproxy.ProxyCtx, host Breakers, status int, text string, reason string) *http.Response {
+	retryAfter := retryAfterHint(host, reason)
+	var resp *http.Response
+	if s.config.ErrorFormat == "text" || !acceptsJSON(req) {
+		resp = goproxy.NewResponse(req, goproxy.ContentTypeText, status, text)
+	} else {
+		body, _ := json.Marshal(errorBody{
+			Error:         text,
+			Reason:        reason,
+			Host:          host.Host.Host,
+			State:         host.State(),
+			RetryAfter:    retryAfter,
+			RequestID:     ctx.Session,
+			CorrelationID: correlationID(ctx),
+		})
+		resp = goproxy.NewResponse(req, "application/json", status, string(body))
+	}
+	resp.Header.Set(requestIDHeader, correlationID(ctx))
+	if retryAfter > 0 {
+		resp.Header.Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+	}
+	return decided(resp, host, reason)
+}
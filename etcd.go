@@ -0,0 +1,211 @@
+package sidebreaker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Etcd is a key or a key prefix of etcd v3 the hosts are loaded from besides the configuration files,
+// read through the JSON gateway of etcd. Each key holds hosts like a conf.d file, the keys are
+// watched and changes are applied while serving.
+type Etcd struct {
+	Endpoint string `json:"endpoint" doc:"URL of an etcd v3 member, hosts aren't loaded from etcd when not set" example:"http://127.0.0.1:2379"`
+	Key      string `json:"key" doc:"Key holding the hosts in JSON or YAML, set either key or prefix" example:"/sidebreaker/hosts"`
+	Prefix   string `json:"prefix" doc:"Key prefix of the host files, each key under it holds hosts in JSON or YAML" example:"/sidebreaker/hosts/"`
+	Username string `json:"username" doc:"User to authenticate as when etcd has authentication enabled" example:"sidebreaker"`
+	Password string `json:"password" secret:"true" doc:"Password of the user, ETCD_PASSWORD is used when not set"`
+}
+
+func (e Etcd) name() string {
+	return "etcd"
+}
+
+func (e Etcd) validate() error {
+	if e.Endpoint == "" {
+		return nil
+	}
+	if u, err := url.Parse(e.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("endpoint must be an http or https URL such as http://127.0.0.1:2379, got %q", e.Endpoint)
+	}
+	if (e.Key == "") == (e.Prefix == "") {
+		return fmt.Errorf("set either key or prefix with an endpoint")
+	}
+	return nil
+}
+
+// The key and range end of the keys read, etcd reads the keys from key up to the range end excluded.
+// A prefix ends before the prefix with its last byte incremented.
+func (e Etcd) keyRange() ([]byte, []byte) {
+	if e.Key != "" {
+		return []byte(e.Key), nil
+	}
+	end := []byte(e.Prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return []byte(e.Prefix), end[:i+1]
+		}
+	}
+	// A prefix of 0xff bytes only has no end, read to the end of the keys
+	return []byte(e.Prefix), []byte{0}
+}
+
+// Messages of the etcd gateway, bytes are base64 encoded and 64-bit numbers are strings
+type etcdHeader struct {
+	Revision int64 `json:"revision,string"`
+}
+
+type etcdRangeResponse struct {
+	Header etcdHeader `json:"header"`
+	Kvs    []struct {
+		Key   []byte `json:"key"`
+		Value []byte `json:"value"`
+	} `json:"kvs"`
+}
+
+type etcdWatchResponse struct {
+	Result struct {
+		Header          etcdHeader        `json:"header"`
+		Created         bool              `json:"created"`
+		Canceled        bool              `json:"canceled"`
+		CompactRevision int64             `json:"compact_revision,string"`
+		Events          []json.RawMessage `json:"events"`
+	} `json:"result"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Call an endpoint of the gateway, the answer is left to read in the body
+func (e Etcd) call(ctx context.Context, token string, path string, request interface{}) (*http.Response, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(e.Endpoint, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("etcd answered %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// Get a token for the user, none without a user
+func (e Etcd) authenticate(ctx context.Context) (string, error) {
+	if e.Username == "" {
+		return "", nil
+	}
+	password := e.Password
+	if password == "" {
+		password = os.Getenv("ETCD_PASSWORD")
+	}
+	resp, err := e.call(ctx, "", "/v3/auth/authenticate", map[string]string{"name": e.Username, "password": password})
+	if err != nil {
+		return "", fmt.Errorf("error authenticating to etcd: %w", err)
+	}
+	defer resp.Body.Close()
+	var auth struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&auth); err != nil {
+		return "", fmt.Errorf("error authenticating to etcd: %w", err)
+	}
+	return auth.Token, nil
+}
+
+// Wait for a change of the keys after the revision, false when there was none within remoteWait
+func (e Etcd) watch(ctx context.Context, token string, revision uint64) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, remoteWait)
+	defer cancel()
+	key, end := e.keyRange()
+	create := map[string]interface{}{"key": key, "start_revision": strconv.FormatUint(revision+1, 10)}
+	if end != nil {
+		create["range_end"] = end
+	}
+	resp, err := e.call(ctx, token, "/v3/watch", map[string]interface{}{"create_request": create})
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var w etcdWatchResponse
+		if err := decoder.Decode(&w); err != nil {
+			if errors.Is(err, context.DeadlineExceeded) || ctx.Err() != nil {
+				return false, nil
+			}
+			return false, err
+		}
+		switch {
+		case w.Error != nil:
+			return false, fmt.Errorf("etcd watch failed: %s", w.Error.Message)
+		case len(w.Result.Events) > 0:
+			return true, nil
+		case w.Result.CompactRevision > 0:
+			// The changes since the revision were compacted away, read the keys again
+			return true, nil
+		case w.Result.Canceled:
+			return false, fmt.Errorf("etcd canceled the watch")
+		}
+	}
+}
+
+// Read the keys as host files. With a revision the keys are watched until they change past it,
+// the revision of the answer is returned for the next watch.
+func (e Etcd) fetch(ctx context.Context, revision uint64) ([]configFile, uint64, error) {
+	token, err := e.authenticate(ctx)
+	if err != nil {
+		return nil, revision, err
+	}
+	if revision > 0 {
+		changed, err := e.watch(ctx, token, revision)
+		if err != nil || !changed {
+			return nil, revision, err
+		}
+	}
+	key, end := e.keyRange()
+	request := map[string]interface{}{"key": key}
+	if end != nil {
+		request["range_end"] = end
+	}
+	ctx, cancel := context.WithTimeout(ctx, remoteRetry)
+	defer cancel()
+	resp, err := e.call(ctx, token, "/v3/kv/range", request)
+	if err != nil {
+		return nil, revision, err
+	}
+	defer resp.Body.Close()
+	var r etcdRangeResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, revision, fmt.Errorf("error decoding the etcd keys: %w", err)
+	}
+	var files []configFile
+	for _, kv := range r.Kvs {
+		if len(bytes.TrimSpace(kv.Value)) == 0 {
+			continue
+		}
+		files = append(files, configFile{name: "etcd:" + string(kv.Key), data: kv.Value, hostsOnly: true})
+	}
+	return files, uint64(r.Header.Revision), nil
+}
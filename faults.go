@@ -0,0 +1,167 @@
+package sidebreaker
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Faults struct for the configuration, failures injected into the calls to a host so the
+// applications can be tested against the failures the sidebreaker surfaces
+type Faults struct {
+	Delay        Duration `json:"delay" doc:"Milliseconds waited before dialing the host, the wait counts in the timeout of the call" example:"2000"`
+	DelayPercent float64  `json:"delayPercent" doc:"Percentage of the calls delayed, all when not set" example:"10"`
+	ErrorPercent float64  `json:"errorPercent" doc:"Percentage of the calls answered with an error instead of dialing the host" example:"5"`
+	Error        string   `json:"error" doc:"Error answered: unavailable (503 as an open breaker), timeout (504) or unreachable (500), unavailable when not set" example:"unavailable"`
+}
+
+// Errors the faults can answer with
+const (
+	faultUnavailable = "unavailable"
+	faultTimeout     = "timeout"
+	faultUnreachable = "unreachable"
+)
+
+func (f Faults) validate() error {
+	if f.Delay < 0 {
+		return fmt.Errorf("delay must not be negative, got %s", f.Delay)
+	}
+	if f.DelayPercent < 0 || f.DelayPercent > 100 || f.ErrorPercent < 0 || f.ErrorPercent > 100 {
+		return fmt.Errorf("percentages must be between 0 and 100")
+	}
+	switch f.Error {
+	case "", faultUnavailable, faultTimeout, faultUnreachable:
+		return nil
+	}
+	return fmt.Errorf("error must be unavailable, timeout or unreachable, got %q", f.Error)
+}
+
+// Faults injected by host, as api.example.com.delay and api.example.com.error
+var injectedFaults = expvar.NewMap("injectedFaults")
+
+// Faults set with the admin API by host, they replace the faults of the configuration until the
+// next restart
+var (
+	faultOverrides   = map[string]Faults{}
+	faultOverridesMu sync.Mutex
+)
+
+// The faults of a host, the ones of the admin API before the configured ones
+func faultsFor(host string, configured Faults) Faults {
+	faultOverridesMu.Lock()
+	defer faultOverridesMu.Unlock()
+	if f, ok := faultOverrides[host]; ok {
+		return f
+	}
+	return configured
+}
+
+// Pick the fault of a call to the host: the error it is answered with, empty to dial the host,
+// and the delay before dialing
+func (f Faults) pick(host string) (string, time.Duration) {
+	if f.ErrorPercent > 0 && rand.Float64()*100 < f.ErrorPercent {
+		injectedFaults.Add(host+".error", 1)
+		if f.Error == "" {
+			return faultUnavailable, 0
+		}
+		return f.Error, 0
+	}
+	if f.Delay > 0 && (f.DelayPercent == 0 || rand.Float64()*100 < f.DelayPercent) {
+		injectedFaults.Add(host+".delay", 1)
+		return "", f.Delay.Duration()
+	}
+	return "", 0
+}
+
+// The status, text and access log outcome of an injected error, as the sidebreaker answers the
+// real failures
+func faultAnswer(fault string) (int, string, string) {
+	switch fault {
+	case faultTimeout:
+		return http.StatusGatewayTimeout, "Gateway Timeout", outcomeTimeout
+	case faultUnreachable:
+		return http.StatusInternalServerError, "Cannot reach destination", outcomeError
+	}
+	return http.StatusServiceUnavailable, "Cannot reach destination", outcomeRejected
+}
+
+// Wait for an injected delay, or until ctx ends so the call fails as it times out
+func faultDelay(ctx context.Context, delay time.Duration) {
+	if delay == 0 {
+		return
+	}
+	timelineFrom(ctx).add("fault delay", "delay_ms", delay.Milliseconds())
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// Body of the fault endpoint, the faults of a host
+type faultsBody struct {
+	Host string `json:"host"`
+	Faults
+}
+
+// Get the faults set with the admin API, set the faults of a host with PUT and remove them with
+// DELETE ?host= so the configured ones apply again
+func faultsHandler(s *Sidebreaker) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			body := faultsBody{}
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if body.Host == "" {
+				http.Error(w, "host is required", http.StatusBadRequest)
+				return
+			}
+			body.Host = canonicalHost(body.Host)
+			if err := body.Faults.validate(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			faultOverridesMu.Lock()
+			faultOverrides[body.Host] = body.Faults
+			faultOverridesMu.Unlock()
+			logger.Info("Faults changed", "host", body.Host, "delay", body.Delay.String(), "delay_percent", body.DelayPercent, "error_percent", body.ErrorPercent, "error", body.Error)
+			detail, _ := json.Marshal(body.Faults)
+			s.audit(req, "faults", body.Host, string(detail))
+		case http.MethodDelete:
+			host := canonicalHost(req.URL.Query().Get("host"))
+			if host == "" {
+				http.Error(w, "host is required", http.StatusBadRequest)
+				return
+			}
+			faultOverridesMu.Lock()
+			delete(faultOverrides, host)
+			faultOverridesMu.Unlock()
+			logger.Info("Faults reset to the configuration", "host", host)
+			s.audit(req, "faults", host, "reset")
+		default:
+			w.Header().Set("Allow", "GET, PUT, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		faultOverridesMu.Lock()
+		list := make([]faultsBody, 0, len(faultOverrides))
+		for host, f := range faultOverrides {
+			list = append(list, faultsBody{Host: host, Faults: f})
+		}
+		faultOverridesMu.Unlock()
+		sort.Slice(list, func(i, j int) bool { return list[i].Host < list[j].Host })
+		w.Header().Set("Content-Type", "application/json")
+		writeJSON(w, list)
+	}
+}
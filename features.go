@@ -0,0 +1,45 @@
+package sidebreaker
+
+import (
+	"expvar"
+	"math/rand"
+	"strings"
+)
+
+// Features struct for the configuration, rolls features of the hosts out to part of the connections.
+// A feature without a flag is on wherever it is configured, with a flag it is only on for the
+// percentage of connections and the hosts of the flag.
+type Features struct {
+	Mitm             *FeatureFlag `json:"mitm" doc:"Decrypt the CONNECT calls of hosts with mitm"`
+	LatencyInjection *FeatureFlag `json:"latencyInjection" doc:"Inject latency into the calls of hosts with latencyInjection"`
+	Protocol         *FeatureFlag `json:"protocol" doc:"Inspect the tunnels of hosts with a protocol"`
+}
+
+// FeatureFlag struct for the rollout of a feature
+type FeatureFlag struct {
+	Percent float64  `json:"percent" doc:"Percentage of connections the feature is on for, 0 turns it off" example:"10"`
+	Hosts   []string `json:"hosts" doc:"Hosts the feature is always on for, whatever the percentage" example:"api.example.com"`
+}
+
+// Connections a feature was turned on and off for
+var featureDecisions = expvar.NewMap("featureDecisions")
+
+// Test wether the feature is on for a connection to the host, hosts with a path prefix
+// share the flag of their host
+func (f *FeatureFlag) enabled(name string, host string) bool {
+	if f == nil {
+		return true
+	}
+	on := rand.Float64()*100 < f.Percent
+	for _, h := range f.Hosts {
+		if host == canonicalHost(h) || strings.HasPrefix(host, h+"/") {
+			on = true
+		}
+	}
+	if on {
+		featureDecisions.Add(name+".on", 1)
+	} else {
+		featureDecisions.Add(name+".off", 1)
+	}
+	return on
+}
@@ -0,0 +1,186 @@
+package sidebreaker
+
+import (
+	"flag"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ConfigFlags are the command line flags of the settings of the configuration, one per field named
+// by its path in the file such as -admin.listen, generated from the configuration structs like the
+// configuration reference. Lists are given separated by commas. Lists of objects, such as the hosts,
+// only come from the files.
+type ConfigFlags struct {
+	set []configFlag
+}
+
+// configFlag is a setting given on the command line, in the order of the command line
+type configFlag struct {
+	path  []string
+	value string
+}
+
+// flagValue records the settings of a field given on the command line, they are applied to the
+// configuration once it is loaded
+type flagValue struct {
+	flags  *ConfigFlags
+	path   []string
+	isBool bool
+}
+
+func (v *flagValue) String() string {
+	return ""
+}
+
+func (v *flagValue) Set(value string) error {
+	v.flags.set = append(v.flags.set, configFlag{path: v.path, value: value})
+	return nil
+}
+
+func (v *flagValue) IsBoolFlag() bool {
+	return v.isBool
+}
+
+// RegisterConfigFlags adds a flag for each setting of the configuration to a flag set
+func RegisterConfigFlags(fs *flag.FlagSet) *ConfigFlags {
+	flags := &ConfigFlags{}
+	flags.register(fs, reflect.TypeOf(Configuration{}), nil)
+	return flags
+}
+
+func (c *ConfigFlags) register(fs *flag.FlagSet, t reflect.Type, prefix []string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		path := append(append([]string{}, prefix...), jsonName(f))
+		ft := f.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		switch {
+		case ft.Kind() == reflect.Struct:
+			c.register(fs, ft, path)
+		case ft.Kind() == reflect.Slice && !scalarKind(ft.Elem().Kind()):
+		case ft.Kind() == reflect.Slice || scalarKind(ft.Kind()):
+			usage := f.Tag.Get("doc")
+			if ft.Kind() == reflect.Slice {
+				usage += ", separated by commas"
+			}
+			fs.Var(&flagValue{flags: c, path: path, isBool: ft.Kind() == reflect.Bool}, strings.Join(path, "."), usage)
+		}
+	}
+}
+
+func scalarKind(k reflect.Kind) bool {
+	switch k {
+	case reflect.String, reflect.Bool, reflect.Int, reflect.Int64, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// Load reads a configuration file like LoadConfig with the settings given on the command line over
+// the ones of its files, and validates it once they are set. Nil flags load the file alone.
+func (c *ConfigFlags) Load(path string) (Configuration, error) {
+	return loadConfig(path, c)
+}
+
+// Test wether a field is set on the command line
+func (c *ConfigFlags) sets(field string) bool {
+	if c == nil {
+		return false
+	}
+	for _, f := range c.set {
+		if strings.Join(f.path, ".") == field {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply sets the settings given on the command line in a configuration, over the ones of its files.
+// The configuration isn't validated again, see Load.
+func (c *ConfigFlags) Apply(configuration *Configuration) error {
+	var errs ConfigErrors
+	for _, f := range c.set {
+		if err := setField(reflect.ValueOf(configuration).Elem(), f.path, f.value); err != nil {
+			errs = append(errs, ConfigError{Field: strings.Join(f.path, "."), Msg: err.Error()})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Set the field at a path of a struct from its flag
+func setField(v reflect.Value, path []string, value string) error {
+	for _, name := range path {
+		if v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			if jsonName(t.Field(i)) == name {
+				v = v.Field(i)
+				break
+			}
+		}
+	}
+	if v.Kind() != reflect.Slice {
+		return setScalar(v, value)
+	}
+	list := reflect.MakeSlice(v.Type(), 0, 0)
+	if value != "" {
+		for _, item := range strings.Split(value, ",") {
+			e := reflect.New(v.Type().Elem()).Elem()
+			if err := setScalar(e, strings.TrimSpace(item)); err != nil {
+				return err
+			}
+			list = reflect.Append(list, e)
+		}
+	}
+	v.Set(list)
+	return nil
+}
+
+func setScalar(v reflect.Value, value string) error {
+	if v.Type() == reflect.TypeOf(Duration(0)) {
+		d, err := parseDuration(value)
+		if ms, convErr := strconv.ParseInt(value, 10, 64); convErr == nil {
+			d, err = Duration(ms), nil
+		}
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("expected true or false, got %q", value)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("expected an integer, got %q", value)
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("expected a number, got %q", value)
+		}
+		v.SetFloat(n)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package sidebreaker
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Test wether the flags are set before the configuration is validated, and their problems aren't
+// positioned in the file
+func TestConfigFlagsLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	os.WriteFile(path, []byte(`{
+  "port": 70000,
+  "hosts": [{"host": "api.example.com", "breakType": "consecutive", "threshold": 2, "timeout": 1000}]
+}`), 0o600)
+	tests := []struct {
+		name  string
+		args  []string
+		field string
+		line  int
+	}{
+		{"invalid file", nil, "port", 2},
+		{"fixed by a flag", []string{"-port", "8080"}, "", 0},
+		{"broken by a flag", []string{"-port", "8080", "-statusPort", "8080"}, "statusPort", 0},
+		{"flag of the wrong type", []string{"-port", "proxy"}, "port", 0},
+	}
+	for _, test := range tests {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		flags := RegisterConfigFlags(fs)
+		if err := fs.Parse(test.args); err != nil {
+			t.Fatal(err)
+		}
+		configuration, err := flags.Load(path)
+		if test.field == "" {
+			if err != nil || configuration.Port != 8080 {
+				t.Errorf("%s: expected the port of the flag, got %d %v", test.name, configuration.Port, err)
+			}
+			continue
+		}
+		var errs ConfigErrors
+		if !errors.As(err, &errs) || len(errs) != 1 {
+			t.Errorf("%s: expected an error of %s, got %v", test.name, test.field, err)
+			continue
+		}
+		if errs[0].Field != test.field || errs[0].Line != test.line {
+			t.Errorf("%s: expected %s at line %d, got %s at line %d", test.name, test.field, test.line, errs[0].Field, errs[0].Line)
+		}
+	}
+
+	var none *ConfigFlags
+	if _, err := none.Load(path); err == nil {
+		t.Error("expected the file alone to be invalid")
+	}
+}
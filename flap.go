@@ -0,0 +1,82 @@
+package sidebreaker
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+// Number of times each host's breaker was detected flapping
+var flapCount = expvar.NewMap("breakerFlaps")
+
+// FlapDamping struct for the configuration, breakers that open more than Threshold times
+// within Window milliseconds are held open for an extra Duration milliseconds
+type FlapDamping struct {
+	Window    Duration `json:"window" doc:"Window in milliseconds in which breaker opens are counted" example:"300000"`
+	Threshold int      `json:"threshold" doc:"Opens within the window that make a breaker flapping" example:"3"`
+	Duration  Duration `json:"duration" doc:"Milliseconds a flapping breaker is held open" example:"60000"`
+}
+
+// flapDamper tracks how often a breaker opens and holds it open while it keeps oscillating.
+// Flapping breakers are worse for clients than a breaker that stays open.
+type flapDamper struct {
+	config FlapDamping
+
+	mu          sync.Mutex
+	trips       []time.Time
+	dampedUntil time.Time
+}
+
+func newFlapDamper(config FlapDamping) *flapDamper {
+	return &flapDamper{config: config}
+}
+
+// Trip records the breaker opening. If the breaker is flapping it returns how long it will be
+// held open, every extra open inside the window extends the hold further.
+func (f *flapDamper) Trip(now time.Time) (time.Duration, bool) {
+	if f.config.Threshold <= 0 {
+		return 0, false
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Forget the opens that fell out of the window
+	window := f.config.Window.Duration()
+	recent := f.trips[:0]
+	for _, t := range f.trips {
+		if now.Sub(t) < window {
+			recent = append(recent, t)
+		}
+	}
+	f.trips = append(recent, now)
+
+	if len(f.trips) < f.config.Threshold {
+		return 0, false
+	}
+	hold := f.config.Duration.Duration() * time.Duration(len(f.trips)-f.config.Threshold+1)
+	f.dampedUntil = now.Add(hold)
+	return hold, true
+}
+
+// When the breaker is held open until, in the past when it isn't
+func (f *flapDamper) until() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.dampedUntil
+}
+
+// Damped reports whether the breaker is being held open
+func (f *flapDamper) Damped(now time.Time) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return now.Before(f.dampedUntil)
+}
+
+// Forget the opens and stop holding the breaker open, when it is reset by hand
+func (f *flapDamper) reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.trips = nil
+	f.dampedUntil = time.Time{}
+}
@@ -0,0 +1,202 @@
+package sidebreaker
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Control port of ftp hosts that don't list their ports
+const ftpControlPort = 21
+
+// A passive port can be reached for this long after the server announced it
+const ftpPassiveWindow = 30 * time.Second
+
+// Passive data ports announced by ftp servers, by host, with the time they stop being allowed
+var (
+	ftpPassivePorts   = map[string]map[int]time.Time{}
+	ftpPassivePortsMu sync.Mutex
+)
+
+// Allow a CONNECT call to a passive port of a host
+func allowPassivePort(host string, port int) {
+	ftpPassivePortsMu.Lock()
+	defer ftpPassivePortsMu.Unlock()
+	ports, ok := ftpPassivePorts[host]
+	if !ok {
+		ports = map[int]time.Time{}
+		ftpPassivePorts[host] = ports
+	}
+	now := time.Now()
+	for p, until := range ports {
+		if now.After(until) {
+			delete(ports, p)
+		}
+	}
+	ports[port] = now.Add(ftpPassiveWindow)
+}
+
+// Test wether a passive port of a host was announced, each announcement allows a single connection
+func takePassivePort(host string, port int) bool {
+	ftpPassivePortsMu.Lock()
+	defer ftpPassivePortsMu.Unlock()
+	until, ok := ftpPassivePorts[host][port]
+	if !ok {
+		return false
+	}
+	delete(ftpPassivePorts[host], port)
+	return time.Now().Before(until)
+}
+
+// Port of a 227 Entering Passive Mode (h1,h2,h3,h4,p1,p2) or 229 Entering Extended Passive Mode (|||port|) reply
+var (
+	ftpPassiveReply  = regexp.MustCompile(`(\d+),(\d+),(\d+),(\d+),(\d+),(\d+)`)
+	ftpExtendedReply = regexp.MustCompile(`\(\|\|\|(\d+)\|\)`)
+)
+
+func ftpPassivePort(code int, line string) (int, bool) {
+	port := 0
+	switch code {
+	case 227:
+		if m := ftpPassiveReply.FindStringSubmatch(line); m != nil {
+			high, _ := strconv.Atoi(m[5])
+			low, _ := strconv.Atoi(m[6])
+			if high <= 255 && low <= 255 {
+				port = high<<8 | low
+			}
+		}
+	case 229:
+		if m := ftpExtendedReply.FindStringSubmatch(line); m != nil {
+			port, _ = strconv.Atoi(m[1])
+		}
+	}
+	// Ports out of range can't be allowed
+	if port <= 0 || port > 65535 {
+		return 0, false
+	}
+	return port, true
+}
+
+// ftpInspector follows the control connection of an FTP session until it switches to TLS. Passive
+// ports announced by the server are allowed for a data connection, 4xx replies and an error greeting
+// are failures. Control connections have no total timeout, a server that doesn't answer a command
+// is considered dead, except while a transfer runs on the data connection or once encrypted.
+type ftpInspector struct {
+	inspectorState
+	host     string
+	interval time.Duration
+
+	clientLine   []byte
+	serverLine   []byte
+	greeted      bool
+	authTLS      bool
+	encrypted    bool
+	transfer     bool
+	waitingSince time.Time
+}
+
+func newFTPInspector(host Host) *ftpInspector {
+	return &ftpInspector{host: host.Host, interval: heartbeatInterval(host)}
+}
+
+func (m *ftpInspector) fromClient(p []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.waitingSince.IsZero() && !m.transfer {
+		m.waitingSince = time.Now()
+	}
+	for len(p) > 0 && !m.done {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			m.clientLine = append(m.clientLine, p...)
+			if len(m.clientLine) > maxInspectedBytes {
+				m.done = true
+			}
+			return
+		}
+		m.clientLine = append(m.clientLine, p[:i]...)
+		p = p[i+1:]
+		command := strings.ToUpper(strings.TrimSpace(string(m.clientLine)))
+		m.clientLine = m.clientLine[:0]
+		if command == "AUTH TLS" || command == "AUTH SSL" {
+			m.authTLS = true
+		}
+	}
+}
+
+func (m *ftpInspector) fromServer(p []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.waitingSince = time.Time{}
+	for len(p) > 0 && !m.done {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			m.serverLine = append(m.serverLine, p...)
+			if len(m.serverLine) > maxInspectedBytes {
+				m.done = true
+			}
+			return
+		}
+		m.serverLine = append(m.serverLine, p[:i]...)
+		p = p[i+1:]
+		line := strings.TrimRight(string(m.serverLine), "\r")
+		m.serverLine = m.serverLine[:0]
+		m.reply(line)
+	}
+}
+
+// Handle a reply line, multiline replies are handled on their last line
+func (m *ftpInspector) reply(line string) {
+	if len(line) < 3 || (len(line) > 3 && line[3] != ' ') {
+		return
+	}
+	code, err := strconv.Atoi(line[:3])
+	if err != nil {
+		return
+	}
+	greeting := !m.greeted
+	m.greeted = true
+	if m.err == nil && code >= 400 && (code < 500 || greeting) {
+		m.err = fmt.Errorf("ftp %s", line)
+	}
+
+	// A transfer runs between the preliminary reply and the final one
+	m.transfer = code >= 100 && code < 200
+	if port, ok := ftpPassivePort(code, line); ok {
+		allowPassivePort(m.host, port)
+	}
+	if m.authTLS {
+		// Once the server accepts, the rest of the control connection is encrypted
+		m.encrypted = code == 234
+		m.done = m.encrypted
+		m.authTLS = false
+	}
+}
+
+func (m *ftpInspector) dead(now time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.encrypted && !m.waitingSince.IsZero() && now.Sub(m.waitingSince) > m.interval {
+		m.err = fmt.Errorf("ftp server left a command unanswered for %s", now.Sub(m.waitingSince).Round(time.Second))
+		return true
+	}
+	return false
+}
+
+// ftpDataInspector is used for the data connections of ftp hosts, it sees nothing but
+// gives the connection no total timeout since a transfer can take as long as it needs
+type ftpDataInspector struct {
+	inspectorState
+}
+
+func (m *ftpDataInspector) fromClient(p []byte) {}
+
+func (m *ftpDataInspector) fromServer(p []byte) {}
+
+func (m *ftpDataInspector) dead(now time.Time) bool {
+	return false
+}
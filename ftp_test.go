@@ -0,0 +1,109 @@
+package sidebreaker
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Test wether the data ports are read from PASV and EPSV replies, and nothing from other replies
+func TestFTPPassivePort(t *testing.T) {
+	tests := []struct {
+		code     int
+		line     string
+		expected int
+		ok       bool
+	}{
+		{227, "227 Entering Passive Mode (192,0,2,1,195,80).", 50000, true},
+		{227, "227 Entering Passive Mode 192,0,2,1,195,81", 50001, true},
+		{229, "229 Entering Extended Passive Mode (|||50002|)", 50002, true},
+		{227, "227 Entering Passive Mode", 0, false},
+		{229, "229 Entering Extended Passive Mode (|1|192.0.2.1|50003|)", 0, false},
+		{229, "229 Entering Extended Passive Mode (|||99999999999999999999|)", 0, false},
+		{229, "229 Entering Extended Passive Mode (|||70000|)", 0, false},
+		{227, "227 Entering Passive Mode (192,0,2,1,300,80)", 0, false},
+		{227, "227 Entering Passive Mode (192,0,2,1,0,0)", 0, false},
+		{200, "200 PORT command successful (192,0,2,1,195,80)", 0, false},
+	}
+	for _, test := range tests {
+		port, ok := ftpPassivePort(test.code, test.line)
+		if port != test.expected || ok != test.ok {
+			t.Errorf("%q: expected %v %v, got %v %v", test.line, test.expected, test.ok, port, ok)
+		}
+	}
+}
+
+// Test wether the passive ports announced on a control connection allow a single data connection, also
+// with replies split over reads, 4xx replies and an error greeting fail the session and nothing is
+// looked at once the control connection switched to TLS
+func TestFTPInspector(t *testing.T) {
+	greeting := "220 ftp.example.com ready\r\n"
+	login := []exchange{serverSends(greeting), clientSends("USER app\r\n"), serverSends("331 Password required\r\n"),
+		clientSends("PASS secret\r\n"), serverSends("230 Logged in\r\n")}
+	tests := []struct {
+		name      string
+		exchanges []exchange
+		// passive ports allowed at the end
+		ports    []int
+		expected string
+	}{
+		{"PASV", append(login, clientSends("PASV\r\n"), serverSends("227 Entering Passive Mode (192,0,2,1,195,80)\r\n")), []int{50000}, ""},
+		{"EPSV", append(login, clientSends("EPSV\r\n"), serverSends("229 Entering Extended Passive Mode (|||50001|)\r\n")), []int{50001}, ""},
+		{"multiline", []exchange{serverSends("220-Welcome\r\n227 not a reply (192,0,2,1,195,80)\r\n220 ready\r\n"), clientSends("EPSV\r\n"),
+			serverSends("229 Entering Extended Passive Mode (|||50002|)\r\n")}, []int{50002}, ""},
+		{"greeting refused", []exchange{serverSends("421 Too many connections\r\n")}, nil, "ftp 421 Too many connections"},
+		{"greeting error", []exchange{serverSends("530 Not allowed from your address\r\n")}, nil, "ftp 530 Not allowed from your address"},
+		{"login failed", []exchange{serverSends(greeting), clientSends("USER app\r\n"), serverSends("331 Password required\r\n"),
+			clientSends("PASS wrong\r\n"), serverSends("530 Login incorrect\r\n")}, nil, ""},
+		{"data connection failed", append(login, clientSends("RETR file\r\n"), serverSends("425 Can't open data connection\r\n")), nil, "ftp 425 Can't open data connection"},
+		{"AUTH TLS", []exchange{serverSends(greeting), clientSends("AUTH TLS\r\n"), serverSends("234 Proceed with negotiation\r\n"),
+			serverSends("227 Entering Passive Mode (192,0,2,1,195,83)\r\n421 encrypted\r\n")}, nil, ""},
+		{"AUTH TLS refused", []exchange{serverSends(greeting), clientSends("auth tls\r\n"), serverSends("534 TLS not available\r\n"),
+			clientSends("PASV\r\n"), serverSends("227 Entering Passive Mode (192,0,2,1,195,84)\r\n")}, []int{50004}, ""},
+	}
+	for i, test := range tests {
+		for _, split := range []bool{false, true} {
+			host := fmt.Sprintf("ftp-%d-%v.example.com", i, split)
+			m := newFTPInspector(Host{Host: host})
+			inspectTunnel(m, test.exchanges, split)
+			if got := inspectorErr(m); got != test.expected {
+				t.Errorf("%s (split %v): expected %q, got %q", test.name, split, test.expected, got)
+			}
+			for _, port := range test.ports {
+				if !takePassivePort(host, port) {
+					t.Errorf("%s (split %v): expected port %d allowed", test.name, split, port)
+				}
+				if takePassivePort(host, port) {
+					t.Errorf("%s (split %v): expected port %d allowed once", test.name, split, port)
+				}
+			}
+			for _, port := range []int{50003, 50004, 21} {
+				if takePassivePort(host, port) {
+					t.Errorf("%s (split %v): expected port %d not allowed", test.name, split, port)
+				}
+			}
+		}
+	}
+}
+
+// Test wether a server leaving a command unanswered is dead, except during a transfer or once encrypted
+func TestFTPInspectorDead(t *testing.T) {
+	tests := []struct {
+		name      string
+		exchanges []exchange
+		dead      bool
+	}{
+		{"answered", []exchange{serverSends("220 ready\r\n"), clientSends("NOOP\r\n"), serverSends("200 OK\r\n")}, false},
+		{"unanswered", []exchange{serverSends("220 ready\r\n"), clientSends("NOOP\r\n")}, true},
+		{"transfer", []exchange{serverSends("220 ready\r\n"), clientSends("RETR file\r\n"), serverSends("150 Opening data connection\r\n"), clientSends("NOOP\r\n")}, false},
+		{"transfer complete", []exchange{serverSends("220 ready\r\n"), clientSends("RETR file\r\n"), serverSends("150 Opening data connection\r\n226 Transfer complete\r\n"), clientSends("NOOP\r\n")}, true},
+		{"encrypted", []exchange{serverSends("220 ready\r\n"), clientSends("AUTH TLS\r\n"), serverSends("234 Proceed\r\n"), clientSends("\x16\x03\x01")}, false},
+	}
+	for _, test := range tests {
+		m := newFTPInspector(Host{Host: "ftp.example.com", Heartbeat: 5000})
+		inspectTunnel(m, test.exchanges, false)
+		if dead := m.dead(time.Now().Add(6 * time.Second)); dead != test.dead {
+			t.Errorf("%s: expected dead %v, got %v", test.name, test.dead, dead)
+		}
+	}
+}
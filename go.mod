@@ -1,10 +1,26 @@
 module github.com/ifuyivara/sidebreaker
 
-go 1.15
+go 1.21
 
 require (
-	github.com/cenk/backoff v2.2.1+incompatible // indirect
+	github.com/cenk/backoff v2.2.1+incompatible
 	github.com/elazarl/goproxy v0.0.0-20190911111923-ecfe977594f1
-	github.com/facebookgo/clock v0.0.0-20150410010913-600d898af40a // indirect
+	github.com/facebookgo/clock v0.0.0-20150410010913-600d898af40a
 	github.com/rubyist/circuitbreaker v2.2.1+incompatible
+	golang.org/x/net v0.23.0
+	golang.org/x/sys v0.22.0
+	gopkg.in/yaml.v3 v3.0.1
+	modernc.org/sqlite v1.34.5
+)
+
+require (
+	github.com/dustin/go-humanize v1.0.1 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/mattn/go-isatty v0.0.20 // indirect
+	github.com/ncruces/go-strftime v0.1.9 // indirect
+	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
+	golang.org/x/text v0.14.0 // indirect
+	modernc.org/libc v1.55.3 // indirect
+	modernc.org/mathutil v1.6.0 // indirect
+	modernc.org/memory v1.8.0 // indirect
 )
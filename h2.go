@@ -0,0 +1,345 @@
+package sidebreaker
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"expvar"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+	"sync/atomic"
+
+	"github.com/elazarl/goproxy"
+	"golang.org/x/net/http2"
+)
+
+// Requests and connections served without goproxy, from the passthroughs, the reverse proxy and
+// MITM, get negative request ids apart from the ids of the proxy
+var ownSessions int64
+
+func ownSession() int64 {
+	return atomic.AddInt64(&ownSessions, -1)
+}
+
+// Transport of the hosts with h2c, HTTP/2 without TLS as gRPC services often serve it
+func newH2C(dial func(ctx context.Context, network, addr string) (net.Conn, error)) *http2.Transport {
+	t := &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return dial(ctx, network, addr)
+		},
+	}
+	t.ConnPool = newH2Pool(&h2cConns{t: t, conns: map[string][]*http2.ClientConn{}})
+	return t
+}
+
+// Call the upstreams offering HTTP/2 with the transport of golang.org/x/net rather than the one
+// bundled in net/http, so the health of each connection is followed
+func setupH2(tr *http.Transport) (*http2.Transport, error) {
+	t2, err := http2.ConfigureTransports(tr)
+	if err != nil {
+		return nil, err
+	}
+	t2.ConnPool = newH2Pool(t2.ConnPool)
+	return t2, nil
+}
+
+// Close the HTTP/2 connections of a transport that carry no streams
+func closeIdleH2(t *http2.Transport) {
+	if p, ok := t.ConnPool.(*h2Pool); ok {
+		p.closeIdle()
+	}
+}
+
+// Upstream HTTP/2 connections, by host: streams reset by the upstream, GOAWAYs received, connections
+// that failed with their streams in flight and connections retired for resetting too many streams,
+// as api.example.com.resets
+var h2Connections = expvar.NewMap("h2Connections")
+
+// Connections whose upstream reset this many streams, and more than half of the streams they
+// carried, take no new streams
+const h2ResetLimit = 10
+
+// h2Conn follows the health of an upstream HTTP/2 connection
+type h2Conn struct {
+	cc      *http2.ClientConn
+	host    string
+	streams atomic.Int64
+	resets  atomic.Int64
+	retired atomic.Bool
+	goAway  atomic.Bool
+	// Set by the first stream failing with the connection, the others don't count
+	failed atomic.Bool
+}
+
+// A stream of the connection was reset by the upstream, the connection is retired when it resets
+// too many of them: the calls in flight finish and new calls go to a new connection
+func (c *h2Conn) reset() {
+	h2Connections.Add(c.host+".resets", 1)
+	resets := c.resets.Add(1)
+	if resets < h2ResetLimit || resets*2 <= c.streams.Load() || !c.retired.CompareAndSwap(false, true) {
+		return
+	}
+	c.cc.SetDoNotReuse()
+	h2Connections.Add(c.host+".retired", 1)
+	logger.Warn("Upstream resets too many HTTP/2 streams, retiring the connection", "host", c.host, "resets", resets, "streams", c.streams.Load())
+}
+
+// h2Pool wraps the connection pool of an HTTP/2 transport to follow the connections it hands out
+type h2Pool struct {
+	http2.ClientConnPool
+	mu    sync.Mutex
+	conns map[*http2.ClientConn]*h2Conn
+}
+
+func newH2Pool(pool http2.ClientConnPool) *h2Pool {
+	return &h2Pool{ClientConnPool: pool, conns: map[*http2.ClientConn]*h2Conn{}}
+}
+
+func (p *h2Pool) GetClientConn(req *http.Request, addr string) (*http2.ClientConn, error) {
+	cc, err := p.ClientConnPool.GetClientConn(req, addr)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	c, ok := p.conns[cc]
+	if !ok {
+		host, _, _ := net.SplitHostPort(addr)
+		c = &h2Conn{cc: cc, host: host}
+		p.conns[cc] = c
+	}
+	p.mu.Unlock()
+	c.streams.Add(1)
+	if call, ok := req.Context().Value(h2CallKey{}).(*h2Call); ok {
+		call.conn.Store(c)
+	}
+	return cc, nil
+}
+
+func (p *h2Pool) MarkDead(cc *http2.ClientConn) {
+	p.mu.Lock()
+	delete(p.conns, cc)
+	p.mu.Unlock()
+	p.ClientConnPool.MarkDead(cc)
+}
+
+func (p *h2Pool) closeIdle() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for cc := range p.conns {
+		if cc.State().StreamsActive == 0 {
+			cc.Close()
+		}
+	}
+}
+
+// h2cConns dials the h2c connections of the hosts, and reuses them while they take new streams
+type h2cConns struct {
+	t     *http2.Transport
+	mu    sync.Mutex
+	conns map[string][]*http2.ClientConn
+}
+
+func (p *h2cConns) GetClientConn(req *http.Request, addr string) (*http2.ClientConn, error) {
+	p.mu.Lock()
+	for _, cc := range p.conns[addr] {
+		if cc.CanTakeNewRequest() {
+			p.mu.Unlock()
+			return cc, nil
+		}
+	}
+	p.mu.Unlock()
+	conn, err := p.t.DialTLSContext(req.Context(), "tcp", addr, nil)
+	if err != nil {
+		return nil, err
+	}
+	cc, err := p.t.NewClientConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	p.mu.Lock()
+	p.conns[addr] = append(p.conns[addr], cc)
+	p.mu.Unlock()
+	return cc, nil
+}
+
+func (p *h2cConns) MarkDead(cc *http2.ClientConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for addr, conns := range p.conns {
+		for i, c := range conns {
+			if c == cc {
+				p.conns[addr] = append(conns[:i:i], conns[i+1:]...)
+				if len(p.conns[addr]) == 0 {
+					delete(p.conns, addr)
+				}
+				return
+			}
+		}
+	}
+}
+
+type h2CallKey struct{}
+
+// h2Call is the HTTP/2 connection a call went over, once the transport picked it
+type h2Call struct {
+	conn atomic.Pointer[h2Conn]
+}
+
+// Context following the HTTP/2 connection of a call
+func withH2Call(ctx context.Context) (context.Context, *h2Call) {
+	call := &h2Call{}
+	return context.WithValue(ctx, h2CallKey{}, call), call
+}
+
+// Whether a failed call counts for the breakers of the host, with the reason when it doesn't. A
+// stream reset by the upstream fails its own call only. When the connection fails, after a GOAWAY
+// or because it broke, its streams in flight fail with it and the failure counts once. Calls cut
+// by a graceful GOAWAY, an upstream restarting, don't count. The streams the upstream never
+// processed are retried by the transport on a new connection.
+func (c *h2Call) counts(err error) (bool, string) {
+	conn := c.conn.Load()
+	if conn == nil {
+		return true, ""
+	}
+	var streamErr http2.StreamError
+	if errors.As(err, &streamErr) {
+		conn.reset()
+		return true, ""
+	}
+	var goAway http2.GoAwayError
+	isGoAway := errors.As(err, &goAway)
+	if isGoAway && conn.goAway.CompareAndSwap(false, true) {
+		h2Connections.Add(conn.host+".goaway", 1)
+	}
+	switch {
+	case isGoAway && goAway.ErrCode == http2.ErrCodeNo:
+		return false, "goaway"
+	case !isGoAway && !conn.cc.State().Closed:
+		// The call failed on its own, e.g. it timed out
+		return true, ""
+	}
+	if conn.failed.CompareAndSwap(false, true) {
+		h2Connections.Add(conn.host+".failed", 1)
+		return true, ""
+	}
+	return false, "h2 connection"
+}
+
+// breakerTransport sends the requests of the reverse proxy and MITM through the breakers like the
+// plain HTTP requests of the proxy, hosts that aren't configured are called without a breaker
+type breakerTransport struct {
+	hosts  *hostTable
+	handle func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response)
+	tr     http.RoundTripper
+}
+
+func newBreakerTransport(s *Sidebreaker, tr http.RoundTripper) *breakerTransport {
+	return &breakerTransport{hosts: s.hosts, handle: s.handleRequest(tr), tr: tr}
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	b, ok := t.hosts.get(req.URL.Hostname())
+	if !ok {
+		return t.tr.RoundTrip(req)
+	}
+	if b.Host.Mirror.enabled() {
+		req = mirror(req, b.Host, t.tr)
+	}
+	ctx := &goproxy.ProxyCtx{Req: req, Session: ownSession()}
+	req, resp := t.handle(req, ctx)
+	if resp != nil {
+		return resp, nil
+	}
+	return ctx.RoundTripper.RoundTrip(req, ctx)
+}
+
+// Proxy the requests the rewrite sends upstream. Unlike the responses of the proxy, streamed
+// responses are flushed as they come and trailers are passed on, so gRPC works through it.
+func streamingProxy(transport http.RoundTripper, rewrite func(*httputil.ProxyRequest)) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite:   rewrite,
+		Transport: transport,
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			logger.Warn("Error proxying request", "host", req.URL.Host, "error", err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+}
+
+// Decrypt the CONNECT calls of MITM hosts and serve their requests over HTTP/2 or HTTP/1.1, as the
+// client prefers. Each request goes through the breakers of the host.
+func handleMitm(ca *certAuthority, transport http.RoundTripper) func(req *http.Request, client net.Conn, ctx *goproxy.ProxyCtx) {
+	return func(req *http.Request, client net.Conn, ctx *goproxy.ProxyCtx) {
+		config, err := ca.tlsConfig(req.URL.Host)
+		if err != nil {
+			logger.Warn("Error creating the MITM certificate", "host", req.URL.Host, "error", err)
+			client.Close()
+			return
+		}
+		config.NextProtos = []string{"h2", "http/1.1"}
+		// The requests go to the host of the CONNECT whatever their Host header says
+		proxy := streamingProxy(transport, func(pr *httputil.ProxyRequest) {
+			pr.Out.URL.Scheme = "https"
+			pr.Out.URL.Host = req.URL.Host
+		})
+		server := &http.Server{Handler: proxy, ErrorLog: debugLog()}
+		if err := http2.ConfigureServer(server, &http2.Server{}); err != nil {
+			logger.Warn("Error configuring HTTP/2 for MITM", "host", req.URL.Host, "error", err)
+			client.Close()
+			return
+		}
+		newConnListener(tls.Server(client, config)).serve(server)
+	}
+}
+
+// connListener serves a single connection, Accept returns it once and then blocks until the server
+// is done with it. The connection isn't wrapped so the server still sees a TLS connection.
+type connListener struct {
+	conn   net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newConnListener(conn net.Conn) *connListener {
+	return &connListener{conn: conn, closed: make(chan struct{})}
+}
+
+// Serve the connection, until it is closed
+func (l *connListener) serve(server *http.Server) {
+	var done sync.Once
+	server.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed || state == http.StateHijacked {
+			done.Do(func() { close(l.closed) })
+		}
+	}
+	server.Serve(l)
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	l.once.Do(func() { conn = l.conn })
+	if conn != nil {
+		return conn, nil
+	}
+	<-l.closed
+	return nil, net.ErrClosed
+}
+
+func (l *connListener) Close() error {
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// Errors of the servers of the reverse proxy and MITM, such as failed handshakes, logged at debug level
+func debugLog() *log.Logger {
+	return slog.NewLogLogger(logger.Handler(), slog.LevelDebug)
+}
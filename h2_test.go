@@ -0,0 +1,186 @@
+package sidebreaker
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// HTTP/2 test server whose handler resets the streams of the paths starting with /reset
+func newH2Server(t *testing.T) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if len(req.URL.Path) >= 6 && req.URL.Path[:6] == "/reset" {
+			panic(http.ErrAbortHandler)
+		}
+		io.WriteString(w, "ok")
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Transport of the server set up like the one of the proxy
+func newH2Transport(t *testing.T, server *httptest.Server) (*http.Transport, *http2.Transport) {
+	tr := &http.Transport{TLSClientConfig: server.Client().Transport.(*http.Transport).TLSClientConfig.Clone()}
+	t2, err := setupH2(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(tr.CloseIdleConnections)
+	return tr, t2
+}
+
+// Test wether calls know the HTTP/2 connection they went over
+func TestH2CallConnection(t *testing.T) {
+	server := newH2Server(t)
+	tr, _ := newH2Transport(t, server)
+	ctx, call := withH2Call(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("expected HTTP/2, got %s", resp.Proto)
+	}
+	conn := call.conn.Load()
+	if conn == nil {
+		t.Fatal("expected the connection of the call")
+	}
+	if conn.host != "127.0.0.1" || conn.streams.Load() != 1 {
+		t.Errorf("expected 1 stream to 127.0.0.1, got %d to %s", conn.streams.Load(), conn.host)
+	}
+}
+
+// Test wether reset streams fail their own call, and a connection resetting most of its streams is retired
+func TestH2StreamResets(t *testing.T) {
+	server := newH2Server(t)
+	tr, _ := newH2Transport(t, server)
+	var conn *h2Conn
+	for i := 0; i < h2ResetLimit; i++ {
+		ctx, call := withH2Call(context.Background())
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/reset", nil)
+		_, err := tr.RoundTrip(req)
+		var streamErr http2.StreamError
+		if !errors.As(err, &streamErr) {
+			t.Fatalf("expected a stream error, got %v", err)
+		}
+		if counts, _ := call.counts(err); !counts {
+			t.Errorf("expected reset stream %d to count for its call", i)
+		}
+		if conn == nil {
+			conn = call.conn.Load()
+		} else if call.conn.Load() != conn {
+			t.Fatalf("expected the streams to share a connection")
+		}
+		if retired := conn.retired.Load(); retired != (i == h2ResetLimit-1) {
+			t.Errorf("expected retired %v after %d resets, got %v", i == h2ResetLimit-1, i+1, retired)
+		}
+	}
+	if conn.cc.CanTakeNewRequest() {
+		t.Error("expected the retired connection to take no new streams")
+	}
+	// New calls go over a new connection
+	ctx, call := withH2Call(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if call.conn.Load() == conn {
+		t.Error("expected a new connection after retiring")
+	}
+}
+
+// Test wether the streams failing with their connection count once, and graceful GOAWAYs don't count
+func TestH2ConnectionFailures(t *testing.T) {
+	server := newH2Server(t)
+	t2 := &http2.Transport{TLSClientConfig: server.Client().Transport.(*http.Transport).TLSClientConfig}
+	tests := []struct {
+		name     string
+		closed   bool
+		errs     []error
+		expected []bool
+	}{
+		{"timeout on a live connection", false, []error{context.DeadlineExceeded, context.DeadlineExceeded}, []bool{true, true}},
+		{"broken connection", true, []error{io.ErrUnexpectedEOF, io.ErrUnexpectedEOF, io.ErrUnexpectedEOF}, []bool{true, false, false}},
+		{"goaway with an error", true, []error{http2.GoAwayError{ErrCode: http2.ErrCodeInternal}, http2.GoAwayError{ErrCode: http2.ErrCodeInternal}}, []bool{true, false}},
+		{"graceful goaway", true, []error{http2.GoAwayError{ErrCode: http2.ErrCodeNo}, http2.GoAwayError{ErrCode: http2.ErrCodeNo}}, []bool{false, false}},
+		{"graceful goaway wrapped", true, []error{fmt.Errorf("reading the response: %w", http2.GoAwayError{ErrCode: http2.ErrCodeNo})}, []bool{false}},
+		{"goaway in the message only", false, []error{errors.New("http2: Transport received Server's graceful shutdown GOAWAY")}, []bool{true}},
+	}
+	for _, test := range tests {
+		tlsConn, err := tls.Dial("tcp", server.Listener.Addr().String(), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cc, err := t2.NewClientConn(tlsConn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.closed {
+			cc.Close()
+		}
+		conn := &h2Conn{cc: cc, host: "127.0.0.1"}
+		for i, err := range test.errs {
+			call := &h2Call{}
+			call.conn.Store(conn)
+			if counts, _ := call.counts(err); counts != test.expected[i] {
+				t.Errorf("%s: expected call %d to count %v, got %v", test.name, i, test.expected[i], counts)
+			}
+		}
+		cc.Close()
+	}
+}
+
+// Test wether h2c connections are reused while they take new streams, and dropped once dead
+func TestH2CConnections(t *testing.T) {
+	server := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "ok")
+	}), &http2.Server{}))
+	defer server.Close()
+	h2cTransport := newH2C((&net.Dialer{}).DialContext)
+	var conns []*h2Conn
+	for i := 0; i < 2; i++ {
+		ctx, call := withH2Call(context.Background())
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+		resp, err := h2cTransport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		conns = append(conns, call.conn.Load())
+	}
+	if conns[0] == nil || conns[0] != conns[1] {
+		t.Fatalf("expected both calls over the same connection, got %p and %p", conns[0], conns[1])
+	}
+	pool := h2cTransport.ConnPool.(*h2Pool).ClientConnPool.(*h2cConns)
+	pool.MarkDead(conns[0].cc)
+	if len(pool.conns) != 0 {
+		t.Errorf("expected no connection once dead, got %v", pool.conns)
+	}
+	closeIdleH2(h2cTransport)
+	if !conns[0].cc.State().Closed {
+		t.Error("expected the idle connection closed")
+	}
+}
+
+// Test wether calls over no HTTP/2 connection count as they always did
+func TestH2CallWithoutConnection(t *testing.T) {
+	call := &h2Call{}
+	if counts, reason := call.counts(io.ErrUnexpectedEOF); !counts || reason != "" {
+		t.Errorf("expected the call to count, got %v %q", counts, reason)
+	}
+}
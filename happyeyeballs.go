@@ -0,0 +1,120 @@
+package sidebreaker
+
+import (
+	"context"
+	"expvar"
+	"net"
+	"time"
+)
+
+// Wait before the next address is dialed while an attempt is pending, as RFC 8305 recommends
+const defaultHappyEyeballsDelay = 250 * time.Millisecond
+
+// Connections of hosts resolving to both families by the family that connected first, the ipv4
+// count of a host growing while it has IPv6 addresses means its IPv6 is broken
+var happyEyeballs = expvar.NewMap("happyEyeballs")
+
+// The addresses with the families taking turns, starting with the family of the first address. It is
+// false when the addresses are all of one family.
+func interleaveFamilies(addrs []string) ([]string, bool) {
+	var first, other []string
+	firstV4 := isIPv4(addrs[0])
+	for _, a := range addrs {
+		if isIPv4(a) == firstV4 {
+			first = append(first, a)
+		} else {
+			other = append(other, a)
+		}
+	}
+	if len(other) == 0 {
+		return addrs, false
+	}
+	interleaved := make([]string, 0, len(addrs))
+	for i := 0; i < len(first) || i < len(other); i++ {
+		if i < len(first) {
+			interleaved = append(interleaved, first[i])
+		}
+		if i < len(other) {
+			interleaved = append(interleaved, other[i])
+		}
+	}
+	return interleaved, true
+}
+
+func isIPv4(addr string) bool {
+	ip := net.ParseIP(addr)
+	return ip == nil || ip.To4() != nil
+}
+
+// Dial the addresses as RFC 8305 describes: an attempt starts once the previous one failed or has
+// been pending for delay, the first connection wins and the other attempts are canceled. A host
+// with a broken family connects on the other one after delay instead of its connect timeout.
+func dialRacing(ctx context.Context, host string, addrs []string, delay time.Duration, dial func(context.Context, string) (net.Conn, error)) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		conn net.Conn
+		err  error
+		addr string
+	}
+	// Attempts never block on sending, the ones still pending when a connection wins are closed
+	results := make(chan result, len(addrs))
+	next, pending := 0, 0
+	start := func() {
+		a := addrs[next]
+		next++
+		pending++
+		go func() {
+			conn, err := dial(ctx, a)
+			results <- result{conn: conn, err: err, addr: a}
+		}()
+	}
+	stagger := time.NewTimer(delay)
+	defer stagger.Stop()
+	restart := func() {
+		if !stagger.Stop() {
+			select {
+			case <-stagger.C:
+			default:
+			}
+		}
+		stagger.Reset(delay)
+	}
+
+	start()
+	var firstErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				family := "ipv6"
+				if isIPv4(r.addr) {
+					family = "ipv4"
+				}
+				happyEyeballs.Add(host+"."+family, 1)
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(addrs) && ctx.Err() == nil {
+				start()
+				restart()
+			}
+		case <-stagger.C:
+			if next < len(addrs) {
+				start()
+				stagger.Reset(delay)
+			}
+		}
+	}
+	return nil, firstErr
+}
@@ -0,0 +1,51 @@
+package sidebreaker
+
+import (
+	"fmt"
+	"os"
+)
+
+// RunAs struct for the configuration of the privileges the sidebreaker runs with
+type RunAs struct {
+	User      string `json:"user" doc:"User to switch to once the ports are bound, by name or uid, the sidebreaker keeps its user when not set" example:"nobody"`
+	Group     string `json:"group" doc:"Group to switch to, by name or gid, the primary group of the user by default" example:"nogroup"`
+	AllowRoot bool   `json:"allowRoot" doc:"Allow serving as root, the sidebreaker refuses to unless a user to switch to is set" example:"false"`
+	Seccomp   string `json:"seccomp" doc:"Seccomp profile applied once serving, linux amd64 and arm64 only: default denies the syscalls a proxy never needs, disabled when not set" example:"default"`
+}
+
+// Refuse to start as root when we would keep serving as root
+func (r RunAs) check() error {
+	if os.Geteuid() == 0 && r.User == "" && !r.AllowRoot {
+		return fmt.Errorf("refusing to run as root, set runAs.user to switch user once the ports are bound or runAs.allowRoot")
+	}
+	return r.validate()
+}
+
+// Check the settings, independent of the user we run as
+func (r RunAs) validate() error {
+	if r.Group != "" && r.User == "" {
+		return fmt.Errorf("runAs.group needs runAs.user")
+	}
+	if r.Seccomp != "" && r.Seccomp != "default" {
+		return fmt.Errorf("unknown seccomp profile %q, only default is supported", r.Seccomp)
+	}
+	return nil
+}
+
+// Drop the privileges once the ports are bound, then apply the seccomp profile
+func (r RunAs) apply() error {
+	if r.User != "" {
+		uid, gid, err := dropPrivileges(r.User, r.Group)
+		if err != nil {
+			return fmt.Errorf("error switching to user %s: %w", r.User, err)
+		}
+		logger.Info("Switched user", "user", r.User, "uid", uid, "gid", gid)
+	}
+	if r.Seccomp != "" {
+		if err := applySeccomp(); err != nil {
+			return fmt.Errorf("error applying the seccomp profile: %w", err)
+		}
+		logger.Info("Seccomp profile applied", "profile", r.Seccomp)
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package sidebreaker
+
+import "fmt"
+
+func dropPrivileges(name, group string) (int, int, error) {
+	return 0, 0, fmt.Errorf("switching user is not supported on this platform")
+}
@@ -0,0 +1,50 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package sidebreaker
+
+import (
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// Switch to the user and group, the supplementary groups are dropped first as they can't be once we
+// aren't root anymore. Setuid applies to every thread of the process.
+func dropPrivileges(name, group string) (int, int, error) {
+	u, err := user.Lookup(name)
+	if _, ok := err.(user.UnknownUserError); ok {
+		u, err = user.LookupId(name)
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	gidString := u.Gid
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if _, ok := err.(user.UnknownGroupError); ok {
+			g, err = user.LookupGroupId(group)
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		gidString = g.Gid
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, err
+	}
+	gid, err := strconv.Atoi(gidString)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := syscall.Setgroups([]int{gid}); err != nil && syscall.Geteuid() == 0 {
+		return 0, 0, err
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return 0, 0, err
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return 0, 0, err
+	}
+	return uid, gid, nil
+}
@@ -0,0 +1,253 @@
+package sidebreaker
+
+import (
+	"context"
+	"encoding/binary"
+	"expvar"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// HealthCheck struct for the active probes of a host
+type HealthCheck struct {
+	Type     string   `json:"type" doc:"Probe sent to the host: tcp, dns, ntp or icmp, no probes when empty" example:"dns"`
+	Interval Duration `json:"interval" doc:"Milliseconds between probes, 10000 by default" example:"10000"`
+	Timeout  Duration `json:"timeout" doc:"Milliseconds a probe can take, 2000 by default" example:"2000"`
+	Port     int      `json:"port" doc:"Port probed, 53 for dns and 123 for ntp by default, required for tcp" example:"53"`
+	Query    string   `json:"query" doc:"Name looked up by dns probes, the root by default" example:"example.com"`
+}
+
+// Failed probes per host
+var healthCheckFailures = expvar.NewMap("healthCheckFailures")
+
+// A probe checks the host once, returning an error when it is unhealthy
+type probe func(r *dnsResolver, host string, check HealthCheck, timeout time.Duration) error
+
+// Probes available for the type of a health check
+var probes = map[string]probe{
+	"tcp":  probeTCP,
+	"dns":  probeDNS,
+	"ntp":  probeNTP,
+	"icmp": probeICMP,
+}
+
+// Default ports of the probes
+var probePorts = map[string]int{"dns": 53, "ntp": 123}
+
+// Check the health check configuration of a host
+func (c HealthCheck) validate() error {
+	if c.Type == "" {
+		return nil
+	}
+	if _, ok := probes[c.Type]; !ok {
+		return fmt.Errorf("unknown health check type %q, use tcp, dns, ntp or icmp", c.Type)
+	}
+	if c.Type == "tcp" && c.Port == 0 {
+		return fmt.Errorf("tcp health checks need a port")
+	}
+	return nil
+}
+
+// Probe a host for as long as the sidebreaker runs. A failed probe is a failure of its breakers, a
+// successful probe closes a breaker that is tripped so the host is used again without waiting for a call.
+func runHealthCheck(b Breakers, r *dnsResolver) {
+	check := b.Host.HealthCheck
+	interval := check.Interval.Duration()
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	timeout := check.Timeout.Duration()
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	if check.Port == 0 {
+		check.Port = probePorts[check.Type]
+	}
+
+	for wait(b.done, interval) {
+		start := time.Now()
+		err := probes[check.Type](r, b.Host.Host, check, timeout)
+		latency := time.Since(start)
+		for _, cb := range b.all() {
+			if err != nil {
+				cb.Fail(latency)
+			} else if cb.Breaker.Tripped() && cb.Ready() {
+				cb.Success(latency)
+			}
+		}
+		if err != nil {
+			healthCheckFailures.Add(b.Host.Host, 1)
+			logger.Warn("Health check failed, breaker fail increased", "host", b.Host.Host, "state", b.State(), "check", check.Type, "latency_ms", latency.Milliseconds(), "error", err)
+		} else {
+			logger.Debug("Health check passed", "host", b.Host.Host, "state", b.State(), "check", check.Type, "latency_ms", latency.Milliseconds())
+		}
+	}
+}
+
+// Open a TCP connection to the port
+func probeTCP(r *dnsResolver, host string, check HealthCheck, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	conn, err := resolveDial(ctx, r, nil, &net.Dialer{}, "tcp", net.JoinHostPort(host, fmt.Sprint(check.Port)))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// Send a UDP request and return the first answer
+func exchangeUDP(r *dnsResolver, host string, port int, request []byte, timeout time.Duration) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	conn, err := resolveDial(ctx, r, nil, &net.Dialer{}, "udp", net.JoinHostPort(host, fmt.Sprint(port)))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(request); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// DNS response codes that mean the server can't answer
+var dnsFailures = map[byte]string{2: "SERVFAIL", 5: "REFUSED"}
+
+// Look up the A record of the query name, any answer but a server failure or refusal is healthy
+func probeDNS(r *dnsResolver, host string, check HealthCheck, timeout time.Duration) error {
+	id := uint16(rand.Intn(1 << 16))
+	query := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(query[0:], id)
+	binary.BigEndian.PutUint16(query[2:], 0x0100) // recursion desired
+	binary.BigEndian.PutUint16(query[4:], 1)      // one question
+	for _, label := range strings.Split(strings.Trim(check.Query, "."), ".") {
+		if label == "" {
+			continue
+		}
+		if len(label) > 63 {
+			return fmt.Errorf("dns label %q is too long", label)
+		}
+		query = append(query, byte(len(label)))
+		query = append(query, label...)
+	}
+	query = append(query, 0, 0, 1, 0, 1) // end of name, type A, class IN
+
+	answer, err := exchangeUDP(r, host, check.Port, query, timeout)
+	if err != nil {
+		return err
+	}
+	if len(answer) < 12 || binary.BigEndian.Uint16(answer) != id || answer[2]&0x80 == 0 {
+		return fmt.Errorf("invalid dns answer")
+	}
+	if name, ok := dnsFailures[answer[3]&0x0f]; ok {
+		return fmt.Errorf("dns answered %s", name)
+	}
+	return nil
+}
+
+// Send an NTP client request, the server must answer with a synchronized time
+func probeNTP(r *dnsResolver, host string, check HealthCheck, timeout time.Duration) error {
+	request := make([]byte, 48)
+	request[0] = 0x23 // no leap warning, version 4, client mode
+	answer, err := exchangeUDP(r, host, check.Port, request, timeout)
+	if err != nil {
+		return err
+	}
+	if len(answer) < 48 || answer[0]&0x07 != 4 {
+		return fmt.Errorf("invalid ntp answer")
+	}
+	// Stratum 0 is a kiss of death such as RATE or DENY, an unsynchronized server has leap indicator 3
+	if stratum := answer[1]; stratum == 0 || stratum >= 16 {
+		return fmt.Errorf("ntp server unusable, stratum %d %q", stratum, strings.TrimRight(string(answer[12:16]), "\x00"))
+	}
+	if answer[0]>>6 == 3 {
+		return fmt.Errorf("ntp server not synchronized")
+	}
+	return nil
+}
+
+// Send an ICMP echo request and wait for the reply, this needs a raw socket (root or CAP_NET_RAW)
+func probeICMP(_ *dnsResolver, host string, check HealthCheck, timeout time.Duration) error {
+	addr, err := net.ResolveIPAddr("ip", host)
+	if err != nil {
+		return err
+	}
+	network, echo, reply := "ip4:icmp", byte(8), byte(0)
+	if addr.IP.To4() == nil {
+		network, echo, reply = "ip6:ipv6-icmp", byte(128), byte(129)
+	}
+	// Raw sockets need privileges, unprivileged ping sockets are used without them
+	var to net.Addr = addr
+	conn, err := net.ListenPacket(network, "")
+	raw := err == nil
+	if !raw {
+		if conn, err = pingSocket(addr.IP.To4() == nil); err != nil {
+			return err
+		}
+		to = &net.UDPAddr{IP: addr.IP}
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	id, seq := uint16(os.Getpid()), uint16(rand.Intn(1<<16))
+	request := []byte{echo, 0, 0, 0, 0, 0, 0, 0, 's', 'i', 'd', 'e', 'b', 'r', 'e', 'a', 'k', 'e', 'r'}
+	binary.BigEndian.PutUint16(request[4:], id)
+	binary.BigEndian.PutUint16(request[6:], seq)
+	// The kernel fills in the checksum of ICMPv6
+	if echo == 8 {
+		binary.BigEndian.PutUint16(request[2:], icmpChecksum(request))
+	}
+	if _, err := conn.WriteTo(request, to); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		// Raw sockets see every ICMP message, wait for the reply to our request. Ping sockets
+		// only get the replies to their own requests, the kernel replaces the identifier.
+		if n >= 8 && buf[0] == reply && (!raw || binary.BigEndian.Uint16(buf[4:]) == id) && binary.BigEndian.Uint16(buf[6:]) == seq &&
+			addrIP(from).Equal(addr.IP) {
+			return nil
+		}
+	}
+}
+
+// Internet checksum of an ICMP message
+func icmpChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// IP of the sender of a raw or ping socket message
+func addrIP(a net.Addr) net.IP {
+	switch a := a.(type) {
+	case *net.IPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package sidebreaker
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"time"
+)
+
+// Hedges sent by host, and the hedges that answered first, as api.example.com.sent and api.example.com.won
+var hedgedRequests = expvar.NewMap("hedgedRequests")
+
+// Test wether a request can be sent twice, only GET and HEAD requests without a body are hedged
+func hedgeable(req *http.Request) bool {
+	return (req.Method == http.MethodGet || req.Method == http.MethodHead) && (req.Body == nil || req.Body == http.NoBody)
+}
+
+// attempt is the outcome of one of the requests of a hedged call
+type attempt struct {
+	resp  *http.Response
+	err   error
+	hedge bool
+}
+
+// Send the request, and a second one when the first hasn't answered after delay. The first response
+// wins and the other request is canceled, an error waits for the other request if there is one. The
+// caller sees a single call, so the breaker counts the outcome of the call once.
+func hedgedRoundTrip(rt http.RoundTripper, req *http.Request, delay time.Duration, host string) (*http.Response, error) {
+	results := make(chan attempt, 2)
+	var cancels []context.CancelFunc
+	send := func(hedge bool) {
+		ctx, cancel := context.WithCancel(req.Context())
+		cancels = append(cancels, cancel)
+		out := req.Clone(ctx)
+		go func() {
+			resp, err := rt.RoundTrip(out)
+			results <- attempt{resp: resp, err: err, hedge: hedge}
+		}()
+	}
+	send(false)
+	pending := 1
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var a attempt
+	select {
+	case a = <-results:
+		pending--
+	case <-timer.C:
+		timelineFrom(req.Context()).add("hedge sent", "delay_ms", delay.Milliseconds())
+		hedgedRequests.Add(host+".sent", 1)
+		send(true)
+		pending++
+		a = <-results
+		pending--
+		if a.err != nil {
+			a = <-results
+			pending--
+		}
+	}
+
+	// The winner's request lives until its body is closed, the loser is canceled and its response dropped
+	winner, loser := cancels[0], context.CancelFunc(nil)
+	if len(cancels) > 1 {
+		loser = cancels[1]
+	}
+	if a.hedge {
+		winner, loser = cancels[1], cancels[0]
+		if a.err == nil {
+			hedgedRequests.Add(host+".won", 1)
+		}
+	}
+	if loser != nil {
+		loser()
+	}
+	if pending > 0 {
+		go func() {
+			if l := <-results; l.resp != nil {
+				l.resp.Body.Close()
+			}
+		}()
+	}
+	if a.err != nil {
+		for _, cancel := range cancels {
+			cancel()
+		}
+		return nil, a.err
+	}
+	a.resp.Body = &cancelBody{Reader: a.resp.Body, body: a.resp.Body, cancel: winner, done: func() {}}
+	return a.resp, nil
+}
@@ -0,0 +1,214 @@
+package sidebreaker
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// hostTable holds the breakers of the configured hosts by name and the connections open to them. A
+// reload swaps the whole map so lookups don't lock, and calls in flight keep the breakers they
+// started with.
+type hostTable struct {
+	hosts       atomic.Pointer[map[string]Breakers]
+	connections *connLimits
+}
+
+func newHostTable(hosts map[string]Breakers) *hostTable {
+	t := &hostTable{connections: newConnLimits()}
+	t.set(hosts)
+	return t
+}
+
+func (t *hostTable) set(hosts map[string]Breakers) {
+	t.hosts.Store(&hosts)
+}
+
+func (t *hostTable) get(name string) (Breakers, bool) {
+	b, ok := (*t.hosts.Load())[canonicalHost(name)]
+	return b, ok
+}
+
+// The breakers of every host, the map is shared and must not be changed
+func (t *hostTable) breakers() map[string]Breakers {
+	return *t.hosts.Load()
+}
+
+// hostSettings holds a setting of the hosts by name, such as their balancers or upstream proxies. A
+// reload replaces them all, calls in flight keep the setting they got.
+type hostSettings[T any] struct {
+	mu     sync.Mutex
+	byHost map[string]T
+}
+
+// The setting of a host, the zero value for the hosts without one
+func (s *hostSettings[T]) get(host string) T {
+	v, _ := s.lookup(host)
+	return v
+}
+
+func (s *hostSettings[T]) lookup(host string) (T, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.byHost[host]
+	return v, ok
+}
+
+// Replace the settings with the ones made from the current settings, so hosts that didn't change can keep theirs
+func (s *hostSettings[T]) update(next func(current map[string]T) map[string]T) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byHost = next(s.byHost)
+}
+
+// The settings of every host, the map is shared and must not be changed
+func (s *hostSettings[T]) all() map[string]T {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.byHost
+}
+
+// Create the breakers of a host, with a breaker for each of its paths
+func buildBreakers(v Host, damping FlapDamping, notifier *policyNotifier, injection *FeatureFlag) (Breakers, error) {
+	b, err := newBreakers(v, damping, notifier)
+	if err != nil {
+		return b, fmt.Errorf("error in host configuration of %s: %w", v.Host, err)
+	}
+	b.done = make(chan struct{})
+	// Paths of a host get their own breakers, longest prefixes first so they match first
+	for _, p := range v.Paths {
+		pb, err := newBreakers(p.apply(v), damping, notifier)
+		if err != nil {
+			return b, fmt.Errorf("error in host configuration of %s, path %s: %w", v.Host, p.Prefix, err)
+		}
+		pb.Prefix = p.Prefix
+		pb.done = b.done
+		b.Paths = append(b.Paths, pb)
+	}
+	sort.Slice(b.Paths, func(i, j int) bool { return len(b.Paths[i].Prefix) > len(b.Paths[j].Prefix) })
+	// The vendor status is polled once per host and shared by its breakers, as is the maintenance mode
+	b.Vendor, err = newVendorState(v.VendorStatus)
+	if err != nil {
+		return b, fmt.Errorf("error in host configuration of %s: %w", v.Host, err)
+	}
+	b.Maintenance = maintenanceFor(v.Host)
+	b.Injection = injection
+	for i := range b.Paths {
+		b.Paths[i].Vendor = b.Vendor
+		b.Paths[i].Maintenance = b.Maintenance
+		b.Paths[i].Injection = injection
+	}
+	return b, nil
+}
+
+// Watch the breakers of a host so we get alerted when it opens or closes, and probe the host with
+// its health check or vendor status. Everything stops once the host is removed.
+func startBreakers(b Breakers, notifier *policyNotifier, r *dnsResolver) {
+	go watchBreaker(b.Host.Host, b, notifier)
+	for _, p := range b.Paths {
+		go watchBreaker(p.Host.Host, p, notifier)
+	}
+	if b.Host.HealthCheck.Type != "" {
+		go runHealthCheck(b, r)
+	}
+	if b.Vendor != nil {
+		go pollVendorStatus(b.Host.Host, b.Host.VendorStatus, b.Vendor, notifier, b.done)
+	}
+}
+
+// Stop the watchers of the client breakers of a host and its paths
+func (b Breakers) closeClients() {
+	for _, c := range append([]Breakers{b}, b.Paths...) {
+		if c.Clients != nil {
+			c.Clients.close()
+		}
+	}
+}
+
+// Wait for d, false when done is closed first
+func wait(done <-chan struct{}, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// Reloads of a closed sidebreaker are refused
+var errClosed = errors.New("sidebreaker is closed")
+
+// Reload applies the hosts of a new configuration while serving. Hosts whose settings didn't change
+// keep their breakers and state, changed hosts start over with new breakers and removed hosts are
+// proxied without a breaker again. The other settings are applied on the next start.
+func (s *Sidebreaker) Reload(configuration Configuration) error {
+	if err := configuration.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	configuration = configuration.withDefaults()
+
+	tlsConfigs, err := loadUpstreamTLS(configuration.Hosts)
+	if err != nil {
+		return err
+	}
+
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	if s.ctx.Err() != nil {
+		return errClosed
+	}
+	current := s.hosts.breakers()
+	next := make(map[string]Breakers, len(configuration.Hosts))
+	var added, changed, removed []string
+	for _, v := range configuration.Hosts {
+		if b, ok := current[v.Host]; ok && reflect.DeepEqual(b.Host, v) {
+			next[v.Host] = b
+			continue
+		}
+		b, err := buildBreakers(v, configuration.FlapDamping, s.notifier, s.config.Features.LatencyInjection)
+		if err != nil {
+			return err
+		}
+		next[v.Host] = b
+		if _, ok := current[v.Host]; ok {
+			changed = append(changed, v.Host)
+		} else {
+			added = append(added, v.Host)
+		}
+	}
+	s.setupConnectLimiters(configuration.Hosts)
+	s.setupAddressPins(configuration.Hosts)
+	s.setupSRV(configuration.Hosts)
+	s.setupBalancers(configuration.Hosts)
+	s.setupUpstreamProxies(configuration.Hosts)
+	s.setupProxyProtocols(configuration.Hosts)
+	s.hosts.connections.setHosts(configuration.Hosts)
+	s.setupLatencies(configuration.Hosts)
+	s.setupAdaptiveLimiters(configuration.Hosts)
+	s.upstreamTLS.update(func(map[string]hostTLS) map[string]hostTLS { return tlsConfigs })
+	s.hosts.set(next)
+	for name, b := range current {
+		n, ok := next[name]
+		if !ok {
+			removed = append(removed, name)
+		}
+		if !ok || n.done != b.done {
+			close(b.done)
+			b.closeClients()
+		}
+	}
+	sort.Strings(removed)
+	for _, name := range append(added, changed...) {
+		startBreakers(next[name], s.notifier, s.resolver)
+	}
+	if len(added)+len(changed)+len(removed) > 0 {
+		logger.Info("Reloaded hosts", "added", added, "changed", changed, "removed", removed)
+	}
+	return nil
+}
@@ -0,0 +1,301 @@
+package sidebreaker
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Path struct for the configuration, a path prefix of a host that gets its own circuit breaker.
+// Fields that are not set are inherited from the host.
+type Path struct {
+	Prefix    string   `json:"prefix" doc:"Path prefix the breaker applies to" example:"/payments"`
+	BreakType string   `json:"breakType" doc:"Circuit breaker type, inherited from the host when not set"`
+	Timeout   Duration `json:"timeout" doc:"Timeout in milliseconds, inherited from the host when not set" example:"5000"`
+	Threshold int64    `json:"threshold" doc:"Trip threshold, inherited from the host when not set" example:"3"`
+	Rate      float64  `json:"rate" doc:"Error rate percentage, inherited from the host when not set"`
+	Policy    string   `json:"policy" doc:"Policy expression, inherited from the host when not set"`
+}
+
+// Build the host configuration for a path of the given host
+func (p Path) apply(h Host) Host {
+	h.Host = h.Host + p.Prefix
+	h.Paths = nil
+	if p.BreakType != "" {
+		h.BreakType = p.BreakType
+	}
+	if p.Timeout != 0 {
+		h.Timeout = p.Timeout
+	}
+	if p.Threshold != 0 {
+		h.Threshold = p.Threshold
+	}
+	if p.Rate != 0 {
+		h.Rate = p.Rate
+	}
+	if p.Policy != "" {
+		h.Policy = p.Policy
+	}
+	return h
+}
+
+// Find the breaker for a request path, paths are sorted so the longest matching prefix wins
+func (b Breakers) forPath(path string) Breakers {
+	for _, p := range b.Paths {
+		if strings.HasPrefix(path, p.Prefix) {
+			return p
+		}
+	}
+	return b
+}
+
+// Test wether the host is in our configuration and has MITM enabled
+func isMitmHost(hosts *hostTable, flag *FeatureFlag) goproxy.ReqConditionFunc {
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		host, ok := hosts.get(req.URL.Hostname())
+		return ok && host.Host.Mitm && flag.enabled("mitm", host.Host.Host)
+	}
+}
+
+// Apply the circuit breaker to plain HTTP requests and to requests decrypted with MITM.
+// Unlike CONNECT tunnels we can see the path here, so path breakers are used when configured.
+func (s *Sidebreaker) handleRequest(tr http.RoundTripper) func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	hosts := s.hosts
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		// IPv6 literals are dialed and counted under the form of the host in the configuration
+		req.URL.Host = canonicalHostPort(req.URL.Host)
+		b, _ := hosts.get(req.URL.Hostname())
+		host := b.forPath(req.URL.Path).forClient(req)
+		record := s.newAccessRecord(req, ctx, host)
+		t := s.timelines.start(req, ctx.Session, host)
+		record.timeline = t
+		// The upstream gets the correlation ID of the client, or the one generated for the call
+		req.Header.Set(requestIDHeader, record.correlation)
+		if req.ContentLength > 0 {
+			record.bytesIn = req.ContentLength
+		}
+		span := s.tracer.startSpan(req, host)
+		activeRequests.Add(1)
+		release := func() {}
+		// The adaptive limit of the host learns from the latency of the calls that reached the upstream
+		adaptive := func(time.Duration, bool) {}
+		var upstreamLatency time.Duration
+		finish := func(outcome string, status int) {
+			release()
+			switch outcome {
+			case outcomeSuccess, outcomeError, outcomeTimeout:
+				adaptive(upstreamLatency, outcome != outcomeSuccess)
+			default:
+				adaptive(0, false)
+			}
+			activeRequests.Add(-1)
+			record.write(outcome, status)
+			span.finish(outcome, status)
+		}
+		// Hosts in maintenance are answered with its message, the breakers are left as they are
+		if message, maintenance := host.Maintenance.active(); maintenance {
+			t.add("maintenance", "message", message)
+			logCall(slog.LevelInfo, ctx, host, "Host in maintenance, returning error immediately")
+			finish(outcomeRejected, http.StatusServiceUnavailable)
+			return req, s.errorResponse(req, ctx, host, http.StatusServiceUnavailable, message, reasonMaintenance)
+		}
+
+		// Injected errors are answered before the breaker, they never count for the host
+		fault, delay := faultsFor(req.URL.Hostname(), host.Host.Faults).pick(req.URL.Hostname())
+		if fault != "" {
+			status, text, outcome := faultAnswer(fault)
+			t.add("fault injected", "error", fault)
+			logCall(slog.LevelInfo, ctx, host, "Injecting fault, returning error", "error", fault)
+			finish(outcome, status)
+			return req, s.errorResponse(req, ctx, host, status, text, reasonFault)
+		}
+
+		// Calls over the connections of the process or the host are rejected before the breaker
+		if release = hosts.connections.acquire(req.URL.Hostname()); release == nil {
+			release = func() {}
+			t.add("connection limit")
+			logCall(slog.LevelWarn, ctx, host, "Connection limit reached, rejecting request")
+			finish(outcomeRejected, http.StatusServiceUnavailable)
+			return req, s.errorResponse(req, ctx, host, http.StatusServiceUnavailable, "Too many connections", reasonLimited)
+		}
+
+		// Degraded hosts shed the requests of the low classes first, before they can take the probe
+		if class, shed := host.shed(req); shed {
+			t.add("shed", "class", class)
+			logCall(slog.LevelInfo, ctx, host, "Host degraded, shedding request", "class", class)
+			finish(outcomeRejected, http.StatusServiceUnavailable)
+			return req, s.errorResponse(req, ctx, host, http.StatusServiceUnavailable, "Request shed", reasonShed)
+		}
+
+		if adaptive = s.acquireAdaptive(req.URL.Hostname()); adaptive == nil {
+			adaptive = func(time.Duration, bool) {}
+			t.add("concurrency limit")
+			logCall(slog.LevelWarn, ctx, host, "Adaptive concurrency limit reached, rejecting request")
+			finish(outcomeRejected, http.StatusServiceUnavailable)
+			return req, s.errorResponse(req, ctx, host, http.StatusServiceUnavailable, "Concurrency limit reached", reasonLimited)
+		}
+
+		// A tripped breaker that lets the call through is half-open, the call probes the host
+		probe := host.Breaker.Tripped()
+		if !host.Ready() {
+			t.add("breaker open", "state", host.State())
+			logCall(slog.LevelWarn, ctx, host, "Circuit breaker is tripped, returning error immediately")
+			finish(outcomeRejected, http.StatusServiceUnavailable)
+			return req, s.errorResponse(req, ctx, host, http.StatusServiceUnavailable, "Cannot reach destination", reasonTripped)
+		}
+
+		t.add("breaker ready", "state", host.State(), "probe", probe)
+		timeout := host.Host.callTimeout(probe)
+		// Callers can ask for their own timeout within the max of the host, probes keep theirs
+		if requested, ok := requestedTimeout(req, host.Host); ok && !probe {
+			t.add("timeout requested", "timeout_ms", requested.Milliseconds())
+			timeout = requested
+		}
+		ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+			reqCtx, cancel := context.WithTimeout(withClientAddr(req.Context(), req.RemoteAddr), timeout)
+			reqCtx = t.clientTrace(withConnectDeadline(reqCtx))
+			reqCtx, called := s.traceCall(withPoolTrace(reqCtx, req.URL.Hostname()), req.URL.Hostname())
+			reqCtx, stream := withH2Call(reqCtx)
+			start := time.Now()
+			// The delay is part of the call, as a slow network
+			faultDelay(reqCtx, delay)
+			rt := tr
+			if host.Host.H2C && req.URL.Scheme == "http" {
+				rt = s.h2c
+			}
+			// The PROXY protocol header names a single client, connections aren't shared between clients
+			if host.Host.ProxyProtocol != "" {
+				req.Close = true
+			}
+			var resp *http.Response
+			var err error
+			if hedge := host.Host.HedgeDelay.Duration(); hedge > 0 && hedgeable(req) {
+				resp, err = hedgedRoundTrip(rt, req.WithContext(reqCtx), hedge, host.Host.Host)
+			} else {
+				resp, err = rt.RoundTrip(req.WithContext(reqCtx))
+			}
+			latency := time.Since(start)
+			upstreamLatency = latency
+			if errors.Is(err, errConnectRate) {
+				cancel()
+				logCall(slog.LevelWarn, ctx, host, "Connect rate reached, rejecting request", "error", err)
+				finish(outcomeRejected, http.StatusServiceUnavailable)
+				return s.errorResponse(req, ctx, host, http.StatusServiceUnavailable, "Connect rate exceeded", reasonLimited), nil
+			}
+			// The client went away before the response, e.g. it canceled the request or closed its connection
+			if err != nil && req.Context().Err() != nil {
+				cancel()
+				if host.clientFailed(latency) {
+					t.breakerUpdated(host, "failure")
+					logCall(slog.LevelWarn, ctx, host, "Client went away, breaker fail increased", "latency_ms", latency.Milliseconds(), "error", err)
+				} else {
+					logCall(slog.LevelInfo, ctx, host, "Client went away, breaker not updated", "latency_ms", latency.Milliseconds(), "error", err)
+				}
+				finish(outcomeClientError, statusClientClosed)
+				return goproxy.NewResponse(req, goproxy.ContentTypeText, statusClientClosed, "Client closed request"), nil
+			}
+			if err != nil {
+				cancel()
+				// Streams failing with their HTTP/2 connection count once for the connection
+				var kind string
+				counted := false
+				if counts, reason := stream.counts(err); counts {
+					kind, counted = host.callFailed(err, latency)
+				} else {
+					kind = reason
+				}
+				called(true)
+				update := "breaker fail increased"
+				if counted {
+					t.breakerUpdated(host, "failure")
+				} else {
+					t.add("failure ignored", "kind", kind)
+					update = "breaker not updated"
+				}
+				if reqCtx.Err() == context.DeadlineExceeded {
+					logCall(slog.LevelWarn, ctx, host, "Call timed out, "+update, "latency_ms", latency.Milliseconds(), "kind", kind, "error", err)
+					finish(outcomeTimeout, http.StatusGatewayTimeout)
+					return s.errorResponse(req, ctx, host, http.StatusGatewayTimeout, "Gateway Timeout", reasonTimeout), nil
+				}
+				logCall(slog.LevelWarn, ctx, host, "Call failed, "+update, "latency_ms", latency.Milliseconds(), "kind", kind, "error", err)
+				finish(outcomeError, http.StatusInternalServerError)
+				return s.errorResponse(req, ctx, host, http.StatusInternalServerError, "Cannot reach destination", reasonRefused), nil
+			}
+			// Any response counts as a success, the timeout keeps running until the body is read
+			host.Success(latency)
+			called(false)
+			t.breakerUpdated(host, "success")
+			status := resp.StatusCode
+			decided(resp, host, "")
+			resp.Header.Set(requestIDHeader, record.correlation)
+			resp.Body = &cancelBody{
+				Reader: countReader(resp.Body, &record.bytesOut),
+				body:   resp.Body,
+				cancel: cancel,
+				done:   func() { finish(outcomeSuccess, status) },
+			}
+			return resp, nil
+		})
+		return req, nil
+	}
+}
+
+// Status of the requests whose client went away before the response, as nginx logs them
+const statusClientClosed = 499
+
+// Headers telling the clients the state of the breaker of the host, and why the sidebreaker answered
+// a request itself. Responses of the upstream have no reason, so the applications can tell the
+// errors of the sidebreaker from those of the upstream.
+const (
+	stateHeader  = "X-Sidebreaker-State"
+	reasonHeader = "X-Sidebreaker-Reason"
+)
+
+// Reasons of the responses of the sidebreaker
+const (
+	reasonTripped     = "tripped"
+	reasonTimeout     = "timeout"
+	reasonRefused     = "refused"
+	reasonLimited     = "limited"
+	reasonMaintenance = "maintenance"
+	reasonFault       = "fault"
+	reasonShed        = "shed"
+	reasonPort        = "port"
+)
+
+// Set the decision headers of a response, without a reason for the responses of the upstream
+func decided(resp *http.Response, host Breakers, reason string) *http.Response {
+	resp.Header.Set(stateHeader, host.State())
+	if reason != "" {
+		resp.Header.Set(reasonHeader, reason)
+	} else {
+		resp.Header.Del(reasonHeader)
+	}
+	return resp
+}
+
+// cancelBody releases the request context once the response body is closed,
+// and then calls done. goproxy can close a body more than once.
+type cancelBody struct {
+	io.Reader
+	body   io.Closer
+	cancel context.CancelFunc
+	done   func()
+	once   sync.Once
+}
+
+func (b *cancelBody) Close() error {
+	err := b.body.Close()
+	b.once.Do(func() {
+		b.cancel()
+		b.done()
+	})
+	return err
+}
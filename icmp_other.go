@@ -0,0 +1,12 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package sidebreaker
+
+import (
+	"fmt"
+	"net"
+)
+
+func pingSocket(v6 bool) (net.PacketConn, error) {
+	return nil, fmt.Errorf("unprivileged ping sockets are not supported on this platform")
+}
@@ -0,0 +1,25 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package sidebreaker
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// Open an unprivileged ICMP socket, the kernel sets the identifier of the echo requests and
+// only passes the replies to them. Linux allows them to the groups of net.ipv4.ping_group_range.
+func pingSocket(v6 bool) (net.PacketConn, error) {
+	family, proto := syscall.AF_INET, syscall.IPPROTO_ICMP
+	if v6 {
+		family, proto = syscall.AF_INET6, syscall.IPPROTO_ICMPV6
+	}
+	fd, err := syscall.Socket(family, syscall.SOCK_DGRAM, proto)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	f := os.NewFile(uintptr(fd), "ping")
+	defer f.Close()
+	return net.FilePacketConn(f)
+}
@@ -0,0 +1,283 @@
+package sidebreaker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configFile is a file of the configuration, the main one or a host file of its conf.d directory
+type configFile struct {
+	name string
+	data []byte
+	// Host files only add hosts, teams owning a backend ship theirs without editing the main file
+	hostsOnly bool
+}
+
+// hostsFile is what a host file of the conf.d directory can set
+type hostsFile struct {
+	Hosts []Host `json:"hosts"`
+}
+
+// The host files of a conf.d directory, json and yaml files in the order of their names.
+// There are none when the directory doesn't exist.
+func includeFiles(dir string) ([]configFile, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var files []configFile
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || (ext != ".json" && !isYAML(entry.Name())) {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, configFile{name: path, data: data, hostsOnly: true})
+	}
+	return files, nil
+}
+
+func isYAML(name string) bool {
+	ext := filepath.Ext(name)
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// Read the files of a configuration, the first is the main one, and validate them once merged with
+// the settings of the flags when given. The hosts of the host files are added after the hosts of
+// the main file.
+func parseConfig(files []configFile, flags *ConfigFlags) (Configuration, error) {
+	configuration := Configuration{}
+	var sources []*configSource
+	var errs ConfigErrors
+	for _, f := range files {
+		var src *configSource
+		var fileErrs ConfigErrors
+		if f.hostsOnly {
+			var hosts hostsFile
+			src, fileErrs = decodeConfigFile(f, &hosts)
+			src.firstHost = len(configuration.Hosts)
+			configuration.Hosts = append(configuration.Hosts, hosts.Hosts...)
+			for i, e := range fileErrs {
+				if e.Msg == "unknown field" && !strings.ContainsAny(e.Field, ".[") {
+					fileErrs[i].Msg = "only hosts can be set in conf.d files"
+				}
+			}
+		} else {
+			src, fileErrs = decodeConfigFile(f, &configuration)
+		}
+		src.hosts = len(configuration.Hosts) - src.firstHost
+		sources = append(sources, src)
+		errs = append(errs, fileErrs...)
+	}
+	if len(errs) > 0 {
+		return configuration, errs
+	}
+	if flags != nil {
+		if err := flags.Apply(&configuration); err != nil {
+			return configuration, err
+		}
+	}
+	if err := configuration.Validate(); err != nil {
+		for _, e := range err.(ConfigErrors) {
+			// The settings of the flags aren't in the files
+			if flags.sets(e.Field) {
+				errs = append(errs, e)
+				continue
+			}
+			errs = append(errs, locateMerged(sources, e))
+		}
+		return configuration, errs
+	}
+	return configuration, nil
+}
+
+// configSource is a file a merged configuration was read from, with the position of its fields
+type configSource struct {
+	file      string
+	positions map[string][2]int
+	// Hosts of the merged configuration that came from this file
+	firstHost int
+	hosts     int
+}
+
+// Position an error at its field, or at the closest parent in the file for fields that aren't set
+func (s *configSource) locate(e ConfigError) ConfigError {
+	e.File = s.file
+	for path := e.Field; ; {
+		if p, ok := s.positions[path]; ok {
+			e.Line, e.Column = p[0], p[1]
+			return e
+		}
+		i := strings.LastIndexAny(path, ".[")
+		if i < 0 {
+			return e
+		}
+		path = path[:i]
+	}
+}
+
+// Position an error of the merged configuration in the file its field came from, the hosts of the
+// host files are numbered within their file, also when the message refers to another host
+func locateMerged(sources []*configSource, e ConfigError) ConfigError {
+	src := sources[0]
+	if m := hostRef.FindStringSubmatchIndex(e.Field); m != nil && m[0] == 0 {
+		i, _ := strconv.Atoi(e.Field[m[2]:m[3]])
+		var local int
+		src, local = sourceOfHost(sources, i)
+		e.Field = fmt.Sprintf("hosts[%d]%s", local, e.Field[m[1]:])
+	}
+	e.Msg = hostRef.ReplaceAllStringFunc(e.Msg, func(ref string) string {
+		i, _ := strconv.Atoi(ref[len("hosts[") : len(ref)-1])
+		other, local := sourceOfHost(sources, i)
+		if other != src {
+			return fmt.Sprintf("hosts[%d] of %s", local, other.file)
+		}
+		return fmt.Sprintf("hosts[%d]", local)
+	})
+	return src.locate(e)
+}
+
+var hostRef = regexp.MustCompile(`hosts\[(\d+)\]`)
+
+// The file a host of the merged configuration came from and its index there
+func sourceOfHost(sources []*configSource, i int) (*configSource, int) {
+	for _, src := range sources[1:] {
+		if i >= src.firstHost && i < src.firstHost+src.hosts {
+			return src, i - src.firstHost
+		}
+	}
+	return sources[0], i
+}
+
+// Decode a file of the configuration into v, with its problems positioned in the file. YAML files
+// are converted to JSON first so both are checked the same way.
+func decodeConfigFile(f configFile, v interface{}) (*configSource, ConfigErrors) {
+	src := &configSource{file: f.name}
+	data := stripComments(f.data)
+	if isYAML(f.name) {
+		var err error
+		if data, src.positions, err = yamlToJSON(f.data); err != nil {
+			return src, ConfigErrors{yamlError(f.name, err)}
+		}
+	}
+
+	w := &configWalker{data: data, dec: json.NewDecoder(strings.NewReader(string(data))), offsets: map[string]int64{}}
+	if err := w.walk(reflect.TypeOf(v).Elem()); err != nil {
+		errs := err.(ConfigErrors)
+		for i := range errs {
+			errs[i].File = f.name
+		}
+		return src, errs
+	}
+	if src.positions == nil {
+		src.positions = offsetPositions(data, w.offsets)
+	}
+	var errs ConfigErrors
+	for _, e := range w.errs {
+		errs = append(errs, src.locate(e))
+	}
+	// The walker finds the values encoding/json refuses, with their position, so this is a fallback
+	if err := json.Unmarshal(data, v); err != nil && len(errs) == 0 {
+		e := ConfigError{Msg: err.Error()}
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			e = ConfigError{Field: typeErr.Field, Msg: fmt.Sprintf("expected %s, got %s", typeName(typeErr.Type), typeErr.Value)}
+		}
+		errs = append(errs, src.locate(e))
+	}
+	return src, errs
+}
+
+// Line and column of the fields from their byte offset in the file
+func offsetPositions(data []byte, offsets map[string]int64) map[string][2]int {
+	starts := []int64{0}
+	for i, c := range data {
+		if c == '\n' {
+			starts = append(starts, int64(i+1))
+		}
+	}
+	positions := make(map[string][2]int, len(offsets))
+	for field, off := range offsets {
+		line := sort.Search(len(starts), func(i int) bool { return starts[i] > off })
+		positions[field] = [2]int{line, int(off-starts[line-1]) + 1}
+	}
+	return positions
+}
+
+// Convert a YAML file to JSON, with the position of its fields named like the walker names them
+func yamlToJSON(data []byte) ([]byte, map[string][2]int, error) {
+	var node yaml.Node
+	if err := yaml.Unmarshal(data, &node); err != nil {
+		return nil, nil, err
+	}
+	positions := map[string][2]int{}
+	if len(node.Content) == 0 {
+		return []byte("{}"), positions, nil
+	}
+	yamlPositions(&node, "", positions)
+	var v interface{}
+	if err := node.Decode(&v); err != nil {
+		return nil, nil, err
+	}
+	out, err := json.Marshal(v)
+	if err != nil {
+		return nil, nil, fmt.Errorf("only string keys are supported: %w", err)
+	}
+	return out, positions, nil
+}
+
+func yamlPositions(n *yaml.Node, path string, positions map[string][2]int) {
+	if _, ok := positions[path]; !ok {
+		positions[path] = [2]int{n.Line, n.Column}
+	}
+	switch n.Kind {
+	case yaml.DocumentNode:
+		for _, c := range n.Content {
+			yamlPositions(c, path, positions)
+		}
+	case yaml.AliasNode:
+		yamlPositions(n.Alias, path, positions)
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := n.Content[i]
+			child := key.Value
+			if path != "" {
+				child = path + "." + key.Value
+			}
+			positions[child] = [2]int{key.Line, key.Column}
+			yamlPositions(n.Content[i+1], child, positions)
+		}
+	case yaml.SequenceNode:
+		for i, c := range n.Content {
+			yamlPositions(c, fmt.Sprintf("%s[%d]", path, i), positions)
+		}
+	}
+}
+
+var yamlLine = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+
+// Errors of the YAML parser have their line in the message
+func yamlError(file string, err error) ConfigError {
+	e := ConfigError{File: file, Msg: err.Error()}
+	if m := yamlLine.FindStringSubmatch(e.Msg); m != nil {
+		e.Line, _ = strconv.Atoi(m[1])
+		e.Msg = m[2]
+	}
+	return e
+}
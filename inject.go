@@ -0,0 +1,35 @@
+package sidebreaker
+
+import (
+	"expvar"
+	"math/rand"
+	"time"
+)
+
+// Latency in milliseconds of the last successful call to each host, as observed by the breaker
+var observedLatency = expvar.NewMap("observedLatencyMs")
+
+// LatencyInjection struct for the configuration, adds artificial latency to the observed latency of successful
+// calls to exercise latency based breakers and alerting. Real traffic is not delayed.
+type LatencyInjection struct {
+	Latency Duration `json:"latency" doc:"Milliseconds added to the observed latency of successful calls"`
+	Percent float64  `json:"percent" doc:"Percentage of successful calls that get the extra latency, all when not set"`
+}
+
+// Add the injected latency to a successful call to the host, if it was picked and the flag is on
+func (l LatencyInjection) inflate(flag *FeatureFlag, host string, latency time.Duration) time.Duration {
+	if l.Latency == 0 || !flag.enabled("latencyInjection", host) {
+		return latency
+	}
+	if l.Percent > 0 && rand.Float64()*100 >= l.Percent {
+		return latency
+	}
+	return latency + l.Latency.Duration()
+}
+
+// Record the latency of a successful call in the metrics
+func recordLatency(host string, latency time.Duration) {
+	v := new(expvar.Float)
+	v.Set(float64(latency) / float64(time.Millisecond))
+	observedLatency.Set(host, v)
+}
@@ -0,0 +1,322 @@
+package sidebreaker
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Kubernetes is the cluster the hosts are loaded from besides the configuration files, from
+// SideBreakerPolicy resources and from Services annotated with sidebreaker.io/breaker. The resources
+// are watched and changes are applied while serving, so policies are managed with kubectl.
+type Kubernetes struct {
+	Enabled       bool   `json:"enabled" doc:"Load hosts from SideBreakerPolicy resources and annotated Services" example:"false"`
+	APIServer     string `json:"apiServer" doc:"URL of the API server, the one of the cluster the sidebreaker runs in when not set" example:"http://127.0.0.1:8001"`
+	Namespace     string `json:"namespace" doc:"Namespace of the resources, the namespace of the pod when not set" example:"payments"`
+	AllNamespaces bool   `json:"allNamespaces" doc:"Read the resources of every namespace" example:"false"`
+	ClusterDomain string `json:"clusterDomain" doc:"Domain of the hosts of annotated Services, cluster.local when not set" example:"cluster.local"`
+}
+
+// Annotation of a Service holding the settings of its host in JSON, the host defaults to the DNS name of the Service
+const serviceAnnotation = "sidebreaker.io/breaker"
+
+// Group, version and resource of the SideBreakerPolicy custom resource
+const policyResource = "/apis/sidebreaker.io/v1/sidebreakerpolicies"
+
+// Credentials of the service account of the pod, used when the API server isn't set
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+func (k Kubernetes) name() string {
+	return "kubernetes"
+}
+
+func (k Kubernetes) validate() error {
+	if !k.Enabled {
+		return nil
+	}
+	if k.APIServer != "" {
+		if u, err := url.Parse(k.APIServer); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("apiServer must be an http or https URL such as http://127.0.0.1:8001, got %q", k.APIServer)
+		}
+	}
+	if k.Namespace != "" && k.AllNamespaces {
+		return fmt.Errorf("set either namespace or allNamespaces")
+	}
+	return nil
+}
+
+// Client of the API server, the in-cluster one trusts the CA of the service account
+var (
+	kubernetesClient   *http.Client
+	kubernetesClientMu sync.Mutex
+)
+
+// The URL of the API server, the client to call it and the bearer token of the service account
+func (k Kubernetes) connect() (string, *http.Client, string, error) {
+	if k.APIServer != "" {
+		return strings.TrimRight(k.APIServer, "/"), http.DefaultClient, "", nil
+	}
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return "", nil, "", fmt.Errorf("not running in a Kubernetes cluster, set apiServer")
+	}
+	// The token is read on every call, the kubelet rotates it
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return "", nil, "", fmt.Errorf("error reading the service account token: %w", err)
+	}
+	kubernetesClientMu.Lock()
+	defer kubernetesClientMu.Unlock()
+	if kubernetesClient == nil {
+		ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+		if err != nil {
+			return "", nil, "", fmt.Errorf("error reading the service account CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return "", nil, "", fmt.Errorf("no certificate in the service account CA")
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+		kubernetesClient = &http.Client{Transport: transport}
+	}
+	return "https://" + net.JoinHostPort(host, port), kubernetesClient, "Bearer " + strings.TrimSpace(string(token)), nil
+}
+
+// The namespace of the resources, empty for every namespace
+func (k Kubernetes) namespace() (string, error) {
+	if k.AllNamespaces {
+		return "", nil
+	}
+	if k.Namespace != "" {
+		return k.Namespace, nil
+	}
+	ns, err := os.ReadFile(serviceAccountDir + "/namespace")
+	if err != nil {
+		return "", fmt.Errorf("error reading the namespace of the pod, set namespace or allNamespaces: %w", err)
+	}
+	return strings.TrimSpace(string(ns)), nil
+}
+
+// Path of a resource in the namespace, /api/v1/services becomes /api/v1/namespaces/ns/services
+func namespacedPath(resource string, namespace string) string {
+	if namespace == "" {
+		return resource
+	}
+	i := strings.LastIndex(resource, "/")
+	return resource[:i] + "/namespaces/" + url.PathEscape(namespace) + resource[i:]
+}
+
+// kubernetesObject is the part of the resources we read, policies hold hosts like a conf.d file in their spec
+type kubernetesObject struct {
+	Metadata struct {
+		Name            string            `json:"name"`
+		Namespace       string            `json:"namespace"`
+		ResourceVersion string            `json:"resourceVersion"`
+		Annotations     map[string]string `json:"annotations"`
+	} `json:"metadata"`
+	Spec json.RawMessage `json:"spec"`
+	// Status objects sent instead of a resource when a watch fails
+	Code int `json:"code"`
+}
+
+type kubernetesList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []kubernetesObject `json:"items"`
+}
+
+type kubernetesEvent struct {
+	Type   string           `json:"type"`
+	Object kubernetesObject `json:"object"`
+}
+
+// Call the API server, the answer is left to read in the body
+func (k Kubernetes) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	server, client, token, err := k.connect()
+	if err != nil {
+		return nil, err
+	}
+	u := server + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return resp, fmt.Errorf("Kubernetes answered %s for %s: %s", resp.Status, path, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// List a resource, the resource version of the list is returned for the next watch. A resource
+// that isn't installed, such as the policies before their CRD is applied, has no objects.
+func (k Kubernetes) list(ctx context.Context, path string) ([]kubernetesObject, uint64, error) {
+	resp, err := k.get(ctx, path, url.Values{})
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			return nil, 0, nil
+		}
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	var l kubernetesList
+	if err := json.NewDecoder(resp.Body).Decode(&l); err != nil {
+		return nil, 0, fmt.Errorf("error decoding the %s list: %w", path, err)
+	}
+	version, _ := strconv.ParseUint(l.Metadata.ResourceVersion, 10, 64)
+	return l.Items, version, nil
+}
+
+// Wait for a change of a resource after the version, false when there was none within remoteWait
+func (k Kubernetes) watchResource(ctx context.Context, path string, version uint64, relevant func(kubernetesEvent) bool) (bool, error) {
+	query := url.Values{
+		"watch":           {"true"},
+		"resourceVersion": {strconv.FormatUint(version, 10)},
+		"timeoutSeconds":  {strconv.Itoa(int(remoteWait.Seconds()))},
+	}
+	resp, err := k.get(ctx, path, query)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			// Not installed, wait for the other resources
+			<-ctx.Done()
+			return false, nil
+		}
+		return false, err
+	}
+	defer resp.Body.Close()
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var e kubernetesEvent
+		if err := decoder.Decode(&e); err != nil {
+			if err == io.EOF || ctx.Err() != nil {
+				return false, nil
+			}
+			return false, err
+		}
+		switch {
+		case e.Type == "ERROR" && e.Object.Code == http.StatusGone:
+			// The version is too old to watch from, list the resources again
+			return true, nil
+		case e.Type == "ERROR":
+			return false, fmt.Errorf("Kubernetes watch of %s failed with code %d", path, e.Object.Code)
+		case e.Type == "BOOKMARK":
+		case relevant(e):
+			return true, nil
+		}
+	}
+}
+
+// Wait for a change of the policies or annotated Services after the version
+func (k Kubernetes) watch(ctx context.Context, namespace string, version uint64) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, remoteWait)
+	defer cancel()
+	type result struct {
+		changed bool
+		err     error
+	}
+	results := make(chan result, 2)
+	go func() {
+		changed, err := k.watchResource(ctx, namespacedPath(policyResource, namespace), version, func(kubernetesEvent) bool { return true })
+		results <- result{changed, err}
+	}()
+	go func() {
+		// Any Service can be annotated, a Service that was modified or deleted could have been
+		changed, err := k.watchResource(ctx, namespacedPath("/api/v1/services", namespace), version, func(e kubernetesEvent) bool {
+			_, annotated := e.Object.Metadata.Annotations[serviceAnnotation]
+			return annotated || e.Type != "ADDED"
+		})
+		results <- result{changed, err}
+	}()
+	for i := 0; i < 2; i++ {
+		if r := <-results; r.changed || r.err != nil {
+			return r.changed, r.err
+		}
+	}
+	return false, nil
+}
+
+// Read the policies and annotated Services as host files. With a version the resources are watched
+// until they change past it, the version of the answer is returned for the next watch.
+func (k Kubernetes) fetch(ctx context.Context, version uint64) ([]configFile, uint64, error) {
+	namespace, err := k.namespace()
+	if err != nil {
+		return nil, version, err
+	}
+	if version > 0 {
+		changed, err := k.watch(ctx, namespace, version)
+		if err != nil || !changed {
+			return nil, version, err
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, remoteRetry)
+	defer cancel()
+	policies, policiesVersion, err := k.list(ctx, namespacedPath(policyResource, namespace))
+	if err != nil {
+		return nil, version, err
+	}
+	services, servicesVersion, err := k.list(ctx, namespacedPath("/api/v1/services", namespace))
+	if err != nil {
+		return nil, version, err
+	}
+
+	var files []configFile
+	for _, p := range policies {
+		if len(bytes.TrimSpace(p.Spec)) == 0 {
+			continue
+		}
+		name := "kubernetes:sidebreakerpolicy/" + p.Metadata.Namespace + "/" + p.Metadata.Name
+		files = append(files, configFile{name: name, data: p.Spec, hostsOnly: true})
+	}
+	for _, s := range services {
+		annotation, ok := s.Metadata.Annotations[serviceAnnotation]
+		if !ok {
+			continue
+		}
+		name := "kubernetes:service/" + s.Metadata.Namespace + "/" + s.Metadata.Name
+		files = append(files, configFile{name: name, data: k.serviceHosts(s, annotation), hostsOnly: true})
+	}
+	return files, max(policiesVersion, servicesVersion), nil
+}
+
+// The host file of an annotated Service. The host is the DNS name of the Service unless the
+// annotation sets one, an annotation that isn't a JSON object is passed on so its error is reported.
+func (k Kubernetes) serviceHosts(s kubernetesObject, annotation string) []byte {
+	var host map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(annotation), &host); err != nil || host == nil {
+		return []byte(`{"hosts": [` + annotation + `]}`)
+	}
+	if _, ok := host["host"]; !ok {
+		domain := k.ClusterDomain
+		if domain == "" {
+			domain = "cluster.local"
+		}
+		host["host"], _ = json.Marshal(s.Metadata.Name + "." + s.Metadata.Namespace + ".svc." + domain)
+	}
+	data, _ := json.Marshal(map[string]interface{}{"hosts": []interface{}{host}})
+	return data
+}
@@ -0,0 +1,251 @@
+package sidebreaker
+
+import (
+	"context"
+	"expvar"
+	"math/bits"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Histograms keep 2^histogramSubBits buckets per power of two of microseconds, so the percentiles
+// are within about 3% of the real latency, as HDR histograms do with their significant digits.
+// Latencies above an hour, which takes 32 bits of microseconds, count as an hour.
+const (
+	histogramSubBits = 5
+	histogramSub     = 1 << histogramSubBits
+	histogramMax     = int64(time.Hour / time.Microsecond)
+	histogramBuckets = (32 - histogramSubBits + 1) * histogramSub
+)
+
+// Percentiles are of the calls of the last one to two minutes, the histograms of a host are
+// rotated each minute
+const latencyWindow = time.Minute
+
+// histogram counts latencies in buckets of about the same relative width
+type histogram struct {
+	counts [histogramBuckets]uint64
+	total  uint64
+	max    int64
+}
+
+// Bucket of a latency in microseconds: the latencies below histogramSub have a bucket each, the
+// others share a bucket with those that have the same histogramSubBits+1 high bits
+func histogramBucket(us int64) int {
+	if us < histogramSub {
+		return int(max(us, 0))
+	}
+	shift := bits.Len64(uint64(us)) - histogramSubBits - 1
+	return (shift+1)*histogramSub + int(us>>shift) - histogramSub
+}
+
+// The latency in the middle of a bucket, in microseconds
+func histogramValue(bucket int) int64 {
+	if bucket < histogramSub {
+		return int64(bucket)
+	}
+	shift := bucket/histogramSub - 1
+	low := int64(bucket%histogramSub+histogramSub) << shift
+	return low + (int64(1)<<shift)/2
+}
+
+func (h *histogram) record(d time.Duration) {
+	us := min(d.Microseconds(), histogramMax)
+	h.counts[histogramBucket(us)]++
+	h.total++
+	h.max = max(h.max, us)
+}
+
+func (h *histogram) merge(other *histogram) {
+	for i, c := range other.counts {
+		h.counts[i] += c
+	}
+	h.total += other.total
+	h.max = max(h.max, other.max)
+}
+
+// The latency under which a share q of the calls completed, 0 without calls
+func (h *histogram) percentile(q float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	rank := uint64(q*float64(h.total) + 0.5)
+	rank = min(max(rank, 1), h.total)
+	var seen uint64
+	for i, c := range h.counts {
+		seen += c
+		if seen >= rank {
+			// The middle of the last bucket can be past the slowest call
+			return time.Duration(min(histogramValue(i), h.max)) * time.Microsecond
+		}
+	}
+	return time.Duration(h.max) * time.Microsecond
+}
+
+// latencyHistogram is the histogram of a host for the current minute and the one before
+type latencyHistogram struct {
+	mu       sync.Mutex
+	current  *histogram
+	previous *histogram
+	rotated  time.Time
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{current: &histogram{}, previous: &histogram{}, rotated: time.Now()}
+}
+
+// Start a new minute once the current one is over, the calls of older minutes are dropped
+func (l *latencyHistogram) rotate(now time.Time) {
+	elapsed := now.Sub(l.rotated)
+	if elapsed < latencyWindow {
+		return
+	}
+	if elapsed < 2*latencyWindow {
+		l.previous = l.current
+	} else {
+		l.previous = &histogram{}
+	}
+	l.current = &histogram{}
+	l.rotated = now
+}
+
+func (l *latencyHistogram) record(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rotate(time.Now())
+	l.current.record(d)
+}
+
+// Percentiles struct, the latencies of the calls to a host in milliseconds
+type Percentiles struct {
+	Count int64   `json:"count"`
+	P50   float64 `json:"p50"`
+	P95   float64 `json:"p95"`
+	P99   float64 `json:"p99"`
+	Max   float64 `json:"max"`
+}
+
+func (l *latencyHistogram) percentiles() Percentiles {
+	l.mu.Lock()
+	l.rotate(time.Now())
+	h := &histogram{}
+	h.merge(l.previous)
+	h.merge(l.current)
+	l.mu.Unlock()
+	ms := func(d time.Duration) float64 { return float64(d) / float64(time.Millisecond) }
+	return Percentiles{
+		Count: int64(h.total),
+		P50:   ms(h.percentile(0.50)),
+		P95:   ms(h.percentile(0.95)),
+		P99:   ms(h.percentile(0.99)),
+		Max:   float64(h.max) / 1000,
+	}
+}
+
+// hostLatency has the histograms of a host: establishing connections, including the DNS lookup, and
+// the duration of its requests and tunnels
+type hostLatency struct {
+	connect *latencyHistogram
+	request *latencyHistogram
+	tunnel  *latencyHistogram
+}
+
+// HostLatency struct, the latency percentiles of a host in the admin API and the metrics
+type HostLatency struct {
+	Host    string      `json:"host"`
+	Connect Percentiles `json:"connect"`
+	Request Percentiles `json:"request"`
+	Tunnel  Percentiles `json:"tunnel"`
+}
+
+// The histograms of the last sidebreaker created, in the metrics
+var publishedLatencies atomic.Pointer[hostSettings[*hostLatency]]
+
+func init() {
+	expvar.Publish("hostLatency", expvar.Func(func() any {
+		byHost := map[string]HostLatency{}
+		if latencies := publishedLatencies.Load(); latencies != nil {
+			for _, l := range latencyReport(latencies) {
+				byHost[l.Host] = l
+			}
+		}
+		return byHost
+	}))
+}
+
+// Set up the histograms of the hosts of the configuration, the hosts that stay keep theirs
+func (s *Sidebreaker) setupLatencies(hosts []Host) {
+	s.latencies.update(func(current map[string]*hostLatency) map[string]*hostLatency {
+		latencies := map[string]*hostLatency{}
+		for _, h := range hosts {
+			l, ok := current[h.Host]
+			if !ok {
+				l = &hostLatency{connect: newLatencyHistogram(), request: newLatencyHistogram(), tunnel: newLatencyHistogram()}
+			}
+			latencies[h.Host] = l
+		}
+		return latencies
+	})
+}
+
+// Dial an upstream address and record how long it took for its host
+func (s *Sidebreaker) timedDial(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	start := time.Now()
+	conn, err := s.pinnedDial(ctx, dialer, network, addr)
+	if err == nil {
+		host, _, splitErr := net.SplitHostPort(addr)
+		if splitErr != nil {
+			host = addr
+		}
+		if l := s.latencies.get(canonicalHost(host)); l != nil {
+			l.connect.record(time.Since(start))
+		}
+	}
+	return conn, err
+}
+
+// The latency percentiles of every host, sorted by host
+func latencyReport(latencies *hostSettings[*hostLatency]) []HostLatency {
+	all := latencies.all()
+	report := make([]HostLatency, 0, len(all))
+	for host, l := range all {
+		report = append(report, HostLatency{
+			Host:    host,
+			Connect: l.connect.percentiles(),
+			Request: l.request.percentiles(),
+			Tunnel:  l.tunnel.percentiles(),
+		})
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].Host < report[j].Host })
+	return report
+}
+
+// Report the latency percentiles by host, or of the host given as ?host=
+func latencyHandler(s *Sidebreaker) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		report := latencyReport(&s.latencies)
+		if host := req.URL.Query().Get("host"); host != "" {
+			host = canonicalHost(host)
+			for _, l := range report {
+				if l.Host == host {
+					w.Header().Set("Content-Type", "application/json")
+					writeJSON(w, l)
+					return
+				}
+			}
+			http.Error(w, "unknown host "+host, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		writeJSON(w, report)
+	}
+}
@@ -0,0 +1,112 @@
+package sidebreaker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Logger used for everything sidebreaker logs, configured by setupLogging
+var logger = slog.New(slog.NewTextHandler(os.Stderr, nil))
+
+// Logger returns the logger of the sidebreaker, as configured by the log settings once New is called
+func Logger() *slog.Logger {
+	return logger
+}
+
+// Level of the application log, it can be changed at runtime through /admin/loglevel
+var logLevel = new(slog.LevelVar)
+
+// Configure the log format, "json" or "console" (the default), and the log level, info by default
+func setupLogging(format string, level string) error {
+	if err := setLogLevel(level); err != nil {
+		return err
+	}
+	opts := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, opts)
+	if format == "json" {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	}
+	logger = slog.New(handler)
+	return nil
+}
+
+// The log level of the configuration, the deprecated verbose is debug unless logLevel is set
+func (c Configuration) effectiveLogLevel() string {
+	if c.Verbose && c.LogLevel == "" {
+		return "debug"
+	}
+	return c.LogLevel
+}
+
+// Change the log level: debug, info, warn or error
+func setLogLevel(level string) error {
+	if level == "" {
+		level = "info"
+	}
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("unknown log level %q, use debug, info, warn or error", level)
+	}
+	logLevel.Set(l)
+	return nil
+}
+
+// logLevelBody is the body of the log level admin endpoint
+type logLevelBody struct {
+	Level string `json:"level"`
+}
+
+// Handler for /admin/loglevel, GET returns the log level and PUT changes it
+func logLevelHandler(s *Sidebreaker) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			body := logLevelBody{}
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := setLogLevel(body.Level); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			logger.Info("Log level changed", "level", strings.ToLower(logLevel.Level().String()))
+			s.audit(req, "loglevel", "", strings.ToLower(logLevel.Level().String()))
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		writeJSON(w, logLevelBody{strings.ToLower(logLevel.Level().String())})
+	}
+}
+
+// Log a line about a proxied call with the host, the current breaker state and the request ID
+func logCall(level slog.Level, ctx *goproxy.ProxyCtx, host Breakers, msg string, args ...any) {
+	args = append([]any{"host", host.Host.Host, "state", host.State(), "request_id", ctx.Session, "correlation_id", correlationID(ctx)}, args...)
+	logger.Log(context.Background(), level, msg, args...)
+}
+
+// goproxyLogger sends the lines goproxy logs itself through our logger. Its lines are prefixed
+// with a truncated session number and their level, the level is kept and the prefix dropped.
+type goproxyLogger struct{}
+
+func (goproxyLogger) Printf(format string, v ...interface{}) {
+	msg := strings.TrimSpace(fmt.Sprintf(format, v...))
+	if i := strings.Index(msg, "WARN: "); i >= 0 {
+		logger.Warn(msg[i+len("WARN: "):], "source", "goproxy")
+	} else if i := strings.Index(msg, "INFO: "); i >= 0 {
+		logger.Debug(msg[i+len("INFO: "):], "source", "goproxy")
+	} else {
+		logger.Info(msg, "source", "goproxy")
+	}
+}
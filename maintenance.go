@@ -0,0 +1,143 @@
+package sidebreaker
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Hosts in maintenance mode, 1 while it is on
+var hostMaintenance = expvar.NewMap("hostMaintenance")
+
+// Answer of the calls to a host in maintenance without a message of its own
+const defaultMaintenanceMessage = "Host under maintenance"
+
+// maintenanceState is the maintenance mode of a host, turned on and off with the admin API. Unlike a
+// tripped breaker it doesn't touch the counts of the breakers, which pick up where they were once it
+// is off. It is shared by the breakers of the host and kept when the hosts are reloaded.
+type maintenanceState struct {
+	mu      sync.Mutex
+	on      bool
+	message string
+	since   time.Time
+}
+
+// Maintenance states by host, a host keeps its state when it is reloaded
+var (
+	maintenances   = map[string]*maintenanceState{}
+	maintenancesMu sync.Mutex
+)
+
+func maintenanceFor(host string) *maintenanceState {
+	maintenancesMu.Lock()
+	defer maintenancesMu.Unlock()
+	m, ok := maintenances[host]
+	if !ok {
+		m = &maintenanceState{}
+		maintenances[host] = m
+	}
+	return m
+}
+
+// The message the calls are answered with, false when the host isn't in maintenance
+func (m *maintenanceState) active() (string, bool) {
+	if m == nil {
+		return "", false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.message, m.on
+}
+
+// Body of the maintenance endpoint
+type maintenanceBody struct {
+	Host    string     `json:"host"`
+	State   string     `json:"state"`
+	Message string     `json:"message,omitempty"`
+	Since   *time.Time `json:"since,omitempty"`
+}
+
+func (m *maintenanceState) body(host string) maintenanceBody {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	body := maintenanceBody{Host: host, State: "off"}
+	if m.on {
+		since := m.since
+		body.State, body.Message, body.Since = "on", m.message, &since
+	}
+	return body
+}
+
+// Turn the maintenance mode of a host on with POST /hosts/{host}/maintenance and a body such as
+// {"state": "on", "message": "Database migration until 14:00"}, and off with {"state": "off"}.
+// GET returns the current state.
+func maintenanceHandler(s *Sidebreaker) http.HandlerFunc {
+	hosts := s.hosts
+	return func(w http.ResponseWriter, req *http.Request) {
+		host, ok := strings.CutSuffix(strings.TrimPrefix(req.URL.Path, "/hosts/"), "/maintenance")
+		if !ok || host == "" || strings.Contains(host, "/") {
+			http.NotFound(w, req)
+			return
+		}
+		b, ok := hosts.get(host)
+		if !ok {
+			http.Error(w, "unknown host "+host, http.StatusNotFound)
+			return
+		}
+		host = b.Host.Host
+		m := maintenanceFor(host)
+		switch req.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			body := maintenanceBody{}
+			if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+				http.Error(w, "invalid body: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			// The message is the reason of the status line answering tunnels
+			if strings.ContainsAny(body.Message, "\r\n") {
+				http.Error(w, "message must be a single line", http.StatusBadRequest)
+				return
+			}
+			switch body.State {
+			case "on":
+				if body.Message == "" {
+					body.Message = defaultMaintenanceMessage
+				}
+				m.mu.Lock()
+				if !m.on {
+					m.since = time.Now()
+				}
+				m.on, m.message = true, body.Message
+				m.mu.Unlock()
+				publishMaintenance(host, 1)
+				logger.Warn("Maintenance mode on, calls are rejected", "host", host, "message", body.Message)
+			case "off":
+				m.mu.Lock()
+				m.on, m.message = false, ""
+				m.mu.Unlock()
+				publishMaintenance(host, 0)
+				logger.Warn("Maintenance mode off", "host", host)
+			default:
+				http.Error(w, `state must be on or off, got "`+body.State+`"`, http.StatusBadRequest)
+				return
+			}
+			s.audit(req, "maintenance", host, body.State)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		writeJSON(w, m.body(host))
+	}
+}
+
+func publishMaintenance(host string, on int64) {
+	published := new(expvar.Int)
+	published.Set(on)
+	hostMaintenance.Set(host, published)
+}
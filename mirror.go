@@ -0,0 +1,127 @@
+package sidebreaker
+
+import (
+	"bytes"
+	"context"
+	"expvar"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Mirror struct for the configuration, a copy of part of the requests of a host is sent to a shadow
+// upstream, such as a new version of the backend, whose responses are discarded
+type Mirror struct {
+	Upstream string   `json:"upstream" doc:"URL the copies are sent to, with the path and query of the request" example:"http://billing-v2.internal:8080"`
+	Percent  float64  `json:"percent" doc:"Percentage of the requests copied, all when not set" example:"10"`
+	Timeout  Duration `json:"timeout" doc:"Timeout of a copy in milliseconds, the timeout of the host when not set" example:"5000"`
+}
+
+// Test wether the requests of the host are mirrored
+func (m Mirror) enabled() bool {
+	return m.Upstream != ""
+}
+
+func (m Mirror) validate() error {
+	if !m.enabled() {
+		return nil
+	}
+	u, err := url.Parse(m.Upstream)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("upstream must be an http or https URL such as http://billing-v2.internal:8080, got %q", m.Upstream)
+	}
+	return nil
+}
+
+// Copies sent, failed and skipped by host, as api.example.com.sent
+var mirroredRequests = expvar.NewMap("mirroredRequests")
+
+// Bodies of the requests copied are read in memory, requests with larger or unknown bodies are skipped
+const maxMirrorBody = 1 << 20
+
+// Timeout of the copies when neither the mirror nor the host sets one
+const defaultMirrorTimeout = 10 * time.Second
+
+// Copies in flight, copies beyond it are skipped so a slow shadow upstream can't pile up goroutines
+var mirrorSlots = make(chan struct{}, 128)
+
+// Send a copy of the request to the shadow upstream of the host when it is picked. The copy goes
+// straight to the transport, so its failures never count for the breakers of the host, and the
+// request is given back with its body restored.
+func mirror(req *http.Request, host Host, tr http.RoundTripper) *http.Request {
+	m := host.Mirror
+	if m.Percent > 0 && rand.Float64()*100 >= m.Percent {
+		return req
+	}
+	name := host.Host
+	if req.ContentLength < 0 || req.ContentLength > maxMirrorBody {
+		mirroredRequests.Add(name+".skipped", 1)
+		return req
+	}
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(req.Body, maxMirrorBody))
+		req.Body.Close()
+		if err != nil {
+			// The request can't be sent either, its transport reports the error
+			req.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), errReader{err}))
+			mirroredRequests.Add(name+".skipped", 1)
+			return req
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	select {
+	case mirrorSlots <- struct{}{}:
+	default:
+		mirroredRequests.Add(name+".skipped", 1)
+		return req
+	}
+
+	// Validated with the configuration
+	upstream, _ := url.Parse(m.Upstream)
+	timeout := m.Timeout.Duration()
+	if timeout == 0 {
+		timeout = host.Timeout.Duration()
+	}
+	if timeout == 0 {
+		timeout = defaultMirrorTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	shadow := req.Clone(ctx)
+	shadow.URL.Scheme = upstream.Scheme
+	shadow.URL.Host = upstream.Host
+	shadow.Host = upstream.Host
+	shadow.RequestURI = ""
+	shadow.Body = http.NoBody
+	if len(body) > 0 {
+		shadow.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	go func() {
+		defer func() { <-mirrorSlots }()
+		defer cancel()
+		resp, err := tr.RoundTrip(shadow)
+		if err == nil {
+			_, err = io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		if err != nil {
+			mirroredRequests.Add(name+".failed", 1)
+			logger.Debug("Mirrored request failed", "host", name, "upstream", upstream.Host, "error", err)
+			return
+		}
+		mirroredRequests.Add(name+".sent", 1)
+		logger.Debug("Mirrored request", "host", name, "upstream", upstream.Host, "status", resp.StatusCode)
+	}()
+	return req
+}
+
+// errReader returns the error a body failed with once its read part is consumed
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
@@ -0,0 +1,324 @@
+package sidebreaker
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"expvar"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// MitmCA struct for the configuration, the certificate authority the certificates of the MITM hosts
+// are issued by. `sidebreaker ca generate` creates one, with its key encrypted with a passphrase.
+type MitmCA struct {
+	Cert string `json:"cert" doc:"PEM file of the CA certificate, the clients of MITM hosts must trust it" example:"/etc/sidebreaker/ca.crt"`
+	Key  string `json:"key" doc:"PEM file of the private key of the CA, encrypted with the passphrase in SIDEBREAKER_CA_PASSPHRASE or plain" example:"/etc/sidebreaker/ca.key"`
+}
+
+// Environment variable with the passphrase of the key of the MITM CA
+const CAPassphraseEnv = "SIDEBREAKER_CA_PASSPHRASE"
+
+// PEM type of a private key encrypted with a passphrase: the PKCS #8 key sealed with AES-256-GCM, with
+// a key derived with PBKDF2-SHA256. The salt and iterations are headers of the block.
+const encryptedKeyType = "SIDEBREAKER ENCRYPTED PRIVATE KEY"
+
+// PBKDF2 iterations of the keys encrypted by `sidebreaker ca generate`
+const caKeyIterations = 600000
+
+// How long the MITM certificates of the hosts are valid, and how long before their end a new one is issued
+const (
+	leafValidity = 7 * 24 * time.Hour
+	leafRenewal  = 24 * time.Hour
+)
+
+// Hosts whose MITM certificate is kept, the cache is emptied when more hosts are decrypted
+const maxLeafCertificates = 4096
+
+// MITM certificates issued and taken from the cache
+var mitmCertificates = expvar.NewMap("mitmCertificates")
+
+func (c MitmCA) enabled() bool {
+	return c.Cert != "" || c.Key != ""
+}
+
+func (c MitmCA) validate() error {
+	if (c.Cert == "") != (c.Key == "") {
+		return fmt.Errorf("cert and key must be set together")
+	}
+	return nil
+}
+
+// certAuthority issues the MITM certificates of the hosts and keeps them until they are about to end
+type certAuthority struct {
+	cert   *x509.Certificate
+	signer any
+
+	mu     sync.Mutex
+	leaves map[string]*tls.Certificate
+}
+
+func newCertAuthority(ca tls.Certificate) (*certAuthority, error) {
+	cert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	return &certAuthority{cert: cert, signer: ca.PrivateKey, leaves: map[string]*tls.Certificate{}}, nil
+}
+
+// The certificate authority of the MITM hosts, the one bundled with goproxy when none is configured
+func newMitmAuthority(config MitmCA, hosts []Host) (*certAuthority, error) {
+	if !config.enabled() {
+		for _, h := range hosts {
+			if h.Mitm {
+				logger.Warn("MITM hosts use the CA bundled with goproxy, whose key is public, set mitmCa for a CA of your own", "host", h.Host)
+				break
+			}
+		}
+		return newCertAuthority(goproxy.GoproxyCa)
+	}
+	ca, err := LoadCA(config.Cert, config.Key, []byte(os.Getenv(CAPassphraseEnv)))
+	if err != nil {
+		return nil, err
+	}
+	return newCertAuthority(ca)
+}
+
+// The TLS configuration the client of a MITM host is served with, with a certificate of the host
+func (a *certAuthority) tlsConfig(hostport string) (*tls.Config, error) {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	leaf, err := a.leaf(host)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{*leaf}}, nil
+}
+
+// The certificate of a host, from the cache while it isn't about to end
+func (a *certAuthority) leaf(host string) (*tls.Certificate, error) {
+	now := time.Now()
+	a.mu.Lock()
+	cert, ok := a.leaves[host]
+	a.mu.Unlock()
+	if ok && now.Add(leafRenewal).Before(cert.Leaf.NotAfter) {
+		mitmCertificates.Add("cached", 1)
+		return cert, nil
+	}
+	cert, err := a.issue(host, now)
+	if err != nil {
+		return nil, err
+	}
+	mitmCertificates.Add("issued", 1)
+	a.mu.Lock()
+	if len(a.leaves) >= maxLeafCertificates {
+		a.leaves = map[string]*tls.Certificate{}
+	}
+	a.leaves[host] = cert
+	a.mu.Unlock()
+	return cert, nil
+}
+
+// Issue a certificate of a host with a key of its own, valid for a week at most
+func (a *certAuthority) issue(host string, now time.Time) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(leafValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if template.NotAfter.After(a.cert.NotAfter) {
+		template.NotAfter = a.cert.NotAfter
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, a.cert, &key.PublicKey, a.signer)
+	if err != nil {
+		return nil, fmt.Errorf("error issuing the MITM certificate of %s: %w", host, err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der, a.cert.Raw}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// GenerateCA creates a certificate authority for the MITM hosts, valid for the given time. The key
+// is returned encrypted with the passphrase.
+func GenerateCA(name string, validity time.Duration, passphrase []byte) (certPEM []byte, keyPEM []byte, err error) {
+	if len(passphrase) == 0 {
+		return nil, nil, fmt.Errorf("the key of the CA needs a passphrase")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name, Organization: []string{"Sidebreaker"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, err := encryptKey(pkcs8, passphrase)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(block), nil
+}
+
+// LoadCA reads a certificate authority, its key is decrypted with the passphrase when it is encrypted
+func LoadCA(certPath string, keyPath string, passphrase []byte) (tls.Certificate, error) {
+	certPEM, err := os.ReadFile(certPath)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("error reading the CA certificate: %w", err)
+	}
+	keyPEM, err := os.ReadFile(keyPath)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("error reading the CA key: %w", err)
+	}
+	if block, _ := pem.Decode(keyPEM); block != nil && block.Type == encryptedKeyType {
+		if len(passphrase) == 0 {
+			return tls.Certificate{}, fmt.Errorf("the CA key is encrypted, set its passphrase in %s", CAPassphraseEnv)
+		}
+		pkcs8, err := decryptKey(block, passphrase)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})
+	}
+	ca, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("error loading the CA: %w", err)
+	}
+	cert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if !cert.IsCA {
+		return tls.Certificate{}, fmt.Errorf("%s is not a CA certificate", certPath)
+	}
+	ca.Leaf = cert
+	return ca, nil
+}
+
+func encryptKey(pkcs8 []byte, passphrase []byte) (*pem.Block, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := keyCipher(passphrase, salt, caKeyIterations)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return &pem.Block{
+		Type: encryptedKeyType,
+		Headers: map[string]string{
+			"KDF":        "pbkdf2-sha256",
+			"Salt":       hex.EncodeToString(salt),
+			"Iterations": strconv.Itoa(caKeyIterations),
+		},
+		Bytes: aead.Seal(nonce, nonce, pkcs8, nil),
+	}, nil
+}
+
+func decryptKey(block *pem.Block, passphrase []byte) ([]byte, error) {
+	salt, err := hex.DecodeString(block.Headers["Salt"])
+	iterations, convErr := strconv.Atoi(block.Headers["Iterations"])
+	if block.Headers["KDF"] != "pbkdf2-sha256" || err != nil || convErr != nil || iterations <= 0 {
+		return nil, fmt.Errorf("unknown encryption of the CA key")
+	}
+	aead, err := keyCipher(passphrase, salt, iterations)
+	if err != nil {
+		return nil, err
+	}
+	if len(block.Bytes) < aead.NonceSize() {
+		return nil, fmt.Errorf("the CA key is truncated")
+	}
+	nonce, sealed := block.Bytes[:aead.NonceSize()], block.Bytes[aead.NonceSize():]
+	pkcs8, err := aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, errors.New("wrong passphrase for the CA key")
+	}
+	return pkcs8, nil
+}
+
+// AES-256-GCM with the key derived from a passphrase
+func keyCipher(passphrase []byte, salt []byte, iterations int) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(pbkdf2SHA256(passphrase, salt, iterations))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// PBKDF2 (RFC 8018) with HMAC-SHA256, for a 32 byte key: a single block
+func pbkdf2SHA256(password []byte, salt []byte, iterations int) []byte {
+	prf := hmac.New(sha256.New, password)
+	prf.Write(salt)
+	prf.Write(binary.BigEndian.AppendUint32(nil, 1))
+	u := prf.Sum(nil)
+	key := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
@@ -0,0 +1,204 @@
+package sidebreaker
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test wether the key derivation matches the PBKDF2-HMAC-SHA256 test vectors
+func TestPBKDF2SHA256(t *testing.T) {
+	tests := []struct {
+		password, salt string
+		iterations     int
+		expected       string
+	}{
+		{"password", "salt", 1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{"password", "salt", 2, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{"password", "salt", 4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+		{"passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096, "348c89dbcbd32b2f32d814b8116e84cf2b17347ebc1800181c4e2a1fb8dd53e1"},
+		{"", "salt", 1, "f135c27993baf98773c5cdb40a5706ce6a345cde61b000a67858650cd6a324d7"},
+	}
+	for _, test := range tests {
+		key := pbkdf2SHA256([]byte(test.password), []byte(test.salt), test.iterations)
+		if got := hex.EncodeToString(key); got != test.expected {
+			t.Errorf("expected %s for %q with %d iterations, got %s", test.expected, test.password, test.iterations, got)
+		}
+	}
+}
+
+// Test wether encrypted keys decrypt with their passphrase only, and blocks that aren't ours are refused
+func TestDecryptKey(t *testing.T) {
+	pkcs8 := []byte("not really a PKCS #8 key")
+	block, err := encryptKey(pkcs8, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block.Type != encryptedKeyType || block.Headers["KDF"] != "pbkdf2-sha256" || block.Headers["Iterations"] != "600000" || len(block.Headers["Salt"]) != 32 {
+		t.Errorf("expected the PBKDF2 parameters in the headers, got %s %v", block.Type, block.Headers)
+	}
+	// A copy of the block with a change
+	encrypted := func(change func(b *pem.Block)) *pem.Block {
+		b := &pem.Block{Type: block.Type, Headers: map[string]string{}, Bytes: append([]byte(nil), block.Bytes...)}
+		for k, v := range block.Headers {
+			b.Headers[k] = v
+		}
+		change(b)
+		return b
+	}
+	tests := []struct {
+		name       string
+		block      *pem.Block
+		passphrase string
+		err        string
+	}{
+		{"right passphrase", block, "secret", ""},
+		{"wrong passphrase", block, "Secret", "wrong passphrase for the CA key"},
+		{"other salt", encrypted(func(b *pem.Block) { b.Headers["Salt"] = strings.Repeat("00", 16) }), "secret", "wrong passphrase for the CA key"},
+		{"other iterations", encrypted(func(b *pem.Block) { b.Headers["Iterations"] = "1" }), "secret", "wrong passphrase for the CA key"},
+		{"tampered", encrypted(func(b *pem.Block) { b.Bytes[len(b.Bytes)-1] ^= 1 }), "secret", "wrong passphrase for the CA key"},
+		{"truncated", encrypted(func(b *pem.Block) { b.Bytes = b.Bytes[:8] }), "secret", "the CA key is truncated"},
+		{"unknown KDF", encrypted(func(b *pem.Block) { b.Headers["KDF"] = "scrypt" }), "secret", "unknown encryption of the CA key"},
+		{"no KDF", encrypted(func(b *pem.Block) { delete(b.Headers, "KDF") }), "secret", "unknown encryption of the CA key"},
+		{"salt not hex", encrypted(func(b *pem.Block) { b.Headers["Salt"] = "salt" }), "secret", "unknown encryption of the CA key"},
+		{"iterations not a number", encrypted(func(b *pem.Block) { b.Headers["Iterations"] = "many" }), "secret", "unknown encryption of the CA key"},
+		{"no iterations", encrypted(func(b *pem.Block) { b.Headers["Iterations"] = "0" }), "secret", "unknown encryption of the CA key"},
+	}
+	for _, test := range tests {
+		got, err := decryptKey(test.block, []byte(test.passphrase))
+		if test.err == "" {
+			if err != nil || string(got) != string(pkcs8) {
+				t.Errorf("%s: expected the key back, got %q %v", test.name, got, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%s: expected %q, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+// Test wether a generated CA loads with its passphrase and issues certificates its hosts verify with
+func TestGenerateCA(t *testing.T) {
+	if _, _, err := GenerateCA("Test CA", time.Hour, nil); err == nil {
+		t.Error("expected a CA without passphrase to be refused")
+	}
+	certPEM, keyPEM, err := GenerateCA("Test CA", 30*24*time.Hour, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem")
+	os.WriteFile(certPath, certPEM, 0o600)
+	os.WriteFile(keyPath, keyPEM, 0o600)
+	if block, _ := pem.Decode(keyPEM); block == nil || block.Type != encryptedKeyType {
+		t.Fatalf("expected an encrypted key, got %s", keyPEM)
+	}
+
+	for passphrase, expected := range map[string]string{"": "the CA key is encrypted", "wrong": "wrong passphrase for the CA key"} {
+		if _, err := LoadCA(certPath, keyPath, []byte(passphrase)); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected %q with the passphrase %q, got %v", expected, passphrase, err)
+		}
+	}
+	ca, err := LoadCA(certPath, keyPath, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ca.Leaf.IsCA || ca.Leaf.Subject.CommonName != "Test CA" {
+		t.Errorf("expected the Test CA, got %v", ca.Leaf.Subject)
+	}
+
+	authority, err := newCertAuthority(ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	for _, host := range []string{"api.example.com", "192.0.2.1", "2001:db8::1"} {
+		config, err := authority.tlsConfig(net.JoinHostPort(host, "443"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf := config.Certificates[0].Leaf
+		if _, err := leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: roots}); err != nil {
+			t.Errorf("expected the certificate of %s to verify, got %v", host, err)
+		}
+		if leaf.NotAfter.Sub(leaf.NotBefore) > leafValidity+time.Hour {
+			t.Errorf("expected the certificate of %s to be valid a week, got %v", host, leaf.NotAfter.Sub(leaf.NotBefore))
+		}
+		again, _ := authority.leaf(host)
+		if again.Leaf != leaf {
+			t.Errorf("expected the certificate of %s from the cache", host)
+		}
+	}
+}
+
+// Test wether the certificates of a CA ending soon end with it, and are issued again once about to end
+func TestLeafRenewal(t *testing.T) {
+	certPEM, keyPEM, err := GenerateCA("Short CA", 12*time.Hour, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "ca.pem"), certPEM, 0o600)
+	os.WriteFile(filepath.Join(dir, "ca-key.pem"), keyPEM, 0o600)
+	ca, err := LoadCA(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"), []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	authority, err := newCertAuthority(ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := authority.leaf("api.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !first.Leaf.NotAfter.Equal(ca.Leaf.NotAfter) {
+		t.Errorf("expected the certificate to end with the CA at %v, got %v", ca.Leaf.NotAfter, first.Leaf.NotAfter)
+	}
+	// Within a day of its end, each call issues a new one
+	second, _ := authority.leaf("api.example.com")
+	if second == first {
+		t.Error("expected a new certificate within a day of the end")
+	}
+}
+
+// Test wether keys that aren't encrypted load as they are, and certificates that aren't a CA are refused
+func TestLoadCAPlain(t *testing.T) {
+	certPEM, keyPEM, err := GenerateCA("Plain CA", time.Hour, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(keyPEM)
+	pkcs8, err := decryptKey(block, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem")
+	os.WriteFile(certPath, certPEM, 0o600)
+	os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}), 0o600)
+	ca, err := LoadCA(certPath, keyPath, nil)
+	if err != nil {
+		t.Fatalf("expected the plain key to load, got %v", err)
+	}
+
+	authority, _ := newCertAuthority(ca)
+	leaf, err := authority.leaf("api.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafKey, _ := x509.MarshalPKCS8PrivateKey(leaf.PrivateKey)
+	os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Certificate[0]}), 0o600)
+	os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: leafKey}), 0o600)
+	if _, err := LoadCA(certPath, keyPath, nil); err == nil || !strings.Contains(err.Error(), "is not a CA certificate") {
+		t.Errorf("expected the certificate of a host to be refused as a CA, got %v", err)
+	}
+}
@@ -0,0 +1,132 @@
+package sidebreaker
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+)
+
+// UpstreamTLS struct for the configuration, the TLS the sidebreaker speaks to a host on behalf of
+// its clients, with a client certificate for the hosts that require mutual TLS
+type UpstreamTLS struct {
+	Cert       string `json:"cert" doc:"PEM file of the client certificate presented to the host, with its chain" example:"/etc/sidebreaker/client.crt"`
+	Key        string `json:"key" doc:"PEM file of the private key of the client certificate" example:"/etc/sidebreaker/client.key"`
+	CA         string `json:"ca" doc:"PEM bundle of the CAs the certificate of the host is verified with, the CAs of the system when not set" example:"/etc/sidebreaker/ca.pem"`
+	ServerName string `json:"serverName" doc:"Name sent in the handshake and verified in the certificate of the host, the host when not set" example:"billing.internal"`
+}
+
+// Test wether the sidebreaker speaks TLS to the host
+func (t UpstreamTLS) enabled() bool {
+	return t != UpstreamTLS{}
+}
+
+func (t UpstreamTLS) validate() error {
+	if (t.Cert == "") != (t.Key == "") {
+		return fmt.Errorf("cert and key must be set together")
+	}
+	return nil
+}
+
+// hostTLS is the TLS configuration of a host and its client certificate, nil without one
+type hostTLS struct {
+	config *tls.Config
+	cert   *certificateFile
+}
+
+// Load the certificate and CAs of the TLS settings of a host. The client certificate is read again
+// once its files change.
+func (t UpstreamTLS) config(host string) (hostTLS, error) {
+	config := &tls.Config{ServerName: host}
+	if t.ServerName != "" {
+		config.ServerName = t.ServerName
+	}
+	var file *certificateFile
+	if t.Cert != "" {
+		var err error
+		file, err = loadCertificateFile(host, t.Cert, t.Key)
+		if err != nil {
+			return hostTLS{}, err
+		}
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return file.certificate(), nil
+		}
+	}
+	if t.CA != "" {
+		pem, err := os.ReadFile(t.CA)
+		if err != nil {
+			return hostTLS{}, fmt.Errorf("error reading the CAs of %s: %w", host, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return hostTLS{}, fmt.Errorf("no certificate in the CAs of %s at %s", host, t.CA)
+		}
+		config.RootCAs = pool
+	}
+	return hostTLS{config: config, cert: file}, nil
+}
+
+// Load the TLS settings of the hosts, the certificates and CAs are read again on every reload
+func loadUpstreamTLS(hosts []Host) (map[string]hostTLS, error) {
+	configs := map[string]hostTLS{}
+	for _, h := range hosts {
+		if !h.TLS.enabled() {
+			continue
+		}
+		config, err := h.TLS.config(h.Host)
+		if err != nil {
+			return nil, err
+		}
+		configs[h.Host] = config
+	}
+	return configs, nil
+}
+
+// The TLS configuration of a host, nil for the hosts without TLS settings
+func (s *Sidebreaker) upstreamTLSFor(host string) *tls.Config {
+	if t, ok := s.upstreamTLS.lookup(host); ok {
+		return t.config.Clone()
+	}
+	return nil
+}
+
+// Dial the TLS connections of the MITM and reverse proxy requests, with the TLS settings of the host
+// or the base configuration of the transport. The transport does the handshake.
+func (s *Sidebreaker) dialTLS(dial func(ctx context.Context, network, addr string) (net.Conn, error), base *tls.Config) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		host, _, _ := net.SplitHostPort(addr)
+		config := s.upstreamTLSFor(host)
+		if config == nil {
+			config = &tls.Config{}
+			if base != nil {
+				config = base.Clone()
+			}
+			config.ServerName = host
+		}
+		config.NextProtos = []string{"h2", "http/1.1"}
+		return tls.Client(conn, config), nil
+	}
+}
+
+// Speak TLS to a host with TLS settings on the upstream connection of a tunnel, whose client speaks
+// plain TCP
+func (s *Sidebreaker) originateTLS(ctx context.Context, host string, conn net.Conn) (net.Conn, error) {
+	config := s.upstreamTLSFor(host)
+	if config == nil {
+		return conn, nil
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		timelineFrom(ctx).add("tls failed", "error", err.Error())
+		return nil, fmt.Errorf("error in TLS handshake with %s: %w", host, err)
+	}
+	timelineFrom(ctx).add("tls done", "version", tls.VersionName(tlsConn.ConnectionState().Version))
+	return tlsConn, nil
+}
@@ -0,0 +1,183 @@
+package sidebreaker
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rubyist/circuitbreaker"
+)
+
+// NotificationPolicy struct for the configuration, controls when breaker alerts are sent
+type NotificationPolicy struct {
+	MinInterval     Duration          `json:"minInterval" doc:"Minimum milliseconds between two open alerts for a host" example:"600000"`
+	MinOpenDuration Duration          `json:"minOpenDuration" doc:"Only alert when open for longer than this many milliseconds" example:"30000"`
+	QuietHours      []QuietHours      `json:"quietHours" doc:"Daily windows in which open alerts are not sent"`
+	Slack           []SlackAlerts     `json:"slack" doc:"Slack webhooks the alerts are posted to, next to the log"`
+	PagerDuty       []PagerDutyAlerts `json:"pagerDuty" doc:"PagerDuty services an open breaker raises an incident on, resolved once it closes"`
+}
+
+// QuietHours struct, a daily window in local time (i.e. "22:00" to "07:00") in which open alerts are not sent
+type QuietHours struct {
+	Start string `json:"start" doc:"Start of the window in local time, HH:MM" example:"22:00"`
+	End   string `json:"end" doc:"End of the window in local time, HH:MM" example:"07:00"`
+}
+
+// Notification struct, describes a breaker opening or closing for a host, or a change of its vendor status
+type Notification struct {
+	Host    string
+	Event   string
+	Time    time.Time
+	OpenFor time.Duration
+	Message string
+}
+
+// Notifier is implemented by anything that can deliver breaker alerts
+type Notifier interface {
+	Notify(n Notification) error
+}
+
+// logNotifier writes alerts to the application log
+type logNotifier struct{}
+
+func (logNotifier) Notify(n Notification) error {
+	switch n.Event {
+	case "open":
+		logger.Warn("ALERT circuit breaker open", "host", n.Host, "open_for", n.OpenFor.Round(time.Millisecond).String())
+	case "closed":
+		logger.Warn("ALERT circuit breaker closed", "host", n.Host, "open_for", n.OpenFor.Round(time.Millisecond).String())
+	default:
+		logger.Warn("ALERT "+n.Event, "host", n.Host, "message", n.Message)
+	}
+	return nil
+}
+
+// policyNotifier applies the notification policy in front of a notifier so that
+// flapping breakers don't page people all night
+type policyNotifier struct {
+	policy   NotificationPolicy
+	notifier Notifier
+	// Archive of the breaker transitions, nil when the archive is disabled
+	archive *archiver
+
+	mu       sync.Mutex
+	lastSent map[string]time.Time
+}
+
+func newPolicyNotifier(policy NotificationPolicy, notifier Notifier, archive *archiver) *policyNotifier {
+	return &policyNotifier{
+		policy:   policy,
+		notifier: notifier,
+		archive:  archive,
+		lastSent: map[string]time.Time{},
+	}
+}
+
+// Notify sends the notification unless the policy suppresses it, and reports whether it was sent.
+// Close notifications always go through since they resolve an alert that was already sent.
+func (p *policyNotifier) Notify(n Notification) bool {
+	if n.Event == "open" {
+		if p.inQuietHours(n.Time) {
+			p.suppressed(n, "quiet hours")
+			return false
+		}
+		p.mu.Lock()
+		last, ok := p.lastSent[n.Host]
+		if ok && n.Time.Sub(last) < p.policy.MinInterval.Duration() {
+			p.mu.Unlock()
+			p.suppressed(n, "repeat alert")
+			return false
+		}
+		p.lastSent[n.Host] = n.Time
+		p.mu.Unlock()
+	}
+
+	if err := p.notifier.Notify(n); err != nil {
+		logger.Error("error sending notification", "host", n.Host, "event", n.Event, "error", err)
+		return false
+	}
+	return true
+}
+
+func (p *policyNotifier) suppressed(n Notification, reason string) {
+	logger.Debug("Suppressed notification", "host", n.Host, "event", n.Event, "reason", reason)
+}
+
+// Test wether t falls inside any of the configured quiet hour windows
+func (p *policyNotifier) inQuietHours(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	for _, q := range p.policy.QuietHours {
+		start, err := parseClock(q.Start)
+		if err != nil {
+			continue
+		}
+		end, err := parseClock(q.End)
+		if err != nil {
+			continue
+		}
+		// Windows such as 22:00-07:00 wrap around midnight
+		if start <= end {
+			if minute >= start && minute < end {
+				return true
+			}
+		} else if minute >= start || minute < end {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse a "15:04" clock time into minutes since midnight
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid clock time %q, expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Follow the events of a host's breaker and notify when it opens and closes.
+// An open alert is only sent once the breaker has stayed open for the configured minimum duration.
+func watchBreaker(host string, b Breakers, notifier *policyNotifier) {
+	events := b.Breaker.Subscribe()
+	minOpen := notifier.policy.MinOpenDuration.Duration()
+
+	var openedAt time.Time
+	var pending <-chan time.Time
+	alerted := false
+	for {
+		select {
+		case event := <-events:
+			switch event {
+			case circuit.BreakerTripped:
+				// Failures while already open can trip the breaker again, keep the original open time
+				if !openedAt.IsZero() {
+					continue
+				}
+				openedAt = time.Now()
+				pending = time.After(minOpen)
+				notifier.archive.transition(b.Name(), "open", openedAt)
+				if hold, flapping := b.Damper.Trip(openedAt); flapping {
+					flapCount.Add(host, 1)
+					logger.Warn("Circuit breaker is flapping, holding it open", "host", host, "state", b.State(), "hold", hold.String())
+				}
+			case circuit.BreakerReset:
+				pending = nil
+				now := time.Now()
+				if !openedAt.IsZero() {
+					notifier.archive.transition(b.Name(), "closed", now)
+				}
+				if alerted {
+					notifier.Notify(Notification{Host: host, Event: "closed", Time: now, OpenFor: now.Sub(openedAt)})
+				}
+				openedAt = time.Time{}
+				alerted = false
+			}
+		case now := <-pending:
+			pending = nil
+			alerted = notifier.Notify(Notification{Host: host, Event: "open", Time: now, OpenFor: now.Sub(openedAt)})
+		case <-b.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package sidebreaker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"time"
+)
+
+// Kinds of the parquet columns we write
+const (
+	parquetInt64 = iota
+	parquetDouble
+	parquetString
+	parquetTimestamp
+)
+
+// parquetColumn is a required column, values are int64, float64, string or time.Time following its kind
+type parquetColumn struct {
+	name   string
+	kind   int
+	values []interface{}
+}
+
+// Encode columns of the same length as a parquet file with a single row group. Each column is a
+// single uncompressed page with PLAIN encoding, which any reader understands.
+func encodeParquet(columns []parquetColumn) []byte {
+	rows := 0
+	if len(columns) > 0 {
+		rows = len(columns[0].values)
+	}
+
+	var out bytes.Buffer
+	out.WriteString("PAR1")
+	offsets := make([]int64, len(columns))
+	sizes := make([]int64, len(columns))
+	for i, c := range columns {
+		var data bytes.Buffer
+		for _, v := range c.values {
+			switch c.kind {
+			case parquetInt64:
+				binary.Write(&data, binary.LittleEndian, v.(int64))
+			case parquetTimestamp:
+				binary.Write(&data, binary.LittleEndian, v.(time.Time).UnixMilli())
+			case parquetDouble:
+				binary.Write(&data, binary.LittleEndian, math.Float64bits(v.(float64)))
+			case parquetString:
+				binary.Write(&data, binary.LittleEndian, uint32(len(v.(string))))
+				data.WriteString(v.(string))
+			}
+		}
+
+		// PageHeader
+		var page thriftWriter
+		page.i32(1, 0) // DATA_PAGE
+		page.i32(2, int32(data.Len()))
+		page.i32(3, int32(data.Len()))
+		page.structBegin(5)
+		page.i32(1, int32(rows))
+		page.i32(2, 0) // PLAIN
+		page.i32(3, 3) // RLE levels, none are written for required columns
+		page.i32(4, 3)
+		page.structEnd()
+		page.stop()
+
+		offsets[i] = int64(out.Len())
+		sizes[i] = int64(page.buf.Len() + data.Len())
+		out.Write(page.buf.Bytes())
+		out.Write(data.Bytes())
+	}
+	total := int64(out.Len() - 4)
+
+	// FileMetaData
+	var meta thriftWriter
+	meta.i32(1, 1)
+	meta.listBegin(2, thriftStruct, len(columns)+1)
+	meta.elemBegin()
+	meta.binary(4, "schema")
+	meta.i32(5, int32(len(columns)))
+	meta.elemEnd()
+	for _, c := range columns {
+		meta.elemBegin()
+		meta.i32(1, parquetPhysicalType(c.kind))
+		meta.i32(3, 0) // REQUIRED
+		meta.binary(4, c.name)
+		switch c.kind {
+		case parquetString:
+			meta.i32(6, 0) // UTF8
+		case parquetTimestamp:
+			meta.i32(6, 9) // TIMESTAMP_MILLIS
+		}
+		meta.elemEnd()
+	}
+	meta.i64(3, int64(rows))
+	meta.listBegin(4, thriftStruct, 1)
+	meta.elemBegin()
+	meta.listBegin(1, thriftStruct, len(columns))
+	for i, c := range columns {
+		meta.elemBegin()
+		meta.i64(2, offsets[i])
+		meta.structBegin(3)
+		meta.i32(1, parquetPhysicalType(c.kind))
+		meta.listBegin(2, thriftI32, 1)
+		meta.varint(zigzag(0)) // PLAIN
+		meta.listBegin(3, thriftBinary, 1)
+		meta.varint(uint64(len(c.name)))
+		meta.buf.WriteString(c.name)
+		meta.i32(4, 0) // UNCOMPRESSED
+		meta.i64(5, int64(rows))
+		meta.i64(6, sizes[i])
+		meta.i64(7, sizes[i])
+		meta.i64(9, offsets[i])
+		meta.structEnd()
+		meta.elemEnd()
+	}
+	meta.i64(2, total)
+	meta.i64(3, int64(rows))
+	meta.elemEnd()
+	meta.binary(6, "sidebreaker")
+	meta.stop()
+
+	out.Write(meta.buf.Bytes())
+	binary.Write(&out, binary.LittleEndian, uint32(meta.buf.Len()))
+	out.WriteString("PAR1")
+	return out.Bytes()
+}
+
+func parquetPhysicalType(kind int) int32 {
+	switch kind {
+	case parquetDouble:
+		return 5 // DOUBLE
+	case parquetString:
+		return 6 // BYTE_ARRAY
+	}
+	return 2 // INT64
+}
+
+// Thrift compact protocol types
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter writes the thrift compact protocol used by the parquet metadata. Fields must be
+// written in increasing order within a struct.
+type thriftWriter struct {
+	buf    bytes.Buffer
+	lastID int16
+	stack  []int16
+}
+
+func (t *thriftWriter) field(id int16, typ byte) {
+	if delta := id - t.lastID; delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		t.buf.WriteByte(typ)
+		t.varint(zigzag(int64(id)))
+	}
+	t.lastID = id
+}
+
+func (t *thriftWriter) varint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	t.buf.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+func zigzag(v int64) uint64 {
+	return uint64((v << 1) ^ (v >> 63))
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.varint(zigzag(int64(v)))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.varint(zigzag(v))
+}
+
+func (t *thriftWriter) binary(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.varint(uint64(len(s)))
+	t.buf.WriteString(s)
+}
+
+func (t *thriftWriter) structBegin(id int16) {
+	t.field(id, thriftStruct)
+	t.elemBegin()
+}
+
+func (t *thriftWriter) structEnd() {
+	t.elemEnd()
+}
+
+// A struct element of a list, its fields are numbered from scratch
+func (t *thriftWriter) elemBegin() {
+	t.stack = append(t.stack, t.lastID)
+	t.lastID = 0
+}
+
+func (t *thriftWriter) elemEnd() {
+	t.stop()
+	t.lastID = t.stack[len(t.stack)-1]
+	t.stack = t.stack[:len(t.stack)-1]
+}
+
+func (t *thriftWriter) listBegin(id int16, elemType byte, size int) {
+	t.field(id, thriftList)
+	if size < 15 {
+		t.buf.WriteByte(byte(size)<<4 | elemType)
+	} else {
+		t.buf.WriteByte(0xf0 | elemType)
+		t.varint(uint64(size))
+	}
+}
+
+func (t *thriftWriter) stop() {
+	t.buf.WriteByte(0)
+}
@@ -0,0 +1,171 @@
+package sidebreaker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Test wether the thrift compact protocol encodes field headers, integers, strings and lists
+func TestThriftWriter(t *testing.T) {
+	tests := []struct {
+		name     string
+		write    func(w *thriftWriter)
+		expected []byte
+	}{
+		{"small i32", func(w *thriftWriter) { w.i32(1, 1) }, []byte{0x15, 0x02}},
+		{"negative i32", func(w *thriftWriter) { w.i32(1, -1) }, []byte{0x15, 0x01}},
+		{"i64 over a byte", func(w *thriftWriter) { w.i64(2, 300) }, []byte{0x26, 0xd8, 0x04}},
+		{"field delta", func(w *thriftWriter) { w.i32(1, 0); w.i32(4, 0) }, []byte{0x15, 0x00, 0x35, 0x00}},
+		{"field delta over 15", func(w *thriftWriter) { w.i32(20, 0) }, []byte{0x05, 0x28, 0x00}},
+		{"binary", func(w *thriftWriter) { w.binary(4, "abc") }, []byte{0x48, 0x03, 'a', 'b', 'c'}},
+		{"short list", func(w *thriftWriter) { w.listBegin(2, thriftI32, 3) }, []byte{0x29, 0x35}},
+		{"long list", func(w *thriftWriter) { w.listBegin(2, thriftStruct, 20) }, []byte{0x29, 0xfc, 0x14}},
+		{"nested struct numbers its fields from scratch", func(w *thriftWriter) {
+			w.i32(3, 0)
+			w.structBegin(5)
+			w.i32(1, 0)
+			w.structEnd()
+			w.i32(6, 0)
+		}, []byte{0x35, 0x00, 0x2c, 0x15, 0x00, 0x00, 0x15, 0x00}},
+	}
+	for _, test := range tests {
+		var w thriftWriter
+		test.write(&w)
+		if got := w.buf.Bytes(); !bytes.Equal(got, test.expected) {
+			t.Errorf("%s: expected % x, got % x", test.name, test.expected, got)
+		}
+	}
+}
+
+// Test wether zigzag maps signed integers to small unsigned ones
+func TestZigzag(t *testing.T) {
+	for v, expected := range map[int64]uint64{0: 0, -1: 1, 1: 2, -2: 3, 2147483647: 4294967294, math.MinInt64: math.MaxUint64} {
+		if got := zigzag(v); got != expected {
+			t.Errorf("expected %d for %d, got %d", expected, v, got)
+		}
+	}
+}
+
+// thriftReader decodes the thrift compact protocol, structs as maps by field id
+type thriftReader struct {
+	r *bytes.Reader
+}
+
+func (t thriftReader) varint() int64 {
+	v, _ := binary.ReadUvarint(t.r)
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (t thriftReader) value(typ byte) interface{} {
+	switch typ {
+	case thriftI32, thriftI64:
+		return t.varint()
+	case thriftBinary:
+		n, _ := binary.ReadUvarint(t.r)
+		b := make([]byte, n)
+		t.r.Read(b)
+		return string(b)
+	case thriftList:
+		header, _ := t.r.ReadByte()
+		size := int(header >> 4)
+		if size == 15 {
+			n, _ := binary.ReadUvarint(t.r)
+			size = int(n)
+		}
+		list := []interface{}{}
+		for i := 0; i < size; i++ {
+			list = append(list, t.value(header&0x0f))
+		}
+		return list
+	case thriftStruct:
+		fields := map[int16]interface{}{}
+		var id int16
+		for {
+			header, _ := t.r.ReadByte()
+			if header == 0 {
+				return fields
+			}
+			if delta := header >> 4; delta != 0 {
+				id += int16(delta)
+			} else {
+				id = int16(t.varint())
+			}
+			fields[id] = t.value(header & 0x0f)
+		}
+	}
+	return nil
+}
+
+// Test wether the parquet files hold the columns in their pages and describe them in the footer
+func TestEncodeParquet(t *testing.T) {
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	columns := []parquetColumn{
+		{name: "time", kind: parquetTimestamp, values: []interface{}{start, start.Add(time.Minute)}},
+		{name: "host", kind: parquetString, values: []interface{}{"api.example.com", "db"}},
+		{name: "requests", kind: parquetInt64, values: []interface{}{int64(10), int64(-3)}},
+		{name: "errorRate", kind: parquetDouble, values: []interface{}{0.5, 0.25}},
+	}
+	file := encodeParquet(columns)
+	if !bytes.HasPrefix(file, []byte("PAR1")) || !bytes.HasSuffix(file, []byte("PAR1")) {
+		t.Fatalf("expected the PAR1 magic at both ends")
+	}
+	length := binary.LittleEndian.Uint32(file[len(file)-8:])
+	footer := file[len(file)-8-int(length) : len(file)-8]
+	meta := thriftReader{bytes.NewReader(footer)}.value(thriftStruct).(map[int16]interface{})
+	if meta[1] != int64(1) || meta[3] != int64(2) || meta[6] != "sidebreaker" {
+		t.Errorf("expected version 1 with 2 rows created by sidebreaker, got %v %v %v", meta[1], meta[3], meta[6])
+	}
+
+	schema := meta[2].([]interface{})
+	expectedSchema := []map[int16]interface{}{
+		{4: "schema", 5: int64(4)},
+		{1: int64(2), 3: int64(0), 4: "time", 6: int64(9)},
+		{1: int64(6), 3: int64(0), 4: "host", 6: int64(0)},
+		{1: int64(2), 3: int64(0), 4: "requests"},
+		{1: int64(5), 3: int64(0), 4: "errorRate"},
+	}
+	for i, expected := range expectedSchema {
+		if !reflect.DeepEqual(schema[i], expected) {
+			t.Errorf("expected schema element %v, got %v", expected, schema[i])
+		}
+	}
+
+	group := meta[4].([]interface{})[0].(map[int16]interface{})
+	if group[3] != int64(2) || group[2] != int64(len(file)-12-int(length)) {
+		t.Errorf("expected a row group of 2 rows and %d bytes, got %v rows and %v bytes", len(file)-12-int(length), group[3], group[2])
+	}
+	expectedData := [][]byte{
+		append(le(start.UnixMilli()), le(start.Add(time.Minute).UnixMilli())...),
+		[]byte("\x0f\x00\x00\x00api.example.com\x02\x00\x00\x00db"),
+		append(le(int64(10)), le(int64(-3))...),
+		append(le(math.Float64bits(0.5)), le(math.Float64bits(0.25))...),
+	}
+	for i, chunk := range group[1].([]interface{}) {
+		column := chunk.(map[int16]interface{})[3].(map[int16]interface{})
+		if !reflect.DeepEqual(column[3], []interface{}{columns[i].name}) || column[5] != int64(2) || column[4] != int64(0) {
+			t.Errorf("expected the uncompressed chunk of %s with 2 values, got %v", columns[i].name, column)
+		}
+		offset := column[9].(int64)
+		r := bytes.NewReader(file[offset:])
+		page := thriftReader{r}.value(thriftStruct).(map[int16]interface{})
+		size := page[2].(int64)
+		if header := int64(r.Size()) - int64(r.Len()); header+size != column[6] {
+			t.Errorf("expected the chunk of %s to be %v bytes, got %d", columns[i].name, column[6], header+size)
+		}
+		data := file[offset+int64(r.Size())-int64(r.Len()):][:size]
+		if !bytes.Equal(data, expectedData[i]) {
+			t.Errorf("expected the values of %s to be % x, got % x", columns[i].name, expectedData[i], data)
+		}
+	}
+}
+
+// Little endian bytes of a value
+func le(v interface{}) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, v)
+	return b.Bytes()
+}
@@ -0,0 +1,176 @@
+package sidebreaker
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Passthrough struct for the configuration, a port whose connections are forwarded to an upstream
+// as they are, for clients such as database drivers that can't use a proxy
+type Passthrough struct {
+	Port     int    `json:"port" doc:"Port the connections are accepted on" example:"5432"`
+	Upstream string `json:"upstream" doc:"host:port the connections are forwarded to, through the breaker of the host in the hosts" example:"db.internal:5432"`
+	SNI      bool   `json:"sni" doc:"Forward TLS connections to the server name of their ClientHello, on the port of the upstream (443 when not set), connections without one go to the upstream" example:"false"`
+}
+
+// Name of the listener of the passthrough, for the metrics and restarts
+func (p Passthrough) name() string {
+	return "passthrough-" + strconv.Itoa(p.Port)
+}
+
+func (p Passthrough) validate() error {
+	if p.SNI && p.Upstream == "" {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(p.Upstream)
+	if err != nil || (host == "" && !p.SNI) || port == "" {
+		return fmt.Errorf("upstream must be host:port, or :port with sni, got %q", p.Upstream)
+	}
+	return nil
+}
+
+// The upstream of a connection, the server name of its ClientHello when the passthrough reads it
+func (p Passthrough) upstream(serverName string) string {
+	if serverName == "" {
+		return p.Upstream
+	}
+	port := "443"
+	if _, upstreamPort, err := net.SplitHostPort(p.Upstream); err == nil {
+		port = upstreamPort
+	}
+	return net.JoinHostPort(serverName, port)
+}
+
+// passthroughConn is a client of a passthrough, it doesn't speak HTTP so the tunnel never answers it with a status
+type passthroughConn struct {
+	net.Conn
+}
+
+// Tunnels half close the client connection once the upstream is done
+func (c *passthroughConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
+
+// Answer the client of a CONNECT with a status, passthrough clients are only closed
+func answerConnect(client net.Conn, status string, headers ...string) {
+	if _, ok := client.(*passthroughConn); ok {
+		return
+	}
+	answer := "HTTP/1.1 " + status + "\r\n"
+	for _, h := range headers {
+		answer += h + "\r\n"
+	}
+	client.Write([]byte(answer + "\r\n"))
+}
+
+// Accept the connections of a passthrough and tunnel them to its upstream until ctx is done
+func (s *Sidebreaker) servePassthrough(ctx context.Context, l net.Listener, p Passthrough) error {
+	logger.Info("Passthrough listening", "address", l.Addr().String(), "upstream", p.Upstream)
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return fmt.Errorf("error serving passthrough %d: %w", p.Port, err)
+			}
+			// Out of file descriptors and the like, wait for connections to close
+			logger.Warn("Error accepting a passthrough connection", "port", p.Port, "error", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go s.passthrough(conn, p)
+	}
+}
+
+// Tunnel a passthrough connection like a CONNECT to the upstream
+func (s *Sidebreaker) passthrough(conn net.Conn, p Passthrough) {
+	var serverName string
+	if p.SNI {
+		var err error
+		serverName, conn, err = peekServerName(conn)
+		if err != nil {
+			logger.Debug("No server name in the connection of the passthrough", "port", p.Port, "error", err)
+		}
+	}
+	upstream := p.upstream(serverName)
+	host, _, _ := net.SplitHostPort(upstream)
+	if _, ok := s.hosts.get(host); !ok {
+		logger.Warn("No host in the configuration for the upstream of the passthrough, closing the connection", "port", p.Port, "upstream", upstream)
+		conn.Close()
+		return
+	}
+	req := &http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Host: upstream},
+		Host:       upstream,
+		Header:     http.Header{},
+		RemoteAddr: conn.RemoteAddr().String(),
+	}
+	ctx := &goproxy.ProxyCtx{Req: req, Session: ownSession()}
+	tun, refused := s.openTunnel(req, ctx, true)
+	if refused != nil {
+		conn.Close()
+		return
+	}
+	tun.run(&passthroughConn{Conn: conn})
+}
+
+// How long a passthrough with sni waits for the ClientHello of a connection
+const clientHelloTimeout = 10 * time.Second
+
+// The ClientHello was read, the handshake is left to the upstream
+var errClientHelloRead = errors.New("client hello read")
+
+// Read the server name of the TLS ClientHello of a connection. The returned connection reads the
+// ClientHello again so the upstream gets the handshake as the client sent it.
+func peekServerName(conn net.Conn) (string, net.Conn, error) {
+	var hello bytes.Buffer
+	var serverName string
+	conn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	err := tls.Server(readOnlyConn{Conn: conn, reader: io.TeeReader(conn, &hello)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = info.ServerName
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+	conn.SetReadDeadline(time.Time{})
+	replay := &bufferedConn{Conn: conn, reader: io.MultiReader(&hello, conn)}
+	if !errors.Is(err, errClientHelloRead) {
+		return "", replay, err
+	}
+	return serverName, replay, nil
+}
+
+// readOnlyConn lets the TLS server read the ClientHello without answering the client
+type readOnlyConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c readOnlyConn) Write(p []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
@@ -0,0 +1,153 @@
+package sidebreaker
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// addressPin keeps the new connections to a host on one of its resolved addresses for the pin
+// duration, so a burst of requests reuses the connections and caches of a single upstream, then
+// moves on to the next address.
+type addressPin struct {
+	duration time.Duration
+
+	mu      sync.Mutex
+	address string
+	until   time.Time
+}
+
+// Create the address pins of the hosts with a pin duration, hosts whose pin duration didn't change keep their address
+func (s *Sidebreaker) setupAddressPins(hosts []Host) {
+	s.addressPins.update(func(current map[string]*addressPin) map[string]*addressPin {
+		pins := map[string]*addressPin{}
+		for _, h := range hosts {
+			if h.PinDuration <= 0 {
+				continue
+			}
+			if p, ok := current[h.Host]; ok && p.duration == h.PinDuration.Duration() {
+				pins[h.Host] = p
+			} else {
+				pins[h.Host] = &addressPin{duration: h.PinDuration.Duration()}
+			}
+		}
+		return pins
+	})
+}
+
+// The address to dial for the host, looked up again once the pin expires or its address is ejected.
+// The next address after the one pinned is taken so the connections rotate over all the addresses of
+// the host, or the first in the order of its balancer.
+func (p *addressPin) resolve(ctx context.Context, host string, lookup func(context.Context) ([]string, error), b *balancer) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	if p.address != "" && now.Before(p.until) && !b.ejected(p.address) {
+		return p.address, nil
+	}
+	addrs, err := lookup(ctx)
+	if err != nil {
+		return "", err
+	}
+	next := 0
+	if b != nil {
+		addrs = b.order(addrs)
+	} else {
+		for i, a := range addrs {
+			if a == p.address {
+				next = (i + 1) % len(addrs)
+				break
+			}
+		}
+	}
+	if addrs[next] != p.address {
+		logger.Debug("Pinned the connections of the host to an address", "host", host, "address", addrs[next], "previous", p.address)
+	}
+	p.address = addrs[next]
+	p.until = now.Add(p.duration)
+	return p.address, nil
+}
+
+// Release the pin when the pinned address fails, the next connection moves on
+func (p *addressPin) failed(address string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.address == address {
+		p.until = time.Time{}
+	}
+}
+
+// Dial an upstream address, on the pinned address of its host when it has a pin duration. Hosts with
+// an upstream proxy are reached through it, the others are dialed on the addresses they list, on the targets of their SRV record or on the addresses they
+// resolve to, in the order of their balancer. A pin keeps the connections on one of them.
+func (s *Sidebreaker) pinnedDial(ctx context.Context, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	r := s.resolver
+	t := timelineFrom(ctx)
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return resolveDial(ctx, r, t, dialer, network, addr)
+	}
+	if proxy := s.upstreamProxies.get(host); proxy != nil {
+		return proxyDial(ctx, r, t, dialer, proxy, addr)
+	}
+	ctx = s.egress.withCheck(ctx, host)
+	srv, hasSRV := s.srvRecords.lookup(host)
+	b := s.balancers.get(host)
+	p := s.addressPins.get(host)
+	if p == nil && b == nil && !hasSRV {
+		return resolveDial(ctx, r, t, dialer, network, addr)
+	}
+
+	// Pins only rotate over the SRV targets of the first priority
+	lookup := func(ctx context.Context, preferred bool) ([]string, error) {
+		switch {
+		case b != nil && len(b.addresses) > 0:
+			return b.addresses, nil
+		case hasSRV:
+			targets, err := srv.lookup(ctx, r, preferred)
+			if err != nil {
+				t.add("srv failed", "error", err.Error())
+				return nil, err
+			}
+			t.add("srv resolved", "targets", targets)
+			return targets, nil
+		default:
+			addrs, cached, err := r.lookupHost(ctx, host)
+			if err == nil {
+				if addrs = addressesFor(network, addrs); len(addrs) == 0 {
+					err = &net.DNSError{Err: "no suitable address found", Name: host, IsNotFound: true}
+				}
+			}
+			if err != nil {
+				t.add("dns failed", "error", err.Error(), "cached", cached)
+				return nil, err
+			}
+			t.add("dns done", "addresses", addrs, "cached", cached)
+			return addrs, nil
+		}
+	}
+	var addrs []string
+	if p != nil {
+		pinned, err := p.resolve(ctx, host, func(ctx context.Context) ([]string, error) { return lookup(ctx, true) }, b)
+		if err != nil {
+			return nil, err
+		}
+		addrs = []string{pinned}
+	} else {
+		if addrs, err = lookup(ctx, false); err != nil {
+			return nil, err
+		}
+		addrs = b.order(addrs)
+		if b != nil && b.strategy != "" {
+			t.add("balanced", "strategy", b.strategy, "addresses", addrs)
+		}
+	}
+	return dialInTurn(ctx, addrs, func(ctx context.Context, a string) (net.Conn, error) {
+		conn, err := resolveDial(ctx, r, t, dialer, network, endpointAddr(a, port))
+		if err != nil && p != nil {
+			p.failed(a)
+		}
+		return b.connected(a, conn, err), err
+	})
+}
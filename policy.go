@@ -0,0 +1,250 @@
+package sidebreaker
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Variables that can be used in a policy expression
+var policyVariables = map[string]func(v policyValues) float64{
+	"consecutive": func(v policyValues) float64 { return float64(v.consecutive) },
+	"failures":    func(v policyValues) float64 { return float64(v.failures) },
+	"successes":   func(v policyValues) float64 { return float64(v.successes) },
+	"samples":     func(v policyValues) float64 { return float64(v.failures + v.successes) },
+	"rate":        func(v policyValues) float64 { return v.rate },
+	"latency":     func(v policyValues) float64 { return v.latency },
+}
+
+// policyValues are the current values of the policy variables for a breaker
+type policyValues struct {
+	consecutive int64
+	failures    int64
+	successes   int64
+	rate        float64 // error rate as a percentage
+	latency     float64 // moving average of the call latency in milliseconds
+}
+
+// breakerPolicy trips a breaker when its expression holds, i.e. "consecutive >= 5 || rate >= 50 && samples >= 20 || latency > 800".
+// && binds tighter than || and parenthesis can be used for grouping.
+type breakerPolicy struct {
+	expr policyExpr
+
+	mu      sync.Mutex
+	latency float64
+}
+
+// Weight of the latest call in the latency moving average
+const latencyWeight = 0.2
+
+// Record the latency of a call and report whether the breaker should trip
+func (p *breakerPolicy) observe(cb Breaker, latency time.Duration) bool {
+	ms := float64(latency) / float64(time.Millisecond)
+	p.mu.Lock()
+	if p.latency == 0 {
+		p.latency = ms
+	} else {
+		p.latency = latencyWeight*ms + (1-latencyWeight)*p.latency
+	}
+	v := policyValues{
+		consecutive: cb.ConsecFailures(),
+		failures:    cb.Failures(),
+		successes:   cb.Successes(),
+		rate:        cb.ErrorRate() * 100,
+		latency:     p.latency,
+	}
+	p.mu.Unlock()
+	return p.expr.eval(v)
+}
+
+// Forget the latency history, used once the breaker closes again
+func (p *breakerPolicy) reset() {
+	p.mu.Lock()
+	p.latency = 0
+	p.mu.Unlock()
+}
+
+// policyExpr is a node of a parsed policy expression
+type policyExpr interface {
+	eval(v policyValues) bool
+}
+
+type policyOr []policyExpr
+
+func (e policyOr) eval(v policyValues) bool {
+	for _, x := range e {
+		if x.eval(v) {
+			return true
+		}
+	}
+	return false
+}
+
+type policyAnd []policyExpr
+
+func (e policyAnd) eval(v policyValues) bool {
+	for _, x := range e {
+		if !x.eval(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// policyCondition compares a variable to a number, i.e. "rate >= 50"
+type policyCondition struct {
+	variable string
+	op       string
+	value    float64
+}
+
+func (c policyCondition) eval(v policyValues) bool {
+	x := policyVariables[c.variable](v)
+	switch c.op {
+	case ">=":
+		return x >= c.value
+	case ">":
+		return x > c.value
+	case "<=":
+		return x <= c.value
+	case "<":
+		return x < c.value
+	default:
+		return x == c.value
+	}
+}
+
+// Parse a policy expression
+func parsePolicy(s string) (*breakerPolicy, error) {
+	tokens, err := tokenizePolicy(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &policyParser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in policy %q", p.tokens[p.pos], s)
+	}
+	return &breakerPolicy{expr: expr}, nil
+}
+
+// Split a policy expression into identifiers, numbers, operators and parenthesis
+func tokenizePolicy(s string) ([]string, error) {
+	tokens := []string{}
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, string(c))
+			i++
+		case strings.HasPrefix(s[i:], "&&"), strings.HasPrefix(s[i:], "||"),
+			strings.HasPrefix(s[i:], ">="), strings.HasPrefix(s[i:], "<="), strings.HasPrefix(s[i:], "=="):
+			tokens = append(tokens, s[i:i+2])
+			i += 2
+		case c == '>' || c == '<':
+			tokens = append(tokens, string(c))
+			i++
+		case unicode.IsLetter(c) || unicode.IsDigit(c) || c == '.':
+			j := i
+			for j < len(s) && (unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j])) || s[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected %q in policy %q", c, s)
+		}
+	}
+	return tokens, nil
+}
+
+// policyParser is a recursive descent parser over the policy tokens
+type policyParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *policyParser) next() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+	return t
+}
+
+func (p *policyParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *policyParser) parseOr() (policyExpr, error) {
+	or := policyOr{}
+	for {
+		and, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		or = append(or, and)
+		if p.peek() != "||" {
+			return or, nil
+		}
+		p.next()
+	}
+}
+
+func (p *policyParser) parseAnd() (policyExpr, error) {
+	and := policyAnd{}
+	for {
+		term, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		and = append(and, term)
+		if p.peek() != "&&" {
+			return and, nil
+		}
+		p.next()
+	}
+}
+
+func (p *policyParser) parseTerm() (policyExpr, error) {
+	if p.peek() == "(" {
+		p.next()
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing closing parenthesis in policy")
+		}
+		return expr, nil
+	}
+
+	variable := p.next()
+	if _, ok := policyVariables[variable]; !ok {
+		return nil, fmt.Errorf("unknown policy variable %q", variable)
+	}
+	op := p.next()
+	switch op {
+	case ">=", ">", "<=", "<", "==":
+	default:
+		return nil, fmt.Errorf("expected a comparison after %q in policy, got %q", variable, op)
+	}
+	number := p.next()
+	value, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return nil, fmt.Errorf("expected a number after %q in policy, got %q", variable+" "+op, number)
+	}
+	return policyCondition{variable, op, value}, nil
+}
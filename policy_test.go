@@ -0,0 +1,98 @@
+package sidebreaker
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rubyist/circuitbreaker"
+)
+
+// Test wether policy expressions evaluate with && binding tighter than || and parenthesis grouping
+func TestPolicyEval(t *testing.T) {
+	values := policyValues{consecutive: 3, failures: 10, successes: 30, rate: 25, latency: 900}
+	tests := []struct {
+		policy   string
+		expected bool
+	}{
+		{"consecutive >= 3", true},
+		{"consecutive > 3", false},
+		{"consecutive == 3", true},
+		{"consecutive < 3", false},
+		{"consecutive <= 3", true},
+		{"samples >= 40", true},
+		{"rate >= 50 && samples >= 20", false},
+		{"rate >= 20 && samples >= 20", true},
+		{"consecutive >= 5 || rate >= 50 && samples >= 20 || latency > 800", true},
+		{"consecutive >= 5 || rate >= 50 && samples >= 20", false},
+		{"(consecutive >= 5 || rate >= 20) && samples >= 50", false},
+		{"consecutive >= 5 || rate >= 20 && samples >= 50", false},
+		{"(consecutive >= 5 || rate >= 20) && (samples >= 50 || latency > 800)", true},
+		{"latency > 899.5", true},
+		{"failures>=10&&successes<31", true},
+	}
+	for _, test := range tests {
+		p, err := parsePolicy(test.policy)
+		if err != nil {
+			t.Errorf("expected %q to parse, got %v", test.policy, err)
+			continue
+		}
+		if got := p.expr.eval(values); got != test.expected {
+			t.Errorf("expected %q to be %v, got %v", test.policy, test.expected, got)
+		}
+	}
+}
+
+// Test wether invalid policy expressions are refused with the part that is wrong
+func TestPolicyErrors(t *testing.T) {
+	tests := []struct {
+		policy string
+		err    string
+	}{
+		{"", `unknown policy variable ""`},
+		{"errors >= 5", `unknown policy variable "errors"`},
+		{"consecutive 5", `expected a comparison after "consecutive" in policy, got "5"`},
+		{"consecutive = 5", `unexpected '='`},
+		{"consecutive >= many", `expected a number after "consecutive >=" in policy, got "many"`},
+		{"consecutive >=", `expected a number after "consecutive >=" in policy, got ""`},
+		{"(consecutive >= 5", "missing closing parenthesis in policy"},
+		{"consecutive >= 5)", `unexpected ")" in policy`},
+		{"consecutive >= 5 rate >= 50", `unexpected "rate" in policy`},
+		{"consecutive >= 5 ||", `unknown policy variable ""`},
+		{"consecutive >= 5 & rate >= 50", `unexpected '&'`},
+	}
+	for _, test := range tests {
+		_, err := parsePolicy(test.policy)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("expected error %q for %q, got %v", test.err, test.policy, err)
+		}
+	}
+}
+
+// Test wether the latency of the policy is a moving average of the calls that starts over on reset
+func TestPolicyObserve(t *testing.T) {
+	p, err := parsePolicy("latency > 100 || consecutive >= 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cb := newTimedBreaker(func(*circuit.Breaker) bool { return false })
+	if p.observe(cb, 50*time.Millisecond) {
+		t.Error("expected no trip at 50ms")
+	}
+	// 0.2 * 300 + 0.8 * 50 = 100, not over the limit yet
+	if p.observe(cb, 300*time.Millisecond) {
+		t.Errorf("expected no trip at an average of %vms", p.latency)
+	}
+	if !p.observe(cb, 300*time.Millisecond) {
+		t.Errorf("expected a trip at an average of %vms", p.latency)
+	}
+	p.reset()
+	if p.observe(cb, 50*time.Millisecond) {
+		t.Errorf("expected the average to start over, got %vms", p.latency)
+	}
+	cb.Fail()
+	cb.Fail()
+	if !p.observe(cb, 50*time.Millisecond) {
+		t.Error("expected a trip after 2 consecutive failures")
+	}
+}
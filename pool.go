@@ -0,0 +1,87 @@
+package sidebreaker
+
+import (
+	"context"
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+)
+
+// ConnectionPool tunes the idle connections kept to the upstreams of plain HTTP, MITM and reverse
+// proxy requests, so requests reuse them instead of dialing each time
+type ConnectionPool struct {
+	MaxIdle        int      `json:"maxIdle" doc:"Idle connections kept over all upstreams, 100 by default" example:"100"`
+	MaxIdlePerHost int      `json:"maxIdlePerHost" doc:"Idle connections kept to each upstream, 16 by default" example:"16"`
+	IdleTimeout    Duration `json:"idleTimeout" doc:"How long an idle connection is kept before it is closed, 90s by default" example:"90s"`
+	MaxPerHost     int      `json:"maxPerHost" doc:"Connections open to each upstream, idle or not, requests beyond it wait for one to be free, no limit when not set" example:"64"`
+}
+
+// Defaults of the pool, those of net/http keep 2 idle connections per host and never close them
+const (
+	defaultMaxIdle        = 100
+	defaultMaxIdlePerHost = 16
+	defaultIdleTimeout    = Duration(90_000)
+)
+
+// Connections of the pool by upstream: open now, dialed and reused, as api.example.com.open
+var pooledConnections = expvar.NewMap("pooledConnections")
+
+// Set the pool of the transport of the requests
+func setupPool(tr *http.Transport, config ConnectionPool) {
+	tr.MaxIdleConns = config.MaxIdle
+	if tr.MaxIdleConns == 0 {
+		tr.MaxIdleConns = defaultMaxIdle
+	}
+	tr.MaxIdleConnsPerHost = config.MaxIdlePerHost
+	if tr.MaxIdleConnsPerHost == 0 {
+		tr.MaxIdleConnsPerHost = defaultMaxIdlePerHost
+	}
+	idle := config.IdleTimeout
+	if idle == 0 {
+		idle = defaultIdleTimeout
+	}
+	tr.IdleConnTimeout = idle.Duration()
+	tr.MaxConnsPerHost = config.MaxPerHost
+}
+
+// pooledConn is a connection of the pool counted as open until it is closed
+type pooledConn struct {
+	net.Conn
+	host string
+	once sync.Once
+}
+
+func (c *pooledConn) Close() error {
+	c.once.Do(func() { pooledConnections.Add(c.host+".open", -1) })
+	return c.Conn.Close()
+}
+
+// Count the connections dialed for the pool
+func pooledDial(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		pooledConnections.Add(host+".dialed", 1)
+		pooledConnections.Add(host+".open", 1)
+		return &pooledConn{Conn: conn, host: host}, nil
+	}
+}
+
+// Count the requests to host sent over a connection of the pool
+func withPoolTrace(ctx context.Context, host string) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				pooledConnections.Add(host+".reused", 1)
+			}
+		},
+	})
+}
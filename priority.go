@@ -0,0 +1,159 @@
+package sidebreaker
+
+import (
+	"expvar"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Priority classes of the requests, from the first shed to the never shed
+const (
+	priorityLow      = "low"
+	priorityNormal   = "normal"
+	priorityCritical = "critical"
+)
+
+var priorityClasses = []string{priorityLow, priorityNormal, priorityCritical}
+
+// A class is only shed while a higher class called the host within this window
+const priorityWindow = 10 * time.Second
+
+// Requests shed by host and class, as api.example.com.low
+var shedRequests = expvar.NewMap("shedRequests")
+
+// Priority struct for the configuration, the classes of the requests to a host and when they are shed
+type Priority struct {
+	Header       string         `json:"header" doc:"Header of the requests naming their class: critical, normal or low, X-Priority by default" example:"X-Priority"`
+	Paths        []PriorityPath `json:"paths" doc:"Classes of the requests by path prefix, for requests whose header names none"`
+	Default      string         `json:"default" doc:"Class of the other requests, normal by default" example:"normal"`
+	ShedLowAt    float64        `json:"shedLowAt" doc:"Percent of the way to tripping from which low requests are shed, 50 by default" example:"50"`
+	ShedNormalAt float64        `json:"shedNormalAt" doc:"Percent of the way to tripping from which normal requests are shed too, 90 by default" example:"90"`
+}
+
+// PriorityPath struct for the configuration, the class of the requests under a path prefix
+type PriorityPath struct {
+	Prefix string `json:"prefix" doc:"Path prefix of the requests" example:"/reports"`
+	Class  string `json:"class" doc:"Class of the requests: critical, normal or low" example:"low"`
+}
+
+func (p Priority) enabled() bool {
+	return p.Header != "" || len(p.Paths) > 0 || p.Default != "" || p.ShedLowAt > 0 || p.ShedNormalAt > 0
+}
+
+// The class a request is in: the one its header names, the one of the longest prefix of its path or
+// the default
+func (p Priority) classOf(req *http.Request) string {
+	header := p.Header
+	if header == "" {
+		header = "X-Priority"
+	}
+	if class := strings.ToLower(req.Header.Get(header)); priorityRank(class) >= 0 {
+		return class
+	}
+	class, longest := "", -1
+	for _, path := range p.Paths {
+		if strings.HasPrefix(req.URL.Path, path.Prefix) && len(path.Prefix) > longest {
+			class, longest = path.Class, len(path.Prefix)
+		}
+	}
+	if class != "" {
+		return class
+	}
+	if p.Default != "" {
+		return p.Default
+	}
+	return priorityNormal
+}
+
+// Rank of a class, higher is more important, -1 for unknown classes
+func priorityRank(class string) int {
+	for i, c := range priorityClasses {
+		if c == class {
+			return i
+		}
+	}
+	return -1
+}
+
+// Percent of the way to tripping from which a class is shed, over 100 for the classes never shed
+func (p Priority) shedAt(class string) float64 {
+	switch class {
+	case priorityLow:
+		if p.ShedLowAt > 0 {
+			return p.ShedLowAt
+		}
+		return 50
+	case priorityNormal:
+		if p.ShedNormalAt > 0 {
+			return p.ShedNormalAt
+		}
+		return 90
+	}
+	return 101
+}
+
+// When each class last called a breaker, by breaker name
+var (
+	prioritySeen   = map[string]*[3]atomic.Int64{}
+	prioritySeenMu sync.Mutex
+)
+
+func prioritySeenFor(name string) *[3]atomic.Int64 {
+	prioritySeenMu.Lock()
+	defer prioritySeenMu.Unlock()
+	seen, ok := prioritySeen[name]
+	if !ok {
+		seen = &[3]atomic.Int64{}
+		prioritySeen[name] = seen
+	}
+	return seen
+}
+
+// How close the breaker is to tripping in percent, 100 once tripped. The failures are those of the
+// window of the breaker so a host that stopped failing recovers without a success.
+func (b Breakers) degradation() float64 {
+	if b.Breaker.Tripped() {
+		return 100
+	}
+	level := 0.0
+	if b.Host.Threshold > 0 {
+		failures := b.Breaker.Failures()
+		if b.Host.BreakType == "consecutive" {
+			failures = min(failures, b.Breaker.ConsecFailures())
+		}
+		level = float64(failures) / float64(b.Host.Threshold)
+	}
+	if b.Host.BreakType == "rate" && b.Host.Rate > 0 {
+		// The rate breakers need 100 calls before they trip
+		samples := b.Breaker.Failures() + b.Breaker.Successes()
+		level = max(level, b.Breaker.ErrorRate()/(b.Host.Rate/100)*min(float64(samples)/100, 1))
+	}
+	return min(level*100, 100)
+}
+
+// Test wether a request should be shed, when the host is degraded enough for its class. Classes are
+// only shed while a higher class keeps calling the host, so its calls still test the host and close
+// the breaker again. Critical requests are never shed.
+func (b Breakers) shed(req *http.Request) (string, bool) {
+	if !b.Host.Priority.enabled() {
+		return "", false
+	}
+	class := b.Host.Priority.classOf(req)
+	rank := priorityRank(class)
+	now := time.Now().UnixNano()
+	seen := prioritySeenFor(b.Host.Host)
+	seen[rank].Store(now)
+	if b.degradation() < b.Host.Priority.shedAt(class) {
+		return class, false
+	}
+	for higher := rank + 1; higher < len(priorityClasses); higher++ {
+		if now-seen[higher].Load() < int64(priorityWindow) {
+			shedRequests.Add(b.Host.Host+"."+class, 1)
+			return class, true
+		}
+	}
+	return class, false
+}
@@ -0,0 +1,261 @@
+package sidebreaker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// protocolInspector follows the start of a tunnel to find failures of the upstream that don't show as
+// connection errors, such as a database rejecting logins. It sees the bytes sent in each direction.
+type protocolInspector interface {
+	fromClient(p []byte)
+	fromServer(p []byte)
+	// Err returns the protocol failure found in the tunnel, if any
+	Err() error
+}
+
+// Protocols available for the protocol setting of a host
+var protocols = map[string]func(host Host) protocolInspector{
+	"mysql":    func(host Host) protocolInspector { return &mysqlInspector{} },
+	"postgres": func(host Host) protocolInspector { return &postgresInspector{} },
+	"redis":    func(host Host) protocolInspector { return &redisInspector{host: host.Host} },
+	"amqp":     func(host Host) protocolInspector { return newAMQPInspector(host) },
+	"kafka":    func(host Host) protocolInspector { return newKafkaInspector(host) },
+	"smtp":     func(host Host) protocolInspector { return newSMTPInspector(host) },
+	"ssh":      func(host Host) protocolInspector { return newSSHInspector(host) },
+	"ftp":      func(host Host) protocolInspector { return newFTPInspector(host) },
+}
+
+// Create the inspector for the protocol of a host, nil when the host doesn't use a known protocol or
+// the protocol feature is off for this tunnel. FTP always gets one, its passive ports are found by it.
+func newProtocolInspector(host Host, flag *FeatureFlag) protocolInspector {
+	f, ok := protocols[host.Protocol]
+	if ok && (host.Protocol == "ftp" || flag.enabled("protocol", host.Host)) {
+		return f(host)
+	}
+	return nil
+}
+
+// Wrap a connection so everything read from it is seen by the inspector
+func inspectReader(r io.Reader, inspect func(p []byte)) io.Reader {
+	return &inspectingReader{r, inspect}
+}
+
+type inspectingReader struct {
+	io.Reader
+	inspect func(p []byte)
+}
+
+func (r *inspectingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.inspect(p[:n])
+	}
+	return n, err
+}
+
+// Inspectors give up once this many bytes are buffered without finding the end of the handshake
+const maxInspectedBytes = 64 * 1024
+
+// inspectorState is shared by the inspectors, once done they ignore the rest of the tunnel
+type inspectorState struct {
+	mu        sync.Mutex
+	clientBuf []byte
+	serverBuf []byte
+	done      bool
+	err       error
+}
+
+func (s *inspectorState) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Append bytes to a buffer, reporting false when the inspector should give up
+func (s *inspectorState) buffer(buf *[]byte, p []byte) bool {
+	if s.done {
+		return false
+	}
+	*buf = append(*buf, p...)
+	if len(*buf) > maxInspectedBytes {
+		s.done = true
+		return false
+	}
+	return true
+}
+
+// Capability flag sent by MySQL clients that want to switch to TLS
+const mysqlClientSSL = 0x00000800
+
+// mysqlInspector finds ERR packets sent by the server before the login completes,
+// such as authentication failures or too many connections
+type mysqlInspector struct {
+	inspectorState
+}
+
+// Take the payload of the next complete packet from the buffer
+func nextMySQLPacket(buf *[]byte) ([]byte, bool) {
+	b := *buf
+	if len(b) < 4 {
+		return nil, false
+	}
+	length := int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+	if len(b) < 4+length {
+		return nil, false
+	}
+	*buf = b[4+length:]
+	return b[4 : 4+length], true
+}
+
+func (m *mysqlInspector) fromClient(p []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.buffer(&m.clientBuf, p) {
+		return
+	}
+	for {
+		payload, ok := nextMySQLPacket(&m.clientBuf)
+		if !ok {
+			return
+		}
+		// A short login request with the SSL flag switches to TLS, nothing more can be inspected
+		if len(payload) == 32 && binary.LittleEndian.Uint32(payload)&mysqlClientSSL != 0 {
+			m.done = true
+			return
+		}
+	}
+}
+
+func (m *mysqlInspector) fromServer(p []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.buffer(&m.serverBuf, p) {
+		return
+	}
+	for {
+		payload, ok := nextMySQLPacket(&m.serverBuf)
+		if !ok {
+			return
+		}
+		if len(payload) == 0 {
+			continue
+		}
+		switch payload[0] {
+		case 0xff:
+			m.err = mysqlError(payload)
+			m.done = true
+			return
+		case 0x00:
+			// OK packet, the login completed
+			m.done = true
+			return
+		}
+	}
+}
+
+// Describe a MySQL ERR packet
+func mysqlError(payload []byte) error {
+	if len(payload) < 3 {
+		return fmt.Errorf("mysql error")
+	}
+	code := binary.LittleEndian.Uint16(payload[1:3])
+	message := payload[3:]
+	if len(message) >= 6 && message[0] == '#' {
+		message = message[6:]
+	}
+	return fmt.Errorf("mysql error %d: %s", code, message)
+}
+
+// Codes of the Postgres requests to switch the connection to TLS or GSS encryption
+const (
+	postgresSSLRequest    = 80877103
+	postgresGSSEncRequest = 80877104
+)
+
+// postgresInspector finds ErrorResponse messages sent by the server before it is ready for queries,
+// such as authentication failures or the database starting up
+type postgresInspector struct {
+	inspectorState
+	started      bool
+	pendingReply bool
+}
+
+func (m *postgresInspector) fromClient(p []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.started || !m.buffer(&m.clientBuf, p) {
+		return
+	}
+	// Only the untyped messages at the start are interesting, they can ask for encryption
+	for len(m.clientBuf) >= 8 {
+		code := binary.BigEndian.Uint32(m.clientBuf[4:])
+		if code != postgresSSLRequest && code != postgresGSSEncRequest {
+			m.started = true
+			m.clientBuf = nil
+			return
+		}
+		m.pendingReply = true
+		m.clientBuf = m.clientBuf[8:]
+	}
+}
+
+func (m *postgresInspector) fromServer(p []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.buffer(&m.serverBuf, p) {
+		return
+	}
+	for len(m.serverBuf) > 0 {
+		// Encryption requests get a single byte answer, when accepted the rest is encrypted
+		if m.pendingReply {
+			reply := m.serverBuf[0]
+			m.serverBuf = m.serverBuf[1:]
+			m.pendingReply = false
+			if reply == 'S' || reply == 'G' {
+				m.done = true
+				return
+			}
+			continue
+		}
+
+		if len(m.serverBuf) < 5 {
+			return
+		}
+		length := int(binary.BigEndian.Uint32(m.serverBuf[1:]))
+		if length < 4 {
+			// Not Postgres after all
+			m.done = true
+			return
+		}
+		if len(m.serverBuf) < 1+length {
+			return
+		}
+		kind, body := m.serverBuf[0], m.serverBuf[5:1+length]
+		m.serverBuf = m.serverBuf[1+length:]
+		switch kind {
+		case 'E':
+			m.err = postgresError(body)
+			m.done = true
+			return
+		case 'Z':
+			// ReadyForQuery, the login completed
+			m.done = true
+			return
+		}
+	}
+}
+
+// Describe a Postgres ErrorResponse from its severity, code and message fields
+func postgresError(body []byte) error {
+	fields := map[byte]string{}
+	for _, field := range bytes.Split(body, []byte{0}) {
+		if len(field) > 1 {
+			fields[field[0]] = string(field[1:])
+		}
+	}
+	return fmt.Errorf("postgres %s %s: %s", fields['S'], fields['C'], fields['M'])
+}
@@ -0,0 +1,138 @@
+package sidebreaker
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// A part of a tunnel, sent by the client or by the server
+type exchange struct {
+	client bool
+	data   string
+}
+
+func clientSends(data string) exchange {
+	return exchange{client: true, data: data}
+}
+
+func serverSends(data string) exchange {
+	return exchange{data: data}
+}
+
+// Feed the exchanges of a tunnel to an inspector, each whole or a byte at a time as if split over reads
+func inspectTunnel(m protocolInspector, exchanges []exchange, split bool) {
+	for _, e := range exchanges {
+		send := m.fromServer
+		if e.client {
+			send = m.fromClient
+		}
+		if !split {
+			send([]byte(e.data))
+			continue
+		}
+		for i := 0; i < len(e.data); i++ {
+			send([]byte{e.data[i]})
+		}
+	}
+}
+
+// Error of an inspector as a string, empty without error
+func inspectorErr(m protocolInspector) string {
+	if err := m.Err(); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// MySQL packet with its sequence number
+func mysqlPacket(seq byte, payload string) string {
+	n := len(payload)
+	return string([]byte{byte(n), byte(n >> 8), byte(n >> 16), seq}) + payload
+}
+
+// Test wether the MySQL errors before the end of the login are found, also in packets split over
+// reads, and nothing is looked at once the login completed or the connection switched to TLS
+func TestMySQLInspector(t *testing.T) {
+	greeting := mysqlPacket(0, "\x0a8.0.36\x00\x08\x00\x00\x00abcdefgh\x00\xff\xf7")
+	login := mysqlPacket(1, "\x05\xa6\x0f\x00\x00\x00\x00\x01\x21"+string(make([]byte, 23))+"app\x00\x14"+string(make([]byte, 20)))
+	sslRequest := mysqlPacket(1, "\x05\xae\x0f\x00\x00\x00\x00\x01\x21"+string(make([]byte, 23)))
+	ok := mysqlPacket(2, "\x00\x00\x00\x02\x00\x00\x00")
+	accessDenied := mysqlPacket(2, "\xff\x15\x04#28000Access denied for user 'app'@'10.0.0.5'")
+	tests := []struct {
+		name      string
+		exchanges []exchange
+		expected  string
+	}{
+		{"login", []exchange{serverSends(greeting), clientSends(login), serverSends(ok)}, ""},
+		{"access denied", []exchange{serverSends(greeting), clientSends(login), serverSends(accessDenied)}, "mysql error 1045: Access denied for user 'app'@'10.0.0.5'"},
+		{"too many connections", []exchange{serverSends(mysqlPacket(0, "\xff\x10\x04Too many connections"))}, "mysql error 1040: Too many connections"},
+		{"short ERR", []exchange{serverSends(mysqlPacket(0, "\xff"))}, "mysql error"},
+		{"ERR after the login", []exchange{serverSends(greeting), clientSends(login), serverSends(ok + accessDenied)}, ""},
+		{"packets in a single read", []exchange{serverSends(greeting + accessDenied)}, "mysql error 1045: Access denied for user 'app'@'10.0.0.5'"},
+		{"SSL request", []exchange{serverSends(greeting), clientSends(sslRequest), serverSends(accessDenied)}, ""},
+		{"empty packet", []exchange{serverSends(mysqlPacket(0, "")), serverSends(accessDenied)}, "mysql error 1045: Access denied for user 'app'@'10.0.0.5'"},
+	}
+	for _, test := range tests {
+		for _, split := range []bool{false, true} {
+			m := &mysqlInspector{}
+			inspectTunnel(m, test.exchanges, split)
+			if got := inspectorErr(m); got != test.expected {
+				t.Errorf("%s (split %v): expected %q, got %q", test.name, split, test.expected, got)
+			}
+		}
+	}
+}
+
+// Postgres message of a kind
+func postgresMessage(kind byte, body string) string {
+	header := []byte{kind, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(header[1:], uint32(len(body)+4))
+	return string(header) + body
+}
+
+// Postgres message without kind sent by clients at the start, such as the SSLRequest
+func postgresStart(code uint32, body string) string {
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header, uint32(len(body)+8))
+	binary.BigEndian.PutUint32(header[4:], code)
+	return string(header) + body
+}
+
+// Test wether the Postgres errors before the server is ready for queries are found, also in messages
+// split over reads, and nothing is looked at once the connection is encrypted
+func TestPostgresInspector(t *testing.T) {
+	startup := postgresStart(196608, "user\x00app\x00database\x00billing\x00\x00")
+	sslRequest := postgresStart(postgresSSLRequest, "")
+	gssRequest := postgresStart(postgresGSSEncRequest, "")
+	authFailed := postgresMessage('E', "SFATAL\x00VFATAL\x00C28P01\x00Mpassword authentication failed for user \"app\"\x00\x00")
+	starting := postgresMessage('E', "SFATAL\x00C57P03\x00Mthe database system is starting up\x00\x00")
+	ready := postgresMessage('R', "\x00\x00\x00\x00") + postgresMessage('S', "server_version\x0016.2\x00") +
+		postgresMessage('K', "\x00\x00\x30\x39\x12\x34\x56\x78") + postgresMessage('Z', "I")
+	tests := []struct {
+		name      string
+		exchanges []exchange
+		expected  string
+	}{
+		{"ready for query", []exchange{clientSends(startup), serverSends(ready)}, ""},
+		{"error after ready", []exchange{clientSends(startup), serverSends(ready), serverSends(authFailed)}, ""},
+		{"authentication failed", []exchange{clientSends(startup), serverSends(postgresMessage('R', "\x00\x00\x00\x05salt")), clientSends(postgresMessage('p', "md5abc\x00")), serverSends(authFailed)},
+			`postgres FATAL 28P01: password authentication failed for user "app"`},
+		{"starting up", []exchange{clientSends(startup), serverSends(starting)}, "postgres FATAL 57P03: the database system is starting up"},
+		{"SSLRequest accepted", []exchange{clientSends(sslRequest), serverSends("S"), serverSends(authFailed)}, ""},
+		{"SSLRequest refused", []exchange{clientSends(sslRequest), serverSends("N"), clientSends(startup), serverSends(starting)}, "postgres FATAL 57P03: the database system is starting up"},
+		{"GSSENCRequest accepted", []exchange{clientSends(gssRequest), serverSends("G"), serverSends(authFailed)}, ""},
+		{"GSSENCRequest refused then SSLRequest", []exchange{clientSends(gssRequest), serverSends("N"), clientSends(sslRequest), serverSends("N"), clientSends(startup), serverSends(authFailed)},
+			`postgres FATAL 28P01: password authentication failed for user "app"`},
+		{"refusal and error in a single read", []exchange{clientSends(sslRequest + startup), serverSends("N" + starting)}, "postgres FATAL 57P03: the database system is starting up"},
+		{"not postgres", []exchange{clientSends(startup), serverSends("E\x00\x00\x00\x02" + authFailed)}, ""},
+	}
+	for _, test := range tests {
+		for _, split := range []bool{false, true} {
+			m := &postgresInspector{}
+			inspectTunnel(m, test.exchanges, split)
+			if got := inspectorErr(m); got != test.expected {
+				t.Errorf("%s (split %v): expected %q, got %q", test.name, split, test.expected, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package sidebreaker
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"expvar"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+)
+
+// ProxyAuth struct for the configuration, the credentials the clients of the proxy port must send
+// in Proxy-Authorization, so only the processes that know one can use the proxy. The admin endpoints
+// take the same settings for Authorization.
+type ProxyAuth struct {
+	Users  []string `json:"users" secret:"password" doc:"Clients allowed with basic auth, as user:password" example:"billing:s3cret"`
+	Tokens []string `json:"tokens" secret:"true" doc:"Static tokens allowed as bearer tokens"`
+	File   string   `json:"file" doc:"File with more credentials, one user:password or token per line, lines starting with # are skipped" example:"/etc/sidebreaker/clients"`
+	Env    string   `json:"env" doc:"Environment variable with more credentials, user:password or tokens separated by commas" example:"SIDEBREAKER_CLIENTS"`
+}
+
+// Test wether the clients must authenticate
+func (a ProxyAuth) enabled() bool {
+	return len(a.Users) > 0 || len(a.Tokens) > 0 || a.File != "" || a.Env != ""
+}
+
+func (a ProxyAuth) validate() error {
+	for _, u := range a.Users {
+		if strings.IndexByte(u, ':') <= 0 {
+			return fmt.Errorf("users must be user:password")
+		}
+	}
+	return nil
+}
+
+// Calls refused for missing or wrong credentials
+var proxyAuthFailures = expvar.NewInt("proxyAuthFailures")
+
+// Realm of the challenges of the proxy
+const proxyAuthRealm = `realm="sidebreaker"`
+
+// credentials checks the authorization header of the calls. Only hashes of the credentials are kept.
+type credentials struct {
+	basic  map[[sha256.Size]byte]bool
+	bearer map[[sha256.Size]byte]bool
+}
+
+// Gather the credentials of the configuration, its file and its environment variable. A file or
+// variable without credentials leaves every call refused rather than the proxy open.
+func newCredentials(config ProxyAuth) (*credentials, error) {
+	if !config.enabled() {
+		return nil, nil
+	}
+	a := &credentials{basic: map[[sha256.Size]byte]bool{}, bearer: map[[sha256.Size]byte]bool{}}
+	for _, u := range config.Users {
+		a.add(u)
+	}
+	for _, t := range config.Tokens {
+		a.bearer[sha256.Sum256([]byte(t))] = true
+	}
+	if config.File != "" {
+		data, err := os.ReadFile(config.File)
+		if err != nil {
+			return nil, fmt.Errorf("error reading credentials: %w", err)
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+				a.add(line)
+			}
+		}
+	}
+	if config.Env != "" {
+		for _, c := range strings.Split(os.Getenv(config.Env), ",") {
+			if c = strings.TrimSpace(c); c != "" {
+				a.add(c)
+			}
+		}
+	}
+	if len(a.basic) == 0 && len(a.bearer) == 0 {
+		logger.Warn("No credentials found, every call will be refused", "file", config.File, "env", config.Env)
+	}
+	return a, nil
+}
+
+// Add a credential, user:password for basic auth and a token otherwise
+func (a *credentials) add(credential string) {
+	if strings.Contains(credential, ":") {
+		a.basic[sha256.Sum256([]byte(credential))] = true
+	} else {
+		a.bearer[sha256.Sum256([]byte(credential))] = true
+	}
+}
+
+// Test wether the value of an authorization header is one of the credentials
+func (a *credentials) allows(authorization string) bool {
+	scheme, value, _ := strings.Cut(authorization, " ")
+	switch strings.ToLower(scheme) {
+	case "basic":
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		return err == nil && a.basic[sha256.Sum256(decoded)]
+	case "bearer":
+		return a.bearer[sha256.Sum256([]byte(strings.TrimSpace(value)))]
+	}
+	return false
+}
+
+// Calls without valid credentials. Only the CONNECT calls and the plain requests carry them, the
+// requests decrypted from a MITM session pass on the credentials of its CONNECT.
+func (a *credentials) unauthorized() goproxy.ReqConditionFunc {
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		data := dataOf(ctx)
+		if req.Method != http.MethodConnect && data.authorized {
+			return false
+		}
+		if a.allows(req.Header.Get("Proxy-Authorization")) {
+			if req.Method == http.MethodConnect {
+				data.authorized = true
+			}
+			return false
+		}
+		proxyAuthFailures.Add(1)
+		logger.Debug("Refusing a call without valid proxy credentials", "client", req.RemoteAddr, "destination", req.URL.Host, "request_id", ctx.Session, "correlation_id", correlationID(ctx))
+		return true
+	}
+}
+
+// The 407 answer of a call without valid credentials
+func (a *credentials) challenge(req *http.Request) *http.Response {
+	resp := goproxy.NewResponse(req, goproxy.ContentTypeText, http.StatusProxyAuthRequired, "Proxy authentication required")
+	// The answer to a CONNECT is written as is
+	resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+	a.addChallenges(resp.Header, "Proxy-Authenticate")
+	return resp
+}
+
+// Add a challenge per kind of credential
+func (a *credentials) addChallenges(header http.Header, name string) {
+	if len(a.basic) > 0 || len(a.bearer) == 0 {
+		header.Add(name, "Basic "+proxyAuthRealm)
+	}
+	if len(a.bearer) > 0 {
+		header.Add(name, "Bearer "+proxyAuthRealm)
+	}
+}
+
+// Calls to the admin endpoints refused for missing or wrong credentials
+var adminAuthFailures = expvar.NewInt("adminAuthFailures")
+
+// Require the credentials in the Authorization of the requests to the admin endpoints
+func (a *credentials) protect(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !a.allows(req.Header.Get("Authorization")) {
+			adminAuthFailures.Add(1)
+			a.addChallenges(w.Header(), "WWW-Authenticate")
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// Refuse the plain HTTP requests and CONNECT calls without valid credentials, registered before the
+// other handlers so it takes precedence
+func (a *credentials) register(proxy *goproxy.ProxyHttpServer) {
+	proxy.OnRequest(a.unauthorized()).DoFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		return req, a.challenge(req)
+	})
+	proxy.OnRequest(a.unauthorized()).HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		ctx.Resp = a.challenge(ctx.Req)
+		return goproxy.RejectConnect, host
+	})
+}
@@ -0,0 +1,83 @@
+package sidebreaker
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Test wether the credentials are checked on the CONNECT and the plain requests, and the requests
+// decrypted from a MITM session pass with the credentials of its CONNECT
+func TestProxyAuthMitm(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer server.Close()
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer plain.Close()
+
+	auth, err := newCredentials(ProxyAuth{Users: []string{"billing:s3cret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.Tr = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	auth.register(proxy)
+	proxy.OnRequest().HandleConnect(goproxy.AlwaysMitm)
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+
+	tests := []struct {
+		name     string
+		user     *url.Userinfo
+		target   string
+		expected int
+	}{
+		{"MITM with credentials", url.UserPassword("billing", "s3cret"), server.URL, http.StatusOK},
+		{"MITM with wrong credentials", url.UserPassword("billing", "wrong"), server.URL, http.StatusProxyAuthRequired},
+		{"MITM without credentials", nil, server.URL, http.StatusProxyAuthRequired},
+		{"plain with credentials", url.UserPassword("billing", "s3cret"), plain.URL, http.StatusOK},
+		{"plain without credentials", nil, plain.URL, http.StatusProxyAuthRequired},
+	}
+	for _, test := range tests {
+		before := proxyAuthFailures.Value()
+		proxyURL, _ := url.Parse(proxyServer.URL)
+		proxyURL.User = test.user
+		client := &http.Client{
+			Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+			Timeout:   5 * time.Second,
+		}
+		// Several requests over the session, none of them with the credentials of the CONNECT
+		for i := 0; i < 2; i++ {
+			status := 0
+			resp, err := client.Get(test.target)
+			if err == nil {
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				status = resp.StatusCode
+			} else if strings.Contains(err.Error(), "Proxy Authentication Required") {
+				status = http.StatusProxyAuthRequired
+			}
+			if status != test.expected {
+				t.Errorf("%s: expected %d, got %d %v", test.name, test.expected, status, err)
+			}
+		}
+		client.CloseIdleConnections()
+		expected := int64(0)
+		if test.expected != http.StatusOK {
+			expected = 2
+		}
+		if got := proxyAuthFailures.Value() - before; got != expected {
+			t.Errorf("%s: expected %d calls refused, got %d", test.name, expected, got)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package sidebreaker
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProxyProtocol struct for the configuration, the PROXY protocol header load balancers put in front
+// of the connections they forward so the sidebreaker sees the address of the client
+type ProxyProtocol struct {
+	Accept  bool     `json:"accept" doc:"Read a PROXY protocol v1 or v2 header on the connections of the proxy, reverse proxy and passthrough ports, connections without one are closed" example:"false"`
+	Trusted []string `json:"trusted" doc:"Networks the headers are read from, as CIDR or IP, other connections are served with their own address, any network when empty" example:"10.0.0.0/8"`
+}
+
+// Versions of the PROXY protocol a host can be sent
+const (
+	proxyProtocolV1 = "v1"
+	proxyProtocolV2 = "v2"
+)
+
+// Headers read by version (v1, v2) and the connections closed for a missing or invalid header (invalid)
+var proxyProtocolHeaders = expvar.NewMap("proxyProtocolHeaders")
+
+// How long a connection has to send its PROXY protocol header
+const proxyHeaderTimeout = 10 * time.Second
+
+// Signature starting the binary header of version 2
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// The header is missing, malformed or of an unknown version
+var errProxyHeader = errors.New("invalid PROXY protocol header")
+
+// proxyProtocolListener reads the PROXY protocol header of the connections from the trusted networks
+type proxyProtocolListener struct {
+	net.Listener
+	trusted networks
+}
+
+// Read the PROXY protocol header of the connections of l when the configuration accepts it
+func acceptProxyProtocol(l net.Listener, config ProxyProtocol) net.Listener {
+	if !config.Accept {
+		return l
+	}
+	// Validated with the configuration
+	trusted, _ := parseNetworks(config.Trusted)
+	return &proxyProtocolListener{Listener: l, trusted: trusted}
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil || (len(l.trusted) > 0 && !l.trusted.contain(conn.RemoteAddr())) {
+		return conn, err
+	}
+	return &proxyProtocolConn{Conn: conn}, nil
+}
+
+// proxyProtocolConn is a connection starting with a PROXY protocol header. The header is read on the
+// first read or call of RemoteAddr, in the goroutine serving the connection rather than in Accept.
+type proxyProtocolConn struct {
+	net.Conn
+	once   sync.Once
+	reader *bufio.Reader
+	remote net.Addr
+	err    error
+	// The allowed clients the address of the header is checked against, when they are set
+	allowed *allowListener
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.reader = bufio.NewReader(c.Conn)
+		var version string
+		c.remote, version, c.err = readProxyHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err != nil {
+			proxyProtocolHeaders.Add("invalid", 1)
+			logger.Debug("Closing a connection without a valid PROXY protocol header", "address", c.Conn.RemoteAddr().String(), "error", c.err)
+			c.Conn.Close()
+			return
+		}
+		proxyProtocolHeaders.Add(version, 1)
+		remote := c.remote
+		if remote == nil {
+			remote = c.Conn.RemoteAddr()
+		}
+		if c.allowed != nil && !c.allowed.allows(remote) {
+			c.err = errClientNotAllowed
+			c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyProtocolConn) Read(p []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(p)
+}
+
+// The address of the client in the header, the address of the connection for health checks of the
+// load balancer that send none
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remote == nil {
+		return c.Conn.RemoteAddr()
+	}
+	return c.remote
+}
+
+// Tunnels half close the client connection once the upstream is done
+func (c *proxyProtocolConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Close()
+}
+
+// Read a PROXY protocol header of version 1 or 2 with its version. The address is nil when the
+// header has none, for the LOCAL command and the UNKNOWN protocol.
+func readProxyHeader(r *bufio.Reader) (net.Addr, string, error) {
+	// The shortest version 1 header is shorter than the signature of version 2, and the client may
+	// wait for the server once it is sent
+	start, err := r.Peek(6)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %w", errProxyHeader, err)
+	}
+	if bytes.Equal(start, []byte("PROXY ")) {
+		addr, err := readProxyHeaderV1(r)
+		return addr, proxyProtocolV1, err
+	}
+	if !bytes.HasPrefix(proxyV2Signature, start) {
+		return nil, "", errProxyHeader
+	}
+	addr, err := readProxyHeaderV2(r)
+	return addr, proxyProtocolV2, err
+}
+
+// Version 1 is a line such as PROXY TCP4 192.0.2.1 198.51.100.1 56324 443, of 107 bytes at most
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", errProxyHeader, err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("%w: line too long", errProxyHeader)
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: %q", errProxyHeader, strings.TrimSpace(string(line)))
+	}
+	ip, err := netip.ParseAddr(fields[2])
+	port, perr := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil || perr != nil || ip.Is4() != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("%w: %q", errProxyHeader, strings.TrimSpace(string(line)))
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))), nil
+}
+
+// Version 2 is the signature, the version and command, the family, the length of the addresses and
+// the addresses, followed by extensions that are skipped
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("%w: %w", errProxyHeader, err)
+	}
+	if !bytes.Equal(header[:12], proxyV2Signature) {
+		return nil, errProxyHeader
+	}
+	if header[12]>>4 != 2 || header[12]&0xf > 1 {
+		return nil, fmt.Errorf("%w: version and command %#x", errProxyHeader, header[12])
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("%w: %w", errProxyHeader, err)
+	}
+	// The LOCAL command comes from the load balancer itself, as its health checks
+	if header[12]&0xf == 0 {
+		return nil, nil
+	}
+	switch header[13] {
+	case 0x11, 0x12:
+		if len(body) < 12 {
+			return nil, fmt.Errorf("%w: short IPv4 addresses", errProxyHeader)
+		}
+		ip := netip.AddrFrom4([4]byte(body[0:4]))
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, binary.BigEndian.Uint16(body[8:10]))), nil
+	case 0x21, 0x22:
+		if len(body) < 36 {
+			return nil, fmt.Errorf("%w: short IPv6 addresses", errProxyHeader)
+		}
+		ip := netip.AddrFrom16([16]byte(body[0:16]))
+		return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, binary.BigEndian.Uint16(body[32:34]))), nil
+	}
+	// Unix sockets and unspecified families have no address to use
+	return nil, nil
+}
+
+// Set up the versions of the PROXY protocol header sent to the hosts on each new connection
+func (s *Sidebreaker) setupProxyProtocols(hosts []Host) {
+	versions := map[string]string{}
+	for _, h := range hosts {
+		if h.ProxyProtocol != "" {
+			versions[h.Host] = h.ProxyProtocol
+		}
+	}
+	s.proxyProtocols.update(func(map[string]string) map[string]string { return versions })
+}
+
+// The client a connection to an upstream is opened for
+type clientAddrKey struct{}
+
+func withClientAddr(ctx context.Context, addr string) context.Context {
+	return context.WithValue(ctx, clientAddrKey{}, addr)
+}
+
+// Send the PROXY protocol header on a new connection to a host that wants one, with the address of
+// the client of ctx. The connection is closed when the header can't be written.
+func (s *Sidebreaker) sendProxyHeader(ctx context.Context, host string, conn net.Conn) (net.Conn, error) {
+	version := s.proxyProtocols.get(host)
+	if version == "" {
+		return conn, nil
+	}
+	client, _ := ctx.Value(clientAddrKey{}).(string)
+	src, _ := netip.ParseAddrPort(client)
+	dst, _ := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if _, err := conn.Write(proxyHeader(version, src, dst)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error sending PROXY protocol header: %w", err)
+	}
+	timelineFrom(ctx).add("proxy protocol sent", "version", version, "client", client)
+	return conn, nil
+}
+
+// The header of a version for a connection from src to dst. Without a client, as for connections
+// opened before any request, the header says so and the host uses the address of the connection.
+func proxyHeader(version string, src, dst netip.AddrPort) []byte {
+	if !src.IsValid() || !dst.IsValid() {
+		if version == proxyProtocolV1 {
+			return []byte("PROXY UNKNOWN\r\n")
+		}
+		// LOCAL command, unspecified family
+		return append(append([]byte(nil), proxyV2Signature...), 0x20, 0x00, 0x00, 0x00)
+	}
+	// Both addresses are of the same family, IPv4 ones are mapped when the other is IPv6
+	v4 := src.Addr().Unmap().Is4() && dst.Addr().Unmap().Is4()
+	if v4 {
+		src = netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+		dst = netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port())
+	} else {
+		src = netip.AddrPortFrom(netip.AddrFrom16(src.Addr().As16()), src.Port())
+		dst = netip.AddrPortFrom(netip.AddrFrom16(dst.Addr().As16()), dst.Port())
+	}
+
+	if version == proxyProtocolV1 {
+		family := "TCP6"
+		if v4 {
+			family = "TCP4"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, src.Addr(), dst.Addr(), src.Port(), dst.Port()))
+	}
+
+	header := append([]byte(nil), proxyV2Signature...)
+	var body []byte
+	family := byte(0x21)
+	if v4 {
+		family = 0x11
+		s, d := src.Addr().As4(), dst.Addr().As4()
+		body = append(append(body, s[:]...), d[:]...)
+	} else {
+		s, d := src.Addr().As16(), dst.Addr().As16()
+		body = append(append(body, s[:]...), d[:]...)
+	}
+	body = binary.BigEndian.AppendUint16(body, src.Port())
+	body = binary.BigEndian.AppendUint16(body, dst.Port())
+	header = append(header, 0x21, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(body)))
+	return append(header, body...)
+}
@@ -0,0 +1,190 @@
+package sidebreaker
+
+import (
+	"bufio"
+	"errors"
+	"expvar"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// Version 2 header with the command, family and addresses given as bytes
+func proxyV2(command byte, family byte, body ...byte) string {
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, command, family, byte(len(body)>>8), byte(len(body)))
+	return string(append(header, body...))
+}
+
+// Test wether the PROXY protocol headers of both versions give the address of the client, and the
+// data after them is left for the connection
+func TestReadProxyHeader(t *testing.T) {
+	v4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb}
+	src, dst := netip.MustParseAddr("2001:db8::1").As16(), netip.MustParseAddr("2001:db8::2").As16()
+	v6 := append(append(src[:], dst[:]...), 0xdc, 0x04, 0x01, 0xbb)
+	tests := []struct {
+		name     string
+		header   string
+		addr     string
+		version  string
+		err      bool
+		trailing string
+	}{
+		{name: "v1 TCP4", header: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", addr: "192.0.2.1:56324", version: proxyProtocolV1},
+		{name: "v1 TCP6", header: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", addr: "[2001:db8::1]:56324", version: proxyProtocolV1},
+		{name: "v1 UNKNOWN", header: "PROXY UNKNOWN\r\n", version: proxyProtocolV1},
+		{name: "v1 UNKNOWN with addresses", header: "PROXY UNKNOWN ffff:f...f:ffff 65535 65535\r\n", version: proxyProtocolV1},
+		{name: "v1 followed by data", header: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET / HTTP/1.1\r\n", addr: "192.0.2.1:56324", version: proxyProtocolV1, trailing: "GET / HTTP/1.1\r\n"},
+		{name: "v1 IPv6 address as TCP4", header: "PROXY TCP4 2001:db8::1 198.51.100.1 56324 443\r\n", err: true},
+		{name: "v1 IPv4 address as TCP6", header: "PROXY TCP6 192.0.2.1 198.51.100.1 56324 443\r\n", err: true},
+		{name: "v1 unknown family", header: "PROXY UDP4 192.0.2.1 198.51.100.1 56324 443\r\n", err: true},
+		{name: "v1 port out of range", header: "PROXY TCP4 192.0.2.1 198.51.100.1 65536 443\r\n", err: true},
+		{name: "v1 missing field", header: "PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n", err: true},
+		{name: "v1 without CRLF", header: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n", err: true},
+		{name: "v1 too long", header: "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", err: true},
+		{name: "v1 cut short", header: "PROXY TCP4 192.0.2.1", err: true},
+		{name: "v2 TCP4", header: proxyV2(0x21, 0x11, v4...), addr: "192.0.2.1:56324", version: proxyProtocolV2},
+		{name: "v2 UDP4", header: proxyV2(0x21, 0x12, v4...), addr: "192.0.2.1:56324", version: proxyProtocolV2},
+		{name: "v2 TCP6", header: proxyV2(0x21, 0x21, v6...), addr: "[2001:db8::1]:56324", version: proxyProtocolV2},
+		{name: "v2 with extensions", header: proxyV2(0x21, 0x11, append(v4, 0x04, 0x00, 0x01, 'x')...) + "data", addr: "192.0.2.1:56324", version: proxyProtocolV2, trailing: "data"},
+		{name: "v2 LOCAL", header: proxyV2(0x20, 0x11, v4...), version: proxyProtocolV2},
+		{name: "v2 unix socket", header: proxyV2(0x21, 0x31, make([]byte, 216)...), version: proxyProtocolV2},
+		{name: "v2 short IPv4 addresses", header: proxyV2(0x21, 0x11, v4[:8]...), err: true},
+		{name: "v2 short IPv6 addresses", header: proxyV2(0x21, 0x21, v4...), err: true},
+		{name: "v2 version 1", header: proxyV2(0x11, 0x11, v4...), err: true},
+		{name: "v2 unknown command", header: proxyV2(0x22, 0x11, v4...), err: true},
+		{name: "v2 cut short", header: proxyV2(0x21, 0x11, v4...)[:20], err: true},
+		{name: "v2 bad signature", header: "\r\n\r\n\x00\r\nQUIX\n" + proxyV2(0x21, 0x11, v4...)[12:], err: true},
+		{name: "no header", header: "GET / HTTP/1.1\r\n\r\n", err: true},
+		{name: "empty", header: "", err: true},
+	}
+	for _, test := range tests {
+		r := bufio.NewReader(strings.NewReader(test.header))
+		addr, version, err := readProxyHeader(r)
+		if test.err {
+			if !errors.Is(err, errProxyHeader) {
+				t.Errorf("%s: expected an invalid header, got %v %v", test.name, addr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: expected no error, got %v", test.name, err)
+			continue
+		}
+		if version != test.version {
+			t.Errorf("%s: expected version %s, got %s", test.name, test.version, version)
+		}
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != test.addr {
+			t.Errorf("%s: expected address %q, got %q", test.name, test.addr, got)
+		}
+		if rest, _ := io.ReadAll(r); string(rest) != test.trailing {
+			t.Errorf("%s: expected %q after the header, got %q", test.name, test.trailing, rest)
+		}
+	}
+}
+
+// Test wether the headers sent to the hosts are read back as the client they were sent for
+func TestProxyHeaderRoundTrip(t *testing.T) {
+	tests := []struct {
+		src, dst string
+		expected string
+		v1       string
+	}{
+		{"192.0.2.1:56324", "198.51.100.1:443", "192.0.2.1:56324", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"},
+		{"[2001:db8::1]:56324", "[2001:db8::2]:443", "[2001:db8::1]:56324", "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"},
+		{"[::ffff:192.0.2.1]:56324", "198.51.100.1:443", "192.0.2.1:56324", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"},
+		// IPv4 clients of IPv6 hosts are sent mapped and read back as IPv4
+		{"192.0.2.1:56324", "[2001:db8::2]:443", "192.0.2.1:56324", "PROXY TCP6 ::ffff:192.0.2.1 2001:db8::2 56324 443\r\n"},
+		{"", "198.51.100.1:443", "", "PROXY UNKNOWN\r\n"},
+	}
+	for _, test := range tests {
+		src, _ := netip.ParseAddrPort(test.src)
+		dst := netip.MustParseAddrPort(test.dst)
+		if v1 := string(proxyHeader(proxyProtocolV1, src, dst)); v1 != test.v1 {
+			t.Errorf("expected %q for %s, got %q", test.v1, test.src, v1)
+		}
+		for _, version := range []string{proxyProtocolV1, proxyProtocolV2} {
+			addr, got, err := readProxyHeader(bufio.NewReader(strings.NewReader(string(proxyHeader(version, src, dst)))))
+			if err != nil || got != version {
+				t.Errorf("expected a %s header for %s, got %s %v", version, test.src, got, err)
+				continue
+			}
+			read := ""
+			if addr != nil {
+				read = addr.String()
+			}
+			if read != test.expected {
+				t.Errorf("expected %q from the %s header of %s, got %q", test.expected, version, test.src, read)
+			}
+		}
+	}
+}
+
+// Test wether the allowed clients are checked against the address of the header rather than the
+// load balancer, and the connections from outside the trusted networks against their own
+func TestAllowedClientsOfProxyHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted []string
+		allowed []string
+		header  string
+		remote  string
+		err     error
+	}{
+		{"allowed client", nil, []string{"192.0.2.0/24"}, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", "192.0.2.1:56324", nil},
+		{"client outside", nil, []string{"192.0.2.0/24", "127.0.0.1"}, "PROXY TCP4 203.0.113.1 198.51.100.1 56324 443\r\n", "203.0.113.1:56324", errClientNotAllowed},
+		{"load balancer health check", nil, []string{"127.0.0.1"}, "PROXY UNKNOWN\r\n", "127.0.0.1", nil},
+		{"health check of a load balancer outside", nil, []string{"192.0.2.0/24"}, "PROXY UNKNOWN\r\n", "127.0.0.1", errClientNotAllowed},
+		{"untrusted connection", []string{"10.0.0.0/8"}, []string{"127.0.0.1"}, "PROXY TCP4 203.0.113.1 198.51.100.1 56324 443\r\n", "127.0.0.1", nil},
+	}
+	rejected := func() int64 {
+		if v, ok := rejectedClients.Get("test").(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	for _, test := range tests {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		before := rejected()
+		listener := allowClients(acceptProxyProtocol(l, ProxyProtocol{Accept: true, Trusted: test.trusted}), "test", test.allowed)
+		client, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(client, test.header+"data")
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, len(test.header)+4)
+		n, err := io.ReadAtLeast(conn, data, 4)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+		if host := conn.RemoteAddr().String(); !strings.HasPrefix(host, test.remote) {
+			t.Errorf("%s: expected the client %s, got %s", test.name, test.remote, host)
+		}
+		if test.err == nil && !strings.HasSuffix(string(data[:n]), "data") {
+			t.Errorf("%s: expected the data of the client, got %q", test.name, data[:n])
+		}
+		expected := int64(0)
+		if test.err != nil {
+			expected = 1
+		}
+		if got := rejected() - before; got != expected {
+			t.Errorf("%s: expected %d clients counted as rejected, got %d", test.name, expected, got)
+		}
+		client.Close()
+		conn.Close()
+		l.Close()
+	}
+}
@@ -0,0 +1,126 @@
+package sidebreaker
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"net"
+	"sync"
+	"time"
+)
+
+// rateLimiter spaces events evenly at its interval, such as the messages sent through an smtp host or
+// the connections opened to a host. It is shared by all the tunnels and requests of the host.
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// Reserve the next slot and return how long to wait for it
+func (l *rateLimiter) reserve() time.Duration {
+	wait, _ := l.reserveWithin(-1)
+	return wait
+}
+
+// Reserve the next slot when it comes within max, a negative max waits for as long as needed
+func (l *rateLimiter) reserveWithin(max time.Duration) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	wait := l.next.Sub(now)
+	if max >= 0 && wait > max {
+		return wait, false
+	}
+	l.next = l.next.Add(l.interval)
+	return wait, true
+}
+
+// Connections not opened because the connect rate of their host was reached
+var connectRateLimited = expvar.NewMap("connectRateLimited")
+
+// errConnectRate is returned when a connection would wait past its timeout for the connect rate of the host,
+// the host didn't fail so it is not counted by its breakers
+var errConnectRate = errors.New("connect rate of the host reached")
+
+// Create the connect limiters of the hosts with a connect rate. Hosts whose rate didn't change keep
+// their limiter, a reload doesn't let a burst of connections through.
+func (s *Sidebreaker) setupConnectLimiters(hosts []Host) {
+	s.connectLimiters.update(func(current map[string]*rateLimiter) map[string]*rateLimiter {
+		limiters := map[string]*rateLimiter{}
+		for _, h := range hosts {
+			if h.ConnectRate <= 0 {
+				continue
+			}
+			interval := time.Second / time.Duration(h.ConnectRate)
+			if l, ok := current[h.Host]; ok && l.interval == interval {
+				limiters[h.Host] = l
+			} else {
+				limiters[h.Host] = &rateLimiter{interval: interval}
+			}
+		}
+		return limiters
+	})
+}
+
+// The transport dials without the deadline of the request that needs the connection, it is passed as a value
+type connectDeadlineKey struct{}
+
+// Context carrying the deadline of a request to the dials it triggers
+func withConnectDeadline(ctx context.Context) context.Context {
+	if deadline, ok := ctx.Deadline(); ok {
+		return context.WithValue(ctx, connectDeadlineKey{}, deadline)
+	}
+	return ctx
+}
+
+// Wait until a new connection to the host may be opened, for at most the deadline of ctx
+func (s *Sidebreaker) waitConnect(ctx context.Context, host string) error {
+	l := s.connectLimiters.get(host)
+	if l == nil {
+		return nil
+	}
+	max := time.Duration(-1)
+	if deadline, ok := ctx.Deadline(); ok {
+		max = time.Until(deadline)
+	} else if deadline, ok := ctx.Value(connectDeadlineKey{}).(time.Time); ok {
+		max = time.Until(deadline)
+	}
+	wait, ok := l.reserveWithin(max)
+	if !ok {
+		connectRateLimited.Add(host, 1)
+		return errConnectRate
+	}
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Dial through the connect limiter of the host, for the transport of plain HTTP and MITM requests
+func (s *Sidebreaker) limitedDial(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		if err := s.waitConnect(ctx, host); err != nil {
+			return nil, err
+		}
+		conn, err := s.timedDial(ctx, dialer, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return s.sendProxyHeader(ctx, host, conn)
+	}
+}
@@ -0,0 +1,156 @@
+package sidebreaker
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Redis metrics per host, replies seen and error replies by error code
+var (
+	redisReplies  = expvar.NewMap("redisReplies")
+	redisErrors   = expvar.NewMap("redisErrors")
+	redisErrorsMu sync.Mutex
+)
+
+// Redis errors that mean the server can't serve requests, as opposed to errors caused by the command
+var redisFailures = map[string]bool{
+	"LOADING":     true,
+	"READONLY":    true,
+	"MASTERDOWN":  true,
+	"CLUSTERDOWN": true,
+	"TRYAGAIN":    true,
+	"BUSY":        true,
+	"NOREPLICAS":  true,
+	"OOM":         true,
+}
+
+// Count an error reply of a host by its code
+func countRedisError(host string, code string) {
+	redisErrorsMu.Lock()
+	codes, ok := redisErrors.Get(host).(*expvar.Map)
+	if !ok {
+		codes = new(expvar.Map).Init()
+		redisErrors.Set(host, codes)
+	}
+	redisErrorsMu.Unlock()
+	codes.Add(code, 1)
+}
+
+// redisInspector follows the RESP replies of a Redis server for the whole tunnel. Error replies
+// are counted by code, and errors such as LOADING or READONLY are failures of the upstream.
+type redisInspector struct {
+	inspectorState
+	host  string
+	line  []byte
+	skip  int
+	stack []int
+}
+
+func (m *redisInspector) fromClient(p []byte) {}
+
+func (m *redisInspector) fromServer(p []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for len(p) > 0 && !m.done {
+		// Payloads of bulk strings are skipped without buffering them
+		if m.skip > 0 {
+			n := m.skip
+			if n > len(p) {
+				n = len(p)
+			}
+			m.skip -= n
+			p = p[n:]
+			if m.skip == 0 {
+				m.element()
+			}
+			continue
+		}
+
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			m.line = append(m.line, p...)
+			if len(m.line) > maxInspectedBytes {
+				m.done = true
+			}
+			return
+		}
+		line := append(m.line, p[:i+1]...)
+		m.line = nil
+		p = p[i+1:]
+		m.parseLine(bytes.TrimRight(line, "\r\n"))
+	}
+}
+
+// Parse the first line of a RESP value
+func (m *redisInspector) parseLine(line []byte) {
+	if len(line) == 0 {
+		return
+	}
+	switch line[0] {
+	case '+', ':', ',', '_', '(', '#':
+		m.element()
+	case '-':
+		m.errorReply(string(line[1:]))
+		m.element()
+	case '$', '!', '=':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			m.done = true
+			return
+		}
+		if line[0] == '!' {
+			m.errorReply("bulk error")
+		}
+		if n < 0 {
+			m.element()
+			return
+		}
+		m.skip = n + 2
+	case '*', '%', '~', '>', '|':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			m.done = true
+			return
+		}
+		if line[0] == '%' || line[0] == '|' {
+			n *= 2
+		}
+		if n <= 0 {
+			m.element()
+			return
+		}
+		m.stack = append(m.stack, n)
+	default:
+		// Not RESP, stop inspecting
+		m.done = true
+	}
+}
+
+// Record a completed value, replies are counted once their last nested value completes
+func (m *redisInspector) element() {
+	for len(m.stack) > 0 {
+		top := len(m.stack) - 1
+		m.stack[top]--
+		if m.stack[top] > 0 {
+			return
+		}
+		m.stack = m.stack[:top]
+	}
+	redisReplies.Add(m.host, 1)
+}
+
+// Record an error reply, the first failure of the upstream is kept as the error of the tunnel
+func (m *redisInspector) errorReply(message string) {
+	code := message
+	if i := strings.IndexByte(message, ' '); i >= 0 {
+		code = message[:i]
+	}
+	countRedisError(m.host, code)
+	if redisFailures[code] && m.err == nil {
+		m.err = fmt.Errorf("redis %s", message)
+	}
+}
@@ -0,0 +1,68 @@
+package sidebreaker
+
+import (
+	"expvar"
+	"fmt"
+	"testing"
+)
+
+// Test wether the RESP replies are counted once their nested values complete, also when split over
+// reads, and errors of an unavailable server fail the tunnel while the errors of commands don't
+func TestRedisInspector(t *testing.T) {
+	tests := []struct {
+		name     string
+		replies  string
+		count    int64
+		errors   map[string]int64
+		expected string
+	}{
+		{"simple string", "+OK\r\n", 1, nil, ""},
+		{"command error", "-ERR unknown command 'FOO'\r\n", 1, map[string]int64{"ERR": 1}, ""},
+		{"loading", "-LOADING Redis is loading the dataset in memory\r\n", 1, map[string]int64{"LOADING": 1}, "redis LOADING Redis is loading the dataset in memory"},
+		{"first failure kept", "-READONLY You can't write against a read only replica.\r\n-OOM command not allowed\r\n", 2,
+			map[string]int64{"READONLY": 1, "OOM": 1}, "redis READONLY You can't write against a read only replica."},
+		{"bulk string looking like an error", "$13\r\n-LOADING a\r\nb\r\n+OK\r\n", 2, nil, ""},
+		{"null and empty", "$-1\r\n*0\r\n*-1\r\n$0\r\n\r\n", 4, nil, ""},
+		{"nested arrays", "*3\r\n$3\r\nfoo\r\n*2\r\n:1\r\n:2\r\n+OK\r\n:5\r\n", 2, nil, ""},
+		{"error in a transaction", "*2\r\n+OK\r\n-MASTERDOWN Link with MASTER is down\r\n", 1, map[string]int64{"MASTERDOWN": 1}, "redis MASTERDOWN Link with MASTER is down"},
+		{"RESP3", "%2\r\n+a\r\n:1\r\n+b\r\n#t\r\n~1\r\n,1.5\r\n_\r\n=8\r\ntxt:done\r\n", 4, nil, ""},
+		{"bulk error", "!21\r\nSYNTAX invalid syntax\r\n", 1, map[string]int64{"bulk": 1}, ""},
+		{"not RESP", "HTTP/1.1 400 Bad Request\r\n-LOADING later\r\n", 0, nil, ""},
+	}
+	count := func(m *expvar.Map, key string) int64 {
+		if v, ok := m.Get(key).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	for i, test := range tests {
+		for _, split := range []bool{false, true} {
+			host := fmt.Sprintf("redis-%d-%v.example.com", i, split)
+			codes := map[string]int64{}
+			if m, ok := redisErrors.Get(host).(*expvar.Map); ok {
+				for code := range test.errors {
+					codes[code] = count(m, code)
+				}
+			}
+			replies := count(redisReplies, host)
+			m := &redisInspector{host: host}
+			inspectTunnel(m, []exchange{clientSends("GET key\r\n"), serverSends(test.replies)}, split)
+			if got := inspectorErr(m); got != test.expected {
+				t.Errorf("%s (split %v): expected %q, got %q", test.name, split, test.expected, got)
+			}
+			if got := count(redisReplies, host) - replies; got != test.count {
+				t.Errorf("%s (split %v): expected %d replies, got %d", test.name, split, test.count, got)
+			}
+			for code, expected := range test.errors {
+				m, _ := redisErrors.Get(host).(*expvar.Map)
+				if m == nil {
+					t.Errorf("%s (split %v): expected the errors of the host counted", test.name, split)
+					break
+				}
+				if got := count(m, code) - codes[code]; got != expected {
+					t.Errorf("%s (split %v): expected %d %s errors, got %d", test.name, split, expected, code, got)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package sidebreaker
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// hostSource is a remote store the hosts are loaded from besides the configuration files, such as a
+// Consul or etcd prefix or a Kubernetes cluster. Each of its keys holds hosts like a conf.d file.
+type hostSource interface {
+	name() string
+	// Read the host files. With a version the call waits for a change past it or for remoteWait,
+	// the version of the answer is returned for the next call.
+	fetch(ctx context.Context, version uint64) ([]configFile, uint64, error)
+}
+
+// How long a watch waits for a change, and how long to wait after an error before watching again
+const (
+	remoteWait  = 5 * time.Minute
+	remoteRetry = 10 * time.Second
+)
+
+// Changes of the remote sources applied, and rejected because they made the configuration invalid
+var (
+	remoteReloads  = expvar.NewMap("remoteReloads")
+	remoteRejected = expvar.NewMap("remoteRejected")
+)
+
+// The remote sources set in a configuration
+func hostSources(c Configuration) []hostSource {
+	var sources []hostSource
+	if c.Consul.Address != "" {
+		sources = append(sources, c.Consul)
+	}
+	if c.Etcd.Endpoint != "" {
+		sources = append(sources, c.Etcd)
+	}
+	if c.Kubernetes.Enabled {
+		sources = append(sources, c.Kubernetes)
+	}
+	return sources
+}
+
+// remoteHosts merges the hosts of the remote sources with the hosts of the files. Each source keeps
+// the last files that made a valid configuration, a change that doesn't is rejected.
+type remoteHosts struct {
+	local   Configuration
+	sources []hostSource
+
+	mu    sync.Mutex
+	files map[string][]configFile
+}
+
+func newRemoteHosts(local Configuration) *remoteHosts {
+	return &remoteHosts{local: local, sources: hostSources(local), files: map[string][]configFile{}}
+}
+
+// The configuration with the files of a source replaced, the files of the others are kept
+func (r *remoteHosts) merge(source string, files []configFile) (Configuration, error) {
+	var all []configFile
+	for _, src := range r.sources {
+		if src.name() == source {
+			all = append(all, files...)
+		} else {
+			all = append(all, r.files[src.name()]...)
+		}
+	}
+	data, err := json.Marshal(r.local)
+	if err != nil {
+		return r.local, err
+	}
+	return parseConfig(append([]configFile{{name: "configuration", data: data}}, all...), nil)
+}
+
+// Load the hosts of every source on startup and return the versions to watch from. The sidebreaker
+// starts without the hosts of a source that can't be reached or whose hosts are invalid, its watch
+// applies them once they can be used.
+func (r *remoteHosts) load() (Configuration, []uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	versions := make([]uint64, len(r.sources))
+	for i, src := range r.sources {
+		ctx, cancel := context.WithTimeout(context.Background(), remoteRetry)
+		files, version, err := src.fetch(ctx, 0)
+		cancel()
+		if err != nil {
+			logger.Warn("Error loading hosts, starting without them", "source", src.name(), "error", err)
+			continue
+		}
+		versions[i] = version
+		if _, err := r.merge(src.name(), files); err != nil {
+			remoteRejected.Add(src.name(), 1)
+			logger.Error("Invalid hosts, starting without them", "source", src.name(), "error", err)
+			continue
+		}
+		r.files[src.name()] = files
+		logger.Info("Loaded hosts", "source", src.name(), "keys", len(files))
+	}
+	merged, err := r.merge("", nil)
+	if err != nil {
+		return r.local, versions
+	}
+	return merged, versions
+}
+
+// Watch a source and reload the hosts when it changes. Changes that make the configuration invalid
+// are logged and the current hosts are kept.
+func (s *Sidebreaker) watchSource(src hostSource, version uint64) {
+	// The watch in flight is cancelled when the sidebreaker is closed
+	for s.ctx.Err() == nil {
+		ctx, cancel := context.WithTimeout(s.ctx, remoteWait+time.Minute)
+		files, next, err := src.fetch(ctx, version)
+		cancel()
+		if s.ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logger.Warn("Error watching hosts", "source", src.name(), "error", err)
+			wait(s.ctx.Done(), remoteRetry)
+			continue
+		}
+		switch {
+		case next == 0:
+			// Without a version the call can't wait for a change, don't ask again right away
+			if !wait(s.ctx.Done(), remoteRetry) {
+				return
+			}
+		case next == version:
+			continue
+		case next < version:
+			// The version went back, e.g. the store was restored from a snapshot, start over
+			version = 0
+			continue
+		}
+		version = next
+
+		s.remote.mu.Lock()
+		if reflect.DeepEqual(files, s.remote.files[src.name()]) {
+			// Changes of keys or resources that hold no hosts
+			s.remote.mu.Unlock()
+			continue
+		}
+		merged, err := s.remote.merge(src.name(), files)
+		if err == nil {
+			err = s.Reload(merged)
+		}
+		if err == nil {
+			s.remote.files[src.name()] = files
+			s.configState.applied(src.name(), merged.withDefaults())
+		}
+		s.remote.mu.Unlock()
+		if err != nil {
+			remoteRejected.Add(src.name(), 1)
+			s.configState.failed(src.name(), err)
+			continue
+		}
+		remoteReloads.Add(src.name(), 1)
+		s.recordAudit(src.name(), "reload", "", fmt.Sprintf("version %d, %d hosts", version, len(merged.Hosts)))
+	}
+}
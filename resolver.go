@@ -0,0 +1,317 @@
+package sidebreaker
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DNS struct for the configuration, the resolver of the upstream hosts
+type DNS struct {
+	Servers            []string `json:"servers" doc:"DNS servers the upstream hosts are resolved with, as host:port or host for port 53, the servers of the system when empty" example:"10.0.0.2:53"`
+	TTL                Duration `json:"ttl" doc:"How long resolved addresses are cached, looked up on every connection when not set" example:"30s"`
+	NegativeTTL        Duration `json:"negativeTtl" doc:"How long hosts that don't exist are cached as missing, not cached when not set" example:"5s"`
+	HappyEyeballsDelay Duration `json:"happyEyeballsDelay" doc:"How long a connection attempt to a host resolving to IPv4 and IPv6 is pending before the next address is dialed, 250ms by default, a negative delay dials the addresses in turn" example:"250ms"`
+}
+
+// Lookups by result (resolved, cached, failed, negative), and the latency and failures of the lookups per host
+var (
+	resolverLookups  = expvar.NewMap("resolverLookups")
+	resolverLatency  = expvar.NewMap("resolverLatency")
+	resolverFailures = expvar.NewMap("resolverFailures")
+)
+
+// A lookup is shared by the connections waiting for it, it gets its own timeout
+const resolverTimeout = 10 * time.Second
+
+// dnsResolver resolves the upstream hosts with the servers of the configuration and caches the answers
+type dnsResolver struct {
+	resolver    *net.Resolver
+	servers     []string
+	ttl         time.Duration
+	negativeTTL time.Duration
+	// Delay of the attempts racing over both families, they are dialed in turn when it is negative
+	happyEyeballsDelay time.Duration
+
+	mu       sync.Mutex
+	cache    map[string]dnsEntry
+	inflight map[string]*dnsCall
+}
+
+type dnsEntry struct {
+	value   interface{}
+	err     error
+	expires time.Time
+}
+
+// dnsCall is a lookup in progress, done is closed once it is over
+type dnsCall struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+func newResolver(config DNS) *dnsResolver {
+	r := &dnsResolver{
+		resolver:           net.DefaultResolver,
+		ttl:                config.TTL.Duration(),
+		negativeTTL:        config.NegativeTTL.Duration(),
+		happyEyeballsDelay: config.HappyEyeballsDelay.Duration(),
+		cache:              map[string]dnsEntry{},
+		inflight:           map[string]*dnsCall{},
+	}
+	if len(config.Servers) > 0 {
+		servers := make([]string, len(config.Servers))
+		for i, s := range config.Servers {
+			servers[i] = s
+			if _, _, err := net.SplitHostPort(s); err != nil {
+				servers[i] = net.JoinHostPort(s, "53")
+			}
+		}
+		// Each attempt of a query goes to the next server, a server that doesn't answer is skipped on the retry
+		var next uint32
+		r.servers = servers
+		r.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				server := servers[int(atomic.AddUint32(&next, 1)-1)%len(servers)]
+				var d net.Dialer
+				return d.DialContext(ctx, network, server)
+			},
+		}
+	}
+	if r.happyEyeballsDelay == 0 {
+		r.happyEyeballsDelay = defaultHappyEyeballsDelay
+	}
+	return r
+}
+
+// Look a name up, from the cache while its answer is fresh. Concurrent lookups of a name share one query.
+// It returns whether the answer came from the cache.
+func (r *dnsResolver) lookup(ctx context.Context, key string, name string, query func(context.Context) (interface{}, error)) (interface{}, bool, error) {
+	r.mu.Lock()
+	if e, ok := r.cache[key]; ok && time.Now().Before(e.expires) {
+		r.mu.Unlock()
+		if e.err != nil {
+			resolverLookups.Add("negative", 1)
+		} else {
+			resolverLookups.Add("cached", 1)
+		}
+		return e.value, true, e.err
+	}
+	call, ok := r.inflight[key]
+	if !ok {
+		call = &dnsCall{done: make(chan struct{})}
+		r.inflight[key] = call
+		go r.run(key, name, call, query)
+	}
+	r.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.value, false, call.err
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	}
+}
+
+func (r *dnsResolver) run(key string, name string, call *dnsCall, query func(context.Context) (interface{}, error)) {
+	ctx, cancel := context.WithTimeout(context.Background(), resolverTimeout)
+	start := time.Now()
+	call.value, call.err = query(ctx)
+	cancel()
+	latency := new(expvar.Float)
+	latency.Set(float64(time.Since(start)) / float64(time.Millisecond))
+	resolverLatency.Set(name, latency)
+
+	var dnsErr *net.DNSError
+	if errors.As(call.err, &dnsErr) && len(r.servers) > 0 {
+		// The error names the server of the system, the query went to the servers of the configuration
+		dnsErr.Server = strings.Join(r.servers, ",")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.inflight, key)
+	switch {
+	case call.err == nil:
+		resolverLookups.Add("resolved", 1)
+		if r.ttl > 0 {
+			r.cache[key] = dnsEntry{value: call.value, expires: time.Now().Add(r.ttl)}
+		}
+	case errors.As(call.err, &dnsErr) && dnsErr.IsNotFound:
+		// Only names that don't exist are cached, timeouts and server failures are tried again
+		resolverLookups.Add("failed", 1)
+		resolverFailures.Add(name, 1)
+		if r.negativeTTL > 0 {
+			r.cache[key] = dnsEntry{err: call.err, expires: time.Now().Add(r.negativeTTL)}
+		}
+	default:
+		resolverLookups.Add("failed", 1)
+		resolverFailures.Add(name, 1)
+	}
+	// Expired entries are dropped as new answers come in, so hosts that are gone don't stay
+	if len(r.cache) > 0 {
+		now := time.Now()
+		for k, e := range r.cache {
+			if now.After(e.expires) {
+				delete(r.cache, k)
+			}
+		}
+	}
+	close(call.done)
+}
+
+// The addresses of a host
+func (r *dnsResolver) lookupHost(ctx context.Context, host string) ([]string, bool, error) {
+	v, cached, err := r.lookup(ctx, "host/"+host, host, func(ctx context.Context) (interface{}, error) {
+		return r.resolver.LookupHost(ctx, host)
+	})
+	if err != nil {
+		return nil, cached, err
+	}
+	return v.([]string), cached, nil
+}
+
+// The records of _service._proto.name, or of name alone without service. Cached records are put in
+// order again so the weights still spread the connections.
+func (r *dnsResolver) lookupSRV(ctx context.Context, service, proto, name string) ([]*net.SRV, error) {
+	v, cached, err := r.lookup(ctx, "srv/"+service+"/"+proto+"/"+name, name, func(ctx context.Context) (interface{}, error) {
+		_, records, err := r.resolver.LookupSRV(ctx, service, proto, name)
+		return records, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	records := v.([]*net.SRV)
+	if cached {
+		records = orderSRV(records)
+	}
+	return records, nil
+}
+
+// Sort the records by priority, and randomly by weight within a priority as RFC 2782 describes
+func orderSRV(records []*net.SRV) []*net.SRV {
+	sorted := append([]*net.SRV(nil), records...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Priority < sorted[j].Priority })
+	for start := 0; start < len(sorted); {
+		end := start
+		total := 0
+		for end < len(sorted) && sorted[end].Priority == sorted[start].Priority {
+			total += int(sorted[end].Weight)
+			end++
+		}
+		// Pick each position by weight among the records not placed yet
+		for i := start; i < end-1 && total > 0; i++ {
+			pick := rand.Intn(total + 1)
+			sum := 0
+			for j := i; j < end; j++ {
+				sum += int(sorted[j].Weight)
+				if sum >= pick {
+					sorted[i], sorted[j] = sorted[j], sorted[i]
+					break
+				}
+			}
+			total -= int(sorted[i].Weight)
+		}
+		start = end
+	}
+	return sorted
+}
+
+// Dial an upstream address, resolving its host with the resolver. The addresses are tried in turn,
+// or race with a short stagger when the host has addresses of both families. The steps are recorded
+// on the timeline.
+func resolveDial(ctx context.Context, r *dnsResolver, t *timeline, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return dialAddress(ctx, t, dialer, network, addr)
+	}
+	addrs, cached, err := r.lookupHost(ctx, host)
+	if err != nil {
+		t.add("dns failed", "error", err.Error(), "cached", cached)
+		return nil, err
+	}
+	addrs = addressesFor(network, addrs)
+	if len(addrs) == 0 {
+		err := &net.DNSError{Err: "no suitable address found", Name: host, IsNotFound: true}
+		t.add("dns failed", "error", err.Error(), "cached", cached)
+		return nil, err
+	}
+	t.add("dns done", "addresses", addrs, "cached", cached)
+	dial := func(ctx context.Context, ip string) (net.Conn, error) {
+		return dialAddress(ctx, t, dialer, network, net.JoinHostPort(ip, port))
+	}
+	if delay := r.happyEyeballsDelay; delay > 0 {
+		if interleaved, mixed := interleaveFamilies(addrs); mixed {
+			return dialRacing(ctx, host, interleaved, delay, dial)
+		}
+	}
+	return dialInTurn(ctx, addrs, dial)
+}
+
+// Dial the addresses in turn until one answers, each with a share of the time left as the Go dialer does
+func dialInTurn(ctx context.Context, addrs []string, dial func(context.Context, string) (net.Conn, error)) (net.Conn, error) {
+	var firstErr error
+	for i, a := range addrs {
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if deadline, ok := ctx.Deadline(); ok && len(addrs)-i > 1 {
+			share := time.Until(deadline) / time.Duration(len(addrs)-i)
+			if share < 2*time.Second {
+				share = min(2*time.Second, time.Until(deadline))
+			}
+			attemptCtx, cancel = context.WithTimeout(ctx, share)
+		}
+		conn, err := dial(attemptCtx, a)
+		cancel()
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, firstErr
+}
+
+// The addresses a network can dial, tcp4 and udp4 only dial IPv4 and tcp6 and udp6 only IPv6
+func addressesFor(network string, addrs []string) []string {
+	family := network[len(network)-1]
+	if family != '4' && family != '6' {
+		return addrs
+	}
+	var matching []string
+	for _, a := range addrs {
+		ip := net.ParseIP(a)
+		if ip != nil && (ip.To4() != nil) == (family == '4') {
+			matching = append(matching, a)
+		}
+	}
+	return matching
+}
+
+// Dial a resolved address and record when the connection was opened, addresses the egress rules
+// refuse for the destination of ctx aren't dialed
+func dialAddress(ctx context.Context, t *timeline, dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	if err := checkEgressDial(ctx, addr); err != nil {
+		t.add("connect refused", "address", addr, "error", err.Error())
+		return nil, err
+	}
+	conn, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		t.add("connect failed", "address", addr, "error", err.Error())
+		return nil, err
+	}
+	t.add("connected", "address", conn.RemoteAddr().String())
+	return conn, nil
+}
@@ -0,0 +1,121 @@
+package sidebreaker
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Environment variables set by a sidebreaker handing its listeners to the new process it starts,
+// the listeners as name=fd pairs and the pipe to write to once the new process is serving
+const (
+	listenFDsEnv = "SIDEBREAKER_LISTEN_FDS"
+	readyFDEnv   = "SIDEBREAKER_READY_FD"
+)
+
+// How long a restart waits for the new process to be ready before giving up
+const restartTimeout = 30 * time.Second
+
+// ListenError is returned by ListenAndServe when one of the ports can't be listened on
+type ListenError struct {
+	Name string
+	Port int
+	Err  error
+}
+
+func (e *ListenError) Error() string {
+	return fmt.Sprintf("error listening on the %s port %d: %v", e.Name, e.Port, e.Err)
+}
+
+func (e *ListenError) Unwrap() error {
+	return e.Err
+}
+
+// namedListener is a listener that is handed to the new process on a restart
+type namedListener struct {
+	name     string
+	listener net.Listener
+}
+
+var (
+	listenersMu sync.Mutex
+	listeners   []namedListener
+)
+
+// Listen on a port for IPv4 and IPv6, or take over the listeners from the sidebreaker or systemd that started us.
+// With reusePort another sidebreaker can bind the same port.
+func listen(name string, port int, reusePort bool) (net.Listener, error) {
+	// Sidebreakers from before the dual stack listeners hand over a single listener per port, systemd
+	// hands over its socket
+	if strings.Contains(os.Getenv(listenFDsEnv), name+"=") || systemdActivated(name) {
+		return listenNetwork(name, "tcp", fmt.Sprintf(":%d", port), reusePort)
+	}
+	return listenDualStack(name, port, reusePort)
+}
+
+// Listen on an address for a network, or take over the listener of the same name from the sidebreaker that started us
+func listenNetwork(name string, network string, address string, reusePort bool) (net.Listener, error) {
+	l, err := inheritedListener(name)
+	if err != nil {
+		return nil, err
+	}
+	if l == nil {
+		lc := net.ListenConfig{}
+		if reusePort {
+			lc.Control = reusePortControl
+		}
+		if l, err = lc.Listen(context.Background(), network, address); err != nil {
+			return nil, err
+		}
+	}
+	listenersMu.Lock()
+	listeners = append(listeners, namedListener{name, l})
+	listenersMu.Unlock()
+	return l, nil
+}
+
+func inheritedListener(name string) (net.Listener, error) {
+	for _, pair := range strings.Split(os.Getenv(listenFDsEnv), ",") {
+		n, fd, ok := strings.Cut(pair, "=")
+		if !ok || n != name {
+			continue
+		}
+		num, err := strconv.Atoi(fd)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %q", listenFDsEnv, pair)
+		}
+		f := os.NewFile(uintptr(num), name)
+		defer f.Close()
+		return net.FileListener(f)
+	}
+	return systemdListener(name)
+}
+
+// Tell systemd or the sidebreaker that started us that we are serving, so it can start draining
+func notifyReady(done <-chan struct{}) {
+	fd, err := strconv.Atoi(os.Getenv(readyFDEnv))
+	if err != nil {
+		notifySystemd("READY=1")
+		startSystemdWatchdog(done)
+		return
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	f.Write([]byte{1})
+	f.Close()
+	os.Unsetenv(readyFDEnv)
+	os.Unsetenv(listenFDsEnv)
+	logger.Info("Took over the listeners of the previous sidebreaker")
+	// We are the main process of the service from now on, and the one pinging its watchdog
+	notifySystemd("MAINPID=" + strconv.Itoa(os.Getpid()) + "\nREADY=1")
+	os.Unsetenv(systemdWatchdogPID)
+	startSystemdWatchdog(done)
+}
+
+// Set once a restart handed the listeners to a new process, which tells systemd it is the main process
+var handedOff atomic.Bool
@@ -0,0 +1,23 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package sidebreaker
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// RestartSignal asks a sidebreaker to restart, nil as restarts are not supported on this platform
+var RestartSignal os.Signal
+
+// ReloadSignal asks a sidebreaker to load its configuration file again, nil as there is no SIGHUP on this platform
+var ReloadSignal os.Signal
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return fmt.Errorf("reusePort is not supported on this platform")
+}
+
+func handoff() error {
+	return fmt.Errorf("restarts are not supported on this platform")
+}
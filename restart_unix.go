@@ -0,0 +1,94 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package sidebreaker
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// RestartSignal asks a sidebreaker to restart with Restart, SIGUSR2
+var RestartSignal os.Signal = syscall.SIGUSR2
+
+// ReloadSignal asks a sidebreaker to load its configuration file again with ReloadFile, SIGHUP
+var ReloadSignal os.Signal = syscall.SIGHUP
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var err error
+	c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	})
+	return err
+}
+
+// Start a new sidebreaker from the executable on disk, so a new binary or configuration is picked up,
+// with the listeners passed as inherited file descriptors, and wait until it is serving
+func handoff() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// ExtraFiles start at fd 3, the ready pipe goes first
+	files := []*os.File{w}
+	fds := []string{}
+	listenersMu.Lock()
+	for _, l := range listeners {
+		tl, ok := l.listener.(*net.TCPListener)
+		if !ok {
+			continue
+		}
+		f, err := tl.File()
+		if err != nil {
+			listenersMu.Unlock()
+			return err
+		}
+		defer f.Close()
+		fds = append(fds, fmt.Sprintf("%s=%d", l.name, 3+len(files)))
+		files = append(files, f)
+	}
+	listenersMu.Unlock()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), readyFDEnv+"=3", listenFDsEnv+"="+strings.Join(fds, ","))
+	cmd.ExtraFiles = files
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return err
+	}
+	logger.Info("Started a new sidebreaker, waiting until it is serving", "pid", cmd.Process.Pid)
+
+	ready := make(chan error, 1)
+	go func() {
+		// EOF means the new process exited without being ready, i.e. a bad configuration
+		_, err := r.Read(make([]byte, 1))
+		ready <- err
+	}()
+	select {
+	case err := <-ready:
+		if err != nil {
+			cmd.Wait()
+			return fmt.Errorf("the new sidebreaker exited before serving")
+		}
+	case <-time.After(restartTimeout):
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("the new sidebreaker was not serving after %s", restartTimeout)
+	}
+	go cmd.Wait()
+	return nil
+}
@@ -0,0 +1,137 @@
+package sidebreaker
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cenk/backoff"
+	circuit "github.com/rubyist/circuitbreaker"
+)
+
+// Backoff of the built-in breakers, as the circuit package sets it up when it is given none
+const breakerInitialBackOff = 500 * time.Millisecond
+
+// observedBackOff is the backoff of a breaker, it keeps the last wait it gave the breaker. The
+// breaker asks for the next wait each time it lets a call through, so the last one is the wait
+// after the last failure.
+type observedBackOff struct {
+	*backoff.ExponentialBackOff
+	last atomic.Int64
+}
+
+func (b *observedBackOff) NextBackOff() time.Duration {
+	next := b.ExponentialBackOff.NextBackOff()
+	b.last.Store(int64(next))
+	return next
+}
+
+// timedBreaker is a breaker of the circuit package that can tell when it lets the next call through
+type timedBreaker struct {
+	*circuit.Breaker
+	backoff     *observedBackOff
+	lastFailure atomic.Int64
+
+	mu          sync.Mutex
+	tripped     bool
+	subscribers []chan circuit.BreakerEvent
+}
+
+func newTimedBreaker(trip circuit.TripFunc) *timedBreaker {
+	exponential := backoff.NewExponentialBackOff()
+	exponential.InitialInterval = breakerInitialBackOff
+	exponential.MaxElapsedTime = 0
+	exponential.Clock = MonotonicClock
+	exponential.Reset()
+	b := &timedBreaker{backoff: &observedBackOff{ExponentialBackOff: exponential}}
+	b.Breaker = circuit.NewBreakerWithOptions(&circuit.Options{Clock: MonotonicClock, ShouldTrip: trip, BackOff: b.backoff})
+	return b
+}
+
+// The breaker keeps the time of the last failure, which the wait starts from, for itself
+func (b *timedBreaker) Fail() {
+	b.lastFailure.Store(MonotonicClock.Now().UnixNano())
+	b.Breaker.Fail()
+	b.publish()
+}
+
+func (b *timedBreaker) Trip() {
+	b.lastFailure.Store(MonotonicClock.Now().UnixNano())
+	b.Breaker.Trip()
+	b.publish()
+}
+
+func (b *timedBreaker) Success() {
+	b.Breaker.Success()
+	b.publish()
+}
+
+func (b *timedBreaker) Reset() {
+	b.Breaker.Reset()
+	b.publish()
+}
+
+// Subscribe to the trips and resets of the breaker. The subscriptions of the circuit package keep a
+// goroutine each for as long as the process runs, these are sent the events by the calls that trip
+// or reset the breaker, so a breaker that is dropped goes with its subscriptions.
+func (b *timedBreaker) Subscribe() <-chan circuit.BreakerEvent {
+	events := make(chan circuit.BreakerEvent, 100)
+	b.mu.Lock()
+	b.subscribers = append(b.subscribers, events)
+	b.mu.Unlock()
+	return events
+}
+
+// Send the subscribers a change of state, the oldest events are dropped when they fall behind
+func (b *timedBreaker) publish() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	tripped := b.Breaker.Tripped()
+	if tripped == b.tripped {
+		return
+	}
+	b.tripped = tripped
+	event := circuit.BreakerReset
+	if tripped {
+		event = circuit.BreakerTripped
+	}
+	for _, events := range b.subscribers {
+		select {
+		case events <- event:
+		default:
+			<-events
+			events <- event
+		}
+	}
+}
+
+// RetryAt is when a tripped breaker lets the next call through, half-open
+func (b *timedBreaker) RetryAt() time.Time {
+	return time.Unix(0, b.lastFailure.Load()).Add(time.Duration(b.backoff.last.Load()))
+}
+
+// retryTimer is a breaker that can tell when it lets the next call through once tripped, the
+// built-in break types are. Custom break types can implement it for the Retry-After header.
+type retryTimer interface {
+	RetryAt() time.Time
+}
+
+// How long the calls to the host will be rejected, 0 when the sidebreaker can't tell such as during
+// maintenance or while the vendor reports an incident
+func (b Breakers) RetryAfter() time.Duration {
+	if _, maintenance := b.Maintenance.active(); maintenance || b.Vendor.holding() {
+		return 0
+	}
+	wait := time.Until(b.Damper.until())
+	if timer, ok := b.Breaker.(retryTimer); ok && b.Breaker.Tripped() {
+		// Past the wait a probe is in flight, the next one is at least the initial backoff away
+		wait = max(wait, timer.RetryAt().Sub(MonotonicClock.Now()), breakerInitialBackOff)
+	}
+	return max(wait, 0)
+}
+
+// Seconds of a Retry-After header, rounded up so clients don't call before the breaker is ready
+func retryAfterSeconds(wait time.Duration) int64 {
+	return int64(math.Ceil(wait.Seconds()))
+}
@@ -0,0 +1,105 @@
+package sidebreaker
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// ReverseProxy struct for the configuration, a port serving routes to upstream URLs for the
+// services that can set a base URL but not a proxy
+type ReverseProxy struct {
+	Port   int     `json:"port" doc:"Port the reverse proxy listens on, disabled when not set" example:"3132"`
+	Routes []Route `json:"routes" doc:"Routes of the reverse proxy, the longest matching path wins"`
+}
+
+// Route struct for the configuration, the requests of a host and path prefix go to an upstream URL
+type Route struct {
+	Host      string `json:"host" doc:"Host the route matches, from the Host header, any host when not set" example:"payments.local"`
+	Path      string `json:"path" doc:"Path prefix the route matches, every path when not set" example:"/payments/"`
+	Upstream  string `json:"upstream" doc:"URL the requests are sent to, through the breaker of its host in the hosts" example:"https://payments.example.com"`
+	StripPath bool   `json:"stripPath" doc:"Remove the path prefix before the path is appended to the upstream" example:"false"`
+}
+
+func (r Route) validate() error {
+	u, err := url.Parse(r.Upstream)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("upstream must be an http or https URL such as https://api.example.com, got %q", r.Upstream)
+	}
+	if r.Path != "" && !strings.HasPrefix(r.Path, "/") {
+		return fmt.Errorf("path must start with /, got %q", r.Path)
+	}
+	return nil
+}
+
+// route is a route with its upstream parsed
+type route struct {
+	Route
+	upstream *url.URL
+}
+
+// Handler of the reverse proxy, matching requests are sent to their upstream through the breakers
+// like plain HTTP requests. Clients can speak HTTP/2 without TLS, as gRPC clients do.
+func reverseHandler(routes []Route, transport http.RoundTripper) http.Handler {
+	parsed := make([]route, 0, len(routes))
+	for _, r := range routes {
+		u, err := url.Parse(r.Upstream)
+		if err != nil {
+			continue
+		}
+		parsed = append(parsed, route{Route: r, upstream: u})
+	}
+	// Routes of a host before the routes of any host, then longest paths first
+	sort.SliceStable(parsed, func(i, j int) bool {
+		if (parsed[i].Host == "") != (parsed[j].Host == "") {
+			return parsed[i].Host != ""
+		}
+		return len(parsed[i].Path) > len(parsed[j].Path)
+	})
+	proxy := streamingProxy(transport, func(pr *httputil.ProxyRequest) {
+		r := pr.In.Context().Value(routeKey{}).(route)
+		r.rewrite(pr)
+	})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		for _, r := range parsed {
+			if (r.Host == "" || strings.EqualFold(r.Host, host)) && strings.HasPrefix(req.URL.Path, r.Path) {
+				proxy.ServeHTTP(w, req.WithContext(context.WithValue(withTrustedDestination(req.Context()), routeKey{}, r)))
+				return
+			}
+		}
+		http.Error(w, "No route for "+req.Host+req.URL.Path, http.StatusNotFound)
+	})
+	return h2c.NewHandler(handler, &http2.Server{})
+}
+
+// The route of a request of the reverse proxy
+type routeKey struct{}
+
+// Send the request to the upstream of the route
+func (r route) rewrite(pr *httputil.ProxyRequest) {
+	path := pr.In.URL.Path
+	if r.StripPath {
+		path = "/" + strings.TrimPrefix(strings.TrimPrefix(path, r.Path), "/")
+	}
+	pr.Out.URL = &url.URL{
+		Scheme:   r.upstream.Scheme,
+		Host:     r.upstream.Host,
+		Path:     strings.TrimSuffix(r.upstream.Path, "/") + path,
+		RawQuery: pr.In.URL.RawQuery,
+	}
+	pr.Out.Host = r.upstream.Host
+	// The upstream sees who called and how, as behind any reverse proxy
+	pr.SetXForwarded()
+}
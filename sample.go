@@ -0,0 +1,106 @@
+package sidebreaker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// Configuration written by sidebreaker init. Everything optional is off, the settings that have a
+// default are written with it so they are easy to change.
+func sampleConfig() Configuration {
+	return Configuration{
+		Port:         3129,
+		DrainTimeout: 30000,
+		LogLevel:     "info",
+		LogFormat:    "console",
+		Hosts: []Host{{
+			Host:         "api.example.com",
+			BreakType:    "consecutive",
+			Timeout:      1000,
+			Threshold:    10,
+			HealthCheck:  HealthCheck{Interval: 10000, Timeout: 2000},
+			VendorStatus: VendorStatus{Field: "status.indicator", Interval: 60000, Maintenance: "hold"},
+		}},
+		Observability: Observability{
+			Tracing: Tracing{ServiceName: "sidebreaker"},
+			StatsD:  StatsD{Format: "statsd", Prefix: "sidebreaker"},
+		},
+		Storage: StorageConfig{Interval: 60000},
+		Archive: Archive{Prefix: "sidebreaker/archive", Format: "json", Interval: 3600000},
+	}
+}
+
+// WriteSampleConfig writes a configuration with every field, each documented by a comment. Optional
+// features are off, fields that are off or empty show an example value in their comment.
+func WriteSampleConfig(w io.Writer) error {
+	var buf bytes.Buffer
+	buf.WriteString("// Sidebreaker configuration, written by sidebreaker init. Check it with sidebreaker validate.\n")
+	writeSample(&buf, reflect.ValueOf(sampleConfig()), "")
+	buf.WriteString("\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// Write a value as indented JSON, the fields of structs are preceded by their documentation
+func writeSample(buf *bytes.Buffer, v reflect.Value, indent string) {
+	switch v.Kind() {
+	case reflect.Struct:
+		buf.WriteString("{\n")
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			fmt.Fprintf(buf, "%s  // %s\n", indent, f.Tag.Get("doc"))
+			// Objects show their fields instead
+			if v.Field(i).IsZero() && f.Type.Kind() != reflect.Struct {
+				if example := exampleValue(f.Type, f.Tag.Get("example")); example != nil {
+					if e := compactJSON(example); e != compactJSON(v.Field(i).Interface()) {
+						fmt.Fprintf(buf, "%s  // e.g. %s\n", indent, e)
+					}
+				}
+			}
+			fmt.Fprintf(buf, "%s  %s: ", indent, compactJSON(jsonName(f)))
+			writeSample(buf, v.Field(i), indent+"  ")
+			if i < t.NumField()-1 {
+				buf.WriteString(",")
+			}
+			buf.WriteString("\n")
+		}
+		buf.WriteString(indent + "}")
+	case reflect.Slice:
+		if v.Len() == 0 {
+			buf.WriteString("[]")
+			return
+		}
+		buf.WriteString("[\n")
+		for i := 0; i < v.Len(); i++ {
+			buf.WriteString(indent + "  ")
+			writeSample(buf, v.Index(i), indent+"  ")
+			if i < v.Len()-1 {
+				buf.WriteString(",")
+			}
+			buf.WriteString("\n")
+		}
+		buf.WriteString(indent + "]")
+	case reflect.Ptr:
+		if v.IsNil() {
+			buf.WriteString("null")
+			return
+		}
+		writeSample(buf, v.Elem(), indent)
+	default:
+		buf.WriteString(compactJSON(v.Interface()))
+	}
+}
+
+// JSON of a value on a single line, without escaping characters such as & and >
+func compactJSON(v interface{}) string {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(v)
+	return strings.TrimSpace(buf.String())
+}
@@ -0,0 +1,69 @@
+package sidebreaker
+
+import (
+	"io"
+	"net/http"
+	"reflect"
+)
+
+// Durations are integer milliseconds or Go duration strings, the pattern only applies to strings
+const durationPattern = `^\s*[-+]?(0|([0-9]*(\.[0-9]*)?(ns|us|µs|μs|ms|s|m|h))+)\s*$`
+
+// WriteConfigSchema writes a JSON Schema of the configuration files for editors and CI, generated from
+// the configuration structs like the configuration reference so new fields are in it as they are added.
+// Like the sidebreaker, it refuses unknown fields. Settings that depend on each other, such as the
+// break types, are only checked by sidebreaker validate.
+func WriteConfigSchema(w io.Writer) error {
+	schema := schemaObject{
+		{"$schema", "https://json-schema.org/draft/2020-12/schema"},
+		{"title", "Sidebreaker configuration"},
+	}
+	schema = append(schema, typeSchema(reflect.TypeOf(Configuration{}), "", "")...)
+	return writeJSON(w, schema)
+}
+
+// Handler for the JSON Schema of the configuration
+func configSchema(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	if err := WriteConfigSchema(w); err != nil {
+		logger.Error("error generating configuration schema", "error", err)
+	}
+}
+
+// schemaObject keeps the keywords and properties of a schema in the order of the struct
+type schemaObject = exampleObject
+
+// The schema of a type with the documentation and example of its field
+func typeSchema(t reflect.Type, doc string, example string) schemaObject {
+	schema := schemaObject{}
+	if doc != "" {
+		schema = append(schema, exampleField{"description", doc})
+	}
+	switch {
+	case t == reflect.TypeOf(Duration(0)):
+		schema = append(schema, exampleField{"type", []string{"integer", "string"}}, exampleField{"pattern", durationPattern})
+	case t.Kind() == reflect.Ptr:
+		return append(schema, typeSchema(t.Elem(), "", example)...)
+	case t.Kind() == reflect.Struct:
+		properties := schemaObject{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			properties = append(properties, exampleField{jsonName(f), typeSchema(f.Type, f.Tag.Get("doc"), f.Tag.Get("example"))})
+		}
+		return append(schema, exampleField{"type", "object"}, exampleField{"properties", properties}, exampleField{"additionalProperties", false})
+	case t.Kind() == reflect.Slice:
+		schema = append(schema, exampleField{"type", "array"}, exampleField{"items", typeSchema(t.Elem(), "", "")})
+	case t.Kind() == reflect.Int || t.Kind() == reflect.Int64:
+		schema = append(schema, exampleField{"type", "integer"})
+	case t.Kind() == reflect.Float64:
+		schema = append(schema, exampleField{"type", "number"})
+	case t.Kind() == reflect.Bool:
+		schema = append(schema, exampleField{"type", "boolean"})
+	default:
+		schema = append(schema, exampleField{"type", "string"})
+	}
+	if v := exampleValue(t, example); v != nil {
+		schema = append(schema, exampleField{"examples", []interface{}{v}})
+	}
+	return schema
+}
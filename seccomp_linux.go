@@ -0,0 +1,83 @@
+//go:build linux && (amd64 || arm64)
+
+package sidebreaker
+
+import (
+	"fmt"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// The default profile can be applied on this platform
+const seccompSupported = true
+
+// Syscalls a proxy never needs, they fail with EPERM once the default profile is applied.
+// Everything else is allowed so a restart, the storage and the health checks keep working.
+var seccompDenied = []uintptr{
+	unix.SYS_PTRACE, unix.SYS_PROCESS_VM_READV, unix.SYS_PROCESS_VM_WRITEV,
+	unix.SYS_MOUNT, unix.SYS_UMOUNT2, unix.SYS_PIVOT_ROOT, unix.SYS_CHROOT,
+	unix.SYS_SETNS, unix.SYS_UNSHARE, unix.SYS_OPEN_BY_HANDLE_AT, unix.SYS_NAME_TO_HANDLE_AT,
+	unix.SYS_KEXEC_LOAD, unix.SYS_INIT_MODULE, unix.SYS_FINIT_MODULE, unix.SYS_DELETE_MODULE,
+	unix.SYS_REBOOT, unix.SYS_SWAPON, unix.SYS_SWAPOFF, unix.SYS_ACCT, unix.SYS_QUOTACTL,
+	unix.SYS_BPF, unix.SYS_PERF_EVENT_OPEN, unix.SYS_USERFAULTFD,
+	unix.SYS_KEYCTL, unix.SYS_ADD_KEY, unix.SYS_REQUEST_KEY,
+	unix.SYS_SETTIMEOFDAY, unix.SYS_CLOCK_SETTIME, unix.SYS_CLOCK_ADJTIME, unix.SYS_ADJTIMEX,
+	unix.SYS_SYSLOG, unix.SYS_VHANGUP, unix.SYS_PERSONALITY,
+}
+
+// Audit architecture of the syscalls we are built for, others are denied so they can't get around the filter
+func seccompArch() uint32 {
+	if runtime.GOARCH == "arm64" {
+		return unix.AUDIT_ARCH_AARCH64
+	}
+	return unix.AUDIT_ARCH_X86_64
+}
+
+// The filter is a BPF program checking the architecture, then the syscall number against the denied ones
+func seccompFilter() []unix.SockFilter {
+	deny := uint32(unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM))
+	stmt := func(code uint16, k uint32) unix.SockFilter { return unix.SockFilter{Code: code, K: k} }
+	jump := func(code uint16, k uint32, jt, jf uint8) unix.SockFilter {
+		return unix.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+	}
+	filter := []unix.SockFilter{
+		// seccomp_data.arch at offset 4
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, 4),
+		jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, seccompArch(), 1, 0),
+		stmt(unix.BPF_RET|unix.BPF_K, deny),
+		// seccomp_data.nr at offset 0, the x32 syscalls of amd64 have bit 30 set
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, 0),
+		jump(unix.BPF_JMP|unix.BPF_JGE|unix.BPF_K, 0x40000000, 0, 1),
+		stmt(unix.BPF_RET|unix.BPF_K, deny),
+	}
+	for _, nr := range seccompDenied {
+		filter = append(filter,
+			jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, uint32(nr), 0, 1),
+			stmt(unix.BPF_RET|unix.BPF_K, deny))
+	}
+	return append(filter, stmt(unix.BPF_RET|unix.BPF_K, unix.SECCOMP_RET_ALLOW))
+}
+
+// Apply the default profile to every thread of the process. No new privileges is needed to
+// install a filter without CAP_SYS_ADMIN, it is set on the other threads by the TSYNC flag.
+func applySeccomp() error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return err
+	}
+	filter := seccompFilter()
+	program := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	thread, _, errno := unix.Syscall(unix.SYS_SECCOMP, unix.SECCOMP_SET_MODE_FILTER,
+		unix.SECCOMP_FILTER_FLAG_TSYNC, uintptr(unsafe.Pointer(&program)))
+	if errno != 0 {
+		return errno
+	}
+	// With TSYNC the id of a thread that can't be synchronized is returned instead of an error
+	if thread != 0 {
+		return fmt.Errorf("thread %d can't take the filter", thread)
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !(linux && (amd64 || arm64))
+
+package sidebreaker
+
+import "fmt"
+
+// The default profile can be applied on this platform
+const seccompSupported = false
+
+func applySeccomp() error {
+	return fmt.Errorf("seccomp is only supported on linux amd64 and arm64")
+}
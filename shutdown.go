@@ -0,0 +1,38 @@
+package sidebreaker
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"time"
+)
+
+// Proxied requests in flight, plain HTTP and MITM
+var activeRequests = expvar.NewInt("activeRequests")
+
+// Drain timeout when none is configured
+const defaultDrainTimeout = 30 * time.Second
+
+// Stop accepting connections and let the requests and tunnels in flight finish for at most the drain timeout
+func drainConnections(server *http.Server, drain time.Duration) {
+	logger.Info("Shutting down, draining connections", "drain_timeout", drain.String(),
+		"open_tunnels", openTunnels.Value(), "active_requests", activeRequests.Value())
+
+	ctx, cancel := context.WithTimeout(context.Background(), drain)
+	defer cancel()
+	// Shutdown closes the listener and waits for plain requests, hijacked connections
+	// such as CONNECT tunnels and MITM are not seen by the server so they are counted by us
+	server.Shutdown(ctx)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for openTunnels.Value() > 0 || activeRequests.Value() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			logger.Warn("Drain timeout reached, closing the remaining connections",
+				"open_tunnels", openTunnels.Value(), "active_requests", activeRequests.Value())
+			return
+		}
+	}
+	logger.Info("All connections drained")
+}
@@ -0,0 +1,145 @@
+package sidebreaker
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test wether the goroutines started by New stop once the sidebreaker is served and cancelled
+func TestServeStopsGoroutines(t *testing.T) {
+	storage := filepath.Join(t.TempDir(), "state")
+	configuration, err := ParseConfig([]byte(`{"port": 8080, "runAs": {"allowRoot": true},
+		"storage": {"type": "file", "path": "` + storage + `", "interval": "1s"},
+		"hosts": [{"host": "127.0.0.1", "breakType": "consecutive", "threshold": 3, "timeout": 1000,
+			"healthCheck": {"type": "tcp", "port": 1, "interval": "1s"}, "paths": [{"prefix": "/api"}]},
+			{"host": "localhost", "breakType": "consecutive", "threshold": 2, "timeout": 1000, "clientKey": "header", "clientHeader": "X-Client"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := runtime.NumGoroutine()
+	for i := 0; i < 3; i++ {
+		s, err := New(configuration)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		err = s.Serve(ctx, l)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Stopped goroutines may take a moment to return
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("expected at most %d goroutines after three sidebreakers, got %d", before, after)
+	}
+}
+
+// Test wether a closed sidebreaker refuses reloads
+func TestReloadAfterClose(t *testing.T) {
+	configuration, err := ParseConfig([]byte(`{"port": 8080, "runAs": {"allowRoot": true},
+		"hosts": [{"host": "localhost", "breakType": "consecutive", "threshold": 2, "timeout": 1000}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(configuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("expected a second Close to do nothing, got %v", err)
+	}
+	if err := s.Reload(configuration); err != errClosed {
+		t.Errorf("expected %v, got %v", errClosed, err)
+	}
+}
+
+// Test wether New tells what can't be set up apart from invalid configurations
+func TestNewSetupErrors(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing", "file")
+	tests := []struct {
+		name     string
+		settings string
+		setup    string
+	}{
+		{"invalid configuration", `"storage": {"type": "floppy"},`, ""},
+		{"audit log in a missing directory", `"auditLog": "` + missing + `",`, "auditLog"},
+		{"unreachable storage", `"storage": {"type": "redis", "url": "redis://127.0.0.1:1"},`, "storage"},
+		{"missing CA", `"mitmCa": {"cert": "` + missing + `", "key": "` + missing + `"},`, "mitmCa"},
+		{"missing credentials after the storage", `"storage": {"type": "file", "path": "` + filepath.Join(t.TempDir(), "state") + `"},
+			"proxyAuth": {"file": "` + missing + `"},`, "proxyAuth"},
+	}
+	for _, test := range tests {
+		configuration, err := ParseConfig([]byte(`{"port": 8080, "runAs": {"allowRoot": true}, ` + test.settings + `
+			"hosts": [{"host": "localhost", "breakType": "consecutive", "threshold": 2, "timeout": 1000}]}`))
+		if err == nil {
+			_, err = New(configuration)
+		}
+		var setupErr *SetupError
+		switch {
+		case err == nil:
+			t.Errorf("%s: expected an error", test.name)
+		case test.setup == "" && errors.As(err, &setupErr):
+			t.Errorf("%s: expected an invalid configuration, got %v", test.name, err)
+		case test.setup != "" && (!errors.As(err, &setupErr) || setupErr.Name != test.setup):
+			t.Errorf("%s: expected an error setting up %s, got %v", test.name, test.setup, err)
+		}
+	}
+}
+
+// Test wether two sidebreakers of a process keep their own settings: the format of their error
+// responses and the drain asked for with their admin API
+func TestSidebreakersKeepTheirSettings(t *testing.T) {
+	sidebreakers := map[string]*Sidebreaker{}
+	for _, format := range []string{"json", "text"} {
+		configuration, err := ParseConfig([]byte(`{"port": 8080, "runAs": {"allowRoot": true}, "errorFormat": "` + format + `",
+			"hosts": [{"host": "localhost", "breakType": "consecutive", "threshold": 2, "timeout": 1000, "faults": {"errorPercent": 100}}]}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := New(configuration)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		sidebreakers[format] = s
+	}
+	expected := map[string]string{"json": "application/json", "text": "text/plain"}
+	for format, s := range sidebreakers {
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://localhost/", nil))
+		if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, expected[format]) {
+			t.Errorf("%s: expected %s, got %q", format, expected[format], got)
+		}
+	}
+	sidebreakers["json"].admin.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/admin/drain", nil))
+	select {
+	case <-sidebreakers["json"].drainRequested:
+	default:
+		t.Error("expected a drain of the sidebreaker asked for")
+	}
+	select {
+	case <-sidebreakers["text"].drainRequested:
+		t.Error("expected no drain of the other sidebreaker")
+	default:
+	}
+}
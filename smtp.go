@@ -0,0 +1,220 @@
+package sidebreaker
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SMTP metrics per host, replies seen and 4xx/5xx replies by code
+var (
+	smtpReplies  = expvar.NewMap("smtpReplies")
+	smtpErrors   = expvar.NewMap("smtpErrors")
+	smtpErrorsMu sync.Mutex
+)
+
+// Count an error reply of a host by its code
+func countSMTPError(host string, code string) {
+	smtpErrorsMu.Lock()
+	codes, ok := smtpErrors.Get(host).(*expvar.Map)
+	if !ok {
+		codes = new(expvar.Map).Init()
+		smtpErrors.Set(host, codes)
+	}
+	smtpErrorsMu.Unlock()
+	codes.Add(code, 1)
+}
+
+// Test wether an SMTP reply means the relay misbehaves: transient errors, a relay refusing the
+// connection and policy rejections such as blocklisting. Errors about a mailbox are not failures.
+func smtpFailure(code int, line string, greeting bool) bool {
+	switch {
+	case code >= 400 && code < 500:
+		return true
+	case code >= 500 && greeting:
+		return true
+	case code >= 500:
+		fields := strings.Fields(line)
+		return len(fields) > 1 && strings.HasPrefix(fields[1], "5.7.")
+	}
+	return false
+}
+
+// Send limiters space the messages sent through an smtp host, they are shared by all its tunnels
+var (
+	sendLimiters   = map[string]*rateLimiter{}
+	sendLimitersMu sync.Mutex
+)
+
+// The send limiter of a host, nil when it has no send rate
+func sendLimiterFor(host Host) *rateLimiter {
+	if host.SendRate <= 0 {
+		return nil
+	}
+	sendLimitersMu.Lock()
+	defer sendLimitersMu.Unlock()
+	interval := time.Minute / time.Duration(host.SendRate)
+	l, ok := sendLimiters[host.Host]
+	// A reload can change the rate of the host
+	if !ok || l.interval != interval {
+		l = &rateLimiter{interval: interval}
+		sendLimiters[host.Host] = l
+	}
+	return l
+}
+
+// smtpInspector follows an SMTP session until it switches to TLS. Replies are counted by code and
+// replies showing the relay misbehaves are failures. With a send rate the MAIL commands of the
+// client are held back so the messages sent through the host stay under the rate.
+type smtpInspector struct {
+	inspectorState
+	host    string
+	limiter *rateLimiter
+
+	clientLine []byte
+	serverLine []byte
+	data       bool
+	bdat       int
+	startTLS   bool
+	greeted    bool
+}
+
+func newSMTPInspector(host Host) *smtpInspector {
+	return &smtpInspector{host: host.Host, limiter: sendLimiterFor(host)}
+}
+
+func (m *smtpInspector) fromClient(p []byte) {
+	m.mu.Lock()
+	messages := m.clientCommands(p)
+	m.mu.Unlock()
+
+	// Waiting here holds back the chunk with the MAIL command until its send slot
+	if m.limiter != nil {
+		for i := 0; i < messages; i++ {
+			time.Sleep(m.limiter.reserve())
+		}
+	}
+}
+
+// Parse the client side and return the number of messages started
+func (m *smtpInspector) clientCommands(p []byte) int {
+	messages := 0
+	for len(p) > 0 && !m.done {
+		// BDAT chunks are skipped without buffering them
+		if m.bdat > 0 {
+			n := m.bdat
+			if n > len(p) {
+				n = len(p)
+			}
+			m.bdat -= n
+			p = p[n:]
+			continue
+		}
+
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			m.appendClientLine(p)
+			return messages
+		}
+		m.appendClientLine(p[:i])
+		p = p[i+1:]
+		line := strings.TrimRight(string(m.clientLine), "\r")
+		m.clientLine = m.clientLine[:0]
+
+		// Message content ends with a line holding a single dot
+		if m.data {
+			m.data = line != "."
+			continue
+		}
+		command := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(command, "MAIL FROM:"):
+			messages++
+		case command == "STARTTLS":
+			m.startTLS = true
+		case strings.HasPrefix(command, "BDAT "):
+			fields := strings.Fields(command)
+			if len(fields) > 1 {
+				if n, err := strconv.Atoi(fields[1]); err == nil && n > 0 {
+					m.bdat = n
+				}
+			}
+		}
+	}
+	return messages
+}
+
+// Message content lines are only compared to the final dot so they are not kept whole
+func (m *smtpInspector) appendClientLine(p []byte) {
+	if m.data {
+		if len(m.clientLine) < 2 {
+			n := 2 - len(m.clientLine)
+			if n > len(p) {
+				n = len(p)
+			}
+			m.clientLine = append(m.clientLine, p[:n]...)
+		}
+		return
+	}
+	m.clientLine = append(m.clientLine, p...)
+	if len(m.clientLine) > maxInspectedBytes {
+		m.done = true
+	}
+}
+
+func (m *smtpInspector) fromServer(p []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for len(p) > 0 && !m.done {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			m.serverLine = append(m.serverLine, p...)
+			if len(m.serverLine) > maxInspectedBytes {
+				m.done = true
+			}
+			return
+		}
+		m.serverLine = append(m.serverLine, p[:i]...)
+		p = p[i+1:]
+		line := strings.TrimRight(string(m.serverLine), "\r")
+		m.serverLine = m.serverLine[:0]
+		m.reply(line)
+	}
+}
+
+// Handle a reply line, multiline replies are handled on their last line
+func (m *smtpInspector) reply(line string) {
+	if len(line) < 3 || (len(line) > 3 && line[3] == '-') {
+		return
+	}
+	code, err := strconv.Atoi(line[:3])
+	if err != nil {
+		// Not SMTP after all
+		m.done = true
+		return
+	}
+	greeting := !m.greeted
+	m.greeted = true
+
+	smtpReplies.Add(m.host, 1)
+	if code >= 400 {
+		countSMTPError(m.host, line[:3])
+	}
+	if m.err == nil && smtpFailure(code, line, greeting) {
+		m.err = fmt.Errorf("smtp %s", line)
+	}
+
+	switch {
+	case code == 354:
+		m.data = true
+	case m.startTLS && code == 220:
+		// The rest of the session is encrypted
+		m.done = true
+	case m.startTLS:
+		m.startTLS = false
+	}
+}
@@ -0,0 +1,83 @@
+package sidebreaker
+
+import (
+	"expvar"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Test wether the SMTP replies of a misbehaving relay fail the tunnel while the errors about a
+// mailbox don't, with the message content and BDAT chunks skipped and nothing looked at after STARTTLS
+func TestSMTPInspector(t *testing.T) {
+	greeting := "220 mx.example.com ESMTP\r\n"
+	ehlo := []exchange{serverSends(greeting), clientSends("EHLO client.example.com\r\n"), serverSends("250-mx.example.com\r\n250-STARTTLS\r\n250 CHUNKING\r\n")}
+	tests := []struct {
+		name      string
+		exchanges []exchange
+		replies   int64
+		expected  string
+	}{
+		{"message sent", append(ehlo, clientSends("MAIL FROM:<a@example.com>\r\n"), serverSends("250 2.1.0 OK\r\n"),
+			clientSends("RCPT TO:<b@example.com>\r\n"), serverSends("250 2.1.5 OK\r\n"), clientSends("DATA\r\n"), serverSends("354 Go ahead\r\n"),
+			clientSends("Subject: hi\r\n\r\nSTARTTLS\r\n.\r\n"), serverSends("250 2.0.0 Queued\r\n")), 6, ""},
+		{"unknown mailbox", append(ehlo, clientSends("RCPT TO:<nobody@example.com>\r\n"), serverSends("550 5.1.1 User unknown\r\n")), 3, ""},
+		{"relaying denied", append(ehlo, clientSends("RCPT TO:<b@example.org>\r\n"), serverSends("550 5.7.1 Relaying denied\r\n")), 3, "smtp 550 5.7.1 Relaying denied"},
+		{"transient error", append(ehlo, clientSends("MAIL FROM:<a@example.com>\r\n"), serverSends("421 4.7.0 Try again later\r\n")), 3, "smtp 421 4.7.0 Try again later"},
+		{"greeting refused", []exchange{serverSends("554 5.3.2 No SMTP service here\r\n")}, 1, "smtp 554 5.3.2 No SMTP service here"},
+		{"multiline error", []exchange{serverSends("421-4.3.2 Service shutting down\r\n421 4.3.2 Try later\r\n")}, 1, "smtp 421 4.3.2 Try later"},
+		{"STARTTLS", append(ehlo, clientSends("STARTTLS\r\n"), serverSends("220 2.0.0 Ready to start TLS\r\n"), serverSends("421 encrypted\r\n")), 3, ""},
+		{"STARTTLS refused", append(ehlo, clientSends("STARTTLS\r\n"), serverSends("454 4.7.0 TLS not available\r\n"), serverSends("250 OK\r\n")), 4, "smtp 454 4.7.0 TLS not available"},
+		{"BDAT", append(ehlo, clientSends("BDAT 10 LAST\r\nSTARTTLS\r\n"), serverSends("250 2.0.0 OK\r\n"), serverSends("220 not after STARTTLS\r\n")), 4, ""},
+		{"not SMTP", []exchange{serverSends("HTTP/1.1 400 Bad Request\r\n421 later\r\n")}, 0, ""},
+	}
+	count := func(key string) int64 {
+		if v, ok := smtpReplies.Get(key).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	for i, test := range tests {
+		for _, split := range []bool{false, true} {
+			host := fmt.Sprintf("smtp-%d-%v.example.com", i, split)
+			before := count(host)
+			m := newSMTPInspector(Host{Host: host})
+			inspectTunnel(m, test.exchanges, split)
+			if got := inspectorErr(m); got != test.expected {
+				t.Errorf("%s (split %v): expected %q, got %q", test.name, split, test.expected, got)
+			}
+			if got := count(host) - before; got != test.replies {
+				t.Errorf("%s (split %v): expected %d replies, got %d", test.name, split, test.replies, got)
+			}
+		}
+	}
+}
+
+// Test wether the MAIL commands are counted as messages, outside of the message content
+func TestSMTPMessages(t *testing.T) {
+	m := newSMTPInspector(Host{Host: "smtp.example.com"})
+	if n := m.clientCommands([]byte("MAIL FROM:<a@example.com>\r\nRCPT TO:<b@example.com>\r\nmail from:<c@example.com>\r\nDATA\r\n")); n != 2 {
+		t.Errorf("expected 2 messages, got %d", n)
+	}
+	m.reply("354 Go ahead")
+	if n := m.clientCommands([]byte("MAIL FROM:<quoted@example.com>\r\n.\r\nMAIL FROM:<a@example.com>\r\n")); n != 1 {
+		t.Errorf("expected the content skipped and 1 message after it, got %d", n)
+	}
+}
+
+// Test wether the hosts with the same send rate share a limiter, and a new rate gets a new one
+func TestSendLimiterFor(t *testing.T) {
+	if l := sendLimiterFor(Host{Host: "smtp-unlimited.example.com"}); l != nil {
+		t.Errorf("expected no limiter without a send rate, got %v", l)
+	}
+	first := sendLimiterFor(Host{Host: "smtp-limited.example.com", SendRate: 60})
+	if first == nil || first.interval != time.Second {
+		t.Fatalf("expected a message a second, got %v", first)
+	}
+	if again := sendLimiterFor(Host{Host: "smtp-limited.example.com", SendRate: 60}); again != first {
+		t.Error("expected the tunnels of the host to share the limiter")
+	}
+	if changed := sendLimiterFor(Host{Host: "smtp-limited.example.com", SendRate: 120}); changed == first || changed.interval != time.Second/2 {
+		t.Errorf("expected a new limiter for the new rate, got %v", changed)
+	}
+}
@@ -0,0 +1,74 @@
+package sidebreaker
+
+import (
+	"errors"
+	"expvar"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Tunnels copied in the kernel and in userspace, the tunnels with a protocol, a timeline or a
+// connection that isn't plain TCP are copied in userspace
+var tunnelCopies = expvar.NewMap("tunnelCopies")
+
+// The TCP connection under a tunnel end, false when something reads or writes in between such as
+// TLS or the bytes read ahead of a PROXY protocol header
+func tcpConnOf(c net.Conn) (*net.TCPConn, bool) {
+	for {
+		switch v := c.(type) {
+		case *net.TCPConn:
+			return v, true
+		case *countedConn:
+			c = v.Conn
+		case *endpointConn:
+			c = v.countedConn.Conn
+		case *passthroughConn:
+			c = v.Conn
+		case *proxyProtocolConn:
+			// The header is read with the CONNECT, the client may have sent more behind it
+			if v.reader == nil || v.reader.Buffered() > 0 {
+				return nil, false
+			}
+			c = v.Conn
+		default:
+			return nil, false
+		}
+	}
+}
+
+// The TCP connections of both ends of a tunnel when its data can be copied between them with
+// splice, Linux moves it from one socket to the other without copying it through our buffers
+func spliceable(client, remote net.Conn) (*net.TCPConn, *net.TCPConn, bool) {
+	if !hasCapability("splice") {
+		return nil, nil, false
+	}
+	clientTCP, ok := tcpConnOf(client)
+	if !ok {
+		return nil, nil, false
+	}
+	remoteTCP, ok := tcpConnOf(remote)
+	if !ok {
+		return nil, nil, false
+	}
+	return clientTCP, remoteTCP, true
+}
+
+// Copy a direction of a tunnel from src to dst in the kernel and count its bytes once done. The
+// errors of splice don't say which end failed, a broken pipe or a reset towards the client is
+// taken for the client going away.
+func spliceOrWarn(ctx *goproxy.ProxyCtx, dst, src *net.TCPConn, n *int64, client *clientWriter) error {
+	written, err := dst.ReadFrom(src)
+	atomic.AddInt64(n, written)
+	if err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+		if client != nil && (errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET)) {
+			client.fail(err)
+		}
+		logger.Warn("Error copying tunnel data", "request_id", ctx.Session, "correlation_id", correlationID(ctx), "error", err)
+	}
+	dst.CloseWrite()
+	return err
+}
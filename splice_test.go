@@ -0,0 +1,80 @@
+package sidebreaker
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Both ends of a TCP connection over loopback
+func tcpPair(b *testing.B) (*net.TCPConn, *net.TCPConn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+	dialed, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	accepted, err := l.Accept()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		dialed.Close()
+		accepted.Close()
+	})
+	return dialed.(*net.TCPConn), accepted.(*net.TCPConn)
+}
+
+// Benchmark a direction of a tunnel between two loopback connections copied in the kernel and
+// through the copy buffers, the bytes go from a client to a host through the tunnel
+func BenchmarkTunnelCopy(b *testing.B) {
+	const chunk = 64 * 1024
+	tests := []struct {
+		name string
+		copy func(ctx *goproxy.ProxyCtx, dst, src *net.TCPConn, n *int64) error
+	}{
+		{"splice", func(ctx *goproxy.ProxyCtx, dst, src *net.TCPConn, n *int64) error {
+			return spliceOrWarn(ctx, dst, src, n, nil)
+		}},
+		// Hidden behind plain readers and writers as the tunnels that are read in between
+		{"userspace", func(ctx *goproxy.ProxyCtx, dst, src *net.TCPConn, n *int64) error {
+			*n, _ = copyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src})
+			dst.CloseWrite()
+			return nil
+		}},
+	}
+	for _, test := range tests {
+		b.Run(test.name, func(b *testing.B) {
+			client, tunnelIn := tcpPair(b)
+			tunnelOut, host := tcpPair(b)
+			go func() {
+				buf := make([]byte, chunk)
+				for i := 0; i < b.N; i++ {
+					if _, err := client.Write(buf); err != nil {
+						return
+					}
+				}
+				client.CloseWrite()
+			}()
+			received := make(chan int64, 1)
+			go func() {
+				n, _ := io.Copy(io.Discard, host)
+				received <- n
+			}()
+			b.SetBytes(chunk)
+			b.ResetTimer()
+			var n int64
+			if err := test.copy(&goproxy.ProxyCtx{}, tunnelOut, tunnelIn, &n); err != nil {
+				b.Fatal(err)
+			}
+			if got := <-received; n != int64(b.N)*chunk || got != n {
+				b.Fatalf("expected %d bytes through the tunnel, got %d copied and %d received", int64(b.N)*chunk, n, got)
+			}
+		})
+	}
+}
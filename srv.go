@@ -0,0 +1,67 @@
+package sidebreaker
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// SRV struct for the configuration, the SRV record the addresses and ports of a host are resolved from
+// where the ports are assigned dynamically, such as with Nomad or Mesos
+type SRV struct {
+	Service string `json:"service" doc:"Service of the record, _service._proto.name is looked up, name alone when not set" example:"payments"`
+	Proto   string `json:"proto" doc:"Protocol of the record, tcp by default" example:"tcp"`
+	Name    string `json:"name" doc:"Domain of the record, the host when not set" example:"service.consul"`
+}
+
+// Test wether the host is resolved through an SRV record
+func (s SRV) enabled() bool {
+	return s.Service != "" || s.Name != ""
+}
+
+// Set up the SRV records of the hosts that have one
+func (s *Sidebreaker) setupSRV(hosts []Host) {
+	records := map[string]SRV{}
+	for _, h := range hosts {
+		if !h.SRV.enabled() {
+			continue
+		}
+		record := h.SRV
+		if record.Proto == "" {
+			record.Proto = "tcp"
+		}
+		if record.Name == "" {
+			record.Name = h.Host
+		}
+		records[h.Host] = record
+	}
+	s.srvRecords.update(func(map[string]SRV) map[string]SRV { return records })
+}
+
+// The targets of the record as host:port, by priority and randomly by weight within a priority.
+// Only the targets of the first priority are returned when preferred.
+func (s SRV) lookup(ctx context.Context, r *dnsResolver, preferred bool) ([]string, error) {
+	service, proto := s.Service, s.Proto
+	if service == "" {
+		// The name is the full record, e.g. payments.service.consul
+		proto = ""
+	}
+	records, err := r.lookupSRV(ctx, service, proto, s.Name)
+	if err != nil {
+		return nil, err
+	}
+	targets := make([]string, 0, len(records))
+	for _, r := range records {
+		// A single record with the target . means the service isn't available
+		if r.Target == "." || (preferred && r.Priority != records[0].Priority) {
+			continue
+		}
+		targets = append(targets, net.JoinHostPort(strings.TrimSuffix(r.Target, "."), strconv.Itoa(int(r.Port))))
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no targets in the SRV record of %s", s.Name)
+	}
+	return targets, nil
+}
@@ -0,0 +1,119 @@
+package sidebreaker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// SSH messages sent in the clear during the handshake
+const (
+	sshMsgDisconnect = 1
+	sshMsgNewKeys    = 21
+)
+
+// sshInspector follows an SSH connection. The handshake is in the clear until the server sends
+// NEWKEYS, a connection that ends before that or a server that disconnects during the handshake
+// is a failure. Afterwards everything is encrypted, but a client keepalive (ServerAliveInterval)
+// gets an answer so a server that stays silent while the client waits is considered dead.
+type sshInspector struct {
+	inspectorState
+	interval time.Duration
+
+	line         []byte
+	banner       bool
+	server       *frameScanner
+	clientSeen   bool
+	handshake    bool
+	waitingSince time.Time
+}
+
+func newSSHInspector(host Host) *sshInspector {
+	m := &sshInspector{interval: heartbeatInterval(host)}
+	m.server = &frameScanner{
+		headerLen: 4,
+		length:    func(header []byte) int { return 4 + int(int32(binary.BigEndian.Uint32(header))) },
+		onFrame:   m.serverPacket,
+	}
+	return m
+}
+
+func (m *sshInspector) fromClient(p []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.clientSeen = true
+	if m.waitingSince.IsZero() {
+		m.waitingSince = time.Now()
+	}
+}
+
+func (m *sshInspector) fromServer(p []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.waitingSince = time.Time{}
+	if m.done {
+		return
+	}
+	// The server starts with its identification line, it can be preceded by other lines
+	for !m.banner && len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			m.line = append(m.line, p...)
+			if len(m.line) > maxInspectedBytes {
+				m.done = true
+			}
+			return
+		}
+		m.line = append(m.line, p[:i]...)
+		p = p[i+1:]
+		m.banner = bytes.HasPrefix(m.line, []byte("SSH-"))
+		m.line = m.line[:0]
+	}
+	if len(p) > 0 && !m.server.write(p) {
+		m.done = true
+	}
+}
+
+// Handle a binary packet of the handshake: length, padding length and the message
+func (m *sshInspector) serverPacket(frame []byte) {
+	if len(frame) < 6 {
+		return
+	}
+	switch frame[5] {
+	case sshMsgDisconnect:
+		description := ""
+		if len(frame) >= 14 {
+			n := int(binary.BigEndian.Uint32(frame[10:14]))
+			if len(frame) >= 14+n {
+				description = string(frame[14 : 14+n])
+			}
+		}
+		m.err = fmt.Errorf("ssh server disconnected during the handshake: %s", description)
+		m.done = true
+	case sshMsgNewKeys:
+		// The rest of the connection is encrypted
+		m.handshake = true
+		m.done = true
+	}
+}
+
+// Err also reports handshakes the server didn't complete, once the client started one
+func (m *sshInspector) Err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err == nil && m.clientSeen && !m.handshake {
+		return fmt.Errorf("ssh handshake did not complete")
+	}
+	return m.err
+}
+
+func (m *sshInspector) dead(now time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.waitingSince.IsZero() && now.Sub(m.waitingSince) > m.interval {
+		m.err = fmt.Errorf("ssh server left the client waiting for %s", now.Sub(m.waitingSince).Round(time.Second))
+		return true
+	}
+	return false
+}
@@ -0,0 +1,156 @@
+package sidebreaker
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Observability struct for the telemetry sent to other systems
+type Observability struct {
+	Tracing Tracing `json:"tracing" doc:"Export OpenTelemetry spans of plain HTTP and MITM requests"`
+	StatsD  StatsD  `json:"statsd" doc:"Push metrics to a StatsD or DogStatsD agent"`
+}
+
+// StatsD struct for the push based metrics
+type StatsD struct {
+	Address string   `json:"address" doc:"host:port of the StatsD or DogStatsD agent, metrics are off when empty" example:"127.0.0.1:8125"`
+	Format  string   `json:"format" doc:"statsd puts the host in the metric name, dogstatsd sends it as a tag" example:"dogstatsd"`
+	Prefix  string   `json:"prefix" doc:"Prefix of the metric names, sidebreaker by default" example:"sidebreaker"`
+	Tags    []string `json:"tags" doc:"Tags added to every metric (dogstatsd)" example:"env:prod,team:payments"`
+}
+
+// Metrics are sent in packets that fit the usual MTU, at least once per interval
+const (
+	statsdPacketSize    = 1432
+	statsdFlushInterval = time.Second
+	statsdQueueSize     = 4096
+)
+
+// statsdClient sends metrics over UDP, metrics are dropped when the queue is full
+// so a slow or missing agent never holds back the proxy
+type statsdClient struct {
+	conn   net.Conn
+	dog    bool
+	prefix string
+	tags   []string
+	queue  chan string
+}
+
+// Start sending metrics when an agent address is configured, the breaker states are sent every interval.
+// The client is nil when it is off.
+func newStatsD(config StatsD, hosts *hostTable, done <-chan struct{}) (*statsdClient, error) {
+	if config.Address == "" {
+		return nil, nil
+	}
+	if config.Format != "" && config.Format != "statsd" && config.Format != "dogstatsd" {
+		return nil, fmt.Errorf("unknown statsd format %q, use statsd or dogstatsd", config.Format)
+	}
+	conn, err := net.Dial("udp", config.Address)
+	if err != nil {
+		return nil, err
+	}
+	prefix := config.Prefix
+	if prefix == "" {
+		prefix = "sidebreaker"
+	}
+	c := &statsdClient{
+		conn:   conn,
+		dog:    config.Format == "dogstatsd",
+		prefix: prefix,
+		tags:   config.Tags,
+		queue:  make(chan string, statsdQueueSize),
+	}
+	go c.run(hosts, done)
+	return c, nil
+}
+
+// Record a finished request or tunnel of a breaker
+func (c *statsdClient) request(breaker string, outcome string, duration time.Duration) {
+	if c == nil {
+		return
+	}
+	c.send("requests", breaker, "1|c", "outcome:"+outcome)
+	switch outcome {
+	case outcomeError, outcomeTimeout, outcomeProtocolError:
+		c.send("failures", breaker, "1|c", "outcome:"+outcome)
+	}
+	c.send("latency", breaker, fmt.Sprintf("%d|ms", duration.Milliseconds()))
+}
+
+// Queue a metric of a breaker. StatsD has no tags so the breaker goes in the name and the other tags are dropped.
+func (c *statsdClient) send(name string, breaker string, value string, tags ...string) {
+	var line string
+	if c.dog {
+		tags = append([]string{"host:" + breaker}, tags...)
+		tags = append(tags, c.tags...)
+		line = c.prefix + "." + name + ":" + value + "|#" + strings.Join(tags, ",")
+	} else {
+		line = c.prefix + "." + statsdName(breaker) + "." + name + ":" + value
+	}
+	select {
+	case c.queue <- line:
+	default:
+	}
+}
+
+// Make a breaker name usable in a StatsD metric name
+func statsdName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', ':', '|', '@', '#', ' ', '(', ')', '/':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+func (c *statsdClient) run(hosts *hostTable, done <-chan struct{}) {
+	ticker := time.NewTicker(statsdFlushInterval)
+	defer ticker.Stop()
+	var packet bytes.Buffer
+	for {
+		select {
+		case line := <-c.queue:
+			if packet.Len() > 0 && packet.Len()+1+len(line) > statsdPacketSize {
+				c.flush(&packet)
+			}
+			if packet.Len() > 0 {
+				packet.WriteByte('\n')
+			}
+			packet.WriteString(line)
+		case <-ticker.C:
+			c.gauges(hosts.breakers())
+			c.flush(&packet)
+		case <-done:
+			c.flush(&packet)
+			c.conn.Close()
+			return
+		}
+	}
+}
+
+// Queue the state of every breaker, 1 when open
+func (c *statsdClient) gauges(hostMap map[string]Breakers) {
+	for _, host := range hostMap {
+		for _, b := range host.all() {
+			open := "0|g"
+			if b.State() == "open" {
+				open = "1|g"
+			}
+			c.send("breaker.open", b.Name(), open)
+		}
+	}
+}
+
+func (c *statsdClient) flush(packet *bytes.Buffer) {
+	if packet.Len() == 0 {
+		return
+	}
+	if _, err := c.conn.Write(packet.Bytes()); err != nil {
+		logger.Debug("Error sending statsd metrics", "error", err)
+	}
+	packet.Reset()
+}
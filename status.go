@@ -0,0 +1,205 @@
+package sidebreaker
+
+import (
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Status of a dependency in human terms
+const (
+	statusOperational = "Operational"
+	statusDegraded    = "Degraded"
+	statusUnavailable = "Unavailable"
+	statusMaintenance = "Maintenance"
+)
+
+// Status reports the health of the host in human terms. An open breaker means calls are being
+// rejected, a closed breaker that is seeing failures is degraded. The vendor status page is
+// taken into account too.
+func (b Breakers) Status() string {
+	vendor := b.Vendor.get()
+	if _, maintenance := b.Maintenance.active(); maintenance || vendor == vendorMaintenance {
+		return statusMaintenance
+	}
+	if b.Breaker.Tripped() || b.Damper.Damped(time.Now()) {
+		return statusUnavailable
+	}
+	if b.Breaker.Failures() > 0 || vendor == vendorDegraded {
+		return statusDegraded
+	}
+	return statusOperational
+}
+
+// List the breakers that are in use for a host: its own or one per client, followed by those of its paths
+func (b Breakers) all() []Breakers {
+	list := []Breakers{b}
+	if b.Clients != nil {
+		list = b.Clients.list()
+	}
+	for _, p := range b.Paths {
+		list = append(list, p.all()...)
+	}
+	return list
+}
+
+// dependencyStatus is a row on the status page
+type dependencyStatus struct {
+	Name      string
+	Status    string
+	Message   string
+	ErrorRate string
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="10">
+<title>Dependency status</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+td, th { padding: 0.4em 1em; text-align: left; border-bottom: 1px solid #ddd; }
+.Operational { color: #2e7d32; }
+.Degraded { color: #ef6c00; }
+.Unavailable { color: #c62828; font-weight: bold; }
+.Maintenance { color: #1565c0; }
+</style>
+</head>
+<body>
+<h1>{{.Summary}}</h1>
+<table>
+<tr><th>Dependency</th><th>Status</th><th>Error rate</th></tr>
+{{range .Dependencies}}<tr><td>{{.Name}}</td><td class="{{.Status}}">{{.Status}}{{if .Message}}: {{.Message}}{{end}}</td><td>{{.ErrorRate}}</td></tr>
+{{end}}</table>
+<p>Updated {{.Updated}}</p>
+</body>
+</html>
+`))
+
+// Handler for the status page, lists every protected dependency and its health
+func statusPage(hosts *hostTable) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		dependencies := []dependencyStatus{}
+		issues := 0
+		add := func(b Breakers) {
+			status := b.Status()
+			if status != statusOperational {
+				issues++
+			}
+			// The message of the maintenance mode tells the readers when it ends
+			message, _ := b.Maintenance.active()
+			dependencies = append(dependencies, dependencyStatus{
+				Name:      b.Host.Host,
+				Status:    status,
+				Message:   message,
+				ErrorRate: fmt.Sprintf("%.0f%%", b.Breaker.ErrorRate()*100),
+			})
+		}
+		for _, b := range hosts.breakers() {
+			for _, v := range b.all() {
+				add(v)
+			}
+		}
+		sort.Slice(dependencies, func(i, j int) bool { return dependencies[i].Name < dependencies[j].Name })
+
+		summary := "All systems operational"
+		if issues == 1 {
+			summary = "1 dependency is having issues"
+		} else if issues > 1 {
+			summary = fmt.Sprintf("%d dependencies are having issues", issues)
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err := statusTemplate.Execute(w, map[string]interface{}{
+			"Summary":      summary,
+			"Dependencies": dependencies,
+			"Updated":      time.Now().Format(time.RFC1123),
+		})
+		if err != nil {
+			logger.Error("error rendering status page", "error", err)
+		}
+	}
+}
+
+// BreakerStatus struct, a breaker in the admin API. Hosts with paths or client keys have a breaker for
+// each, with the connections of the host on every one.
+type BreakerStatus struct {
+	Host        string   `json:"host"`
+	Breaker     string   `json:"breaker"`
+	Path        string   `json:"path,omitempty"`
+	State       string   `json:"state"`
+	Status      string   `json:"status"`
+	Message     string   `json:"message,omitempty"`
+	ErrorRate   float64  `json:"errorRate"`
+	Failures    int64    `json:"failures"`
+	Successes   int64    `json:"successes"`
+	Connections int64    `json:"connections"`
+	RetryAfter  Duration `json:"retryAfter,omitempty"`
+}
+
+// The breakers of every host, sorted by host
+func breakerReport(hosts *hostTable) []BreakerStatus {
+	report := []BreakerStatus{}
+	for name, host := range hosts.breakers() {
+		open := hosts.connections.open(name)
+		for _, b := range host.all() {
+			message, _ := b.Maintenance.active()
+			report = append(report, BreakerStatus{
+				Host:        name,
+				Breaker:     b.Host.Host,
+				Path:        b.Prefix,
+				State:       b.State(),
+				Status:      b.Status(),
+				Message:     message,
+				ErrorRate:   b.Breaker.ErrorRate() * 100,
+				Failures:    b.Breaker.Failures(),
+				Successes:   b.Breaker.Successes(),
+				Connections: open,
+				RetryAfter:  Duration(b.RetryAfter().Milliseconds()),
+			})
+		}
+	}
+	sort.SliceStable(report, func(i, j int) bool { return report[i].Host < report[j].Host })
+	return report
+}
+
+// Report the breakers of every host, or of the host given as ?host=
+func breakersHandler(hosts *hostTable) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		report := breakerReport(hosts)
+		if host := req.URL.Query().Get("host"); host != "" {
+			host = canonicalHost(host)
+			filtered := []BreakerStatus{}
+			for _, b := range report {
+				if b.Host == host {
+					filtered = append(filtered, b)
+				}
+			}
+			if len(filtered) == 0 {
+				http.Error(w, "unknown host "+host, http.StatusNotFound)
+				return
+			}
+			report = filtered
+		}
+		w.Header().Set("Content-Type", "application/json")
+		writeJSON(w, report)
+	}
+}
+
+// Serve the status page on its own port so it can be exposed to internal teams without exposing the proxy
+func serveStatusPage(listener net.Listener, hosts *hostTable) error {
+	mux := http.NewServeMux()
+	mux.Handle("/", statusPage(hosts))
+	logger.Info("Status page listening", "address", listener.Addr().String())
+	return fmt.Errorf("error serving status page: %w", http.Serve(listener, mux))
+}
@@ -0,0 +1,160 @@
+package sidebreaker
+
+import (
+	"fmt"
+	"time"
+)
+
+// Storage is where the sidebreaker persists things: snapshots of the breaker states so they
+// survive a restart, the history of the breaker stats and the audit log of admin actions.
+type Storage interface {
+	SaveSnapshot(s Snapshot) error
+	// LoadSnapshot returns an empty snapshot when none was saved yet
+	LoadSnapshot() (Snapshot, error)
+	AppendStats(records []StatsRecord) error
+	AppendAudit(e AuditEntry) error
+	Close() error
+}
+
+// StorageConfig struct for the configuration of the storage
+type StorageConfig struct {
+	Type     string   `json:"type" doc:"Where state, stats and the audit log are kept: file, sqlite, redis or s3, nothing is kept when empty" example:"file"`
+	Path     string   `json:"path" doc:"Directory (file) or database file (sqlite)" example:"/var/lib/sidebreaker"`
+	URL      string   `json:"url" secret:"password" doc:"Redis server as redis://[[user]:password@]host:port[/db] (redis)" example:"redis://localhost:6379/0"`
+	Bucket   string   `json:"bucket" doc:"Bucket (s3)" example:"sidebreaker-state"`
+	Region   string   `json:"region" doc:"Region of the bucket, us-east-1 by default (s3)" example:"eu-west-1"`
+	Endpoint string   `json:"endpoint" doc:"Endpoint of S3 compatible services such as GCS or MinIO (s3)" example:"https://storage.googleapis.com"`
+	Prefix   string   `json:"prefix" doc:"Prefix of the keys or object names (redis and s3), sidebreaker by default" example:"sidebreaker"`
+	Interval Duration `json:"interval" doc:"Milliseconds between snapshots and stats records, 60000 by default" example:"60000"`
+}
+
+// Snapshot struct, the state of every breaker at a point in time
+type Snapshot struct {
+	Time     time.Time         `json:"time"`
+	Breakers []BreakerSnapshot `json:"breakers"`
+}
+
+// BreakerSnapshot struct, the state of a breaker in a snapshot
+type BreakerSnapshot struct {
+	Name  string `json:"name"`
+	State string `json:"state"`
+}
+
+// StatsRecord struct, the counters of a breaker at a point in time
+type StatsRecord struct {
+	Time        time.Time `json:"time"`
+	Host        string    `json:"host"`
+	State       string    `json:"state"`
+	Failures    int64     `json:"failures"`
+	Successes   int64     `json:"successes"`
+	Consecutive int64     `json:"consecutive"`
+	ErrorRate   float64   `json:"errorRate"`
+}
+
+// AuditEntry struct, an admin action
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Who    string    `json:"who"`
+	Action string    `json:"action"`
+	Target string    `json:"target"`
+	Detail string    `json:"detail"`
+}
+
+// Open the configured storage
+func openStorage(config StorageConfig) (Storage, error) {
+	switch config.Type {
+	case "":
+		return nil, nil
+	case "file":
+		return newFileStorage(config.Path)
+	case "sqlite":
+		return newSQLiteStorage(config.Path)
+	case "redis":
+		return newRedisStorage(config.URL, config.Prefix)
+	case "s3":
+		return newS3Storage(config)
+	}
+	return nil, fmt.Errorf("unknown storage type %q, use file, sqlite, redis or s3", config.Type)
+}
+
+// Name of a breaker in snapshots and stats, the host followed by the path prefix
+func (b Breakers) Name() string {
+	return b.Host.Host + b.Prefix
+}
+
+// Take a snapshot of the breakers of every host. Only trips are recorded: breakers held open by a
+// maintenance, flap damping or a vendor status are recorded closed, the hold comes back on its own.
+func takeSnapshot(hostMap map[string]Breakers) Snapshot {
+	s := Snapshot{Time: time.Now(), Breakers: []BreakerSnapshot{}}
+	for _, host := range hostMap {
+		for _, b := range host.all() {
+			s.Breakers = append(s.Breakers, BreakerSnapshot{Name: b.Name(), State: snapshotState(b)})
+		}
+	}
+	return s
+}
+
+// State of a breaker in a snapshot, open only when it tripped
+func snapshotState(b Breakers) string {
+	if b.Breaker.Tripped() {
+		return "open"
+	}
+	return "closed"
+}
+
+// Trip the breakers that were open in the last snapshot, so a restart doesn't send calls to a host
+// that is known to be down. They let a call through to test the host like any open breaker.
+func restoreSnapshot(storage Storage, hostMap map[string]Breakers) {
+	s, err := storage.LoadSnapshot()
+	if err != nil {
+		logger.Warn("Error loading the breaker snapshot", "error", err)
+		return
+	}
+	open := map[string]bool{}
+	for _, b := range s.Breakers {
+		open[b.Name] = b.State == "open"
+	}
+	for _, host := range hostMap {
+		for _, b := range host.all() {
+			if open[b.Name()] {
+				b.Breaker.Trip()
+				logger.Info("Breaker restored open from the snapshot", "host", b.Name(), "snapshot", s.Time.Format(time.RFC3339))
+			}
+		}
+	}
+}
+
+// Save a snapshot and the stats of every breaker to the storage each interval until done is closed
+func runStorage(storage Storage, hosts *hostTable, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+		hostMap := hosts.breakers()
+		if err := storage.SaveSnapshot(takeSnapshot(hostMap)); err != nil {
+			logger.Warn("Error saving the breaker snapshot", "error", err)
+		}
+		now := time.Now()
+		records := []StatsRecord{}
+		for _, host := range hostMap {
+			for _, b := range host.all() {
+				records = append(records, StatsRecord{
+					Time:        now,
+					Host:        b.Name(),
+					State:       b.State(),
+					Failures:    b.Breaker.Failures(),
+					Successes:   b.Breaker.Successes(),
+					Consecutive: b.Breaker.ConsecFailures(),
+					ErrorRate:   b.Breaker.ErrorRate(),
+				})
+			}
+		}
+		if err := storage.AppendStats(records); err != nil {
+			logger.Warn("Error saving breaker stats", "error", err)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package sidebreaker
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// fileStorage keeps everything in a directory: the snapshot in snapshot.json, and the stats
+// and audit log as JSON lines appended to stats.jsonl and audit.jsonl
+type fileStorage struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func newFileStorage(dir string) (*fileStorage, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("file storage needs a path")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &fileStorage{dir: dir}, nil
+}
+
+// The snapshot is written to a temporary file first so a crash never leaves half a snapshot
+func (s *fileStorage) SaveSnapshot(snapshot Snapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tmp := filepath.Join(s.dir, "snapshot.json.tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.dir, "snapshot.json"))
+}
+
+func (s *fileStorage) LoadSnapshot() (Snapshot, error) {
+	snapshot := Snapshot{}
+	data, err := os.ReadFile(filepath.Join(s.dir, "snapshot.json"))
+	if os.IsNotExist(err) {
+		return snapshot, nil
+	}
+	if err != nil {
+		return snapshot, err
+	}
+	err = json.Unmarshal(data, &snapshot)
+	return snapshot, err
+}
+
+func (s *fileStorage) AppendStats(records []StatsRecord) error {
+	lines := make([]interface{}, len(records))
+	for i, r := range records {
+		lines[i] = r
+	}
+	return s.appendLines("stats.jsonl", lines)
+}
+
+func (s *fileStorage) AppendAudit(e AuditEntry) error {
+	return s.appendLines("audit.jsonl", []interface{}{e})
+}
+
+func (s *fileStorage) appendLines(name string, lines []interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := os.OpenFile(filepath.Join(s.dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(f)
+	for _, line := range lines {
+		if err := encoder.Encode(line); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+func (s *fileStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,227 @@
+package sidebreaker
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entries kept in the stats and audit lists, the oldest are trimmed
+const redisListLength = 100000
+
+// redisStorage keeps the snapshot in the <prefix>:snapshot key, and the stats and audit log as
+// JSON entries pushed to the <prefix>:stats and <prefix>:audit lists
+type redisStorage struct {
+	addr     string
+	username string
+	password string
+	db       int
+	prefix   string
+
+	mu   sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newRedisStorage(rawURL string, prefix string) (*redisStorage, error) {
+	s, err := parseRedisURL(rawURL, prefix)
+	if err != nil {
+		return nil, err
+	}
+	// Fail at startup when the server can't be reached
+	if _, err := s.command("PING"); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// The server, credentials and database of a redis:// url
+func parseRedisURL(rawURL string, prefix string) (*redisStorage, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "redis" || u.Host == "" {
+		return nil, fmt.Errorf("redis storage needs a url such as redis://localhost:6379/0")
+	}
+	port := u.Port()
+	if port == "" {
+		port = "6379"
+	}
+	s := &redisStorage{addr: net.JoinHostPort(u.Hostname(), port), prefix: prefix}
+	if s.prefix == "" {
+		s.prefix = "sidebreaker"
+	}
+	if password, ok := u.User.Password(); ok {
+		s.username, s.password = u.User.Username(), password
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if s.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid redis database %q", db)
+		}
+	}
+	return s, nil
+}
+
+// Send a command and read its reply, the connection is opened again after an error
+func (s *redisStorage) command(args ...string) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		if err := s.connect(); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := s.roundTrip(args)
+	if err != nil {
+		if _, ok := err.(redisError); !ok {
+			s.conn.Close()
+			s.conn = nil
+		}
+	}
+	return reply, err
+}
+
+func (s *redisStorage) connect() error {
+	conn, err := net.DialTimeout("tcp", s.addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	s.conn, s.r = conn, bufio.NewReader(conn)
+	// Servers with ACLs take the user with the password
+	if s.password != "" {
+		auth := []string{"AUTH", s.password}
+		if s.username != "" {
+			auth = []string{"AUTH", s.username, s.password}
+		}
+		if _, err := s.roundTrip(auth); err != nil {
+			conn.Close()
+			s.conn = nil
+			return err
+		}
+	}
+	if s.db != 0 {
+		if _, err := s.roundTrip([]string{"SELECT", strconv.Itoa(s.db)}); err != nil {
+			conn.Close()
+			s.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+// redisError is an error reply of the server, the connection can still be used
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+func (s *redisStorage) roundTrip(args []string) (interface{}, error) {
+	s.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := io.WriteString(s.conn, b.String()); err != nil {
+		return nil, err
+	}
+
+	line, err := s.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(s.r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+func (s *redisStorage) SaveSnapshot(snapshot Snapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	_, err = s.command("SET", s.prefix+":snapshot", string(data))
+	return err
+}
+
+func (s *redisStorage) LoadSnapshot() (Snapshot, error) {
+	snapshot := Snapshot{}
+	reply, err := s.command("GET", s.prefix+":snapshot")
+	if err != nil || reply == nil {
+		return snapshot, err
+	}
+	err = json.Unmarshal([]byte(reply.(string)), &snapshot)
+	return snapshot, err
+}
+
+func (s *redisStorage) AppendStats(records []StatsRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	args := []string{"RPUSH", s.prefix + ":stats"}
+	for _, r := range records {
+		data, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		args = append(args, string(data))
+	}
+	return s.push(args...)
+}
+
+func (s *redisStorage) AppendAudit(e AuditEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return s.push("RPUSH", s.prefix+":audit", string(data))
+}
+
+// Push entries to a list and trim it to its last entries
+func (s *redisStorage) push(args ...string) error {
+	if _, err := s.command(args...); err != nil {
+		return err
+	}
+	_, err := s.command("LTRIM", args[1], strconv.Itoa(-redisListLength), "-1")
+	return err
+}
+
+func (s *redisStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
@@ -0,0 +1,225 @@
+package sidebreaker
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// s3Storage keeps the snapshot in <prefix>/snapshot.json, each batch of stats in
+// <prefix>/stats/<date>/<time>.jsonl and each audit entry in <prefix>/audit/<date>/<time>.json.
+// Requests are signed with AWS signature V4 using the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY
+// and AWS_SESSION_TOKEN environment variables, GCS accepts them with HMAC keys.
+type s3Storage struct {
+	client    *http.Client
+	endpoint  string
+	bucket    string
+	prefix    string
+	region    string
+	accessKey string
+	secretKey string
+	token     string
+	seq       int64
+}
+
+func newS3Storage(config StorageConfig) (*s3Storage, error) {
+	if config.Bucket == "" {
+		return nil, fmt.Errorf("s3 storage needs a bucket")
+	}
+	s := &s3Storage{
+		client:    &http.Client{Timeout: 30 * time.Second},
+		endpoint:  strings.TrimSuffix(config.Endpoint, "/"),
+		bucket:    config.Bucket,
+		prefix:    strings.Trim(config.Prefix, "/"),
+		region:    config.Region,
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		token:     os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, fmt.Errorf("s3 storage needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	if s.endpoint == "" {
+		s.endpoint = "https://s3." + s.region + ".amazonaws.com"
+	}
+	if s.prefix == "" {
+		s.prefix = "sidebreaker"
+	}
+	return s, nil
+}
+
+func (s *s3Storage) SaveSnapshot(snapshot Snapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	return s.put(s.prefix+"/snapshot.json", data)
+}
+
+func (s *s3Storage) LoadSnapshot() (Snapshot, error) {
+	snapshot := Snapshot{}
+	resp, err := s.do(http.MethodGet, s.prefix+"/snapshot.json", nil)
+	if err != nil {
+		return snapshot, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return snapshot, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return snapshot, fmt.Errorf("s3 get snapshot: %s", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&snapshot)
+	return snapshot, err
+}
+
+func (s *s3Storage) AppendStats(records []StatsRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, r := range records {
+		if err := encoder.Encode(r); err != nil {
+			return err
+		}
+	}
+	return s.put(s.objectName("stats", ".jsonl"), body.Bytes())
+}
+
+// Objects can't be appended to, so every audit entry is an object of its own
+func (s *s3Storage) AppendAudit(e AuditEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return s.put(s.objectName("audit", ".json"), data)
+}
+
+// Name of a new object, sorted by time and unique within this process
+func (s *s3Storage) objectName(kind string, ext string) string {
+	now := time.Now().UTC()
+	seq := atomic.AddInt64(&s.seq, 1)
+	return fmt.Sprintf("%s/%s/%s/%s-%d%s", s.prefix, kind, now.Format("2006-01-02"), now.Format("150405.000"), seq, ext)
+}
+
+func (s *s3Storage) put(key string, data []byte) error {
+	resp, err := s.do(http.MethodPut, key, data)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("s3 put %s: %s", key, resp.Status)
+	}
+	return nil
+}
+
+// Send a signed request for an object, the bucket is in the path so any endpoint works
+func (s *s3Storage) do(method string, key string, body []byte) (*http.Response, error) {
+	path := "/" + awsEscape(s.bucket) + "/" + awsEscape(key)
+	req, err := http.NewRequest(method, s.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, path, body)
+	return s.client.Do(req)
+}
+
+// Sign a request with AWS signature V4
+func (s *s3Storage) sign(req *http.Request, path string, body []byte) {
+	s.signAt(req, path, body, time.Now().UTC())
+}
+
+func (s *s3Storage) signAt(req *http.Request, path string, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           amzDate,
+	}
+	if s.token != "" {
+		headers["x-amz-security-token"] = s.token
+	}
+	if len(body) > 0 {
+		headers["content-type"] = "application/json"
+	}
+	names := make([]string, 0, len(headers))
+	for name, value := range headers {
+		names = append(names, name)
+		if name != "host" {
+			req.Header.Set(name, value)
+		}
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{req.Method, path, "", canonicalHeaders.String(), signedHeaders, payloadHash}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := awsSigningKey(s.secretKey, date, s.region, "s3")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+// Key of the signatures of a day, region and service
+func awsSigningKey(secret string, date string, region string, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+func (s *s3Storage) Close() error {
+	return nil
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// Escape a path the way AWS signs it, everything but the unreserved characters and slashes is encoded
+func awsEscape(path string) string {
+	var b strings.Builder
+	for _, c := range []byte(path) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,91 @@
+package sidebreaker
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteStorage keeps everything in a SQLite database, the driver is pure Go so no cgo is needed
+type sqliteStorage struct {
+	db *sql.DB
+}
+
+var sqliteSchema = []string{
+	`CREATE TABLE IF NOT EXISTS snapshot (id INTEGER PRIMARY KEY CHECK (id = 1), data TEXT NOT NULL)`,
+	`CREATE TABLE IF NOT EXISTS stats (time TEXT NOT NULL, host TEXT NOT NULL, state TEXT NOT NULL,
+		failures INTEGER NOT NULL, successes INTEGER NOT NULL, consecutive INTEGER NOT NULL, error_rate REAL NOT NULL)`,
+	`CREATE INDEX IF NOT EXISTS stats_host_time ON stats (host, time)`,
+	`CREATE TABLE IF NOT EXISTS audit (time TEXT NOT NULL, who TEXT NOT NULL, action TEXT NOT NULL, target TEXT NOT NULL, detail TEXT NOT NULL)`,
+}
+
+func newSQLiteStorage(path string) (*sqliteStorage, error) {
+	if path == "" {
+		return nil, fmt.Errorf("sqlite storage needs a path")
+	}
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// A single connection avoids SQLITE_BUSY errors between our own writers
+	db.SetMaxOpenConns(1)
+	for _, statement := range sqliteSchema {
+		if _, err := db.Exec(statement); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &sqliteStorage{db: db}, nil
+}
+
+func (s *sqliteStorage) SaveSnapshot(snapshot Snapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO snapshot (id, data) VALUES (1, ?) ON CONFLICT (id) DO UPDATE SET data = excluded.data`, string(data))
+	return err
+}
+
+func (s *sqliteStorage) LoadSnapshot() (Snapshot, error) {
+	snapshot := Snapshot{}
+	var data string
+	err := s.db.QueryRow(`SELECT data FROM snapshot WHERE id = 1`).Scan(&data)
+	if err == sql.ErrNoRows {
+		return snapshot, nil
+	}
+	if err != nil {
+		return snapshot, err
+	}
+	err = json.Unmarshal([]byte(data), &snapshot)
+	return snapshot, err
+}
+
+func (s *sqliteStorage) AppendStats(records []StatsRecord) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, r := range records {
+		_, err := tx.Exec(`INSERT INTO stats (time, host, state, failures, successes, consecutive, error_rate) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			r.Time.UTC().Format(time.RFC3339Nano), r.Host, r.State, r.Failures, r.Successes, r.Consecutive, r.ErrorRate)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStorage) AppendAudit(e AuditEntry) error {
+	_, err := s.db.Exec(`INSERT INTO audit (time, who, action, target, detail) VALUES (?, ?, ?, ?, ?)`,
+		e.Time.UTC().Format(time.RFC3339Nano), e.Who, e.Action, e.Target, e.Detail)
+	return err
+}
+
+func (s *sqliteStorage) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,125 @@
+package sidebreaker
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Environment variables of the systemd socket activation and notification protocols
+const (
+	systemdListenPID   = "LISTEN_PID"
+	systemdListenFDs   = "LISTEN_FDS"
+	systemdListenNames = "LISTEN_FDNAMES"
+	systemdNotify      = "NOTIFY_SOCKET"
+	systemdWatchdog    = "WATCHDOG_USEC"
+	systemdWatchdogPID = "WATCHDOG_PID"
+)
+
+// The sockets passed by systemd start at fd 3
+const systemdFirstFD = 3
+
+// Sockets passed by systemd by name, taken once by the listener of the same name
+var (
+	systemdOnce    sync.Once
+	systemdSockets map[string]int
+	systemdMu      sync.Mutex
+)
+
+// Read the sockets systemd passed to us with the names of their FileDescriptorName. A single socket
+// without a name is the proxy port. The variables are unset so processes we start don't take them.
+func readSystemdSockets() {
+	systemdSockets = map[string]int{}
+	pid, _ := strconv.Atoi(os.Getenv(systemdListenPID))
+	count, _ := strconv.Atoi(os.Getenv(systemdListenFDs))
+	names := strings.Split(os.Getenv(systemdListenNames), ":")
+	os.Unsetenv(systemdListenPID)
+	os.Unsetenv(systemdListenFDs)
+	os.Unsetenv(systemdListenNames)
+	if pid != os.Getpid() || count <= 0 {
+		return
+	}
+	for i := 0; i < count; i++ {
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		if count == 1 && name == "unknown" {
+			name = "proxy"
+		}
+		systemdSockets[name] = systemdFirstFD + i
+	}
+	logger.Info("Received sockets from systemd", "count", count)
+}
+
+// Test wether systemd passed a socket for a listener
+func systemdActivated(name string) bool {
+	systemdOnce.Do(readSystemdSockets)
+	systemdMu.Lock()
+	defer systemdMu.Unlock()
+	_, ok := systemdSockets[name]
+	return ok
+}
+
+// The listener of the socket systemd passed for a name, nil when it passed none
+func systemdListener(name string) (net.Listener, error) {
+	systemdOnce.Do(readSystemdSockets)
+	systemdMu.Lock()
+	fd, ok := systemdSockets[name]
+	delete(systemdSockets, name)
+	systemdMu.Unlock()
+	if !ok {
+		return nil, nil
+	}
+	f := os.NewFile(uintptr(fd), name)
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// Send a state to systemd when it started us with Type=notify, such as READY=1
+func notifySystemd(state string) {
+	if err := sendSystemd(state); err != nil {
+		logger.Warn("Error notifying systemd", "state", state, "error", err)
+	}
+}
+
+func sendSystemd(state string) error {
+	socket := os.Getenv(systemdNotify)
+	if socket == "" {
+		return nil
+	}
+	conn, err := net.Dial("unixgram", socket)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// Ping the watchdog of systemd at half its interval while serving, when WatchdogSec is set
+func startSystemdWatchdog(done <-chan struct{}) {
+	usec, err := strconv.ParseInt(os.Getenv(systemdWatchdog), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv(systemdWatchdogPID); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	interval := time.Duration(usec) * time.Microsecond / 2
+	logger.Info("Pinging the systemd watchdog", "interval", interval)
+	go func() {
+		failing := false
+		for wait(done, interval) {
+			// Logged once until a ping goes through again
+			err := sendSystemd("WATCHDOG=1")
+			if err != nil && !failing {
+				logger.Warn("Error pinging the systemd watchdog", "error", err)
+			}
+			failing = err != nil
+		}
+	}()
+}
@@ -0,0 +1,249 @@
+package sidebreaker
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timelines struct for the configuration, the events of traced connections are recorded while the log
+// level is debug so the time spent in each step of a slow call can be looked up afterwards
+type Timelines struct {
+	Percent float64  `json:"percent" doc:"Percentage of the connections traced while the log level is debug" example:"1"`
+	Hosts   []string `json:"hosts" doc:"Hosts whose connections are all traced while the log level is debug" example:"api.example.com"`
+	Keep    int      `json:"keep" doc:"Timelines kept for the admin API, the oldest are dropped, 1000 by default" example:"1000"`
+}
+
+// Header marking a connection for tracing, whatever the percentage and hosts. It isn't sent upstream.
+const timelineHeader = "X-Sidebreaker-Timeline"
+
+const defaultTimelinesKept = 1000
+
+// timeline is the events of a traced connection, by the request ID of the logs and access log
+type timeline struct {
+	ID     int64           `json:"id"`
+	Host   string          `json:"host"`
+	Start  time.Time       `json:"start"`
+	Events []timelineEvent `json:"events"`
+
+	mu sync.Mutex
+}
+
+type timelineEvent struct {
+	Event     string                 `json:"event"`
+	ElapsedMs float64                `json:"elapsedMs"`
+	Attrs     map[string]interface{} `json:"attrs,omitempty"`
+}
+
+// timelineStore keeps the last timelines, set up once on startup
+type timelineStore struct {
+	config Timelines
+
+	mu    sync.Mutex
+	byID  map[int64]*timeline
+	order []int64
+}
+
+func newTimelineStore(config Timelines) *timelineStore {
+	if config.Keep <= 0 {
+		config.Keep = defaultTimelinesKept
+	}
+	return &timelineStore{config: config, byID: map[int64]*timeline{}}
+}
+
+// Start the timeline of a connection when it is traced, nil otherwise. Connections are only traced
+// while the log level is debug.
+func (s *timelineStore) start(req *http.Request, id int64, host Breakers) *timeline {
+	if s == nil || !logger.Enabled(context.Background(), slog.LevelDebug) {
+		req.Header.Del(timelineHeader)
+		return nil
+	}
+	marked := req.Header.Get(timelineHeader) != ""
+	req.Header.Del(timelineHeader)
+	if !marked && !s.traced(host.Host.Host) {
+		return nil
+	}
+	t := &timeline{ID: id, Host: req.URL.Host, Start: time.Now()}
+	t.add("accepted", "client", req.RemoteAddr, "method", req.Method)
+	t.add("matched host", "host", host.Host.Host)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.byID[id] = t
+	s.order = append(s.order, id)
+	for len(s.order) > s.config.Keep {
+		delete(s.byID, s.order[0])
+		s.order = s.order[1:]
+	}
+	return t
+}
+
+// Test wether the connections of a host are traced, hosts with a path prefix share the hosts of their host
+func (s *timelineStore) traced(host string) bool {
+	for _, h := range s.config.Hosts {
+		if host == h || strings.HasPrefix(host, h+"/") {
+			return true
+		}
+	}
+	return rand.Float64()*100 < s.config.Percent
+}
+
+func (s *timelineStore) get(id int64) *timeline {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.byID[id]
+}
+
+// The kept timelines, the newest first
+func (s *timelineStore) list() []*timeline {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]*timeline, 0, len(s.order))
+	for i := len(s.order) - 1; i >= 0; i-- {
+		list = append(list, s.byID[s.order[i]])
+	}
+	return list
+}
+
+// Record an event with its attributes as key value pairs, like the logger
+func (t *timeline) add(event string, attrs ...any) {
+	if t == nil {
+		return
+	}
+	e := timelineEvent{Event: event}
+	if len(attrs) > 0 {
+		e.Attrs = map[string]interface{}{}
+		for i := 0; i+1 < len(attrs); i += 2 {
+			e.Attrs[attrs[i].(string)] = attrs[i+1]
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e.ElapsedMs = float64(time.Since(t.Start).Microseconds()) / 1000
+	t.Events = append(t.Events, e)
+}
+
+// Record the state of the breaker once a call updated it
+func (t *timeline) breakerUpdated(host Breakers, result string) {
+	t.add("breaker updated", "result", result, "state", host.State())
+}
+
+// Record the first byte the upstream sends back
+func (t *timeline) firstByte(r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return &firstByteReader{Reader: r, t: t}
+}
+
+type firstByteReader struct {
+	io.Reader
+	t    *timeline
+	once sync.Once
+}
+
+func (r *firstByteReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.once.Do(func() { r.t.add("first byte") })
+	}
+	return n, err
+}
+
+// Trace the requests of a traced connection, pooled connections don't dial so their reuse is recorded
+func (t *timeline) clientTrace(ctx context.Context) context.Context {
+	if t == nil {
+		return ctx
+	}
+	return httptrace.WithClientTrace(withTimeline(ctx, t), &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				t.add("reused connection", "address", info.Conn.RemoteAddr().String(), "idle_ms", info.IdleTime.Milliseconds())
+			}
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			t.add("request sent")
+		},
+		GotFirstResponseByte: func() {
+			t.add("first byte")
+		},
+	})
+}
+
+// Dials of traced connections record when the address was resolved and the connection opened
+type timelineKey struct{}
+
+func withTimeline(ctx context.Context, t *timeline) context.Context {
+	if t == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, timelineKey{}, t)
+}
+
+func timelineFrom(ctx context.Context) *timeline {
+	t, _ := ctx.Value(timelineKey{}).(*timeline)
+	return t
+}
+
+// A timeline is written while its connection is open, copy it under its lock
+func (t *timeline) snapshot() timeline {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return timeline{ID: t.ID, Host: t.Host, Start: t.Start, Events: append([]timelineEvent(nil), t.Events...)}
+}
+
+// timelineSummary is a timeline in the list of the admin API
+type timelineSummary struct {
+	ID        int64     `json:"id"`
+	Host      string    `json:"host"`
+	Start     time.Time `json:"start"`
+	ElapsedMs float64   `json:"elapsedMs"`
+	Last      string    `json:"last"`
+}
+
+// Handler for /admin/timeline, the timeline of the connection with the id parameter or the list of
+// the timelines kept when there is none
+func timelineHandler(s *Sidebreaker) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if param := req.URL.Query().Get("id"); param != "" {
+			id, err := strconv.ParseInt(param, 10, 64)
+			if err != nil {
+				http.Error(w, "invalid id: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			t := s.timelines.get(id)
+			if t == nil {
+				http.Error(w, "no timeline for connection "+param+", it wasn't traced or was dropped", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			snapshot := t.snapshot()
+			writeJSON(w, &snapshot)
+			return
+		}
+		list := []timelineSummary{}
+		for _, t := range s.timelines.list() {
+			snapshot := t.snapshot()
+			summary := timelineSummary{ID: snapshot.ID, Host: snapshot.Host, Start: snapshot.Start}
+			if n := len(snapshot.Events); n > 0 {
+				summary.ElapsedMs = snapshot.Events[n-1].ElapsedMs
+				summary.Last = snapshot.Events[n-1].Event
+			}
+			list = append(list, summary)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		writeJSON(w, list)
+	}
+}
@@ -0,0 +1,43 @@
+package sidebreaker
+
+import (
+	"expvar"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Header of a request asking for its own timeout, as milliseconds or a duration such as "30s". It isn't
+// sent upstream.
+const timeoutHeader = "X-Sidebreaker-Timeout"
+
+// Timeouts asked for by host as api.example.com.requested, those longer than the max timeout of the
+// host as api.example.com.capped and the invalid ones as api.example.com.invalid
+var requestedTimeouts = expvar.NewMap("requestedTimeouts")
+
+// The timeout a request asks for with its header, capped at the max timeout of the host. It is false
+// when the request doesn't ask for one, when it isn't valid or when the host has no max timeout.
+func requestedTimeout(req *http.Request, host Host) (time.Duration, bool) {
+	value := req.Header.Get(timeoutHeader)
+	req.Header.Del(timeoutHeader)
+	if value == "" || host.MaxTimeout <= 0 {
+		return 0, false
+	}
+	var requested Duration
+	var err error
+	if ms, convErr := strconv.ParseInt(value, 10, 64); convErr == nil {
+		requested = Duration(ms)
+	} else {
+		requested, err = parseDuration(value)
+	}
+	if err != nil || requested <= 0 {
+		requestedTimeouts.Add(host.Host+".invalid", 1)
+		return 0, false
+	}
+	requestedTimeouts.Add(host.Host+".requested", 1)
+	if requested > host.MaxTimeout {
+		requestedTimeouts.Add(host.Host+".capped", 1)
+		requested = host.MaxTimeout
+	}
+	return requested.Duration(), true
+}
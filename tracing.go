@@ -0,0 +1,275 @@
+package sidebreaker
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Tracing struct for the OpenTelemetry export of the spans of proxied requests
+type Tracing struct {
+	Endpoint    string `json:"endpoint" doc:"OTLP/HTTP traces endpoint the spans are exported to, tracing is off when empty" example:"http://localhost:4318/v1/traces"`
+	ServiceName string `json:"serviceName" doc:"Service name of the exported spans, sidebreaker by default" example:"sidebreaker"`
+}
+
+// Spans are exported in batches, when the queue is full new spans are dropped
+const (
+	spanQueueSize     = 2048
+	spanBatchSize     = 512
+	spanFlushInterval = 5 * time.Second
+)
+
+// spanExporter sends finished spans to an OTLP/HTTP collector using the JSON encoding
+type spanExporter struct {
+	endpoint string
+	service  string
+	client   *http.Client
+	queue    chan *span
+}
+
+// Start exporting spans when an endpoint is configured, nil when tracing is off
+func newSpanExporter(config Tracing, done <-chan struct{}) *spanExporter {
+	if config.Endpoint == "" {
+		return nil
+	}
+	service := config.ServiceName
+	if service == "" {
+		service = "sidebreaker"
+	}
+	e := &spanExporter{
+		endpoint: config.Endpoint,
+		service:  service,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		queue:    make(chan *span, spanQueueSize),
+	}
+	go e.run(done)
+	return e
+}
+
+func (e *spanExporter) run(done <-chan struct{}) {
+	ticker := time.NewTicker(spanFlushInterval)
+	defer ticker.Stop()
+	batch := []*span{}
+	for {
+		select {
+		case s := <-e.queue:
+			batch = append(batch, s)
+			if len(batch) < spanBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case <-done:
+			// The spans of the last calls are sent before stopping
+			if len(batch) > 0 {
+				if err := e.export(batch); err != nil {
+					logger.Warn("Error exporting spans", "spans", len(batch), "error", err)
+				}
+			}
+			return
+		}
+		if err := e.export(batch); err != nil {
+			logger.Warn("Error exporting spans", "spans", len(batch), "error", err)
+		}
+		batch = []*span{}
+	}
+}
+
+// Post a batch of spans to the collector
+func (e *spanExporter) export(batch []*span) error {
+	spans := make([]otlpSpan, len(batch))
+	for i, s := range batch {
+		spans[i] = s.otlp()
+	}
+	body, err := json.Marshal(otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpAttribute{stringAttribute("service.name", e.service)}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "sidebreaker"}, Spans: spans}},
+	}}})
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+// span is the sidecar hop of a proxied request, a client span that is a child of the span
+// in the traceparent header of the request and the parent of the upstream span
+type span struct {
+	traceID    [16]byte
+	spanID     [8]byte
+	parentID   [8]byte
+	name       string
+	start      time.Time
+	end        time.Time
+	attributes []otlpAttribute
+	failed     bool
+	exporter   *spanExporter
+}
+
+// Start the span of a request and propagate it to the upstream with the traceparent header.
+// It returns nil when tracing is off or the caller's trace isn't sampled.
+func (e *spanExporter) startSpan(req *http.Request, host Breakers) *span {
+	if e == nil {
+		return nil
+	}
+	s := &span{name: req.Method, start: time.Now(), exporter: e}
+	if traceID, parentID, sampled, ok := parseTraceparent(req.Header.Get("traceparent")); ok {
+		if !sampled {
+			return nil
+		}
+		s.traceID, s.parentID = traceID, parentID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	req.Header.Set("traceparent", "00-"+hex.EncodeToString(s.traceID[:])+"-"+hex.EncodeToString(s.spanID[:])+"-01")
+
+	s.attributes = []otlpAttribute{
+		stringAttribute("http.request.method", req.Method),
+		// The query isn't exported, it often carries tokens and personal data
+		stringAttribute("url.scheme", req.URL.Scheme),
+		stringAttribute("url.path", req.URL.Path),
+		stringAttribute("server.address", req.URL.Hostname()),
+		stringAttribute("sidebreaker.breaker", host.Host.Host),
+		stringAttribute("sidebreaker.breaker.state", host.State()),
+		intAttribute("sidebreaker.timeout_ms", int64(host.Host.Timeout)),
+	}
+	return s
+}
+
+// Finish the span with the outcome of the request and queue it for export
+func (s *span) finish(outcome string, status int) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	s.attributes = append(s.attributes,
+		stringAttribute("sidebreaker.outcome", outcome),
+		intAttribute("http.response.status_code", int64(status)),
+	)
+	s.failed = outcome != outcomeSuccess
+	select {
+	case s.exporter.queue <- s:
+	default:
+	}
+}
+
+// Parse a W3C traceparent header, version-traceid-parentid-flags
+func parseTraceparent(h string) (traceID [16]byte, parentID [8]byte, sampled bool, ok bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return traceID, parentID, false, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == [16]byte{} {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil || parentID == [8]byte{} {
+		return traceID, parentID, false, false
+	}
+	return traceID, parentID, flags[0]&1 == 1, true
+}
+
+// OTLP span kind and status codes
+const (
+	otlpSpanKindClient  = 3
+	otlpStatusCodeOk    = 1
+	otlpStatusCodeError = 2
+)
+
+func (s *span) otlp() otlpSpan {
+	o := otlpSpan{
+		TraceID:    hex.EncodeToString(s.traceID[:]),
+		SpanID:     hex.EncodeToString(s.spanID[:]),
+		Name:       s.name,
+		Kind:       otlpSpanKindClient,
+		Start:      strconv.FormatInt(s.start.UnixNano(), 10),
+		End:        strconv.FormatInt(s.end.UnixNano(), 10),
+		Attributes: s.attributes,
+		Status:     otlpStatus{Code: otlpStatusCodeOk},
+	}
+	if s.parentID != [8]byte{} {
+		o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	if s.failed {
+		o.Status.Code = otlpStatusCodeError
+	}
+	return o
+}
+
+// The OTLP JSON encoding of the spans
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	Start        string          `json:"startTimeUnixNano"`
+	End          string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes"`
+	Status       otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code int `json:"code"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+func stringAttribute(key, value string) otlpAttribute {
+	return otlpAttribute{key, otlpValue{StringValue: &value}}
+}
+
+// OTLP encodes 64 bit integers as strings in JSON
+func intAttribute(key string, value int64) otlpAttribute {
+	v := strconv.FormatInt(value, 10)
+	return otlpAttribute{key, otlpValue{IntValue: &v}}
+}
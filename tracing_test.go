@@ -0,0 +1,36 @@
+package sidebreaker
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Test wether spans carry the scheme and path of the URL but nothing of its query
+func TestStartSpanURL(t *testing.T) {
+	tracer := &spanExporter{queue: make(chan *span, 1)}
+	host := Host{Host: "api.example.com", BreakType: "consecutive", Threshold: 2, Timeout: 1000}
+	b, err := newBreakers(host, FlapDamping{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "https://api.example.com/v1/charges?token=s3cret&email=a@example.com", nil)
+	s := tracer.startSpan(req, b)
+	attributes := map[string]string{}
+	for _, a := range s.attributes {
+		if a.Value.StringValue != nil {
+			attributes[a.Key] = *a.Value.StringValue
+		}
+	}
+	expected := map[string]string{"url.scheme": "https", "url.path": "/v1/charges", "server.address": "api.example.com"}
+	for key, value := range expected {
+		if attributes[key] != value {
+			t.Errorf("expected %s %q, got %q", key, value, attributes[key])
+		}
+	}
+	for key, value := range attributes {
+		if strings.Contains(value, "s3cret") || key == "url.full" || key == "url.query" {
+			t.Errorf("expected no query in the span, got %s %q", key, value)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package sidebreaker
+
+import (
+	"expvar"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// hostTraffic counts the calls and bytes through the proxy to a host since the start. Bytes are
+// counted once the request or tunnel is over, like in the access log.
+type hostTraffic struct {
+	requests    atomic.Int64
+	tunnels     atomic.Int64
+	openTunnels atomic.Int64
+	bytesIn     atomic.Int64
+	bytesOut    atomic.Int64
+}
+
+// HostTraffic struct, the traffic to a host in the admin API and the metrics. In is what clients
+// sent to the host and out what it answered.
+type HostTraffic struct {
+	Host        string `json:"host"`
+	Requests    int64  `json:"requests"`
+	Tunnels     int64  `json:"tunnels"`
+	OpenTunnels int64  `json:"openTunnels"`
+	BytesIn     int64  `json:"bytesIn"`
+	BytesOut    int64  `json:"bytesOut"`
+}
+
+// Traffic by host, hosts removed by a reload keep their counters
+var (
+	traffic   = map[string]*hostTraffic{}
+	trafficMu sync.Mutex
+)
+
+func init() {
+	expvar.Publish("hostTraffic", expvar.Func(func() any {
+		byHost := map[string]HostTraffic{}
+		for _, t := range trafficReport() {
+			byHost[t.Host] = t
+		}
+		return byHost
+	}))
+}
+
+// The traffic counters of a host, created on its first call
+func trafficFor(host string) *hostTraffic {
+	trafficMu.Lock()
+	defer trafficMu.Unlock()
+	t, ok := traffic[host]
+	if !ok {
+		t = &hostTraffic{}
+		traffic[host] = t
+	}
+	return t
+}
+
+// Count a request or tunnel that is over
+func (t *hostTraffic) add(tunnel bool, in int64, out int64) {
+	if tunnel {
+		t.tunnels.Add(1)
+	} else {
+		t.requests.Add(1)
+	}
+	t.bytesIn.Add(in)
+	t.bytesOut.Add(out)
+}
+
+// The traffic of every host, sorted by host
+func trafficReport() []HostTraffic {
+	trafficMu.Lock()
+	defer trafficMu.Unlock()
+	report := make([]HostTraffic, 0, len(traffic))
+	for host, t := range traffic {
+		report = append(report, HostTraffic{
+			Host:        host,
+			Requests:    t.requests.Load(),
+			Tunnels:     t.tunnels.Load(),
+			OpenTunnels: t.openTunnels.Load(),
+			BytesIn:     t.bytesIn.Load(),
+			BytesOut:    t.bytesOut.Load(),
+		})
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].Host < report[j].Host })
+	return report
+}
+
+// Report the traffic by host, or of the host given as ?host=
+func trafficHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	report := trafficReport()
+	if host := req.URL.Query().Get("host"); host != "" {
+		host = canonicalHost(host)
+		for _, t := range report {
+			if t.Host == host {
+				w.Header().Set("Content-Type", "application/json")
+				writeJSON(w, t)
+				return
+			}
+		}
+		http.Error(w, "no traffic to host "+host, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, report)
+}
@@ -0,0 +1,157 @@
+package sidebreaker
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TuningFinding is a limit of the process or the kernel compared with what the configuration needs
+type TuningFinding struct {
+	Name        string `json:"name"`
+	Current     string `json:"current"`
+	Recommended string `json:"recommended"`
+	OK          bool   `json:"ok"`
+	Detail      string `json:"detail"`
+}
+
+// Connections the sidebreaker is sized for when the configuration doesn't say
+const defaultExpectedConnections = 1024
+
+// Closed connections hold their local port in TIME_WAIT for about a minute on most kernels
+const timeWait = time.Minute
+
+// Findings of the startup check
+var (
+	tuningMu       sync.RWMutex
+	tuningFindings []TuningFinding
+)
+
+// Compare the limits of the process and the kernel with the connections and hosts of the
+// configuration, and log a warning for each limit that is too low
+func adviseTuning(c Configuration) {
+	expected := c.ExpectedConnections
+	if expected <= 0 {
+		expected = defaultExpectedConnections
+	}
+	var findings []TuningFinding
+	if f, ok := checkOpenFiles(expected, len(c.Hosts)); ok {
+		findings = append(findings, f)
+	}
+	if f, ok := checkSomaxconn(expected); ok {
+		findings = append(findings, f)
+	}
+	findings = append(findings, checkPortRange(expected, c.Hosts)...)
+
+	tuningMu.Lock()
+	tuningFindings = findings
+	tuningMu.Unlock()
+	for _, f := range findings {
+		if !f.OK {
+			logger.Warn("Limit too low for the configuration", "limit", f.Name, "current", f.Current, "recommended", f.Recommended, "detail", f.Detail)
+		}
+	}
+}
+
+// Each tunnel holds the client and the upstream connection, each host a few pooled and health check
+// connections, plus the listeners, logs and storage of the process
+func checkOpenFiles(expected int, hosts int) (TuningFinding, bool) {
+	soft, hard, ok := openFilesLimit()
+	if !ok {
+		return TuningFinding{}, false
+	}
+	needed := uint64(2*expected + 4*hosts + 64)
+	f := TuningFinding{
+		Name:        "nofile",
+		Current:     strconv.FormatUint(soft, 10),
+		Recommended: strconv.FormatUint(needed, 10),
+		OK:          soft >= needed,
+		Detail:      fmt.Sprintf("%d connections use 2 file descriptors each, %d hosts a few more", expected, hosts),
+	}
+	if !f.OK && hard < needed {
+		f.Detail += fmt.Sprintf(", the hard limit is %d: raise it with ulimit -Hn, LimitNOFILE or the --ulimit of the container", hard)
+	} else if !f.OK {
+		f.Detail += ", raise the soft limit with ulimit -n"
+	}
+	return f, true
+}
+
+// Bursts of new connections wait in the accept queue of the listeners, which the kernel caps at somaxconn
+func checkSomaxconn(expected int) (TuningFinding, bool) {
+	somaxconn, ok := readSysctl("net/core/somaxconn")
+	if !ok || len(somaxconn) != 1 {
+		return TuningFinding{}, false
+	}
+	needed := min(expected, 4096)
+	return TuningFinding{
+		Name:        "net.core.somaxconn",
+		Current:     strconv.Itoa(somaxconn[0]),
+		Recommended: strconv.Itoa(needed),
+		OK:          somaxconn[0] >= needed,
+		Detail:      "the accept queue of the listeners, connections beyond it are dropped during bursts",
+	}, true
+}
+
+// Each connection to an upstream address takes a local port until it leaves TIME_WAIT, the range
+// limits the connections open to one address and the rate they can be opened at
+func checkPortRange(expected int, hosts []Host) []TuningFinding {
+	r, ok := readSysctl("net/ipv4/ip_local_port_range")
+	if !ok || len(r) != 2 || r[1] < r[0] {
+		return nil
+	}
+	ports := r[1] - r[0] + 1
+	current := fmt.Sprintf("%d-%d", r[0], r[1])
+	findings := []TuningFinding{{
+		Name:        "net.ipv4.ip_local_port_range",
+		Current:     current,
+		Recommended: fmt.Sprintf("%d ports", expected),
+		OK:          ports >= expected,
+		Detail:      fmt.Sprintf("%d local ports for the connections to one upstream address", ports),
+	}}
+	for _, h := range hosts {
+		perWait := int(h.ConnectRate * int64(timeWait/time.Second))
+		if perWait == 0 || perWait <= ports {
+			continue
+		}
+		findings = append(findings, TuningFinding{
+			Name:        "net.ipv4.ip_local_port_range",
+			Current:     current,
+			Recommended: fmt.Sprintf("%d ports", perWait),
+			Detail:      fmt.Sprintf("the connectRate of %s opens %d connections while closed ones stay in TIME_WAIT, more than the %d local ports", h.Host, perWait, ports),
+		})
+	}
+	return findings
+}
+
+// Read the integers of a sysctl from /proc/sys, false where there is no /proc
+func readSysctl(name string) ([]int, bool) {
+	data, err := os.ReadFile("/proc/sys/" + name)
+	if err != nil {
+		return nil, false
+	}
+	var values []int
+	for _, field := range strings.Fields(string(data)) {
+		v, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, false
+		}
+		values = append(values, v)
+	}
+	return values, true
+}
+
+// Handler for the tuning findings
+func tuningHandler(w http.ResponseWriter, req *http.Request) {
+	tuningMu.RLock()
+	findings := tuningFindings
+	tuningMu.RUnlock()
+	if findings == nil {
+		findings = []TuningFinding{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, findings)
+}
@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package sidebreaker
+
+// Windows has no limit of open files to check
+func openFilesLimit() (uint64, uint64, bool) {
+	return 0, 0, false
+}
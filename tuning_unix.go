@@ -0,0 +1,14 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package sidebreaker
+
+import "syscall"
+
+// The soft and hard limits of open files. Go raises the soft limit to the hard limit on startup.
+func openFilesLimit() (uint64, uint64, bool) {
+	var l syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &l); err != nil {
+		return 0, 0, false
+	}
+	return uint64(l.Cur), uint64(l.Max), true
+}
@@ -0,0 +1,609 @@
+package sidebreaker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ConfigError is a problem with a field of the configuration, with the file and position it is at when known
+type ConfigError struct {
+	File   string
+	Line   int
+	Column int
+	Field  string
+	Msg    string
+}
+
+func (e ConfigError) Error() string {
+	msg := e.Msg
+	if e.Field != "" {
+		msg = e.Field + ": " + msg
+	}
+	switch {
+	case e.Line > 0 && e.Column > 0:
+		msg = fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, msg)
+	case e.Line > 0:
+		msg = fmt.Sprintf("line %d: %s", e.Line, msg)
+	}
+	if e.File != "" {
+		return e.File + ": " + msg
+	}
+	return msg
+}
+
+// ConfigErrors are all the problems found in a configuration
+type ConfigErrors []ConfigError
+
+func (e ConfigErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// ParseConfig reads a configuration strictly: unknown fields, values of the wrong type and invalid
+// settings are all reported as ConfigErrors with their line and field. Lines may end with // comments.
+func ParseConfig(data []byte) (Configuration, error) {
+	return parseConfig([]configFile{{data: data}}, nil)
+}
+
+// Blank out // comments outside of strings, rather than removing them so the positions of the errors stay right
+func stripComments(data []byte) []byte {
+	out := append([]byte(nil), data...)
+	inString, escaped := false, false
+	for i := 0; i < len(out); i++ {
+		switch c := out[i]; {
+		case inString && escaped:
+			escaped = false
+		case inString:
+			escaped = c == '\\'
+			inString = c != '"'
+		case c == '"':
+			inString = true
+		case c == '/' && i+1 < len(out) && out[i+1] == '/':
+			for ; i < len(out) && out[i] != '\n'; i++ {
+				out[i] = ' '
+			}
+		}
+	}
+	return out
+}
+
+// Line and column of a byte offset in the file
+func position(data []byte, offset int64) (int, int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	line, column := 1, 1
+	for _, c := range data[:offset] {
+		if c == '\n' {
+			line++
+			column = 1
+		} else {
+			column++
+		}
+	}
+	return line, column
+}
+
+// configWalker follows the tokens of the file against the configuration structs, it finds the
+// unknown fields, the values of the wrong type and where each field is so the errors can point at them
+type configWalker struct {
+	data    []byte
+	dec     *json.Decoder
+	offsets map[string]int64
+	errs    ConfigErrors
+}
+
+func (w *configWalker) walk(t reflect.Type) error {
+	err := w.value("", t)
+	if err == nil {
+		if _, err = w.dec.Token(); err == io.EOF {
+			return nil
+		} else if err == nil {
+			err = fmt.Errorf("unexpected data after the configuration")
+		}
+	}
+	e := ConfigError{Msg: err.Error()}
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		e.Line, e.Column = position(w.data, syntaxErr.Offset)
+	} else if err == io.EOF || err == io.ErrUnexpectedEOF {
+		e.Msg = "unexpected end of the configuration"
+		e.Line, e.Column = position(w.data, int64(len(w.data)))
+	} else {
+		e.Line, e.Column = position(w.data, w.dec.InputOffset())
+	}
+	return ConfigErrors{e}
+}
+
+// Offset of the next token, the decoder consumes the separators lazily
+func (w *configWalker) next() int64 {
+	off := w.dec.InputOffset()
+	for off < int64(len(w.data)) && strings.IndexByte(" \t\r\n,:", w.data[off]) >= 0 {
+		off++
+	}
+	return off
+}
+
+// Read the value at path, t is the type it is decoded into or nil when it isn't
+func (w *configWalker) value(path string, t reflect.Type) error {
+	if _, ok := w.offsets[path]; !ok {
+		w.offsets[path] = w.next()
+	}
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	tok, err := w.dec.Token()
+	if err != nil {
+		return err
+	}
+	if t != nil && t != reflect.TypeOf(Duration(0)) {
+		if got := mismatch(t, tok); got != "" {
+			w.errs = append(w.errs, ConfigError{Field: path, Msg: fmt.Sprintf("expected %s, got %s", typeName(t), got)})
+			// What is inside is not checked against the type
+			t = nil
+		}
+	}
+	delim, ok := tok.(json.Delim)
+	if !ok {
+		// Durations are parsed here too so a bad one is reported with its position
+		if t == reflect.TypeOf(Duration(0)) && tok != nil {
+			if _, err := parseDuration(tok); err != nil {
+				w.errs = append(w.errs, ConfigError{Field: path, Msg: err.Error()})
+			}
+		}
+		return nil
+	}
+	switch delim {
+	case '{':
+		for w.dec.More() {
+			start := w.next()
+			tok, err := w.dec.Token()
+			if err != nil {
+				return err
+			}
+			key, _ := tok.(string)
+			child := key
+			if path != "" {
+				child = path + "." + key
+			}
+			w.offsets[child] = start
+			var ft reflect.Type
+			if t != nil && t.Kind() == reflect.Struct {
+				if f, ok := fieldByJSONName(t, key); ok {
+					ft = f.Type
+				} else {
+					w.errs = append(w.errs, ConfigError{Field: child, Msg: "unknown field"})
+				}
+			} else if t != nil && t.Kind() == reflect.Map {
+				ft = t.Elem()
+			}
+			if err := w.value(child, ft); err != nil {
+				return err
+			}
+		}
+	case '[':
+		var et reflect.Type
+		if t != nil && t.Kind() == reflect.Slice {
+			et = t.Elem()
+		}
+		for i := 0; w.dec.More(); i++ {
+			if err := w.value(fmt.Sprintf("%s[%d]", path, i), et); err != nil {
+				return err
+			}
+		}
+	}
+	_, err = w.dec.Token()
+	return err
+}
+
+// What a token is when it can't be decoded into t, empty when it can. Null is always accepted.
+func mismatch(t reflect.Type, tok json.Token) string {
+	switch tok := tok.(type) {
+	case json.Delim:
+		if tok == '{' && t.Kind() != reflect.Struct && t.Kind() != reflect.Map {
+			return "object"
+		}
+		if tok == '[' && t.Kind() != reflect.Slice && t.Kind() != reflect.Array {
+			return "list"
+		}
+	case string:
+		if t.Kind() != reflect.String {
+			return "string"
+		}
+	case bool:
+		if t.Kind() != reflect.Bool {
+			return "boolean"
+		}
+	case float64:
+		switch t.Kind() {
+		case reflect.Float32, reflect.Float64:
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if tok != math.Trunc(tok) {
+				return fmt.Sprintf("number %v", tok)
+			}
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			if tok != math.Trunc(tok) || tok < 0 {
+				return fmt.Sprintf("number %v", tok)
+			}
+		default:
+			return "number"
+		}
+	}
+	return ""
+}
+
+// Field of a struct by its name in the configuration file, matched without case like encoding/json does
+func fieldByJSONName(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		if f := t.Field(i); strings.EqualFold(jsonName(f), name) {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// configChecker collects the problems of the settings by field
+type configChecker struct {
+	errs ConfigErrors
+}
+
+func (c *configChecker) add(field string, format string, args ...interface{}) {
+	c.errs = append(c.errs, ConfigError{Field: field, Msg: fmt.Sprintf(format, args...)})
+}
+
+func (c *configChecker) check(field string, err error) {
+	if err != nil {
+		c.add(field, "%s", err)
+	}
+}
+
+func (c *configChecker) nonNegative(field string, v int64) {
+	if v < 0 {
+		c.add(field, "must not be negative, got %d", v)
+	}
+}
+
+func (c *configChecker) port(field string, v int) {
+	if v < 0 || v > 65535 {
+		c.add(field, "port must be between 0 and 65535, got %d", v)
+	}
+}
+
+func (c *configChecker) percent(field string, v float64) {
+	if v < 0 || v > 100 {
+		c.add(field, "percentage must be between 0 and 100, got %g", v)
+	}
+}
+
+func (c *configChecker) oneOf(field string, v string, values ...string) {
+	if v == "" {
+		return
+	}
+	for _, allowed := range values {
+		if v == allowed {
+			return
+		}
+	}
+	c.add(field, "unknown value %q, use %s", v, strings.Join(values, ", "))
+}
+
+// Validate checks the settings of a configuration, the errors are ConfigErrors by field.
+// ParseConfig adds their position in the file.
+func (c Configuration) Validate() error {
+	v := &configChecker{}
+	v.port("port", c.Port)
+	v.port("statusPort", c.StatusPort)
+	v.port("adminPort", c.AdminPort)
+	// The admin endpoints are never reachable through the proxy, so their port can't be one of the proxy
+	adminPort := c.adminPort()
+	if c.StatusPort != 0 && (c.StatusPort == c.Port || c.StatusPort == adminPort) {
+		v.add("statusPort", "port %d is already used", c.StatusPort)
+	}
+	switch {
+	case adminPort == 0 || adminPort != c.Port:
+	case c.AdminPort == 0:
+		v.add("port", "port %d is the default port of the admin endpoints, set adminPort to another port", c.Port)
+	default:
+		v.add("adminPort", "port %d is the proxy port, the admin endpoints are never served on the proxy port", c.AdminPort)
+	}
+	used := map[int]bool{c.Port: true, c.StatusPort: true, adminPort: true}
+	if c.Admin.Listen != "" {
+		_, port, err := net.SplitHostPort(c.Admin.Listen)
+		p, perr := strconv.Atoi(port)
+		switch {
+		case err != nil || perr != nil || p < 1 || p > 65535:
+			v.add("admin.listen", "address must be host:port such as 127.0.0.1:3131, got %q", c.Admin.Listen)
+		case c.AdminPort != 0:
+			v.add("admin.listen", "adminPort and admin.listen can't be set together")
+		case used[p]:
+			v.add("admin.listen", "port %d is already used", p)
+		default:
+			used[p] = true
+		}
+	}
+	if (c.Admin.Cert == "") != (c.Admin.Key == "") {
+		v.add("admin.cert", "cert and key must be set together")
+	}
+	v.check("admin.auth.users", c.Admin.Auth.validate())
+	// The addresses of listen replace port, several of them can share a port on different hosts
+	listenPorts := map[int]bool{}
+	for i, address := range c.Listen {
+		field := fmt.Sprintf("listen[%d]", i)
+		_, port, err := net.SplitHostPort(address)
+		p, perr := strconv.Atoi(port)
+		if err != nil || perr != nil || p < 1 || p > 65535 {
+			v.add(field, "address must be host:port such as 127.0.0.1:3129, got %q", address)
+			continue
+		}
+		if slices.Contains(c.Listen[:i], address) {
+			v.add(field, "duplicate address %s", address)
+		}
+		switch {
+		case p == adminPort:
+			v.add(field, "port %d is the port of the admin endpoints, they are never served on the proxy port", p)
+		case p != c.Port && used[p]:
+			v.add(field, "port %d is already used", p)
+		}
+		listenPorts[p] = true
+	}
+	for p := range listenPorts {
+		used[p] = true
+	}
+	if c.ReverseProxy.Port != 0 {
+		v.port("reverseProxy.port", c.ReverseProxy.Port)
+		if used[c.ReverseProxy.Port] {
+			v.add("reverseProxy.port", "port %d is already used", c.ReverseProxy.Port)
+		}
+		used[c.ReverseProxy.Port] = true
+	}
+	for i, r := range c.ReverseProxy.Routes {
+		v.check(fmt.Sprintf("reverseProxy.routes[%d]", i), r.validate())
+	}
+	for i, p := range c.Passthrough {
+		field := fmt.Sprintf("passthrough[%d]", i)
+		if p.Port < 1 || p.Port > 65535 {
+			v.add(field+".port", "port must be between 1 and 65535, got %d", p.Port)
+		} else if used[p.Port] {
+			v.add(field+".port", "port %d is already used", p.Port)
+		}
+		used[p.Port] = true
+		v.check(field+".upstream", p.validate())
+	}
+	if _, err := parseNetworks(c.ProxyProtocol.Trusted); err != nil {
+		v.check("proxyProtocol.trusted", err)
+	}
+	if _, err := parseNetworks(c.AllowedClients); err != nil {
+		v.check("allowedClients", err)
+	}
+	v.check("proxyAuth.users", c.ProxyAuth.validate())
+	for i, r := range c.Egress.Allow {
+		v.check(fmt.Sprintf("egress.allow[%d]", i), r.validate())
+	}
+	for i, r := range c.Egress.Deny {
+		v.check(fmt.Sprintf("egress.deny[%d]", i), r.validate())
+	}
+	v.check("clientRateLimit", c.ClientRateLimit.validate())
+	v.check("mitmCa", c.MitmCA.validate())
+	v.nonNegative("drainTimeout", int64(c.DrainTimeout))
+	v.oneOf("logLevel", strings.ToLower(c.LogLevel), "debug", "info", "warn", "error")
+	v.oneOf("logFormat", c.LogFormat, "console", "json")
+	v.oneOf("errorFormat", c.ErrorFormat, "json", "text")
+
+	// Hosts can set the rate of a default rate break type themselves, they are checked below
+	v.breaker("defaults", c.Defaults.BreakType, c.Defaults.Policy, c.Defaults.Rate, -1, false)
+	v.nonNegative("defaults.timeout", int64(c.Defaults.Timeout))
+	v.nonNegative("defaults.probeTimeout", int64(c.Defaults.ProbeTimeout))
+	v.nonNegative("defaults.threshold", c.Defaults.Threshold)
+	v.nonNegative("defaults.connectRate", c.Defaults.ConnectRate)
+	if c.Defaults.UpstreamProxy != "" {
+		_, err := parseUpstreamProxy(c.Defaults.UpstreamProxy)
+		v.check("defaults.upstreamProxy", err)
+	}
+
+	hosts := map[string]int{}
+	for i, h := range c.Hosts {
+		field := fmt.Sprintf("hosts[%d]", i)
+		if h.Host == "" {
+			v.add(field+".host", "host is required")
+		} else if first, ok := hosts[canonicalHost(h.Host)]; ok {
+			v.add(field+".host", "duplicate host %s, already configured in hosts[%d]", h.Host, first)
+		} else {
+			hosts[canonicalHost(h.Host)] = i
+		}
+		merged := c.Defaults.apply(h)
+		v.breaker(field, h.BreakType, h.Policy, h.Rate, merged.Rate, merged.BreakType == "" && merged.Policy == "")
+		if h.BreakType == "" && h.Policy == "" && merged.BreakType == "rate" && merged.Policy == "" && merged.Rate == 0 {
+			v.add(field+".rate", "the rate break type of the defaults needs a rate above 0")
+		}
+		v.nonNegative(field+".timeout", int64(h.Timeout))
+		v.nonNegative(field+".probeTimeout", int64(h.ProbeTimeout))
+		v.nonNegative(field+".maxTimeout", int64(h.MaxTimeout))
+		v.nonNegative(field+".threshold", h.Threshold)
+		v.nonNegative(field+".heartbeat", int64(h.Heartbeat))
+		v.nonNegative(field+".sendRate", h.SendRate)
+		v.nonNegative(field+".connectRate", h.ConnectRate)
+		v.nonNegative(field+".pinDuration", int64(h.PinDuration))
+		v.nonNegative(field+".hedgeDelay", int64(h.HedgeDelay))
+		v.nonNegative(field+".maxConnections", int64(h.MaxConnections))
+		v.oneOf(field+".srv.proto", h.SRV.Proto, "tcp", "udp")
+		v.check(field+".addresses", validateAddresses(h.Addresses))
+		if len(h.Addresses) > 0 && h.SRV.enabled() {
+			v.add(field+".addresses", "set either addresses or srv")
+		}
+		v.oneOf(field+".balance", h.Balance, balanceRoundRobin, balanceLeastConnections)
+		if h.UpstreamProxy != "" && h.UpstreamProxy != directProxy {
+			_, err := parseUpstreamProxy(h.UpstreamProxy)
+			v.check(field+".upstreamProxy", err)
+		}
+		v.oneOf(field+".proxyProtocol", h.ProxyProtocol, proxyProtocolV1, proxyProtocolV2)
+		for j, p := range h.Priority.Paths {
+			if p.Prefix == "" {
+				v.add(fmt.Sprintf("%s.priority.paths[%d].prefix", field, j), "prefix is required")
+			}
+			if p.Class == "" {
+				v.add(fmt.Sprintf("%s.priority.paths[%d].class", field, j), "class is required")
+			}
+			v.oneOf(fmt.Sprintf("%s.priority.paths[%d].class", field, j), p.Class, priorityClasses...)
+		}
+		v.check(field+".adaptiveConcurrency", h.AdaptiveConcurrency.validate())
+		v.oneOf(field+".priority.default", h.Priority.Default, priorityClasses...)
+		v.percent(field+".priority.shedLowAt", h.Priority.ShedLowAt)
+		v.percent(field+".priority.shedNormalAt", h.Priority.ShedNormalAt)
+		for _, kind := range h.FailOn {
+			v.oneOf(field+".failOn", kind, dialErrorKinds...)
+		}
+		v.check(field+".tls", h.TLS.validate())
+		v.check(field+".faults", h.Faults.validate())
+		v.check(field+".mirror.upstream", h.Mirror.validate())
+		v.percent(field+".mirror.percent", h.Mirror.Percent)
+		v.nonNegative(field+".mirror.timeout", int64(h.Mirror.Timeout))
+		v.nonNegative(field+".outlierDetection.consecutiveFailures", int64(h.OutlierDetection.ConsecutiveFailures))
+		v.nonNegative(field+".outlierDetection.ejection", int64(h.OutlierDetection.Ejection))
+		v.percent(field+".outlierDetection.maxEjectionPercent", float64(h.OutlierDetection.MaxEjectionPercent))
+		v.oneOf(field+".clientKey", h.ClientKey, "ip", "header")
+		if h.ClientKey == "header" && h.ClientHeader == "" {
+			v.add(field+".clientHeader", "clientKey header needs a clientHeader")
+		}
+		v.nonNegative(field+".maxClients", int64(h.MaxClients))
+		if _, ok := protocols[h.Protocol]; h.Protocol != "" && !ok {
+			v.add(field+".protocol", "unknown protocol %q", h.Protocol)
+		}
+		for j, p := range h.Ports {
+			if p < 1 || p > 65535 {
+				v.add(fmt.Sprintf("%s.ports[%d]", field, j), "port must be between 1 and 65535, got %d", p)
+			}
+		}
+		v.nonNegative(field+".latencyInjection.latency", int64(h.LatencyInjection.Latency))
+		v.percent(field+".latencyInjection.percent", h.LatencyInjection.Percent)
+		v.check(field+".healthCheck", h.HealthCheck.validate())
+		v.nonNegative(field+".healthCheck.interval", int64(h.HealthCheck.Interval))
+		v.nonNegative(field+".healthCheck.timeout", int64(h.HealthCheck.Timeout))
+		v.port(field+".healthCheck.port", h.HealthCheck.Port)
+		v.nonNegative(field+".vendorStatus.interval", int64(h.VendorStatus.Interval))
+		v.oneOf(field+".vendorStatus.maintenance", h.VendorStatus.Maintenance, "hold", "notify")
+
+		prefixes := map[string]bool{}
+		for j, p := range h.Paths {
+			pathField := fmt.Sprintf("%s.paths[%d]", field, j)
+			if !strings.HasPrefix(p.Prefix, "/") {
+				v.add(pathField+".prefix", "prefix must start with /, got %q", p.Prefix)
+			} else if prefixes[p.Prefix] {
+				v.add(pathField+".prefix", "duplicate prefix %s", p.Prefix)
+			}
+			prefixes[p.Prefix] = true
+			v.breaker(pathField, p.BreakType, p.Policy, p.Rate, p.apply(merged).Rate, false)
+			v.nonNegative(pathField+".timeout", int64(p.Timeout))
+			v.nonNegative(pathField+".threshold", p.Threshold)
+		}
+	}
+
+	v.nonNegative("notifications.minInterval", int64(c.Notifications.MinInterval))
+	v.nonNegative("notifications.minOpenDuration", int64(c.Notifications.MinOpenDuration))
+	for i, q := range c.Notifications.QuietHours {
+		field := fmt.Sprintf("notifications.quietHours[%d]", i)
+		_, err := parseClock(q.Start)
+		v.check(field+".start", err)
+		_, err = parseClock(q.End)
+		v.check(field+".end", err)
+	}
+	for i, s := range c.Notifications.Slack {
+		field := fmt.Sprintf("notifications.slack[%d]", i)
+		v.check(field, s.validate())
+		v.nonNegative(field+".maxPerHour", int64(s.MaxPerHour))
+	}
+	for i, p := range c.Notifications.PagerDuty {
+		field := fmt.Sprintf("notifications.pagerDuty[%d]", i)
+		v.check(field, p.validate())
+		v.nonNegative(field+".maxPerHour", int64(p.MaxPerHour))
+	}
+	v.nonNegative("flapDamping.window", int64(c.FlapDamping.Window))
+	v.nonNegative("flapDamping.threshold", int64(c.FlapDamping.Threshold))
+	v.nonNegative("flapDamping.duration", int64(c.FlapDamping.Duration))
+	v.oneOf("observability.statsd.format", c.Observability.StatsD.Format, "statsd", "dogstatsd")
+	v.nonNegative("expectedConnections", int64(c.ExpectedConnections))
+	v.nonNegative("maxConnections", int64(c.MaxConnections))
+	if c.CopyBufferSize != 0 && (c.CopyBufferSize < minCopyBufferSize || c.CopyBufferSize > maxCopyBufferSize) {
+		v.add("copyBufferSize", "copyBufferSize must be between %d and %d, got %d", minCopyBufferSize, maxCopyBufferSize, c.CopyBufferSize)
+	}
+	v.nonNegative("pool.maxIdle", int64(c.Pool.MaxIdle))
+	v.nonNegative("pool.maxIdlePerHost", int64(c.Pool.MaxIdlePerHost))
+	v.nonNegative("pool.idleTimeout", int64(c.Pool.IdleTimeout))
+	v.nonNegative("pool.maxPerHost", int64(c.Pool.MaxPerHost))
+	v.nonNegative("dns.ttl", int64(c.DNS.TTL))
+	v.nonNegative("dns.negativeTtl", int64(c.DNS.NegativeTTL))
+	for i, server := range c.DNS.Servers {
+		host, _, err := net.SplitHostPort(server)
+		if err != nil {
+			host = server
+		}
+		if net.ParseIP(host) == nil {
+			v.add(fmt.Sprintf("dns.servers[%d]", i), "server must be an IP address with an optional port such as 10.0.0.2:53, got %q", server)
+		}
+	}
+	v.percent("timelines.percent", c.Timelines.Percent)
+	v.nonNegative("timelines.keep", int64(c.Timelines.Keep))
+	v.oneOf("storage.type", c.Storage.Type, "file", "sqlite", "redis", "s3")
+	v.nonNegative("storage.interval", int64(c.Storage.Interval))
+	v.oneOf("archive.format", c.Archive.Format, "json", "parquet")
+	v.nonNegative("archive.interval", int64(c.Archive.Interval))
+	v.check("consul", c.Consul.validate())
+	v.check("etcd", c.Etcd.validate())
+	v.check("kubernetes", c.Kubernetes.validate())
+	v.check("runAs", c.RunAs.validate())
+	v.feature("features.mitm", c.Features.Mitm, hosts)
+	v.feature("features.latencyInjection", c.Features.LatencyInjection, hosts)
+	v.feature("features.protocol", c.Features.Protocol, hosts)
+
+	if len(v.errs) > 0 {
+		return v.errs
+	}
+	return nil
+}
+
+// Check the break type, policy and rate of a host or path. Hosts need a break type or a policy,
+// paths inherit them from their host so the rate in use may be the one of the host.
+func (c *configChecker) breaker(field string, breakType string, policy string, rate float64, rateInUse float64, required bool) {
+	if required {
+		c.add(field+".breakType", "breakType is required, use consecutive, threshold, rate or a registered custom type, or set a policy, on the host or in defaults")
+	}
+	if breakType != "" {
+		breakTypesMu.RLock()
+		_, ok := breakTypes[breakType]
+		breakTypesMu.RUnlock()
+		if !ok {
+			c.add(field+".breakType", "unknown break type %q", breakType)
+		}
+	}
+	if policy != "" {
+		_, err := parsePolicy(policy)
+		c.check(field+".policy", err)
+	}
+	c.percent(field+".rate", rate)
+	if breakType == "rate" && policy == "" && rateInUse == 0 {
+		c.add(field+".rate", "the rate break type needs a rate above 0")
+	}
+}
+
+// Check the percentage and hosts of a feature flag
+func (c *configChecker) feature(field string, flag *FeatureFlag, hosts map[string]int) {
+	if flag == nil {
+		return
+	}
+	c.percent(field+".percent", flag.Percent)
+	for i, h := range flag.Hosts {
+		if _, ok := hosts[canonicalHost(h)]; !ok {
+			c.add(fmt.Sprintf("%s.hosts[%d]", field, i), "host %s is not in the configuration", h)
+		}
+	}
+}
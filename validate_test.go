@@ -0,0 +1,229 @@
+package sidebreaker
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Test wether the problems of a configuration are reported with their field and position in the file
+func TestParseConfigErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		// field, line and column of each error, and part of its message
+		expected []ConfigError
+	}{
+		{"valid", `{
+  "port": 8080, // the proxy port
+  "hosts": [{"host": "api.example.com", "breakType": "consecutive", "threshold": 2, "timeout": "1s"}]
+}`, nil},
+		{"unknown field", `{
+  "port": 8080,
+  "prot": 8081,
+  "hosts": [{"host": "api.example.com", "breakType": "consecutive", "retries": 2}]
+}`, []ConfigError{{Field: "prot", Line: 3, Column: 3, Msg: "unknown field"}, {Field: "hosts[0].retries", Line: 4, Column: 69, Msg: "unknown field"}}},
+		{"wrong types", `{
+  "port": "8080",
+  "hosts": [{"host": "api.example.com", "breakType": "consecutive", "threshold": 2.5, "mitm": "yes"}],
+  "allowedClients": "10.0.0.0/8"
+}`, []ConfigError{
+			{Field: "port", Line: 2, Column: 3, Msg: "expected integer, got string"},
+			{Field: "hosts[0].threshold", Line: 3, Column: 69, Msg: "expected integer, got number 2.5"},
+			{Field: "hosts[0].mitm", Line: 3, Column: 87, Msg: "expected boolean, got string"},
+			{Field: "allowedClients", Line: 4, Column: 3, Msg: "expected list of string, got string"},
+		}},
+		{"hosts not a list", `{"port": 8080, "hosts": {"host": "api.example.com"}}`, []ConfigError{{Field: "hosts", Line: 1, Column: 16, Msg: "expected list of object, got object"}}},
+		{"negative timeouts", `{
+  "port": 8080,
+  "drainTimeout": -1,
+  "hosts": [{"host": "api.example.com", "breakType": "consecutive",
+    "timeout": "-1s", "probeTimeout": -500}]
+}`, []ConfigError{
+			{Field: "drainTimeout", Line: 3, Column: 3, Msg: "must not be negative, got -1"},
+			{Field: "hosts[0].timeout", Line: 5, Column: 5, Msg: "must not be negative, got -1000"},
+			{Field: "hosts[0].probeTimeout", Line: 5, Column: 23, Msg: "must not be negative, got -500"},
+		}},
+		{"invalid duration", `{"port": 8080, "hosts": [{"host": "api.example.com", "breakType": "consecutive", "timeout": "soon"}]}`,
+			[]ConfigError{{Field: "hosts[0].timeout", Line: 1, Column: 82, Msg: `expected a duration such as "750ms" or "2s", got "soon"`}}},
+		{"rates out of range", `{
+  "port": 8080,
+  "hosts": [
+    {"host": "a.example.com", "breakType": "rate", "rate": 150},
+    {"host": "b.example.com", "breakType": "rate", "rate": -1},
+    {"host": "c.example.com", "breakType": "rate"}
+  ],
+  "features": {"mitm": {"percent": 101}}
+}`, []ConfigError{
+			{Field: "hosts[0].rate", Line: 4, Column: 52, Msg: "percentage must be between 0 and 100, got 150"},
+			{Field: "hosts[1].rate", Line: 5, Column: 52, Msg: "percentage must be between 0 and 100, got -1"},
+			{Field: "hosts[2].rate", Line: 6, Column: 5, Msg: "the rate break type needs a rate above 0"},
+			{Field: "features.mitm.percent", Line: 8, Column: 25, Msg: "percentage must be between 0 and 100, got 101"},
+		}},
+		{"duplicate hosts", `{
+  "port": 8080,
+  "hosts": [
+    {"host": "::1", "breakType": "consecutive"},
+    {"host": "api.example.com", "breakType": "consecutive"},
+    {"host": "[0:0::1]", "breakType": "consecutive"},
+    {"host": "api.example.com", "breakType": "consecutive"}
+  ]
+}`, []ConfigError{
+			{Field: "hosts[2].host", Line: 6, Column: 6, Msg: "duplicate host [0:0::1], already configured in hosts[0]"},
+			{Field: "hosts[3].host", Line: 7, Column: 6, Msg: "duplicate host api.example.com, already configured in hosts[1]"},
+		}},
+		{"missing breakType", `{
+  "port": 8080,
+  "hosts": [
+    {"host": "api.example.com", "threshold": 2}
+  ]
+}`, []ConfigError{{Field: "hosts[0].breakType", Line: 4, Column: 5, Msg: "breakType is required"}}},
+		{"breakType from the defaults", `{"port": 8080, "defaults": {"breakType": "consecutive"}, "hosts": [{"host": "api.example.com"}]}`, nil},
+		{"unknown breakType", `{"port": 8080, "hosts": [{"host": "api.example.com", "breakType": "sometimes"}]}`,
+			[]ConfigError{{Field: "hosts[0].breakType", Line: 1, Column: 54, Msg: `unknown break type "sometimes"`}}},
+		{"missing comma", "{\n  \"port\": 8080\n  \"hosts\": []\n}", []ConfigError{{Line: 3, Column: 4, Msg: "invalid character '\"' after object key:value pair"}}},
+		{"cut short", "{\n  \"port\": 8080,\n  \"hosts\": [", []ConfigError{{Line: 3, Column: 13, Msg: "unexpected end of JSON input"}}},
+		{"data after", `{"port": 8080, "hosts": []} {}`, []ConfigError{{Line: 1, Column: 30, Msg: "unexpected data after the configuration"}}},
+	}
+	for _, test := range tests {
+		_, err := ParseConfig([]byte(test.config))
+		if test.expected == nil {
+			if err != nil {
+				t.Errorf("%s: expected no error, got %v", test.name, err)
+			}
+			continue
+		}
+		var errs ConfigErrors
+		if !errors.As(err, &errs) {
+			t.Errorf("%s: expected ConfigErrors, got %v", test.name, err)
+			continue
+		}
+		if len(errs) != len(test.expected) {
+			t.Errorf("%s: expected %d errors, got %d: %v", test.name, len(test.expected), len(errs), errs)
+			continue
+		}
+		for i, e := range errs {
+			expected := test.expected[i]
+			if e.Field != expected.Field || e.Line != expected.Line || e.Column != expected.Column || !strings.Contains(e.Msg, expected.Msg) {
+				t.Errorf("%s: expected %s at %d:%d with %q, got %s at %d:%d with %q", test.name,
+					expected.Field, expected.Line, expected.Column, expected.Msg, e.Field, e.Line, e.Column, e.Msg)
+			}
+		}
+	}
+}
+
+// Test wether the errors of YAML files and of the host files of conf.d point at their own file
+func TestLoadConfigPositions(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    map[string]string
+		expected []ConfigError
+	}{
+		{"YAML", map[string]string{"config.yaml": `port: 8080
+hosts:
+  - host: api.example.com
+    breakType: consecutive
+    timeout: -1s
+    retries: 2
+`}, []ConfigError{
+			{File: "config.yaml", Field: "hosts[0].retries", Line: 6, Column: 5, Msg: "unknown field"},
+		}},
+		{"YAML negative", map[string]string{"config.yaml": `port: 8080
+hosts:
+  - host: api.example.com
+    breakType: consecutive
+    timeout: -1s
+`}, []ConfigError{
+			{File: "config.yaml", Field: "hosts[0].timeout", Line: 5, Column: 5, Msg: "must not be negative, got -1000"},
+		}},
+		{"YAML syntax", map[string]string{"config.yaml": "port: 8080\nhosts:\n  - host: [api.example.com\n"}, []ConfigError{
+			{File: "config.yaml", Line: 2, Msg: "did not find expected ',' or ']'"},
+		}},
+		{"conf.d", map[string]string{
+			"config.json": `{
+  "port": 8080,
+  "hosts": [{"host": "api.example.com", "breakType": "consecutive"}]
+}`,
+			"conf.d/10-billing.json": `{
+  "hosts": [
+    {"host": "billing.example.com", "breakType": "consecutive"},
+    {"host": "api.example.com", "breakType": "consecutive", "timeout": -1}
+  ]
+}`,
+			"conf.d/20-search.yaml": `hosts:
+  - host: search.example.com
+port: 8081
+`,
+		}, []ConfigError{
+			{File: "conf.d/20-search.yaml", Field: "port", Line: 3, Column: 1, Msg: "only hosts can be set in conf.d files"},
+		}},
+		{"conf.d merged", map[string]string{
+			"config.json": `{
+  "port": 8080,
+  "hosts": [{"host": "api.example.com", "breakType": "consecutive"}]
+}`,
+			"conf.d/10-billing.json": `{
+  "hosts": [
+    {"host": "billing.example.com", "breakType": "consecutive"},
+    {"host": "api.example.com", "breakType": "consecutive", "timeout": -1}
+  ]
+}`,
+			"conf.d/20-search.yaml": `hosts:
+  - host: search.example.com
+`,
+		}, []ConfigError{
+			{File: "conf.d/10-billing.json", Field: "hosts[1].host", Line: 4, Column: 6, Msg: "duplicate host api.example.com, already configured in hosts[0] of "},
+			{File: "conf.d/10-billing.json", Field: "hosts[1].timeout", Line: 4, Column: 61, Msg: "must not be negative, got -1"},
+			{File: "conf.d/20-search.yaml", Field: "hosts[0].breakType", Line: 2, Column: 5, Msg: "breakType is required"},
+		}},
+	}
+	for _, test := range tests {
+		dir := t.TempDir()
+		main := ""
+		for name, data := range test.files {
+			path := filepath.Join(dir, name)
+			os.MkdirAll(filepath.Dir(path), 0o700)
+			os.WriteFile(path, []byte(data), 0o600)
+			if !strings.HasPrefix(name, "conf.d/") {
+				main = path
+			}
+		}
+		_, err := LoadConfig(main)
+		var errs ConfigErrors
+		if !errors.As(err, &errs) || len(errs) != len(test.expected) {
+			t.Errorf("%s: expected %d errors, got %v", test.name, len(test.expected), err)
+			continue
+		}
+		for i, e := range errs {
+			expected := test.expected[i]
+			expected.File = filepath.Join(dir, expected.File)
+			if e.File != expected.File || e.Field != expected.Field || e.Line != expected.Line || e.Column != expected.Column || !strings.Contains(e.Msg, expected.Msg) {
+				t.Errorf("%s: expected %s %s at %d:%d with %q, got %s %s at %d:%d with %q", test.name,
+					expected.File, expected.Field, expected.Line, expected.Column, expected.Msg, e.File, e.Field, e.Line, e.Column, e.Msg)
+			}
+		}
+	}
+}
+
+// Test wether errors read with their file, position and field
+func TestConfigErrorString(t *testing.T) {
+	tests := []struct {
+		err      ConfigError
+		expected string
+	}{
+		{ConfigError{File: "config.json", Line: 3, Column: 5, Field: "port", Msg: "unknown field"}, "config.json: line 3, column 5: port: unknown field"},
+		{ConfigError{File: "config.yaml", Line: 3, Msg: "did not find expected key"}, "config.yaml: line 3: did not find expected key"},
+		{ConfigError{Field: "statusPort", Msg: "port 8080 is already used"}, "statusPort: port 8080 is already used"},
+	}
+	for _, test := range tests {
+		if got := test.err.Error(); got != test.expected {
+			t.Errorf("expected %q, got %q", test.expected, got)
+		}
+	}
+	errs := ConfigErrors{tests[0].err, tests[2].err}
+	if got := errs.Error(); got != tests[0].expected+"; "+tests[2].expected {
+		t.Errorf("expected the errors joined, got %q", got)
+	}
+}
@@ -0,0 +1,147 @@
+package sidebreaker
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VendorStatus struct for polling the status page of the vendor behind a host
+type VendorStatus struct {
+	URL         string   `json:"url" doc:"Status JSON of the vendor, i.e. the api/v2/status.json of a Statuspage site" example:"https://status.example.com/api/v2/status.json"`
+	Field       string   `json:"field" doc:"Dot separated path of the status in the JSON, status.indicator by default" example:"status.indicator"`
+	Interval    Duration `json:"interval" doc:"Milliseconds between polls, 60000 by default" example:"60000"`
+	Maintenance string   `json:"maintenance" doc:"During maintenance: hold keeps the breakers open, notify only alerts; hold by default" example:"hold"`
+}
+
+// Status reported by a vendor
+const (
+	vendorOperational = "operational"
+	vendorDegraded    = "degraded"
+	vendorMaintenance = "maintenance"
+)
+
+// Current vendor status per host
+var vendorStatuses = expvar.NewMap("vendorStatus")
+
+// Map the value of the status field to a vendor status. Statuspage indicators are none, minor, major,
+// critical and maintenance; anything that isn't operational or maintenance is degraded.
+func parseVendorStatus(value string) string {
+	switch strings.ToLower(value) {
+	case "none", "operational", "ok", "up":
+		return vendorOperational
+	case "maintenance", "under_maintenance":
+		return vendorMaintenance
+	}
+	return vendorDegraded
+}
+
+// vendorState is the last status polled for a host, shared by all its breakers
+type vendorState struct {
+	hold bool
+
+	mu     sync.Mutex
+	status string
+}
+
+func newVendorState(config VendorStatus) (*vendorState, error) {
+	if config.URL == "" {
+		return nil, nil
+	}
+	if config.Maintenance != "" && config.Maintenance != "hold" && config.Maintenance != "notify" {
+		return nil, fmt.Errorf("unknown vendor maintenance action %q, use hold or notify", config.Maintenance)
+	}
+	return &vendorState{hold: config.Maintenance != "notify", status: vendorOperational}, nil
+}
+
+// Test wether the breakers are held open for maintenance
+func (v *vendorState) holding() bool {
+	if v == nil {
+		return false
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.hold && v.status == vendorMaintenance
+}
+
+// Status reported by the vendor, operational when the host has no vendor status
+func (v *vendorState) get() string {
+	if v == nil {
+		return vendorOperational
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.status
+}
+
+// Poll the vendor status of a host and notify when it changes. Polls that fail keep the last
+// status, the status page of a vendor being down says nothing about its service.
+func pollVendorStatus(host string, config VendorStatus, state *vendorState, notifier *policyNotifier, done <-chan struct{}) {
+	interval := config.Interval.Duration()
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	field := config.Field
+	if field == "" {
+		field = "status.indicator"
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	for ok := true; ok; ok = wait(done, interval) {
+		value, description, err := fetchVendorStatus(client, config.URL, field)
+		if err != nil {
+			logger.Warn("Error polling vendor status", "host", host, "url", config.URL, "error", err)
+			continue
+		}
+		status := parseVendorStatus(value)
+		published := new(expvar.String)
+		published.Set(status)
+		vendorStatuses.Set(host, published)
+
+		state.mu.Lock()
+		previous := state.status
+		state.status = status
+		state.mu.Unlock()
+		if status == previous {
+			continue
+		}
+		logger.Warn("Vendor status changed", "host", host, "status", status, "previous", previous, "description", description)
+		notifier.Notify(Notification{Host: host, Event: "vendor " + status, Time: time.Now(), Message: description})
+	}
+}
+
+// Fetch the status JSON and return the value of the status field, and the description next to it if any
+func fetchVendorStatus(client *http.Client, url string, field string) (string, string, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("status page answered %s", resp.Status)
+	}
+	var doc interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return "", "", err
+	}
+
+	var parent map[string]interface{}
+	value := doc
+	for _, key := range strings.Split(field, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return "", "", fmt.Errorf("field %q not found in the status", field)
+		}
+		parent, value = object, object[key]
+	}
+	s, ok := value.(string)
+	if !ok {
+		return "", "", fmt.Errorf("field %q of the status is not a string", field)
+	}
+	description, _ := parent["description"].(string)
+	return s, description, nil
+}